@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// States of failed deployments reported by the admin API.
+const (
+	// Failed, and waiting on the controller or a human to act.
+	stateFailed = "failed"
+	// Failing, but not for long enough to be handled yet, see confirmed.
+	stateConfirming = "confirming"
+	// Failed, but its class of failure is configured to wait for the
+	// rollout to complete on its own.
+	stateWaiting = "waiting"
+	// A rollback has been requested and the deployment controller hasn't
+	// processed it yet.
+	stateRollingBack = "rolling-back"
+	statePaused      = "paused"
+	stateScaledDown  = "scaled-down"
+)
+
+// deploymentStatus is the controller's view of a failed deployment.
+type deploymentStatus struct {
+	Cluster    string    `json:"cluster,omitempty"`
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	Region     string    `json:"region,omitempty"`
+	Revision   int64     `json:"revision"`
+	Reason     string    `json:"reason"`
+	State      string    `json:"state"`
+	Strategy   string    `json:"strategy,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	LastUpdate time.Time `json:"lastUpdate"`
+
+	// Circuit breaker state, see countRollback.
+	RollbackAttempts    int    `json:"rollbackAttempts,omitempty"`
+	RollbackWindowStart string `json:"rollbackWindowStart,omitempty"`
+
+	// Cooldown state, see checkCooldown. CooldownUntil is only set while
+	// the deployment is in its cooldown.
+	LastRollback  string `json:"lastRollback,omitempty"`
+	CooldownUntil string `json:"cooldownUntil,omitempty"`
+}
+
+// rollbackRecord is an action the controller took on a deployment.
+type rollbackRecord struct {
+	Time         time.Time `json:"time"`
+	Cluster      string    `json:"cluster,omitempty"`
+	Namespace    string    `json:"namespace"`
+	Deployment   string    `json:"deployment"`
+	Region       string    `json:"region,omitempty"`
+	Action       string    `json:"action"`
+	FromRevision int64     `json:"fromRevision"`
+	ToRevision   int64     `json:"toRevision,omitempty"`
+	Message      string    `json:"message"`
+
+	// Why the rollout failed, set for rollbacks.
+	Diagnostics []*podDiagnostic `json:"diagnostics,omitempty"`
+	// Result of the rollback's smoke test, see startVerification.
+	Verification *verificationResult `json:"verification,omitempty"`
+	// When the deployment's cooldown ends, if it's in one, see
+	// checkCooldown. For rollbacks, the cooldown they started.
+	CooldownUntil string `json:"cooldownUntil,omitempty"`
+}
+
+// Number of rollback records kept by a statusTracker.
+const maxRecords = 200
+
+// statusTracker holds the controller's state for the admin API. The zero
+// value is ready to use.
+type statusTracker struct {
+	mu sync.Mutex
+	// Failed deployments as of the last completed reconcile pass.
+	failed []*deploymentStatus
+	// Recent actions, oldest first.
+	records []*rollbackRecord
+	// Errors reconciling deployments in the last completed pass.
+	errors []*reconcileError
+}
+
+func (s *statusTracker) setFailed(failed []*deploymentStatus) {
+	sort.Slice(failed, func(i, j int) bool {
+		if failed[i].Namespace != failed[j].Namespace {
+			return failed[i].Namespace < failed[j].Namespace
+		}
+		return failed[i].Name < failed[j].Name
+	})
+	s.mu.Lock()
+	s.failed = failed
+	s.mu.Unlock()
+}
+
+func (s *statusTracker) setErrors(errs []*reconcileError) {
+	s.mu.Lock()
+	s.errors = errs
+	s.mu.Unlock()
+}
+
+func (s *statusTracker) addRecord(r *rollbackRecord) {
+	s.addRecords([]*rollbackRecord{r})
+}
+
+// addRecords adds records, such as those restored from a stateStore, keeping
+// the history ordered by time. Records already kept, such as those saved by
+// the controller itself and restored again, aren't added twice.
+func (s *statusTracker) addRecords(records []*rollbackRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	type recordKey struct {
+		time                                   int64
+		namespace, deployment, action, message string
+	}
+	keyOf := func(r *rollbackRecord) recordKey {
+		return recordKey{r.Time.UnixNano(), r.Namespace, r.Deployment, r.Action, r.Message}
+	}
+	kept := make(map[recordKey]bool)
+	for _, r := range s.records {
+		kept[keyOf(r)] = true
+	}
+	for _, r := range records {
+		if !kept[keyOf(r)] {
+			kept[keyOf(r)] = true
+			s.records = append(s.records, r)
+		}
+	}
+	sort.SliceStable(s.records, func(i, j int) bool { return s.records[i].Time.Before(s.records[j].Time) })
+	if n := len(s.records) - maxRecords; n > 0 {
+		s.records = append([]*rollbackRecord(nil), s.records[n:]...)
+	}
+}
+
+// replaceRecord replaces a record with an updated copy, if it's still kept.
+func (s *statusTracker) replaceRecord(old, updated *rollbackRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.records {
+		if r == old {
+			s.records[i] = updated
+			return
+		}
+	}
+}
+
+// newDeploymentStatus summarizes a failed deployment.
+func (c *rollbackController) newDeploymentStatus(d *v1beta1.Deployment, reason, state string) *deploymentStatus {
+	annotations := d.Metadata.GetAnnotations()
+	attempts, _ := strconv.Atoi(annotations[annotationRollbackAttempts])
+	strategy, _ := c.strategyFor(d)
+	last, until := c.cooldownTimes(d)
+	return &deploymentStatus{
+		Cluster:             c.cluster,
+		Namespace:           d.Metadata.GetNamespace(),
+		Name:                d.Metadata.GetName(),
+		Region:              c.regionOf(d),
+		Revision:            revision(annotations),
+		Reason:              reason,
+		State:               state,
+		Strategy:            strategy,
+		LastUpdate:          c.now().UTC(),
+		RollbackAttempts:    attempts,
+		RollbackWindowStart: annotations[annotationRollbackWindowStart],
+		LastRollback:        last,
+		CooldownUntil:       until,
+	}
+}
+
+// cooldownTimes formats a deployment's cooldown state for the admin API.
+// until is empty unless the deployment is in its cooldown.
+func (c *rollbackController) cooldownTimes(d *v1beta1.Deployment) (last, until string) {
+	l, u, err := c.cooldownState(d)
+	if err != nil {
+		return "", ""
+	}
+	if !l.IsZero() {
+		last = l.UTC().Format(time.RFC3339)
+	}
+	if c.now().Before(u) {
+		until = u.UTC().Format(time.RFC3339)
+	}
+	return last, until
+}
+
+// recordAction records an action taken on a deployment in metrics and the
+// admin API's history. toRevision is only set for rollbacks.
+func (c *rollbackController) recordAction(d *v1beta1.Deployment, action string, toRevision int64, msg string) {
+	c.record(c.newRecord(d, action, toRevision, msg))
+}
+
+func (c *rollbackController) newRecord(d *v1beta1.Deployment, action string, toRevision int64, msg string) *rollbackRecord {
+	_, until := c.cooldownTimes(d)
+	return &rollbackRecord{
+		Time:          c.now().UTC(),
+		Cluster:       c.cluster,
+		Namespace:     d.Metadata.GetNamespace(),
+		Deployment:    d.Metadata.GetName(),
+		Region:        c.regionOf(d),
+		Action:        action,
+		FromRevision:  revision(d.Metadata.GetAnnotations()),
+		ToRevision:    toRevision,
+		Message:       msg,
+		CooldownUntil: until,
+	}
+}
+
+// record records an action in metrics, the admin API's history, and the
+// audit log. The record must not be modified afterwards.
+func (c *rollbackController) record(r *rollbackRecord) {
+	metricActions.inc(r.Cluster, r.Namespace, r.Deployment, r.Region, r.Action)
+	c.status.addRecord(r)
+	c.auditRecord(r)
+}
+
+// The admin API lets dashboards and CLIs query the controller's state.
+//
+//	GET /api/v1/deployments  Failed deployments as of the last pass.
+//	GET /api/v1/rollbacks    Recent actions, newest first.
+//
+// Both endpoints accept optional "cluster" and "namespace" query parameters.
+// When running against multiple clusters, one API serves all of them.
+func registerAPI(mux *http.ServeMux, controllers ...*rollbackController) {
+	a := adminAPI(controllers)
+	mux.HandleFunc("/api/v1/deployments", a.serveDeployments)
+	mux.HandleFunc("/api/v1/rollbacks", a.serveRollbacks)
+}
+
+type adminAPI []*rollbackController
+
+func (a adminAPI) serveDeployments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cluster, ns := r.URL.Query().Get("cluster"), r.URL.Query().Get("namespace")
+
+	items := []*deploymentStatus{}
+	for _, c := range a {
+		if cluster != "" && c.cluster != cluster {
+			continue
+		}
+		c.status.mu.Lock()
+		for _, d := range c.status.failed {
+			if ns == "" || d.Namespace == ns {
+				items = append(items, d)
+			}
+		}
+		c.status.mu.Unlock()
+	}
+
+	writeJSON(w, struct {
+		Items []*deploymentStatus `json:"items"`
+	}{items})
+}
+
+func (a adminAPI) serveRollbacks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cluster, ns := r.URL.Query().Get("cluster"), r.URL.Query().Get("namespace")
+
+	items := []*rollbackRecord{}
+	for _, c := range a {
+		if cluster != "" && c.cluster != cluster {
+			continue
+		}
+		c.status.mu.Lock()
+		for _, rec := range c.status.records {
+			if ns == "" || rec.Namespace == ns {
+				items = append(items, rec)
+			}
+		}
+		c.status.mu.Unlock()
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Time.After(items[j].Time) })
+
+	writeJSON(w, struct {
+		Items []*rollbackRecord `json:"items"`
+	}{items})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCooldownStatus(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		args         []string
+		lastRollback string
+
+		wantLast  string
+		wantUntil string
+	}{
+		{
+			name: "never rolled back",
+			args: []string{"--cooldown=1h"},
+		},
+		{
+			name:         "no cooldown",
+			lastRollback: "2017-06-01T11:30:00Z",
+			wantLast:     "2017-06-01T11:30:00Z",
+		},
+		{
+			name:         "in cooldown",
+			args:         []string{"--cooldown=1h"},
+			lastRollback: "2017-06-01T11:30:00Z",
+			wantLast:     "2017-06-01T11:30:00Z",
+			wantUntil:    "2017-06-01T12:30:00Z",
+		},
+		{
+			name:         "cooldown ended",
+			args:         []string{"--cooldown=1h"},
+			lastRollback: "2017-06-01T10:30:00Z",
+			wantLast:     "2017-06-01T10:30:00Z",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestController(t, newFakeAPI(), test.args...)
+			c.clock = func() time.Time { return now }
+			d := testDeployment("hello", 2, true)
+			if test.lastRollback != "" {
+				d.Metadata.Annotations[annotationLastRollbackTime] = test.lastRollback
+			}
+			s := c.newDeploymentStatus(d, "test", stateFailed)
+			if s.LastRollback != test.wantLast || s.CooldownUntil != test.wantUntil {
+				t.Errorf("last rollback %q, cooldown until %q, want %q, %q", s.LastRollback, s.CooldownUntil, test.wantLast, test.wantUntil)
+			}
+			inCooldown := test.wantUntil != ""
+			ok, err := c.checkCooldown(context.Background(), d, "test", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok == inCooldown {
+				t.Errorf("checkCooldown=%t, but status reports cooldown until %q", ok, s.CooldownUntil)
+			}
+		})
+	}
+}
+
+func TestRollbackRecordCooldown(t *testing.T) {
+	f := newFakeAPI()
+	d := testDeployment("hello", 2, true)
+	f.addDeployment(d)
+	f.addReplicaSet(testReplicaSet(d, 2))
+	f.addReplicaSet(testReplicaSet(d, 1))
+	c := newTestController(t, f, "--cooldown=1h")
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.clock = func() time.Time { return now }
+
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	if len(c.status.records) != 1 || c.status.records[0].Action != "rollback" {
+		t.Fatalf("expected a rollback, got %d records", len(c.status.records))
+	}
+	if got, want := c.status.records[0].CooldownUntil, "2017-06-01T13:00:00Z"; got != want {
+		t.Errorf("rollback's cooldown until %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Decisions recorded in the audit log, besides the actions in rollback
+// records, such as "rollback", "notify", or "skipped".
+const (
+	// A deployment was first seen failing.
+	decisionDetected = "detected"
+	// Handling a deployment failed.
+	decisionError = "error"
+)
+
+// auditEntry is a decision the controller made about a deployment.
+type auditEntry struct {
+	Time         time.Time `json:"time"`
+	Cluster      string    `json:"cluster,omitempty"`
+	Namespace    string    `json:"namespace"`
+	Deployment   string    `json:"deployment"`
+	Region       string    `json:"region,omitempty"`
+	Decision     string    `json:"decision"`
+	FromRevision int64     `json:"fromRevision"`
+	ToRevision   int64     `json:"toRevision,omitempty"`
+	Message      string    `json:"message"`
+}
+
+// auditLog appends every decision the controller makes to a local file, for
+// clusters without a pipeline collecting events or metrics. Entries are
+// written as JSON, one per line, so the file survives the controller
+// crashing mid-write and can be read with the export command. An embedded
+// database such as bbolt or SQLite would make exports cheaper to filter, but
+// would have to be vendored, and the log is small enough to scan.
+//
+// Once the file would grow past maxSize, it's renamed with a ".1" suffix,
+// replacing any previous one, and a new file is started, so the log takes up
+// at most about twice maxSize. One log can be shared by the controllers of
+// several clusters in a process, but not by several processes.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+// openAuditLog opens the audit log at path. A maxSize of zero disables
+// rotation.
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// rotatedAuditLog returns the path an audit log is moved to when it's
+// rotated.
+func rotatedAuditLog(path string) string {
+	return path + ".1"
+}
+
+// rotate must be called with mu held.
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, rotatedAuditLog(l.path)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// write appends an entry to the log. A nil log discards entries.
+func (l *auditLog) write(e *auditEntry) error {
+	if l == nil {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log: %v", err)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write audit log: %v", err)
+	}
+	return nil
+}
+
+// audit records a decision about a deployment in the audit log, if there is
+// one.
+func (c *rollbackController) audit(d *v1beta1.Deployment, decision, msg string) {
+	c.writeAudit(&auditEntry{
+		Time:         c.now().UTC(),
+		Cluster:      c.cluster,
+		Namespace:    d.Metadata.GetNamespace(),
+		Deployment:   d.Metadata.GetName(),
+		Region:       c.regionOf(d),
+		Decision:     decision,
+		FromRevision: revision(d.Metadata.GetAnnotations()),
+		Message:      msg,
+	})
+}
+
+func (c *rollbackController) auditRecord(r *rollbackRecord) {
+	c.writeAudit(&auditEntry{
+		Time:         r.Time,
+		Cluster:      r.Cluster,
+		Namespace:    r.Namespace,
+		Deployment:   r.Deployment,
+		Region:       r.Region,
+		Decision:     r.Action,
+		FromRevision: r.FromRevision,
+		ToRevision:   r.ToRevision,
+		Message:      r.Message,
+	})
+}
+
+// writeAudit writes an entry, logging any error. Decisions aren't held up by
+// an audit log that can't be written.
+func (c *rollbackController) writeAudit(e *auditEntry) {
+	if err := c.auditLog.write(e); err != nil {
+		c.logger.Printf("%v", err)
+	}
+}
+
+// openAuditLogFiles opens an audit log for reading, along with the file it
+// was last rotated to, if any, oldest entries first. Closing the returned
+// reader closes both files.
+func openAuditLogFiles(path string) (io.ReadCloser, error) {
+	cur, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	old, err := os.Open(rotatedAuditLog(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cur, nil
+		}
+		cur.Close()
+		return nil, err
+	}
+	// The rotated file might end with a partial line, which mustn't run into
+	// the first line of the current one.
+	return &multiReadCloser{
+		Reader:  io.MultiReader(old, strings.NewReader("\n"), cur),
+		closers: []io.Closer{old, cur},
+	}, nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiReadCloser) Close() error {
+	var err error
+	for _, c := range m.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// readAuditLog calls fn with each entry of an audit log written since the
+// given time. Lines that can't be parsed, such as a partial line left by a
+// crash, are skipped.
+func readAuditLog(r io.Reader, since time.Time, fn func(e *auditEntry) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		e := new(auditEntry)
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			continue
+		}
+		if e.Time.Before(since) {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// Formats of the export command.
+const (
+	exportJSON = "json"
+	exportCSV  = "csv"
+)
+
+var auditCSVHeader = []string{"time", "cluster", "namespace", "deployment", "region", "decision", "fromRevision", "toRevision", "message"}
+
+// exportAuditLog writes the entries of an audit log since the given time as
+// JSON, one object per line, or CSV with a header.
+func exportAuditLog(w io.Writer, r io.Reader, since time.Time, format string) error {
+	switch format {
+	case exportJSON:
+		enc := json.NewEncoder(w)
+		return readAuditLog(r, since, func(e *auditEntry) error { return enc.Encode(e) })
+	case exportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(auditCSVHeader); err != nil {
+			return err
+		}
+		err := readAuditLog(r, since, func(e *auditEntry) error {
+			var to string
+			if e.ToRevision != 0 {
+				to = strconv.FormatInt(e.ToRevision, 10)
+			}
+			return cw.Write([]string{
+				e.Time.Format(time.RFC3339), e.Cluster, e.Namespace, e.Deployment, e.Region,
+				e.Decision, strconv.FormatInt(e.FromRevision, 10), to, e.Message,
+			})
+		})
+		cw.Flush()
+		if err != nil {
+			return err
+		}
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	start := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	entry := func(i int) *auditEntry {
+		return &auditEntry{
+			Time:       start.Add(time.Duration(i) * time.Minute),
+			Namespace:  "default",
+			Deployment: "hello",
+			Decision:   decisionDetected,
+			Message:    "ProgressDeadlineExceeded",
+		}
+	}
+	l, err := openAuditLog(path, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := l.write(entry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.f.Close()
+
+	for _, p := range []string{path, rotatedAuditLog(path)} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 500 {
+			t.Errorf("%s is %d bytes, larger than the maximum size", p, info.Size())
+		}
+	}
+
+	// The export reads the rotated file first, and ignores a partial line at
+	// its end.
+	f, err := os.OpenFile(rotatedAuditLog(path), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2017-06-01T10:`)
+	f.Close()
+
+	r, err := openAuditLogFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var times []time.Time
+	err = readAuditLog(r, start.Add(5*time.Minute), func(e *auditEntry) error {
+		times = append(times, e.Time)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) == 0 || len(times) > 15 {
+		t.Fatalf("read %d entries, want at most 15", len(times))
+	}
+	if last := times[len(times)-1]; !last.Equal(entry(19).Time) {
+		t.Errorf("last entry at %s, want %s", last, entry(19).Time)
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i].Sub(times[i-1]) != time.Minute {
+			t.Fatalf("entries out of order or missing: %v", times)
+		}
+	}
+}
+
+func TestOpenAuditLogFilesWithoutRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := openAuditLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.write(&auditEntry{Time: time.Now(), Decision: decisionError}); err != nil {
+		t.Fatal(err)
+	}
+	l.f.Close()
+
+	r, err := openAuditLogFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	n := 0
+	if err := readAuditLog(r, time.Time{}, func(e *auditEntry) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("read %d entries, want 1", n)
+	}
+}
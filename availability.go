@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// annotationMinAvailable overrides the minAvailable setting for a single
+// deployment.
+const annotationMinAvailable = "rollback-controller/min-available"
+
+// minAvailableFor returns the number of ready pods the previous ReplicaSet of
+// a deployment must have before the controller will roll back to it. Zero
+// means no requirement.
+func (c *rollbackController) minAvailableFor(d *v1beta1.Deployment) (int32, error) {
+	v, ok := c.annotation(d, annotationMinAvailable)
+	if !ok {
+		return c.cfg.MinAvailable, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q", annotationMinAvailable, v)
+	}
+	return int32(n), nil
+}
+
+// checkAvailability determines if rolling back a deployment would scale up a
+// target ReplicaSet that still has enough ready pods to serve traffic. If it
+// doesn't, the returned string explains why.
+func (c *rollbackController) checkAvailability(d *v1beta1.Deployment, target *v1beta1.ReplicaSet) (bool, string, error) {
+	min, err := c.minAvailableFor(d)
+	if err != nil {
+		return false, "", err
+	}
+	if min == 0 {
+		return true, "", nil
+	}
+	if ready := target.Status.GetReadyReplicas(); ready < min {
+		return false, fmt.Sprintf("previous ReplicaSet %s has %d ready pods, policy requires %d",
+			target.Metadata.GetName(), ready, min), nil
+	}
+	return true, "", nil
+}
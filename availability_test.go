@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+)
+
+func TestMinAvailable(t *testing.T) {
+	tests := []struct {
+		name string
+		// Flags, and the annotations of the deployment and its namespace.
+		args        []string
+		annotations map[string]string
+		namespace   map[string]string
+
+		wantActions []string
+		wantPaused  bool
+		wantErr     bool
+	}{
+		{
+			name:        "enough ready pods",
+			args:        []string{"--min-available=2"},
+			wantActions: []string{"rollback"},
+		},
+		{
+			name:        "too few ready pods",
+			args:        []string{"--min-available=3"},
+			wantActions: []string{"pause"},
+			wantPaused:  true,
+		},
+		{
+			name:        "deployment annotation",
+			annotations: map[string]string{annotationMinAvailable: "3"},
+			wantActions: []string{"pause"},
+			wantPaused:  true,
+		},
+		{
+			name:        "deployment annotation overrides flag",
+			args:        []string{"--min-available=3"},
+			annotations: map[string]string{annotationMinAvailable: "0"},
+			wantActions: []string{"rollback"},
+		},
+		{
+			name:        "namespace annotation",
+			namespace:   map[string]string{annotationMinAvailable: "3"},
+			wantActions: []string{"pause"},
+			wantPaused:  true,
+		},
+		{
+			name:        "deployment annotation overrides namespace",
+			annotations: map[string]string{annotationMinAvailable: "1"},
+			namespace:   map[string]string{annotationMinAvailable: "3"},
+			wantActions: []string{"rollback"},
+		},
+		{
+			name:        "invalid annotation",
+			annotations: map[string]string{annotationMinAvailable: "-1"},
+			wantErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			f.addNamespace(&v1.Namespace{Metadata: &v1.ObjectMeta{
+				Name:        k8s.String("default"),
+				Annotations: test.namespace,
+			}})
+			d := testDeployment("hello", 2, true)
+			for k, v := range test.annotations {
+				d.Metadata.Annotations[k] = v
+			}
+			f.addDeployment(d)
+			f.addReplicaSet(testReplicaSet(d, 2))
+			// The previous ReplicaSet has 2 ready pods.
+			f.addReplicaSet(testReplicaSet(d, 1))
+			c := newTestController(t, f, test.args...)
+
+			if err := c.run(context.Background()); (err != nil) != test.wantErr {
+				t.Fatalf("run: err=%v, want error %t", err, test.wantErr)
+			}
+			if actions := c.actions("hello"); !reflect.DeepEqual(actions, test.wantActions) {
+				t.Errorf("actions %q, want %q", actions, test.wantActions)
+			}
+			got, err := f.getDeployment(context.Background(), "default", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Spec.GetPaused() != test.wantPaused {
+				t.Errorf("paused=%t, want %t", got.Spec.GetPaused(), test.wantPaused)
+			}
+			if _, ok := got.Metadata.GetAnnotations()[annotationPausedByController]; ok != test.wantPaused {
+				t.Errorf("paused by controller annotation set=%t, want %t", ok, test.wantPaused)
+			}
+		})
+	}
+}
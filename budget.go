@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// spendBudget counts an automatic rollback against the budget of the
+// deployment's namespace. It returns false, without counting it, if the
+// namespace has already used its budget within the current window.
+//
+// Budgets protect against a bad change pushed to many deployments at once,
+// such as a broken shared config, triggering rollbacks across the cluster.
+// Unlike the per-deployment rollback counts they're kept in memory, so they
+// start over when the controller restarts unless a stateStore is used.
+func (c *rollbackController) spendBudget(d *v1beta1.Deployment, now time.Time) bool {
+	if c.cfg.NamespaceBudget <= 0 {
+		return true
+	}
+	ns := d.Metadata.GetNamespace()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var recent []time.Time
+	for _, t := range c.budgets[ns] {
+		if now.Sub(t) < c.cfg.NamespaceBudgetWindow.Duration {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= c.cfg.NamespaceBudget {
+		c.budgets[ns] = recent
+		return false
+	}
+	if c.budgets == nil {
+		c.budgets = make(map[string][]time.Time)
+	}
+	c.budgets[ns] = append(recent, now)
+	return true
+}
+
+// refundBudget undoes spendBudget, for a rollback spent at the given time
+// that wasn't written. Rollbacks are spent before they're written, rather
+// than after, so concurrent workers can't overspend a namespace's budget.
+func (c *rollbackController) refundBudget(d *v1beta1.Deployment, spent time.Time) {
+	if c.cfg.NamespaceBudget <= 0 {
+		return
+	}
+	ns := d.Metadata.GetNamespace()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	budget := c.budgets[ns]
+	for i, t := range budget {
+		if t.Equal(spent) {
+			c.budgets[ns] = append(budget[:i:i], budget[i+1:]...)
+			return
+		}
+	}
+}
+
+// overBudget notifies about a failed deployment that wasn't rolled back
+// because its namespace has used its rollback budget, once per revision.
+func (c *rollbackController) overBudget(ctx context.Context, f *failure) error {
+	d := f.d
+	if !c.once("over-budget", d) {
+		return nil
+	}
+	msg := fmt.Sprintf("deployment failed (%s) but namespace %q has used its budget of %d automatic rollbacks in the last %s, not rolling back",
+		f.reason, d.Metadata.GetNamespace(), c.cfg.NamespaceBudget, c.cfg.NamespaceBudgetWindow.Duration)
+	c.logger.Printf("not rolling back deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.recordAction(d, "notify", 0, msg)
+	c.recordEvent(ctx, d, eventWarning, "RollbackBudgetExhausted", msg)
+	return c.notify(ctx, d, "over-budget", severityCritical, msg)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNamespaceBudget(t *testing.T) {
+	f := newFakeAPI()
+	c := newTestController(t, f, "--namespace-budget=1", "--namespace-budget-window=1h")
+	d := testDeployment("hello", 2, true)
+	now := time.Now()
+
+	if !c.spendBudget(d, now) {
+		t.Fatal("budget wasn't available")
+	}
+	if c.spendBudget(d, now.Add(time.Minute)) {
+		t.Fatal("budget was spent twice")
+	}
+	c.refundBudget(d, now)
+	if !c.spendBudget(d, now.Add(2*time.Minute)) {
+		t.Fatal("refunded budget wasn't available")
+	}
+	if !c.spendBudget(d, now.Add(62*time.Minute)) {
+		t.Fatal("budget wasn't available after the window")
+	}
+}
+
+func TestNamespaceBudgetAbortedRollback(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	d := testDeployment("hello", 2, true)
+	f.addDeployment(d)
+	f.addReplicaSet(testReplicaSet(d, 1))
+	c := newTestController(t, f, "--namespace-budget=1")
+
+	// The deployment is updated after it's read, so the rollback is
+	// aborted, and mustn't use the budget.
+	read, err := f.getDeployment(ctx, "default", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.patchDeployment(ctx, "default", "hello", []byte(`{"spec":{"minReadySeconds":5}}`)); err != nil {
+		t.Fatal(err)
+	}
+	replicaSets, err := f.listReplicaSets(ctx, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.rollback(ctx, &failure{d: read, reason: "test", replicaSets: replicaSets})
+	if _, ok := err.(*modifiedError); !ok {
+		t.Fatalf("expected modified error, got %v", err)
+	}
+	if !c.spendBudget(d, time.Now()) {
+		t.Error("aborted rollback used the namespace's budget")
+	}
+}
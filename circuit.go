@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Annotations used to count how many times a deployment has been rolled
+// back within the maxRollbacksWindow.
+const (
+	annotationRollbackAttempts    = "rollback-controller/rollback-attempts"
+	annotationRollbackWindowStart = "rollback-controller/rollback-window-start"
+)
+
+func setAnnotation(d *v1beta1.Deployment, key, value string) {
+	if d.Metadata.Annotations == nil {
+		d.Metadata.Annotations = make(map[string]string)
+	}
+	d.Metadata.Annotations[key] = value
+}
+
+// countRollback counts a rollback attempt, returning the annotations that
+// record it. It returns false if the deployment has already been rolled back
+// the maximum number of times within the current window.
+//
+// The annotations are only written to the API server when the caller
+// updates the deployment.
+func (c *rollbackController) countRollback(d *v1beta1.Deployment, now time.Time) (map[string]string, bool) {
+	if c.cfg.MaxRollbacks <= 0 {
+		return nil, true
+	}
+	annotations := d.Metadata.GetAnnotations()
+
+	attempts, _ := strconv.Atoi(annotations[annotationRollbackAttempts])
+	start, err := time.Parse(time.RFC3339, annotations[annotationRollbackWindowStart])
+	if err != nil || now.Sub(start) > c.cfg.MaxRollbacksWindow.Duration {
+		attempts = 0
+		start = now
+	}
+	if attempts >= c.cfg.MaxRollbacks {
+		return nil, false
+	}
+	return map[string]string{
+		annotationRollbackAttempts:    strconv.Itoa(attempts + 1),
+		annotationRollbackWindowStart: start.UTC().Format(time.RFC3339),
+	}, true
+}
+
+// tripCircuitBreaker scales a deployment that keeps failing to zero, rather
+// than rolling it back yet again. Autoscaled deployments are paused instead.
+func (c *rollbackController) tripCircuitBreaker(ctx context.Context, f *failure) error {
+	d := f.d
+	msg := fmt.Sprintf("deployment has been rolled back %s times in the last %s and failed again (%s)",
+		d.Metadata.GetAnnotations()[annotationRollbackAttempts], c.cfg.MaxRollbacksWindow.Duration, f.reason)
+
+	h, err := c.autoscaler(ctx, d)
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		msg += fmt.Sprintf(", pausing it since its replicas are managed by HorizontalPodAutoscaler %s", h.Metadata.GetName())
+		c.recordEvent(ctx, d, eventWarning, "RollbackLoop", msg)
+		return c.pauseDeployment(ctx, d, msg)
+	}
+	msg += ", scaling to zero replicas"
+
+	err = c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+		d.Spec.Replicas = new(int32)
+	})
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("circuit breaker tripped for deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.recordAction(d, "circuit-breaker", 0, msg)
+	c.recordEvent(ctx, d, eventWarning, "RollbackLoop", msg)
+
+	return c.notify(ctx, d, "circuit-breaker", severityCritical, msg)
+}
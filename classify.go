@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Classes of failures, determined from the pods of a failed rollout.
+const (
+	// The image can't be pulled.
+	classBadImage = "bad-image"
+	// Containers crash or can't start.
+	classBadCode = "bad-code"
+	// Pods can't be scheduled, usually because the cluster is out of
+	// capacity.
+	classInsufficientResources = "insufficient-resources"
+	// None of the above, the rollout is just taking too long.
+	classSlowRollout = "slow-rollout"
+)
+
+// classActionWait leaves a failed deployment alone, in the hope the rollout
+// completes on its own, and checks it again on the next pass.
+const classActionWait = "wait"
+
+var failureClasses = map[string]bool{
+	classBadImage:              true,
+	classBadCode:               true,
+	classInsufficientResources: true,
+	classSlowRollout:           true,
+}
+
+// validateFailureClasses validates a mapping of failure classes to the
+// strategy, or wait, used to handle them.
+func validateFailureClasses(classes map[string]string) error {
+	for class, action := range classes {
+		if !failureClasses[class] {
+			return fmt.Errorf("unknown failure class %q", class)
+		}
+		if action == classActionWait {
+			continue
+		}
+		if err := validateStrategy(action); err != nil {
+			return fmt.Errorf("failure class %q: %v", class, err)
+		}
+	}
+	return nil
+}
+
+// Container waiting reasons of each class.
+var (
+	badImageReasons = map[string]bool{
+		"ErrImagePull":      true,
+		"ImagePullBackOff":  true,
+		"InvalidImageName":  true,
+		"ErrImageNeverPull": true,
+	}
+	badCodeReasons = map[string]bool{
+		"CrashLoopBackOff":           true,
+		"RunContainerError":          true,
+		"CreateContainerError":       true,
+		"CreateContainerConfigError": true,
+	}
+)
+
+// classify determines the class of a failed rollout from the pods of its new
+// ReplicaSet. If pods fail in different ways the most specific class wins:
+// an image that can't be pulled over crashing containers, over pods that
+// can't be scheduled.
+func (c *rollbackController) classify(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (string, error) {
+	rs := newReplicaSet(d, replicaSets)
+	if rs == nil {
+		return classSlowRollout, nil
+	}
+	pods, err := c.api.listPods(ctx, d.Metadata.GetNamespace())
+	if err != nil {
+		return "", fmt.Errorf("list pods: %v", err)
+	}
+
+	badCode, unschedulable := false, false
+	for _, p := range pods {
+		if !podOwnedBy(p, rs) {
+			continue
+		}
+		for _, cs := range p.Status.GetContainerStatuses() {
+			reason := cs.GetState().GetWaiting().GetReason()
+			switch {
+			case badImageReasons[reason]:
+				return classBadImage, nil
+			case badCodeReasons[reason], cs.GetState().GetTerminated().GetExitCode() != 0:
+				badCode = true
+			}
+		}
+		if podUnschedulable(p) {
+			unschedulable = true
+		}
+	}
+	switch {
+	case badCode:
+		return classBadCode, nil
+	case unschedulable:
+		return classInsufficientResources, nil
+	}
+	return classSlowRollout, nil
+}
+
+func podUnschedulable(p *v1.Pod) bool {
+	for _, cond := range p.Status.GetConditions() {
+		if cond.GetType() == "PodScheduled" && cond.GetStatus() == "False" && cond.GetReason() == "Unschedulable" {
+			return true
+		}
+	}
+	return false
+}
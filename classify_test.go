@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// unschedulablePod returns a pod of a ReplicaSet that can't be scheduled.
+func unschedulablePod(rs *v1beta1.ReplicaSet, name string) *v1.Pod {
+	p := testPod(rs, name)
+	p.Spec.NodeName = nil
+	p.Status.Phase = k8s.String("Pending")
+	p.Status.Conditions = []*v1.PodCondition{{
+		Type:   k8s.String("PodScheduled"),
+		Status: k8s.String("False"),
+		Reason: k8s.String("Unschedulable"),
+	}}
+	return p
+}
+
+func TestClassify(t *testing.T) {
+	d := testDeployment("hello", 2, true)
+	rs := testReplicaSet(d, 2)
+	old := testReplicaSet(d, 1)
+	exited := &v1.ContainerStatus{
+		Name:  k8s.String("hello"),
+		Ready: k8s.Bool(false),
+		State: &v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: int32Ptr(1)}},
+	}
+
+	tests := []struct {
+		name string
+		pods []*v1.Pod
+		want string
+	}{
+		{
+			name: "image can't be pulled",
+			pods: []*v1.Pod{testPod(rs, "hello-a", waitingContainer("hello", "ImagePullBackOff"))},
+			want: classBadImage,
+		},
+		{
+			name: "crash looping",
+			pods: []*v1.Pod{testPod(rs, "hello-a", crashLoopingContainer("hello", 1, 5))},
+			want: classBadCode,
+		},
+		{
+			name: "exited",
+			pods: []*v1.Pod{testPod(rs, "hello-a", exited)},
+			want: classBadCode,
+		},
+		{
+			name: "unschedulable",
+			pods: []*v1.Pod{unschedulablePod(rs, "hello-a")},
+			want: classInsufficientResources,
+		},
+		{
+			name: "slow",
+			pods: []*v1.Pod{testPod(rs, "hello-a", readyContainer("hello")), testPod(rs, "hello-b", waitingContainer("hello", "ContainerCreating"))},
+			want: classSlowRollout,
+		},
+		{
+			name: "bad image wins",
+			pods: []*v1.Pod{
+				unschedulablePod(rs, "hello-a"),
+				testPod(rs, "hello-b", crashLoopingContainer("hello", 1, 5)),
+				testPod(rs, "hello-c", waitingContainer("hello", "ErrImagePull")),
+			},
+			want: classBadImage,
+		},
+		{
+			name: "bad code over unschedulable",
+			pods: []*v1.Pod{unschedulablePod(rs, "hello-a"), testPod(rs, "hello-b", crashLoopingContainer("hello", 1, 5))},
+			want: classBadCode,
+		},
+		{
+			name: "other ReplicaSets",
+			pods: []*v1.Pod{testPod(old, "hello-old", waitingContainer("hello", "ErrImagePull"))},
+			want: classSlowRollout,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			for _, p := range test.pods {
+				f.addPod(p)
+			}
+			c := newTestController(t, f)
+			got, err := c.classify(context.Background(), d, []*v1beta1.ReplicaSet{rs, old})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got class %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFailureClasses(t *testing.T) {
+	tests := []struct {
+		name string
+		// The failed rollout's pod's container, if it's been scheduled.
+		container   *v1.ContainerStatus
+		annotations map[string]string
+
+		wantClass   string
+		wantState   string
+		wantActions []string
+	}{
+		{
+			name:        "bad image",
+			container:   waitingContainer("hello", "ErrImagePull"),
+			wantClass:   classBadImage,
+			wantState:   statePaused,
+			wantActions: []string{"pause"},
+		},
+		{
+			name:      "insufficient resources",
+			wantClass: classInsufficientResources,
+			wantState: stateWaiting,
+		},
+		{
+			name:        "unconfigured class",
+			container:   crashLoopingContainer("hello", 1, 5),
+			wantClass:   classBadCode,
+			wantState:   stateRollingBack,
+			wantActions: []string{"rollback"},
+		},
+		{
+			// Deployments that chose a strategy aren't classified.
+			name:        "strategy annotation",
+			annotations: map[string]string{annotationStrategy: strategyRollback},
+			wantState:   stateRollingBack,
+			wantActions: []string{"rollback"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			d := testDeployment("hello", 2, true)
+			for k, v := range test.annotations {
+				d.Metadata.Annotations[k] = v
+			}
+			rs := testReplicaSet(d, 2)
+			f.addDeployment(d)
+			f.addReplicaSet(rs)
+			f.addReplicaSet(testReplicaSet(d, 1))
+			if test.container != nil {
+				f.addPod(testPod(rs, "hello-a", test.container))
+			} else {
+				f.addPod(unschedulablePod(rs, "hello-a"))
+			}
+			c := newTestController(t, f)
+			c.cfg.FailureClasses = map[string]string{
+				classBadImage:              strategyPause,
+				classInsufficientResources: classActionWait,
+			}
+
+			if err := c.run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(c.status.failed) != 1 {
+				t.Fatalf("got %d failed deployments, want 1", len(c.status.failed))
+			}
+			if s := c.status.failed[0]; s.Class != test.wantClass || s.State != test.wantState {
+				t.Errorf("got class %q, state %q, want %q, %q", s.Class, s.State, test.wantClass, test.wantState)
+			}
+			if actions := c.actions("hello"); !reflect.DeepEqual(actions, test.wantActions) {
+				t.Errorf("actions %q, want %q", actions, test.wantActions)
+			}
+		})
+	}
+}
+
+func TestValidateFailureClasses(t *testing.T) {
+	if err := validateFailureClasses(map[string]string{classBadImage: strategyPause, classSlowRollout: classActionWait}); err != nil {
+		t.Errorf("valid classes: %v", err)
+	}
+	for _, classes := range []map[string]string{
+		{"bad-luck": strategyPause},
+		{classBadImage: "retry"},
+	} {
+		if err := validateFailureClasses(classes); err == nil {
+			t.Errorf("%v: expected an error", classes)
+		}
+	}
+}
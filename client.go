@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/unversioned"
+	"github.com/ericchiang/k8s/api/v1"
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	batchv1 "github.com/ericchiang/k8s/apis/batch/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	policyv1beta1 "github.com/ericchiang/k8s/apis/policy/v1beta1"
+	"github.com/ericchiang/k8s/runtime"
+	"github.com/golang/protobuf/proto"
+)
+
+// deploymentAPI is the subset of the Kubernetes API the controller uses. It's
+// implemented by clientAPI against a real API server, and by fakeAPI in
+// memory, so the controller's logic can be exercised without a cluster.
+type deploymentAPI interface {
+	listDeployments(ctx context.Context, namespace string) ([]*v1beta1.Deployment, error)
+	getDeployment(ctx context.Context, namespace, name string) (*v1beta1.Deployment, error)
+	// patchDeployment applies a strategic merge patch to a deployment.
+	patchDeployment(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error)
+	// patchDeploymentStatus applies a strategic merge patch to a
+	// deployment's status subresource.
+	patchDeploymentStatus(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error)
+	listReplicaSets(ctx context.Context, namespace string) ([]*v1beta1.ReplicaSet, error)
+	patchReplicaSet(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.ReplicaSet, error)
+	createEvent(ctx context.Context, e *v1.Event) error
+	listPods(ctx context.Context, namespace string) ([]*v1.Pod, error)
+	// podLogs returns the last lines of a container's logs. If previous is
+	// true, the logs of its last terminated instance are returned.
+	podLogs(ctx context.Context, namespace, pod, container string, previous bool, lines int) (string, error)
+	listHorizontalPodAutoscalers(ctx context.Context, namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error)
+	listPodDisruptionBudgets(ctx context.Context, namespace string) ([]*policyv1beta1.PodDisruptionBudget, error)
+	getJob(ctx context.Context, namespace, name string) (*batchv1.Job, error)
+	createJob(ctx context.Context, job *batchv1.Job) (*batchv1.Job, error)
+	listNamespaces(ctx context.Context) ([]*v1.Namespace, error)
+	getNamespace(ctx context.Context, name string) (*v1.Namespace, error)
+	getConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error)
+	createConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error)
+	updateConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error)
+	getSecret(ctx context.Context, namespace, name string) (*v1.Secret, error)
+	createSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error)
+	updateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error)
+}
+
+// clientAPI implements deploymentAPI using a Kubernetes client.
+type clientAPI struct {
+	client *k8s.Client
+}
+
+func (a *clientAPI) listDeployments(ctx context.Context, namespace string) ([]*v1beta1.Deployment, error) {
+	l, err := a.clientFor(ctx).ExtensionsV1Beta1().ListDeployments(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+func (a *clientAPI) getDeployment(ctx context.Context, namespace, name string) (*v1beta1.Deployment, error) {
+	return a.clientFor(ctx).ExtensionsV1Beta1().GetDeployment(ctx, name, namespace)
+}
+
+func (a *clientAPI) listReplicaSets(ctx context.Context, namespace string) ([]*v1beta1.ReplicaSet, error) {
+	l, err := a.clientFor(ctx).ExtensionsV1Beta1().ListReplicaSets(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+func (a *clientAPI) createEvent(ctx context.Context, e *v1.Event) error {
+	_, err := a.clientFor(ctx).CoreV1().CreateEvent(ctx, e)
+	return err
+}
+
+func (a *clientAPI) listPods(ctx context.Context, namespace string) ([]*v1.Pod, error) {
+	l, err := a.clientFor(ctx).CoreV1().ListPods(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+func (a *clientAPI) listHorizontalPodAutoscalers(ctx context.Context, namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error) {
+	l, err := a.clientFor(ctx).AutoscalingV1().ListHorizontalPodAutoscalers(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+func (a *clientAPI) listPodDisruptionBudgets(ctx context.Context, namespace string) ([]*policyv1beta1.PodDisruptionBudget, error) {
+	l, err := a.clientFor(ctx).PolicyV1Beta1().ListPodDisruptionBudgets(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+func (a *clientAPI) getJob(ctx context.Context, namespace, name string) (*batchv1.Job, error) {
+	return a.clientFor(ctx).BatchV1().GetJob(ctx, name, namespace)
+}
+
+func (a *clientAPI) createJob(ctx context.Context, job *batchv1.Job) (*batchv1.Job, error) {
+	return a.clientFor(ctx).BatchV1().CreateJob(ctx, job)
+}
+
+func (a *clientAPI) listNamespaces(ctx context.Context) ([]*v1.Namespace, error) {
+	l, err := a.clientFor(ctx).CoreV1().ListNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+func (a *clientAPI) getNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	return a.clientFor(ctx).CoreV1().GetNamespace(ctx, name)
+}
+
+func (a *clientAPI) getConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error) {
+	return a.clientFor(ctx).CoreV1().GetConfigMap(ctx, name, namespace)
+}
+
+func (a *clientAPI) createConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	return a.clientFor(ctx).CoreV1().CreateConfigMap(ctx, cm)
+}
+
+func (a *clientAPI) updateConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	return a.clientFor(ctx).CoreV1().UpdateConfigMap(ctx, cm)
+}
+
+func (a *clientAPI) getSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	return a.clientFor(ctx).CoreV1().GetSecret(ctx, name, namespace)
+}
+
+func (a *clientAPI) createSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	return a.clientFor(ctx).CoreV1().CreateSecret(ctx, secret)
+}
+
+func (a *clientAPI) updateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	return a.clientFor(ctx).CoreV1().UpdateSecret(ctx, secret)
+}
+
+// podLogs calls the API server directly, since the client doesn't support
+// the log subresource.
+func (a *clientAPI) podLogs(ctx context.Context, namespace, pod, container string, previous bool, lines int) (string, error) {
+	q := url.Values{
+		"container": {container},
+		"tailLines": {strconv.Itoa(lines)},
+		"previous":  {strconv.FormatBool(previous)},
+	}
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/log?%s",
+		strings.TrimSuffix(a.client.Endpoint, "/"), url.PathEscape(namespace), url.PathEscape(pod), q.Encode())
+	b, err := a.get(ctx, u)
+	return string(b), err
+}
+
+// patchDeployment calls the API server directly, since the client doesn't
+// support patches.
+func (a *clientAPI) patchDeployment(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error) {
+	d := new(v1beta1.Deployment)
+	if err := a.patch(ctx, "deployments", namespace, name, "", patch, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (a *clientAPI) patchDeploymentStatus(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error) {
+	d := new(v1beta1.Deployment)
+	if err := a.patch(ctx, "deployments", namespace, name, "status", patch, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (a *clientAPI) patchReplicaSet(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.ReplicaSet, error) {
+	rs := new(v1beta1.ReplicaSet)
+	if err := a.patch(ctx, "replicasets", namespace, name, "", patch, rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// patch applies a strategic merge patch to an extensions/v1beta1 object, or
+// its subresource if non-empty, decoding the patched object into obj. The
+// controller is identified as the field manager of the fields it changes.
+func (a *clientAPI) patch(ctx context.Context, resource, namespace, name, subresource string, patch []byte, obj proto.Message) error {
+	path := url.PathEscape(name)
+	if subresource != "" {
+		path += "/" + subresource
+	}
+	u := fmt.Sprintf("%s/apis/extensions/v1beta1/namespaces/%s/%s/%s?%s",
+		strings.TrimSuffix(a.client.Endpoint, "/"), url.PathEscape(namespace), resource, path,
+		url.Values{"fieldManager": {managerName}}.Encode())
+	req, err := http.NewRequest("PATCH", u, bytes.NewReader(patch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/strategic-merge-patch+json")
+	req.Header.Set("Accept", contentTypeProtobuf)
+	code, b, err := a.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		status := new(unversioned.Status)
+		if err := unmarshalProtobuf(b, status); err != nil {
+			status = &unversioned.Status{Status: k8s.String("Failure"), Message: k8s.String(string(bytes.TrimSpace(b)))}
+		}
+		return &k8s.APIError{Code: code, Status: status}
+	}
+	if err := unmarshalProtobuf(b, obj); err != nil {
+		return fmt.Errorf("decode %s: %v", resource, err)
+	}
+	return nil
+}
+
+// Kubernetes' protobuf encoding wraps each object in a runtime.Unknown,
+// prefixed by magic bytes.
+const contentTypeProtobuf = "application/vnd.kubernetes.protobuf"
+
+var protobufMagic = []byte("k8s\x00")
+
+func unmarshalProtobuf(b []byte, m proto.Message) error {
+	if !bytes.HasPrefix(b, protobufMagic) {
+		return fmt.Errorf("response isn't a kubernetes protobuf object")
+	}
+	u := new(runtime.Unknown)
+	if err := u.Unmarshal(b[len(protobufMagic):]); err != nil {
+		return err
+	}
+	return proto.Unmarshal(u.Raw, m)
+}
+
+// get makes a raw GET request to the API server, for requests the client
+// doesn't support.
+func (a *clientAPI) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	code, b, err := a.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if code/100 != 2 {
+		return nil, fmt.Errorf("GET %s: %d %s: %s", req.URL.Path, code, http.StatusText(code), bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
+// do makes a raw request with the client's credentials, returning the status
+// code and body of the response.
+func (a *clientAPI) do(ctx context.Context, req *http.Request) (int, []byte, error) {
+	client := a.clientFor(ctx)
+	if client.SetHeaders != nil {
+		if err := client.SetHeaders(req.Header); err != nil {
+			return 0, nil, err
+		}
+	}
+	httpClient := a.client.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, b, nil
+}
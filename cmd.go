@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// globalFlags are the flags shared by every command. Most of them provide
+// defaults for settings in the config file.
+type globalFlags struct {
+	clientType string
+	namespace  string
+	configPath string
+
+	minAvailable int
+	workers      int
+	maxRollbacks int
+
+	qps   float64
+	burst int
+
+	skipOwnerKinds   string
+	resources        string
+	systemNamespaces string
+
+	base config
+}
+
+func newFlagSet(name, args string) (*flag.FlagSet, *globalFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: kube-rollback-controller %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	g := new(globalFlags)
+	fs.StringVar(&g.clientType, "client", clientInCluster, "Strategy for initializing the Kubernetes client. Either uses 'in-cluster' or grabs current context with 'kubectl'.")
+	fs.StringVar(&g.namespace, "namespace", "", "Namespace to operate on. Defaults to the client's namespace.")
+	fs.StringVar(&g.configPath, "config", "", "Path to a YAML config file. Settings in the file override flags.")
+	fs.Float64Var(&g.qps, "qps", 20, "Maximum average number of Kubernetes API requests per second, for each cluster. Zero disables the limit.")
+	fs.IntVar(&g.burst, "burst", 30, "Maximum number of Kubernetes API requests in a burst above --qps.")
+	fs.StringVar(&g.base.RegionLabel, "region-label", defaultRegionLabel, "Label holding the region of a deployment. Regions are included in metrics and notifications, and can have their own policies in the config file.")
+	fs.DurationVar(&g.base.ConfirmationDelay.Duration, "confirmation-delay", 0, "How long a deployment must keep failing before it's handled. Avoids rolling back deployments that were about to succeed, for example when nodes are slow to pull images.")
+	fs.IntVar(&g.minAvailable, "min-available", 0, "Number of ready pods the previous ReplicaSet must have before rolling back. Deployments that don't meet this are paused and a notification is sent instead. Zero disables the check.")
+	fs.StringVar(&g.resources, "resources", resourceDeployments, "Comma separated kinds of resources to reconcile. Only 'deployments' are supported: 'statefulsets' and 'daemonsets' are rejected, since the vendored client's StatefulSet and DaemonSet types keep no revision history to roll back to.")
+	fs.StringVar(&g.systemNamespaces, "system-namespaces", strings.Join(defaultSystemNamespaces, ","), "Comma separated namespaces whose deployments, such as CNI or DNS components, are only handled if they, or the namespace, set the "+annotationEnabled+" annotation to true, or the controller's --namespace is set to them.")
+	fs.IntVar(&g.workers, "workers", 4, "Number of deployments to reconcile concurrently.")
+	fs.StringVar(&g.base.DefaultStrategy, "default-strategy", strategyRollback, "How failed deployments are handled, unless they set the "+annotationStrategy+" annotation. One of 'rollback', 'pause', 'scale-to-zero', 'notify-only', 'git', 'image', or 'plugin'.")
+	fs.BoolVar(&g.base.UnpauseAfterRollback, "unpause-after-rollback", false, "Resume deployments the controller paused when they're rolled back, so the rollback takes effect. Deployments paused by anyone else are left paused.")
+	fs.BoolVar(&g.base.OptIn, "opt-in", false, "Only handle deployments that set the "+annotationEnabled+" annotation to 'true', on the deployment or its namespace. Otherwise deployments are handled unless it's set to 'false'.")
+	fs.DurationVar(&g.base.Cooldown.Duration, "cooldown", 0, "How long after a rollback a deployment that fails again must wait before it's rolled back again. A notification is sent instead. Zero disables the cooldown.")
+	fs.DurationVar(&g.base.Quarantine.Duration, "quarantine", 0, "How long after a rollback new rollouts of a deployment are quarantined: they're handled without --confirmation-delay, and fail as soon as a container restarts or can't start, or if they don't complete within --quarantine-deadline. Zero disables quarantine.")
+	fs.DurationVar(&g.base.QuarantineDeadline.Duration, "quarantine-deadline", 2*time.Minute, "How long a quarantined rollout has to complete.")
+	fs.DurationVar(&g.base.RolloutTimeout.Duration, "rollout-timeout", 0, "How long a rollout can run before it's considered stuck and handled as failed, for deployments without a progressDeadlineSeconds, or with a longer one, which the API server never or only later reports as failed. Zero disables the check.")
+	fs.BoolVar(&g.base.ScaleDownFailedReplicaSet, "scale-down-failed-replicaset", false, "When a failed rollout is only partially complete, scale the failed revision's ReplicaSet down to zero before rolling back, so its pods stop serving immediately while the previous revision's pods keep running.")
+	fs.StringVar(&g.skipOwnerKinds, "skip-owner-kinds", "", "Comma separated kinds of owners, such as 'Kafka,Prometheus', whose deployments are never handled. A warning event is raised when one fails instead.")
+	fs.BoolVar(&g.base.SkipOperatorOwned, "skip-operator-owned", true, "Don't handle deployments with a controlling owner reference, such as those created by operators, which would roll them forward again. Deployments can opt back in by setting the "+annotationEnabled+" annotation to 'true'.")
+	fs.StringVar(&g.base.VerifyJob, "verify-job", "", "Name of a Job, in each deployment's namespace, used as a template for a smoke test run after the deployment is rolled back, unless it sets the "+annotationVerifyJob+" annotation. Whether the test passed is reported in the rollback's record and a notification.")
+	fs.DurationVar(&g.base.VerifyTimeout.Duration, "verify-timeout", 10*time.Minute, "How long a rollback's rollout and its smoke test Job have to complete before verification fails.")
+	fs.BoolVar(&g.base.StatusCondition, "status-condition", false, "Report the controller's view of each failed or rolled back deployment in a "+conditionType+" condition of its status, shown by kubectl describe. Requires permission to patch deployments/status.")
+	fs.BoolVar(&g.base.SnapshotConfig, "snapshot-config", false, "Copy the ConfigMaps and Secrets used by each revision of a deployment once its rollout completes, and restore them when rolling back to it. Requires permission to get, create, and update ConfigMaps and Secrets.")
+	fs.BoolVar(&g.base.AllowSelfRollback, "allow-self-rollback", false, "Handle the controller's own deployment, found using the "+envPodName+" and "+envPodNamespace+" environment variables, like any other. By default it's only notified about when it fails, since rolling it back during an upgrade could leave it unable to run.")
+	fs.IntVar(&g.maxRollbacks, "max-rollbacks", 0, "Maximum number of times a deployment is rolled back within --max-rollbacks-window. A deployment that fails again is scaled to zero replicas instead. Zero disables the limit.")
+	fs.DurationVar(&g.base.MaxRollbacksWindow.Duration, "max-rollbacks-window", time.Hour, "Window for --max-rollbacks.")
+	fs.IntVar(&g.base.NamespaceBudget, "namespace-budget", 0, "Maximum number of automatic rollbacks in a namespace within --namespace-budget-window. Once it's used up, failed deployments in the namespace are only notified about. Zero disables the limit.")
+	fs.DurationVar(&g.base.NamespaceBudgetWindow.Duration, "namespace-budget-window", time.Hour, "Window for --namespace-budget.")
+	fs.StringVar(&g.base.NotifyTemplatesConfigMap, "notify-templates-configmap", "", "ConfigMap, as 'namespace/name', holding Go templates of notification messages keyed by notifier: 'log', 'webhook', 'pagerDuty', 'opsgenie', or 'default'. It's read on every pass, and takes precedence over the config file's notifyTemplates.")
+	fs.StringVar(&g.base.NotifyWebhook, "notify-webhook", "", "URL to POST JSON notifications to. If empty, notifications are logged.")
+	fs.StringVar(&g.base.PrometheusURL, "prometheus-url", "", "URL of a Prometheus server. If set, deployments annotated with a "+annotationPrometheusQuery+" are marked as failed when the query returns results during a rollout.")
+	fs.DurationVar(&g.base.PrometheusWindow.Duration, "prometheus-window", 10*time.Minute, "How long after a rollout starts Prometheus queries are evaluated.")
+	return fs, g
+}
+
+// baseConfig returns the config defined by flags.
+func (g *globalFlags) baseConfig() (*config, error) {
+	base := g.base
+	base.MinAvailable = int32(g.minAvailable)
+	base.Workers = g.workers
+	base.MaxRollbacks = g.maxRollbacks
+	for _, kind := range strings.Split(g.resources, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			base.Resources = append(base.Resources, kind)
+		}
+	}
+	for _, kind := range strings.Split(g.skipOwnerKinds, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			base.SkipOwnerKinds = append(base.SkipOwnerKinds, kind)
+		}
+	}
+	for _, ns := range strings.Split(g.systemNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			base.SystemNamespaces = append(base.SystemNamespaces, ns)
+		}
+	}
+	if err := base.validate(); err != nil {
+		return nil, fmt.Errorf("invalid flags: %v", err)
+	}
+	return &base, nil
+}
+
+// loadConfig returns the config defined by flags and the config file, and
+// the raw contents of the file.
+func (g *globalFlags) loadConfig() (*config, []byte, error) {
+	base, err := g.baseConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	if g.configPath == "" {
+		return base, nil, nil
+	}
+	data, err := ioutil.ReadFile(g.configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read config: %v", err)
+	}
+	cfg, err := parseConfig(data, base)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid config file %s: %v", g.configPath, err)
+	}
+	return cfg, data, nil
+}
+
+// newClient initializes a client. kubeContext names the kubeconfig context to
+// use with the kubectl client type, or "" for the current context.
+func (g *globalFlags) newClient(kubeContext string) (*k8s.Client, error) {
+	var (
+		client *k8s.Client
+		err    error
+	)
+	switch g.clientType {
+	case clientInCluster:
+		if client, err = k8s.NewInClusterClient(); err != nil {
+			return nil, fmt.Errorf("initialize in-cluster client: %v", err)
+		}
+	case clientKubectl:
+		if client, err = kubectlClient(kubeContext); err != nil {
+			return nil, fmt.Errorf("initialize client from kubectl: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unrecognized client type: %s", g.clientType)
+	}
+	if g.namespace != "" {
+		client.Namespace = g.namespace
+	}
+
+	httpClient := new(http.Client)
+	if client.Client != nil {
+		*httpClient = *client.Client
+	}
+	t := &rateLimitedTransport{base: httpClient.Transport, cluster: kubeContext}
+	if t.base == nil {
+		t.base = http.DefaultTransport
+	}
+	if g.qps > 0 {
+		t.limiter = newTokenBucket(g.qps, g.burst)
+	}
+	httpClient.Transport = t
+	client.Client = httpClient
+	return client, nil
+}
+
+// newController initializes a controller from flags, exiting on error.
+func (g *globalFlags) newController(l *log.Logger) *rollbackController {
+	cfg, _, err := g.loadConfig()
+	if err != nil {
+		l.Fatal(err)
+	}
+	client, err := g.newClient("")
+	if err != nil {
+		l.Fatal(err)
+	}
+	c := &rollbackController{api: &clientAPI{client}, logger: l, namespace: client.Namespace}
+	c.configure(cfg)
+	return c
+}
+
+// runFlags are the flags of the run command, besides the global ones.
+type runFlags struct {
+	configPoll    time.Duration
+	resync        time.Duration
+	resyncJitter  float64
+	httpAddr      string
+	contexts      string
+	otlp          string
+	allNamespaces bool
+
+	storeType      string
+	stateConfigMap string
+	auditPath      string
+	auditMaxSize   int64
+	once           bool
+	debug          bool
+}
+
+// newRunFlagSet returns the flags of the run command, which install also
+// accepts, to pass on to the controller it installs.
+func newRunFlagSet(name string) (*flag.FlagSet, *globalFlags, *runFlags) {
+	fs, g := newFlagSet(name, "")
+	r := new(runFlags)
+	fs.DurationVar(&r.configPoll, "config-poll-interval", 10*time.Second, "How often to check the config file for changes.")
+	fs.DurationVar(&r.resync, "resync-interval", 2*time.Second, "How long to wait between reconcile passes.")
+	fs.Float64Var(&r.resyncJitter, "resync-jitter", 0.1, "Fraction of --resync-interval to randomly add to each wait, so controllers across many clusters don't make their requests in lockstep.")
+	fs.StringVar(&r.httpAddr, "http-addr", "", "Address to serve Prometheus metrics (/metrics) and the admin API (/api/v1/) on. If empty, nothing is served.")
+	fs.BoolVar(&r.allNamespaces, "all-namespaces", false, "Reconcile deployments in every namespace, rather than --namespace or the client's namespace. The in-cluster client's namespace is the controller's own.")
+	fs.StringVar(&r.contexts, "contexts", "", "Comma separated kubeconfig contexts of clusters to run against, each with its own reconcile loop. Requires --client=kubectl. Defaults to the current context.")
+	fs.StringVar(&r.storeType, "state-store", stateStoreMemory, "Where to keep state that isn't stored on deployments, such as when they started failing, namespace budgets, and recent actions. Either 'memory', which is lost on restart, or 'configmap', which saves it in a ConfigMap in each namespace.")
+	fs.StringVar(&r.stateConfigMap, "state-configmap", "rollback-controller-state", "Name of the ConfigMaps used by --state-store=configmap.")
+	fs.StringVar(&r.auditPath, "audit-log", "", "Path of a file to append every decision the controller makes to, such as failures detected, deployments skipped, and rollbacks, for the export command. If empty, decisions aren't recorded.")
+	fs.Int64Var(&r.auditMaxSize, "audit-log-max-size", 100, "Size in megabytes the audit log can grow to before it's rotated, by renaming it with a .1 suffix, replacing the previous one. Zero disables rotation.")
+	fs.BoolVar(&r.once, "once", false, "Run a single reconcile pass, print a JSON summary of failed deployments, actions taken, and errors to stdout, and exit. Exits non-zero if any rollback failed, for running as a CronJob or in CI pipelines.")
+	fs.BoolVar(&r.debug, "debug", false, "Serve runtime profiles at /debug/pprof/ and memory stats and the sizes of the controller's state at /debug/vars. Requires --http-addr.")
+	fs.StringVar(&r.otlp, "otlp-endpoint", "", "Base URL of an OpenTelemetry collector, e.g. 'http://otel-collector:4318'. If set, reconcile passes are traced and spans are exported using OTLP/HTTP.")
+	return fs, g, r
+}
+
+// cmdRun runs the controller forever.
+func cmdRun(args []string) {
+	fs, g, r := newRunFlagSet("run")
+	fs.Parse(args)
+
+	l := log.New(os.Stderr, "", log.LstdFlags)
+	rand.Seed(time.Now().UnixNano())
+
+	cfg, data, err := g.loadConfig()
+	if err != nil {
+		l.Fatal(err)
+	}
+	switch r.storeType {
+	case stateStoreMemory, stateStoreConfigMap:
+	default:
+		l.Fatalf("unknown --state-store %q", r.storeType)
+	}
+	if r.debug && r.httpAddr == "" {
+		l.Fatal("--debug requires --http-addr")
+	}
+	if r.allNamespaces && g.namespace != "" {
+		l.Fatal("--all-namespaces can't be used with --namespace")
+	}
+
+	// Without --contexts there's a single, unnamed cluster.
+	clusters := []string{""}
+	if r.contexts != "" {
+		if g.clientType != clientKubectl {
+			l.Fatalf("--contexts requires --client=%s", clientKubectl)
+		}
+		clusters = nil
+		for _, name := range strings.Split(r.contexts, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				clusters = append(clusters, name)
+			}
+		}
+	}
+
+	var audit *auditLog
+	if r.auditPath != "" {
+		if audit, err = openAuditLog(r.auditPath, r.auditMaxSize<<20); err != nil {
+			l.Fatalf("open audit log: %v", err)
+		}
+	}
+
+	var controllers []*rollbackController
+	for _, cluster := range clusters {
+		client, err := g.newClient(cluster)
+		if err != nil {
+			l.Fatalf("cluster %q: %v", cluster, err)
+		}
+		logger := l
+		if cluster != "" {
+			logger = log.New(os.Stderr, "cluster="+cluster+" ", log.LstdFlags)
+		}
+		var api deploymentAPI = &clientAPI{client}
+		if r.otlp != "" {
+			api = &tracedAPI{api}
+		}
+		namespace := client.Namespace
+		if r.allNamespaces {
+			namespace = ""
+		}
+		c := &rollbackController{api: api, logger: logger, namespace: namespace, cluster: cluster, auditLog: audit}
+		if r.storeType == stateStoreConfigMap {
+			c.store = &configMapStore{api: api, name: r.stateConfigMap}
+		}
+		c.configure(cfg)
+		controllers = append(controllers, c)
+	}
+
+	// Config reloads are handed to each cluster's loop, which applies them
+	// between passes.
+	reloads := make([]chan *config, len(controllers))
+	for i := range reloads {
+		reloads[i] = make(chan *config, 1)
+	}
+	if g.configPath != "" {
+		base, _ := g.baseConfig()
+		updates := watchConfig(context.Background(), g.configPath, data, base, r.configPoll, l)
+		go func() {
+			for cfg := range updates {
+				for _, ch := range reloads {
+					// Replace a reload the loop hasn't picked up yet.
+					select {
+					case <-ch:
+					default:
+					}
+					ch <- cfg
+				}
+			}
+		}()
+	}
+
+	if r.otlp != "" {
+		tracer = newOTLPExporter(r.otlp, l)
+		go tracer.run(context.Background(), 5*time.Second)
+	}
+
+	if r.once {
+		summary := runOnce(context.Background(), controllers)
+		if tracer != nil {
+			if err := tracer.export(context.Background()); err != nil {
+				l.Printf("export spans: %v", err)
+			}
+		}
+		if err := summary.write(os.Stdout); err != nil {
+			l.Fatal(err)
+		}
+		if summary.failed() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if r.httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler)
+		registerAPI(mux, controllers...)
+		if r.debug {
+			registerDebug(mux, controllers...)
+		}
+		go func() {
+			l.Fatalf("serve http: %v", http.ListenAndServe(r.httpAddr, mux))
+		}()
+	}
+
+	// Run a rollback controller per cluster forever.
+	for i, c := range controllers[1:] {
+		go runForever(c, reloads[i+1], g.configPath, r.resync, r.resyncJitter)
+	}
+	runForever(controllers[0], reloads[0], g.configPath, r.resync, r.resyncJitter)
+}
+
+// runForever runs a controller's reconcile loop, applying config reloads
+// between passes, and waiting a jittered interval after each one.
+func runForever(c *rollbackController, reloads <-chan *config, configPath string, interval time.Duration, jitterFactor float64) {
+	for {
+		select {
+		case cfg := <-reloads:
+			c.configure(cfg)
+			c.logger.Printf("reloaded config file %s", configPath)
+		default:
+		}
+
+		if err := c.run(context.Background()); err != nil {
+			c.logger.Printf("running rollbackController: %v", err)
+		}
+
+		time.Sleep(jitter(interval, jitterFactor))
+	}
+}
+
+// cmdStatus lists failed deployments, using the same detectors as the
+// controller.
+func cmdStatus(args []string) {
+	fs, g := newFlagSet("status", "")
+	fs.Parse(args)
+
+	l := log.New(os.Stderr, "", 0)
+	c := g.newController(l)
+	ctx := context.Background()
+
+	deployments, err := c.api.listDeployments(ctx, c.namespace)
+	if err != nil {
+		l.Fatalf("list deployments: %v", err)
+	}
+	replicaSets, err := c.api.listReplicaSets(ctx, c.namespace)
+	if err != nil {
+		l.Fatalf("list replica sets: %v", err)
+	}
+
+	var failed []*deploymentStatus
+	for _, d := range deployments {
+		ok, reason, err := c.detect(ctx, d, replicaSets)
+		if err != nil {
+			l.Printf("detect failure: %s: %v", d.Metadata.GetName(), err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		state := handledState(d)
+		if state == "" {
+			state = stateFailed
+		}
+		failed = append(failed, c.newDeploymentStatus(d, reason, state))
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Name < failed[j].Name })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tREVISION\tSTATE\tSTRATEGY\tREASON")
+	for _, s := range failed {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", s.Namespace, s.Name, s.Revision, s.State, s.Strategy, s.Reason)
+	}
+	w.Flush()
+}
+
+// cmdRollback manually rolls back a deployment, choosing the target
+// revision the same way the controller does.
+func cmdRollback(args []string) {
+	fs, g := newFlagSet("rollback", "<deployment>")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	l := log.New(os.Stderr, "", 0)
+	c := g.newController(l)
+	ctx := context.Background()
+
+	d, err := c.api.getDeployment(ctx, c.namespace, fs.Arg(0))
+	if err != nil {
+		l.Fatalf("get deployment: %v", err)
+	}
+	replicaSets, err := c.api.listReplicaSets(ctx, d.Metadata.GetNamespace())
+	if err != nil {
+		l.Fatalf("list replica sets: %v", err)
+	}
+	target, skipped, why := rollbackTarget(d, replicaSets)
+	for _, rs := range skipped {
+		l.Printf("skipping revision %d, it has the same pod template as the failed revision", revision(rs.Metadata.GetAnnotations()))
+	}
+	if target == nil {
+		l.Fatalf("can't roll back deployment %s: %s", d.Metadata.GetName(), why)
+	}
+	diags := c.diagnose(ctx, d, replicaSets)
+	if err := c.rollbackTo(ctx, d, target, "rolled back manually", diags, nil); err != nil {
+		l.Fatalf("roll back deployment %s: %v", d.Metadata.GetName(), err)
+	}
+	fmt.Printf("deployment %s rolling back to revision %d\n", d.Metadata.GetName(), revision(target.Metadata.GetAnnotations()))
+}
+
+// cmdPause manually pauses a deployment.
+func cmdPause(args []string) {
+	fs, g := newFlagSet("pause", "<deployment>")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	l := log.New(os.Stderr, "", 0)
+	c := g.newController(l)
+	ctx := context.Background()
+
+	d, err := c.api.getDeployment(ctx, c.namespace, fs.Arg(0))
+	if err != nil {
+		l.Fatalf("get deployment: %v", err)
+	}
+	if err := c.setPaused(ctx, d, "paused manually", nil); err != nil {
+		l.Fatalf("pause deployment %s: %v", d.Metadata.GetName(), err)
+	}
+	fmt.Printf("deployment %s paused\n", d.Metadata.GetName())
+}
+
+// cmdSimulate evaluates the controller's decisions against a snapshot of a
+// cluster's manifests, without a live cluster.
+func cmdSimulate(args []string) {
+	var at string
+	fs, g := newFlagSet("simulate", "<snapshot directory>")
+	fs.StringVar(&at, "at", "", "Time to evaluate the snapshot at, in RFC 3339 format, such as 2017-06-01T10:00:00Z. Defaults to the latest timestamp in the snapshot, or the current time if it has none.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	l := log.New(os.Stderr, "", 0)
+	cfg, _, err := g.loadConfig()
+	if err != nil {
+		l.Fatal(err)
+	}
+	var now time.Time
+	if at != "" {
+		if now, err = time.Parse(time.RFC3339, at); err != nil {
+			l.Fatalf("invalid --at: %v", err)
+		}
+	}
+	f := newFakeAPI()
+	n, err := loadSnapshot(fs.Arg(0), f)
+	if err != nil {
+		l.Fatalf("load snapshot: %v", err)
+	}
+	if now.IsZero() {
+		if now = snapshotTime(f); now.IsZero() {
+			now = time.Now()
+		}
+	}
+	l.Printf("loaded %d objects from %s, evaluating at %s", n, fs.Arg(0), now.UTC().Format(time.RFC3339))
+
+	c := &rollbackController{api: f, logger: l, namespace: g.namespace}
+	c.configure(cfg)
+	failed, records, err := c.simulate(context.Background(), now)
+	if err != nil {
+		l.Printf("simulate: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tREVISION\tSTATE\tSTRATEGY\tREASON")
+	for _, s := range failed {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", s.Namespace, s.Name, s.Revision, s.State, s.Strategy, s.Reason)
+	}
+	w.Flush()
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tACTION\tFROM\tTO\tMESSAGE")
+	for _, r := range records {
+		to := "-"
+		if r.ToRevision != 0 {
+			to = strconv.FormatInt(r.ToRevision, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Namespace, r.Deployment, r.Action, r.FromRevision, to, r.Message)
+	}
+	w.Flush()
+}
+
+// cmdExport dumps an audit log written with run --audit-log.
+func cmdExport(args []string) {
+	var (
+		auditPath string
+		since     time.Duration
+		format    string
+	)
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: kube-rollback-controller export [flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&auditPath, "audit-log", "", "Path of the audit log to export. The file it was last rotated to is exported too.")
+	fs.DurationVar(&since, "since", 24*time.Hour, "Only export decisions made this recently. Zero exports the whole log.")
+	fs.StringVar(&format, "format", exportJSON, "Output format. Either 'json', one object per line, or 'csv'.")
+	fs.Parse(args)
+
+	l := log.New(os.Stderr, "", 0)
+	if auditPath == "" {
+		l.Fatal("--audit-log is required")
+	}
+	f, err := openAuditLogFiles(auditPath)
+	if err != nil {
+		l.Fatal(err)
+	}
+	defer f.Close()
+	var from time.Time
+	if since > 0 {
+		from = time.Now().Add(-since)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := exportAuditLog(w, f, from, format); err != nil {
+		l.Fatalf("export %s: %v", auditPath, err)
+	}
+	if err := w.Flush(); err != nil {
+		l.Fatal(err)
+	}
+}
+
+// cmdWebhook runs the mutating admission webhook.
+func cmdWebhook(args []string) {
+	var (
+		addr     string
+		certFile string
+		keyFile  string
+	)
+	fs, g := newFlagSet("webhook", "")
+	fs.StringVar(&addr, "webhook-addr", ":8443", "Address to serve the admission webhook on.")
+	fs.StringVar(&certFile, "tls-cert", "", "Path to the webhook's TLS certificate.")
+	fs.StringVar(&keyFile, "tls-key", "", "Path to the webhook's TLS private key.")
+	fs.Parse(args)
+
+	l := log.New(os.Stderr, "", log.LstdFlags)
+	if certFile == "" || keyFile == "" {
+		l.Fatal("--tls-cert and --tls-key are required")
+	}
+	client, err := g.newClient("")
+	if err != nil {
+		l.Fatal(err)
+	}
+	l.Fatalf("serve webhook: %v", serveWebhook(&clientAPI{client}, l, addr, certFile, keyFile))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// conditionType is the type of the condition the controller reports its view
+// of a deployment in, with the statusCondition setting, so it's shown by
+// kubectl describe. Its status is "True" while the deployment has failed.
+const conditionType = "RollbackController"
+
+// Reasons of the controller's condition.
+const (
+	conditionHealthy     = "Healthy"
+	conditionConfirming  = "Confirming"
+	conditionFailed      = "Failed"
+	conditionWaiting     = "Waiting"
+	conditionSkipped     = "Skipped"
+	conditionRollingBack = "RollingBack"
+	conditionPaused      = "Paused"
+	conditionScaledDown  = "ScaledDown"
+	conditionRolledBack  = "RolledBack"
+	conditionQuarantined = "Quarantined"
+)
+
+var stateConditions = map[string]string{
+	stateFailed:      conditionFailed,
+	stateConfirming:  conditionConfirming,
+	stateWaiting:     conditionWaiting,
+	stateRollingBack: conditionRollingBack,
+	statePaused:      conditionPaused,
+	stateScaledDown:  conditionScaledDown,
+}
+
+// deploymentCondition is a deployment condition in a status patch. The
+// reason and message are always included, so a previous message is cleared.
+type deploymentCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	LastUpdateTime     string `json:"lastUpdateTime,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+}
+
+// conditionPatch is a strategic merge patch of a deployment's status, which
+// merges conditions by their type, so the deployment controller's own
+// conditions are kept.
+type conditionPatch struct {
+	Status struct {
+		Conditions []deploymentCondition `json:"conditions"`
+	} `json:"status"`
+}
+
+// conditionFor returns the status, reason, and message of the controller's
+// condition for a deployment, given its status from reconcile. Healthy
+// deployments that were rolled back report the rollback, and whether new
+// rollouts are quarantined. It returns false for healthy deployments that
+// were never rolled back and don't report a condition yet, so most
+// deployments are never written to.
+func (c *rollbackController) conditionFor(d *v1beta1.Deployment, status *deploymentStatus, now time.Time) (string, string, string, bool) {
+	if status != nil {
+		reason := stateConditions[status.State]
+		if status.State == stateFailed && c.skippedOwner(d) != "" {
+			reason = conditionSkipped
+		}
+		if reason == "" {
+			reason = conditionFailed
+		}
+		return "True", reason, status.Reason, true
+	}
+
+	annotations := d.Metadata.GetAnnotations()
+	if last, err := time.Parse(time.RFC3339, annotations[annotationLastRollbackTime]); err == nil {
+		msg := fmt.Sprintf("rolled back from revision %s at %s", annotations[annotationFromRevision], last.UTC().Format(time.RFC3339))
+		if r := annotations[annotationRollbackReason]; r != "" {
+			msg += ": " + r
+		}
+		if until := last.Add(c.cfg.Quarantine.Duration); now.Before(until) {
+			return "False", conditionQuarantined, fmt.Sprintf("%s, new rollouts are quarantined until %s", msg, until.UTC().Format(time.RFC3339)), true
+		}
+		return "False", conditionRolledBack, msg, true
+	}
+	if findCondition(d, conditionType) == nil {
+		return "", "", "", false
+	}
+	return "False", conditionHealthy, "", true
+}
+
+// findCondition returns a deployment's condition of the given type, or nil.
+func findCondition(d *v1beta1.Deployment, typ string) *v1beta1.DeploymentCondition {
+	for _, cond := range d.Status.GetConditions() {
+		if cond.GetType() == typ {
+			return cond
+		}
+	}
+	return nil
+}
+
+// reportCondition writes the controller's condition to a deployment's
+// status, if the statusCondition setting is enabled and it changed.
+func (c *rollbackController) reportCondition(ctx context.Context, d *v1beta1.Deployment, status *deploymentStatus) error {
+	if !c.cfg.StatusCondition {
+		return nil
+	}
+	now := c.now()
+	condStatus, reason, msg, ok := c.conditionFor(d, status, now)
+	if !ok {
+		return nil
+	}
+	transition := now
+	if cur := findCondition(d, conditionType); cur != nil {
+		if cur.GetStatus() == condStatus && cur.GetReason() == reason && cur.GetMessage() == msg {
+			return nil
+		}
+		if cur.GetStatus() == condStatus && cur.LastTransitionTime != nil {
+			transition = time.Unix(cur.LastTransitionTime.GetSeconds(), 0)
+		}
+	}
+
+	var p conditionPatch
+	p.Status.Conditions = []deploymentCondition{{
+		Type:               conditionType,
+		Status:             condStatus,
+		LastUpdateTime:     now.UTC().Format(time.RFC3339),
+		LastTransitionTime: transition.UTC().Format(time.RFC3339),
+		Reason:             reason,
+		Message:            msg,
+	}}
+	patch, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if _, err := c.api.patchDeploymentStatus(ctx, d.Metadata.GetNamespace(), d.Metadata.GetName(), patch); err != nil {
+		return fmt.Errorf("patch deployment status: %v", err)
+	}
+	return nil
+}
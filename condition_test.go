@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// controllerCondition returns the controller's condition of a deployment in
+// the fake API.
+func controllerCondition(t *testing.T, f *fakeAPI, name string) *v1beta1.DeploymentCondition {
+	d, err := f.getDeployment(context.Background(), "default", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return findCondition(d, conditionType)
+}
+
+func TestReportCondition(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	rolledBack := func(at string) map[string]string {
+		return map[string]string{
+			annotationLastRollbackTime: at,
+			annotationFromRevision:     "2",
+			annotationRollbackReason:   "ProgressDeadlineExceeded",
+		}
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// The deployment's status from reconcile, and its current
+		// condition if any.
+		status  *deploymentStatus
+		current *v1beta1.DeploymentCondition
+
+		// The condition reported, or nil if it isn't written.
+		wantStatus, wantReason, wantMessage string
+		wantTransition                      string
+	}{
+		{
+			name: "never rolled back",
+		},
+		{
+			name:           "rolling back",
+			status:         &deploymentStatus{State: stateRollingBack, Reason: "ProgressDeadlineExceeded"},
+			wantStatus:     "True",
+			wantReason:     conditionRollingBack,
+			wantMessage:    "ProgressDeadlineExceeded",
+			wantTransition: "2017-06-01T12:00:00Z",
+		},
+		{
+			name:           "failed",
+			annotations:    map[string]string{},
+			status:         &deploymentStatus{State: stateFailed, Reason: "ProgressDeadlineExceeded"},
+			wantStatus:     "True",
+			wantReason:     conditionFailed,
+			wantMessage:    "ProgressDeadlineExceeded",
+			wantTransition: "2017-06-01T12:00:00Z",
+		},
+		{
+			name:           "quarantined",
+			annotations:    rolledBack("2017-06-01T11:30:00Z"),
+			wantStatus:     "False",
+			wantReason:     conditionQuarantined,
+			wantMessage:    "rolled back from revision 2 at 2017-06-01T11:30:00Z: ProgressDeadlineExceeded, new rollouts are quarantined until 2017-06-01T12:30:00Z",
+			wantTransition: "2017-06-01T12:00:00Z",
+		},
+		{
+			// The status didn't change, so neither does the transition
+			// time.
+			name:        "rolled back",
+			annotations: rolledBack("2017-06-01T10:30:00Z"),
+			current: &v1beta1.DeploymentCondition{
+				Type:               k8s.String(conditionType),
+				Status:             k8s.String("False"),
+				Reason:             k8s.String(conditionQuarantined),
+				LastTransitionTime: fakeTime("2017-06-01T10:30:00Z"),
+			},
+			wantStatus:     "False",
+			wantReason:     conditionRolledBack,
+			wantMessage:    "rolled back from revision 2 at 2017-06-01T10:30:00Z: ProgressDeadlineExceeded",
+			wantTransition: "2017-06-01T10:30:00Z",
+		},
+		{
+			name: "recovered",
+			current: &v1beta1.DeploymentCondition{
+				Type:               k8s.String(conditionType),
+				Status:             k8s.String("True"),
+				Reason:             k8s.String(conditionRollingBack),
+				LastTransitionTime: fakeTime("2017-06-01T10:30:00Z"),
+			},
+			wantStatus:     "False",
+			wantReason:     conditionHealthy,
+			wantTransition: "2017-06-01T12:00:00Z",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			d := testDeployment("hello", 3, test.status != nil)
+			for k, v := range test.annotations {
+				d.Metadata.Annotations[k] = v
+			}
+			if test.current != nil {
+				d.Status.Conditions = append(d.Status.Conditions, test.current)
+			}
+			f.addDeployment(d)
+			c := newTestController(t, f, "--status-condition", "--quarantine=1h")
+			c.clock = func() time.Time { return now }
+
+			if err := c.reportCondition(context.Background(), d, test.status); err != nil {
+				t.Fatal(err)
+			}
+			cond := controllerCondition(t, f, "hello")
+			if test.wantStatus == "" {
+				if cond != nil {
+					t.Fatalf("unexpected condition %+v", cond)
+				}
+				return
+			}
+			if cond == nil {
+				t.Fatal("no condition reported")
+			}
+			if cond.GetStatus() != test.wantStatus || cond.GetReason() != test.wantReason || cond.GetMessage() != test.wantMessage {
+				t.Errorf("got condition %s %s %q, want %s %s %q", cond.GetStatus(), cond.GetReason(), cond.GetMessage(), test.wantStatus, test.wantReason, test.wantMessage)
+			}
+			if got := time.Unix(cond.GetLastTransitionTime().GetSeconds(), 0).UTC().Format(time.RFC3339); got != test.wantTransition {
+				t.Errorf("got transition time %s, want %s", got, test.wantTransition)
+			}
+			if got := time.Unix(cond.GetLastUpdateTime().GetSeconds(), 0).UTC(); !got.Equal(now) {
+				t.Errorf("got update time %s, want %s", got, now)
+			}
+		})
+	}
+}
+
+func TestReportConditionUnchanged(t *testing.T) {
+	f := newFakeAPI()
+	d := testDeployment("hello", 3, true)
+	f.addDeployment(d)
+	f.addReplicaSet(testReplicaSet(d, 3))
+	f.addReplicaSet(testReplicaSet(d, 2))
+	c := newTestController(t, f, "--status-condition")
+
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cond := controllerCondition(t, f, "hello")
+	if cond == nil || cond.GetReason() != conditionRollingBack {
+		t.Fatalf("got condition %+v, want %s", cond, conditionRollingBack)
+	}
+
+	// Until the deployment controller acts on the rollback, the deployment
+	// is reported as rolled back.
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cond := controllerCondition(t, f, "hello"); cond.GetReason() != conditionRolledBack {
+		t.Fatalf("got condition %+v, want %s", cond, conditionRolledBack)
+	}
+	before, err := f.getDeployment(context.Background(), "default", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The condition is the same on the next pass, so it isn't written
+	// again.
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	after, err := f.getDeployment(context.Background(), "default", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Metadata.GetResourceVersion() != after.Metadata.GetResourceVersion() {
+		t.Errorf("unchanged condition was written again")
+	}
+}
+
+func TestReportConditionDisabled(t *testing.T) {
+	f := newFakeAPI()
+	d := testDeployment("hello", 3, true)
+	f.addDeployment(d)
+	c := newTestController(t, f)
+	if err := c.reportCondition(context.Background(), d, &deploymentStatus{State: stateFailed}); err != nil {
+		t.Fatal(err)
+	}
+	if cond := controllerCondition(t, f, "hello"); cond != nil {
+		t.Errorf("condition reported without --status-condition: %+v", cond)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// config holds the controller's settings. Defaults come from flags, which
+// are then overridden by any fields set in the -config file.
+type config struct {
+	// Number of deployments reconciled concurrently.
+	Workers int `json:"workers"`
+
+	// Kinds of resources to reconcile, see reconcilers.
+	Resources []string `json:"resources"`
+
+	// How failed deployments are handled, unless they set the strategy
+	// annotation.
+	DefaultStrategy string `json:"defaultStrategy"`
+
+	// How long a deployment must keep failing before it's handled.
+	ConfirmationDelay duration `json:"confirmationDelay"`
+
+	// Number of ready pods the previous ReplicaSet must have before a
+	// deployment is rolled back. Zero disables the check.
+	MinAvailable int32 `json:"minAvailable"`
+
+	// Resume deployments the controller paused when they're rolled back.
+	UnpauseAfterRollback bool `json:"unpauseAfterRollback"`
+
+	// Scale the ReplicaSet of a failed revision down to zero before rolling
+	// back, if its rollout is only partially complete.
+	ScaleDownFailedReplicaSet bool `json:"scaleDownFailedReplicaSet"`
+
+	// Only handle deployments that opt in with the enabled annotation, on
+	// the deployment or its namespace.
+	OptIn bool `json:"optIn"`
+
+	// How long after a rollback a deployment must wait before it's rolled
+	// back again. Zero disables the cooldown.
+	Cooldown duration `json:"cooldown"`
+
+	// How long after a rollback new rollouts of a deployment are
+	// quarantined, and how long a quarantined rollout has to complete. Zero
+	// disables quarantine. See quarantineDetector.
+	Quarantine         duration `json:"quarantine"`
+	QuarantineDeadline duration `json:"quarantineDeadline"`
+
+	// How long a rollout can run before it's considered stuck, for
+	// deployments the API server won't report as failed first. Zero
+	// disables the check. See stuckRolloutDetector.
+	RolloutTimeout duration `json:"rolloutTimeout"`
+
+	// Kinds of owners whose deployments aren't handled, and whether
+	// deployments with any controlling owner, such as an operator, aren't
+	// handled either. See skippedOwner.
+	SkipOwnerKinds    []string `json:"skipOwnerKinds"`
+	SkipOperatorOwned bool     `json:"skipOperatorOwned"`
+
+	// Namespaces whose deployments are only handled when explicitly
+	// enabled. See systemNamespace.
+	SystemNamespaces []string `json:"systemNamespaces"`
+
+	// Job used as a template to verify deployments after they're rolled
+	// back, unless they set the verify-job annotation, and how long a
+	// rollback's rollout and the Job have to complete.
+	VerifyJob     string   `json:"verifyJob"`
+	VerifyTimeout duration `json:"verifyTimeout"`
+
+	// Report the controller's view of each deployment it handles in a
+	// condition of the deployment's status. See reportCondition.
+	StatusCondition bool `json:"statusCondition"`
+
+	// Snapshot the ConfigMaps and Secrets used by each revision once its
+	// rollout completes, and restore them when rolling back to it. See
+	// snapshotConfig.
+	SnapshotConfig bool `json:"snapshotConfig"`
+
+	// Identities to impersonate when reconciling deployments, keyed by
+	// namespace, or "*" for namespaces without their own. See impersonation.
+	Impersonate map[string]*impersonation `json:"impersonate"`
+
+	// Handle the controller's own deployment like any other, rather than
+	// only notifying about it when it fails.
+	AllowSelfRollback bool `json:"allowSelfRollback"`
+
+	// Maximum number of times a deployment is rolled back within the window
+	// before it's scaled to zero instead. Zero disables the limit.
+	MaxRollbacks       int      `json:"maxRollbacks"`
+	MaxRollbacksWindow duration `json:"maxRollbacksWindow"`
+
+	// Maximum number of automatic rollbacks in a namespace within the
+	// window before failed deployments in it are only notified about. Zero
+	// disables the limit.
+	NamespaceBudget       int      `json:"namespaceBudget"`
+	NamespaceBudgetWindow duration `json:"namespaceBudgetWindow"`
+
+	// Where to send notifications. If none are set, notifications are
+	// logged.
+	NotifyWebhook string           `json:"notifyWebhook"`
+	PagerDuty     *pagerDutyConfig `json:"pagerDuty"`
+	Opsgenie      *opsgenieConfig  `json:"opsgenie"`
+
+	// Go templates of notification messages, keyed by notifier: "log",
+	// "webhook", "pagerDuty", "opsgenie", or "default" for notifiers without
+	// their own, and a ConfigMap, as "namespace/name", holding more
+	// templates keyed the same way, which take precedence. See
+	// templatedNotifier.
+	NotifyTemplates          map[string]string `json:"notifyTemplates"`
+	NotifyTemplatesConfigMap string            `json:"notifyTemplatesConfigMap"`
+
+	// Prometheus server used to evaluate per-deployment queries, and how
+	// long after a rollout starts to evaluate them.
+	PrometheusURL    string   `json:"prometheusURL"`
+	PrometheusWindow duration `json:"prometheusWindow"`
+
+	// Label holding a deployment's region, and policies for how failed
+	// deployments in each region are handled. Regions without a policy are
+	// rolled back automatically.
+	RegionLabel string                  `json:"regionLabel"`
+	Regions     map[string]regionPolicy `json:"regions"`
+
+	// How each class of failure is handled, by strategy or "wait". Classes
+	// that aren't listed use the default strategy.
+	FailureClasses map[string]string `json:"failureClasses"`
+
+	// Windows during which automatic rollbacks are allowed or forbidden.
+	Windows []*timeWindow `json:"windows"`
+
+	// Repo to propose reverts to, for the git strategy.
+	Git *gitConfig `json:"git"`
+
+	// External detectors and strategies. Every plugin is asked if each
+	// deployment has failed, in order, after the built in detectors.
+	Plugins []*pluginConfig `json:"plugins"`
+}
+
+func (c *config) validate() error {
+	if err := validateResources(c.Resources); err != nil {
+		return fmt.Errorf("resources: %v", err)
+	}
+	if err := validateStrategy(c.DefaultStrategy); err != nil {
+		return fmt.Errorf("defaultStrategy: %v", err)
+	}
+	if c.NamespaceBudget > 0 && c.NamespaceBudgetWindow.Duration <= 0 {
+		return fmt.Errorf("namespaceBudgetWindow must be positive")
+	}
+	if c.VerifyTimeout.Duration <= 0 {
+		return fmt.Errorf("verifyTimeout must be positive")
+	}
+	if c.Cooldown.Duration < 0 {
+		return fmt.Errorf("cooldown must not be negative")
+	}
+	if c.RolloutTimeout.Duration < 0 {
+		return fmt.Errorf("rolloutTimeout must not be negative")
+	}
+	if c.Quarantine.Duration > 0 && c.QuarantineDeadline.Duration <= 0 {
+		return fmt.Errorf("quarantineDeadline must be positive")
+	}
+	if _, err := parseTemplates(c.NotifyTemplates); err != nil {
+		return fmt.Errorf("notifyTemplates: %v", err)
+	}
+	if cm := c.NotifyTemplatesConfigMap; cm != "" {
+		if parts := strings.SplitN(cm, "/", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("notifyTemplatesConfigMap must be namespace/name, got %q", cm)
+		}
+	}
+	for ns, i := range c.Impersonate {
+		if i == nil {
+			return fmt.Errorf("impersonate: %s: user or serviceAccount is required", ns)
+		}
+		if err := i.validate(); err != nil {
+			return fmt.Errorf("impersonate: %s: %v", ns, err)
+		}
+	}
+	if c.PagerDuty != nil {
+		if err := c.PagerDuty.validate(); err != nil {
+			return fmt.Errorf("pagerDuty: %v", err)
+		}
+	}
+	if c.Opsgenie != nil {
+		if err := c.Opsgenie.validate(); err != nil {
+			return fmt.Errorf("opsgenie: %v", err)
+		}
+	}
+	if c.Git != nil {
+		if err := c.Git.validate(); err != nil {
+			return fmt.Errorf("git: %v", err)
+		}
+	} else if c.DefaultStrategy == strategyGit {
+		return fmt.Errorf("defaultStrategy: the git strategy requires git to be configured")
+	}
+	if err := validateFailureClasses(c.FailureClasses); err != nil {
+		return fmt.Errorf("failureClasses: %v", err)
+	}
+	for class, action := range c.FailureClasses {
+		if action == strategyGit && c.Git == nil {
+			return fmt.Errorf("failureClasses: %s: the git strategy requires git to be configured", class)
+		}
+		if action == strategyPlugin && len(c.Plugins) == 0 {
+			return fmt.Errorf("failureClasses: %s: the plugin strategy requires a plugin to be configured", class)
+		}
+	}
+	for region, p := range c.Regions {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("region %q: %v", region, err)
+		}
+	}
+	for i, w := range c.Windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("window %d (%s): %v", i, w.Name, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, p := range c.Plugins {
+		if p == nil {
+			return fmt.Errorf("plugin %d: name is required", i)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("plugin %d (%s): %v", i, p.Name, err)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("plugin %d: duplicate name %q", i, p.Name)
+		}
+		names[p.Name] = true
+	}
+	if c.DefaultStrategy == strategyPlugin && len(c.Plugins) == 0 {
+		return fmt.Errorf("defaultStrategy: the plugin strategy requires a plugin to be configured")
+	}
+	return nil
+}
+
+// duration is a time.Duration encoded as a string, such as "10m".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10m\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// parseConfig parses a YAML config file, using base for any fields that the
+// file doesn't set.
+func parseConfig(data []byte, base *config) (*config, error) {
+	j, err := yamlToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	// Decoding reuses the slices, maps and pointers of the struct it
+	// decodes into, so decode into a copy that shares none with base, which
+	// is reused for every reload.
+	cfg := base.clone()
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// clone returns a deep copy of a config.
+func (c *config) clone() *config {
+	return deepCopy(reflect.ValueOf(c)).Interface().(*config)
+}
+
+// deepCopy copies a value, and everything it points to. Unexported fields of
+// structs are copied shallowly.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(deepCopy(v.Elem()))
+		return p
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return s
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		m := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			m.SetMapIndex(k, deepCopy(v.MapIndex(k)))
+		}
+		return m
+	case reflect.Struct:
+		s := reflect.New(v.Type()).Elem()
+		s.Set(v)
+		for i := 0; i < s.NumField(); i++ {
+			if f := s.Field(i); f.CanSet() {
+				f.Set(deepCopy(v.Field(i)))
+			}
+		}
+		return s
+	}
+	return v
+}
+
+// watchConfig polls a config file and sends the parsed config whenever its
+// contents change. Kubernetes updates ConfigMap volumes by atomically
+// swapping a symlink, so comparing contents is more reliable than file
+// modification times. Invalid files are logged and ignored, leaving the last
+// good config in place.
+func watchConfig(ctx context.Context, path string, data []byte, base *config, interval time.Duration, logger *log.Logger) <-chan *config {
+	ch := make(chan *config)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				logger.Printf("read config: %v", err)
+				continue
+			}
+			if bytes.Equal(b, data) {
+				continue
+			}
+			data = b
+
+			cfg, err := parseConfig(b, base)
+			if err != nil {
+				logger.Printf("invalid config file %s, keeping previous config: %v", path, err)
+				continue
+			}
+			select {
+			case ch <- cfg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// configure applies a config to the controller. It must not be called
+// concurrently with run.
+func (c *rollbackController) configure(cfg *config) {
+	c.cfg = cfg
+
+	// Templates were checked by validate.
+	templates, _ := parseTemplates(cfg.NotifyTemplates)
+	c.mu.Lock()
+	c.fileTemplates = templates
+	if cfg.NotifyTemplatesConfigMap == "" {
+		c.configMapTemplates = nil
+	}
+	c.mu.Unlock()
+
+	var notifiers multiNotifier
+	if cfg.NotifyWebhook != "" {
+		notifiers = append(notifiers, &templatedNotifier{notifierWebhook, &webhookNotifier{url: cfg.NotifyWebhook, client: http.DefaultClient}, c})
+	}
+	if cfg.PagerDuty != nil {
+		notifiers = append(notifiers, &templatedNotifier{notifierPagerDuty, &pagerDutyNotifier{cfg: cfg.PagerDuty, client: http.DefaultClient}, c})
+	}
+	if cfg.Opsgenie != nil {
+		notifiers = append(notifiers, &templatedNotifier{notifierOpsgenie, &opsgenieNotifier{cfg: cfg.Opsgenie, client: http.DefaultClient}, c})
+	}
+	switch len(notifiers) {
+	case 0:
+		c.notifier = &templatedNotifier{notifierLog, &logNotifier{logger: c.logger}, c}
+	case 1:
+		c.notifier = notifiers[0]
+	default:
+		c.notifier = notifiers
+	}
+
+	c.git = nil
+	if cfg.Git != nil {
+		c.git = newGitHost(cfg.Git, http.DefaultClient)
+	}
+
+	c.detectors = []detector{progressDeadlineDetector{}}
+	if cfg.RolloutTimeout.Duration > 0 {
+		c.detectors = append(c.detectors, &stuckRolloutDetector{timeout: cfg.RolloutTimeout.Duration, now: c.now})
+	}
+	if cfg.Quarantine.Duration > 0 {
+		c.detectors = append(c.detectors, &quarantineDetector{
+			api:      c.api,
+			period:   cfg.Quarantine.Duration,
+			deadline: cfg.QuarantineDeadline.Duration,
+			now:      c.now,
+		})
+	}
+	if cfg.PrometheusURL != "" {
+		c.detectors = append(c.detectors, &prometheusDetector{
+			url:    cfg.PrometheusURL,
+			client: http.DefaultClient,
+			window: cfg.PrometheusWindow.Duration,
+			now:    c.now,
+		})
+	}
+
+	for _, p := range c.plugins {
+		if p, ok := p.(*grpcPlugin); ok {
+			p.closeIdle()
+		}
+	}
+	c.plugins = make(map[string]pluginCaller)
+	for _, pc := range cfg.Plugins {
+		// CAs were checked by validate.
+		p, err := newGRPCPlugin(pc)
+		if err != nil {
+			c.logger.Printf("plugin %s: %v", pc.Name, err)
+			continue
+		}
+		c.plugins[pc.Name] = p
+		c.detectors = append(c.detectors, &pluginDetector{name: pc.Name, plugin: p, cluster: c.cluster})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testBaseConfig(t *testing.T) *config {
+	_, g := newFlagSet("test", "")
+	base, err := g.baseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func TestParseConfigKeepsBase(t *testing.T) {
+	base := testBaseConfig(t)
+	base.Regions = map[string]regionPolicy{"us-east": {Mode: regionModeApprove}}
+	want := base.clone()
+
+	files := []string{
+		"systemNamespaces: [istio-system]\nskipOwnerKinds: [Foo]\nresources: [deployments]\n",
+		"regions:\n  eu-west:\n    mode: notify\n  us-east:\n    mode: auto\n",
+		"workers: 3\n",
+	}
+	for _, file := range files {
+		if _, err := parseConfig([]byte(file), base); err != nil {
+			t.Fatalf("parse %q: %v", file, err)
+		}
+		if !reflect.DeepEqual(base, want) {
+			t.Fatalf("parsing %q modified base config:\ngot  %+v\nwant %+v", file, base, want)
+		}
+	}
+
+	cfg, err := parseConfig([]byte("workers: 3\n"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.SystemNamespaces, want.SystemNamespaces) {
+		t.Errorf("system namespaces after reload: got %q, want %q", cfg.SystemNamespaces, want.SystemNamespaces)
+	}
+}
+
+func TestCloneConfig(t *testing.T) {
+	base := testBaseConfig(t)
+	base.PagerDuty = &pagerDutyConfig{}
+	c := base.clone()
+	if !reflect.DeepEqual(c, base) {
+		t.Fatalf("clone differs:\ngot  %+v\nwant %+v", c, base)
+	}
+	if c.PagerDuty == base.PagerDuty {
+		t.Errorf("clone shares PagerDuty config")
+	}
+	if len(base.SystemNamespaces) == 0 {
+		t.Fatal("no default system namespaces")
+	}
+	c.SystemNamespaces[0] = "changed"
+	if base.SystemNamespaces[0] == "changed" {
+		t.Errorf("clone shares system namespaces")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	base := testBaseConfig(t)
+	want := base.clone()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := watchConfig(ctx, path, nil, base, 10*time.Millisecond, log.New(ioutil.Discard, "", 0))
+
+	reload := func(data string) *config {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case cfg := <-ch:
+			return cfg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("config %q wasn't reloaded", data)
+		}
+		return nil
+	}
+
+	cfg := reload("systemNamespaces: [istio-system]\n")
+	if got := cfg.SystemNamespaces; !reflect.DeepEqual(got, []string{"istio-system"}) {
+		t.Errorf("system namespaces: got %q, want [istio-system]", got)
+	}
+
+	// An invalid config is skipped, and the next valid one reloaded.
+	if err := ioutil.WriteFile(path, []byte("workers: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg = reload("workers: 2\n")
+	if cfg.Workers != 2 {
+		t.Errorf("workers: got %d, want 2", cfg.Workers)
+	}
+	if !reflect.DeepEqual(cfg.SystemNamespaces, want.SystemNamespaces) {
+		t.Errorf("system namespaces after reload: got %q, want defaults %q", cfg.SystemNamespaces, want.SystemNamespaces)
+	}
+	if !reflect.DeepEqual(base, want) {
+		t.Errorf("reloading modified base config")
+	}
+}
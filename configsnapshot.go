@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Annotations of the copies of ConfigMaps and Secrets snapshotted for a
+// ReplicaSet, naming the object copied and the ReplicaSet.
+const (
+	annotationSnapshotOf         = "rollback-controller/snapshot-of"
+	annotationSnapshotReplicaSet = "rollback-controller/snapshot-replicaset"
+)
+
+// Kinds of objects that are snapshotted.
+const (
+	kindConfigMap = "ConfigMap"
+	kindSecret    = "Secret"
+)
+
+// configRef is a ConfigMap or Secret used by a pod template.
+type configRef struct {
+	kind string
+	name string
+}
+
+func (r configRef) String() string {
+	return r.kind + " " + r.name
+}
+
+// configRefs returns the ConfigMaps and Secrets a pod template mounts as
+// volumes or reads environment variables from, sorted by kind and name.
+func configRefs(t *v1.PodTemplateSpec) []configRef {
+	seen := make(map[configRef]bool)
+	add := func(kind, name string) {
+		if name != "" {
+			seen[configRef{kind, name}] = true
+		}
+	}
+	spec := t.GetSpec()
+	for _, vol := range spec.GetVolumes() {
+		src := vol.GetVolumeSource()
+		add(kindConfigMap, src.GetConfigMap().GetLocalObjectReference().GetName())
+		add(kindSecret, src.GetSecret().GetSecretName())
+	}
+	for _, c := range spec.GetContainers() {
+		for _, env := range c.GetEnv() {
+			from := env.GetValueFrom()
+			add(kindConfigMap, from.GetConfigMapKeyRef().GetLocalObjectReference().GetName())
+			add(kindSecret, from.GetSecretKeyRef().GetLocalObjectReference().GetName())
+		}
+	}
+
+	refs := make([]configRef, 0, len(seen))
+	for ref := range seen {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].kind != refs[j].kind {
+			return refs[i].kind < refs[j].kind
+		}
+		return refs[i].name < refs[j].name
+	})
+	return refs
+}
+
+// snapshotName returns the name of the copy of an object snapshotted for a
+// ReplicaSet. Snapshots are keyed by ReplicaSet rather than revision, since
+// a ReplicaSet's revision changes when it's rolled back to.
+func snapshotName(name string, rs *v1beta1.ReplicaSet) string {
+	return name + "." + rs.Metadata.GetName()
+}
+
+// snapshotMetadata returns the metadata of the copy of an object
+// snapshotted for a ReplicaSet. Copies are owned by the ReplicaSet, so
+// they're garbage collected along with it once it falls out of the
+// deployment's revision history.
+func snapshotMetadata(name string, rs *v1beta1.ReplicaSet) *v1.ObjectMeta {
+	return &v1.ObjectMeta{
+		Name:      k8s.String(snapshotName(name, rs)),
+		Namespace: k8s.String(rs.Metadata.GetNamespace()),
+		Annotations: map[string]string{
+			annotationSnapshotOf:         name,
+			annotationSnapshotReplicaSet: rs.Metadata.GetName(),
+		},
+		OwnerReferences: []*v1.OwnerReference{{
+			ApiVersion: k8s.String("extensions/v1beta1"),
+			Kind:       k8s.String("ReplicaSet"),
+			Name:       k8s.String(rs.Metadata.GetName()),
+			Uid:        k8s.String(rs.Metadata.GetUid()),
+		}},
+	}
+}
+
+// snapshotConfig copies the ConfigMaps and Secrets used by a healthy
+// deployment's current ReplicaSet once its rollout completes, so they can be
+// restored if the deployment is later rolled back to it. Only the first
+// snapshot of each ReplicaSet is kept, since that's the config its rollout
+// completed with.
+func (c *rollbackController) snapshotConfig(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (err error) {
+	if !c.cfg.SnapshotConfig || !rolloutComplete(d) {
+		return nil
+	}
+	rs := newReplicaSet(d, replicaSets)
+	if rs == nil || !c.once("config-snapshot", d) {
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			c.forget("config-snapshot", d)
+		}
+	}()
+
+	var taken []string
+	for _, ref := range configRefs(rs.Spec.GetTemplate()) {
+		ok, err := c.snapshot(ctx, ref, rs)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %v", ref, err)
+		}
+		if ok {
+			taken = append(taken, ref.String())
+		}
+	}
+	if len(taken) > 0 {
+		c.logger.Printf("snapshotted config of deployment: %s replicaset=%s: %s", *d.Metadata.Name, rs.Metadata.GetName(), strings.Join(taken, ", "))
+	}
+	return nil
+}
+
+// snapshot copies an object for a ReplicaSet, unless it's already been
+// copied. It reports if a copy was made. Objects that don't exist, such as
+// optional ones, aren't copied.
+func (c *rollbackController) snapshot(ctx context.Context, ref configRef, rs *v1beta1.ReplicaSet) (bool, error) {
+	namespace := rs.Metadata.GetNamespace()
+	copyName := snapshotName(ref.name, rs)
+	switch ref.kind {
+	case kindConfigMap:
+		if _, err := c.api.getConfigMap(ctx, namespace, copyName); !isNotFound(err) {
+			return false, err
+		}
+		cm, err := c.api.getConfigMap(ctx, namespace, ref.name)
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		_, err = c.api.createConfigMap(ctx, &v1.ConfigMap{
+			Metadata: snapshotMetadata(ref.name, rs),
+			Data:     cm.Data,
+		})
+		return err == nil, err
+	case kindSecret:
+		if _, err := c.api.getSecret(ctx, namespace, copyName); !isNotFound(err) {
+			return false, err
+		}
+		secret, err := c.api.getSecret(ctx, namespace, ref.name)
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		_, err = c.api.createSecret(ctx, &v1.Secret{
+			Metadata: snapshotMetadata(ref.name, rs),
+			Data:     secret.Data,
+			Type:     secret.Type,
+		})
+		return err == nil, err
+	}
+	return false, fmt.Errorf("unknown kind %s", ref.kind)
+}
+
+// restoreConfig sets the ConfigMaps and Secrets used by the ReplicaSet a
+// deployment is being rolled back to back to their snapshots, so the
+// reverted pods get the config they originally ran with. It returns a note
+// for the rollback's message of what was restored, and of what couldn't be.
+// Failing to restore config doesn't stop the rollback.
+func (c *rollbackController) restoreConfig(ctx context.Context, d *v1beta1.Deployment, target *v1beta1.ReplicaSet) string {
+	if !c.cfg.SnapshotConfig {
+		return ""
+	}
+	var restored, failed []string
+	for _, ref := range configRefs(target.Spec.GetTemplate()) {
+		ok, err := c.restore(ctx, ref, target)
+		if err != nil {
+			c.logger.Printf("restore config of deployment: %s: %s: %v", *d.Metadata.Name, ref, err)
+			failed = append(failed, ref.String())
+			continue
+		}
+		if ok {
+			restored = append(restored, ref.String())
+		}
+	}
+	var note string
+	if len(restored) > 0 {
+		note += ", restored " + strings.Join(restored, ", ")
+	}
+	if len(failed) > 0 {
+		note += ", couldn't restore " + strings.Join(failed, ", ")
+	}
+	return note
+}
+
+// restore sets an object back to its snapshot for a ReplicaSet, recreating
+// it if it's been deleted. It reports if the object was changed. Objects
+// without a snapshot are left alone.
+func (c *rollbackController) restore(ctx context.Context, ref configRef, rs *v1beta1.ReplicaSet) (bool, error) {
+	namespace := rs.Metadata.GetNamespace()
+	copyName := snapshotName(ref.name, rs)
+	switch ref.kind {
+	case kindConfigMap:
+		snap, err := c.api.getConfigMap(ctx, namespace, copyName)
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		cm, err := c.api.getConfigMap(ctx, namespace, ref.name)
+		if isNotFound(err) {
+			_, err = c.api.createConfigMap(ctx, &v1.ConfigMap{
+				Metadata: &v1.ObjectMeta{Name: k8s.String(ref.name), Namespace: k8s.String(namespace)},
+				Data:     snap.Data,
+			})
+			return err == nil, err
+		}
+		if err != nil {
+			return false, err
+		}
+		if reflect.DeepEqual(cm.Data, snap.Data) {
+			return false, nil
+		}
+		cm.Data = snap.Data
+		_, err = c.api.updateConfigMap(ctx, cm)
+		return err == nil, err
+	case kindSecret:
+		snap, err := c.api.getSecret(ctx, namespace, copyName)
+		if err != nil {
+			if isNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		secret, err := c.api.getSecret(ctx, namespace, ref.name)
+		if isNotFound(err) {
+			_, err = c.api.createSecret(ctx, &v1.Secret{
+				Metadata: &v1.ObjectMeta{Name: k8s.String(ref.name), Namespace: k8s.String(namespace)},
+				Data:     snap.Data,
+				Type:     snap.Type,
+			})
+			return err == nil, err
+		}
+		if err != nil {
+			return false, err
+		}
+		if reflect.DeepEqual(secret.Data, snap.Data) {
+			return false, nil
+		}
+		secret.Data = snap.Data
+		_, err = c.api.updateSecret(ctx, secret)
+		return err == nil, err
+	}
+	return false, fmt.Errorf("unknown kind %s", ref.kind)
+}
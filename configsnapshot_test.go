@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// configTestDeployment returns a deployment whose pods mount the ConfigMap
+// "hello-config" and read an environment variable from the Secret
+// "hello-secret", along with the ReplicaSet of its revision, with its rollout
+// complete.
+func configTestDeployment(rev int64) (*v1beta1.Deployment, *v1beta1.ReplicaSet) {
+	d := testDeployment("hello", rev, false)
+	spec := d.Spec.Template.Spec
+	spec.Volumes = []*v1.Volume{{
+		Name: k8s.String("config"),
+		VolumeSource: &v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{
+			LocalObjectReference: &v1.LocalObjectReference{Name: k8s.String("hello-config")},
+		}},
+	}}
+	spec.Containers[0].Env = []*v1.EnvVar{{
+		Name: k8s.String("TOKEN"),
+		ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: &v1.LocalObjectReference{Name: k8s.String("hello-secret")},
+			Key:                  k8s.String("token"),
+		}},
+	}}
+	d.Status.Replicas = int32Ptr(2)
+	d.Status.UpdatedReplicas = int32Ptr(2)
+	d.Status.AvailableReplicas = int32Ptr(2)
+
+	rs := testReplicaSet(d, rev)
+	rs.Metadata.Uid = k8s.String("uid-" + rs.Metadata.GetName())
+	rs.Spec.Template = d.Spec.Template
+	return d, rs
+}
+
+// setConfig creates, or updates, the ConfigMap and Secret used by
+// configTestDeployment.
+func setConfig(t *testing.T, f *fakeAPI, value string) {
+	ctx := context.Background()
+	cm := &v1.ConfigMap{
+		Metadata: &v1.ObjectMeta{Name: k8s.String("hello-config"), Namespace: k8s.String("default")},
+		Data:     map[string]string{"config.yaml": value},
+	}
+	secret := &v1.Secret{
+		Metadata: &v1.ObjectMeta{Name: k8s.String("hello-secret"), Namespace: k8s.String("default")},
+		Data:     map[string][]byte{"token": []byte(value)},
+		Type:     k8s.String("Opaque"),
+	}
+	if cur, err := f.getConfigMap(ctx, "default", "hello-config"); err == nil {
+		cm.Metadata.ResourceVersion = cur.Metadata.ResourceVersion
+		if _, err := f.updateConfigMap(ctx, cm); err != nil {
+			t.Fatal(err)
+		}
+	} else if _, err := f.createConfigMap(ctx, cm); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := f.getSecret(ctx, "default", "hello-secret"); err == nil {
+		secret.Metadata.ResourceVersion = cur.Metadata.ResourceVersion
+		if _, err := f.updateSecret(ctx, secret); err != nil {
+			t.Fatal(err)
+		}
+	} else if _, err := f.createSecret(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkConfig checks the data of a ConfigMap and Secret used by
+// configTestDeployment, or their snapshots for a ReplicaSet.
+func checkConfig(t *testing.T, f *fakeAPI, rs *v1beta1.ReplicaSet, want string) {
+	ctx := context.Background()
+	cmName, secretName := "hello-config", "hello-secret"
+	if rs != nil {
+		cmName, secretName = snapshotName(cmName, rs), snapshotName(secretName, rs)
+	}
+	cm, err := f.getConfigMap(ctx, "default", cmName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cm.Data["config.yaml"]; got != want {
+		t.Errorf("ConfigMap %s: got %q, want %q", cmName, got, want)
+	}
+	secret, err := f.getSecret(ctx, "default", secretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secret.Data["token"]); got != want {
+		t.Errorf("Secret %s: got %q, want %q", secretName, got, want)
+	}
+	if secret.GetType() != "Opaque" {
+		t.Errorf("Secret %s: got type %q, want Opaque", secretName, secret.GetType())
+	}
+}
+
+func TestConfigRefs(t *testing.T) {
+	d, _ := configTestDeployment(1)
+	got := configRefs(d.Spec.Template)
+	want := []configRef{{kindConfigMap, "hello-config"}, {kindSecret, "hello-secret"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got refs %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotConfig(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	setConfig(t, f, "v1")
+	d, rs := configTestDeployment(1)
+	c := newTestController(t, f, "--snapshot-config")
+
+	if err := c.snapshotConfig(ctx, d, []*v1beta1.ReplicaSet{rs}); err != nil {
+		t.Fatal(err)
+	}
+	checkConfig(t, f, rs, "v1")
+	snap, err := f.getConfigMap(ctx, "default", snapshotName("hello-config", rs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owners := snap.Metadata.OwnerReferences; len(owners) != 1 || owners[0].GetUid() != rs.Metadata.GetUid() {
+		t.Errorf("snapshot isn't owned by its ReplicaSet: %v", owners)
+	}
+
+	// The first snapshot of a ReplicaSet is kept, even by a controller
+	// that hasn't seen it before, such as after a restart.
+	setConfig(t, f, "changed")
+	for _, c := range []*rollbackController{c, newTestController(t, f, "--snapshot-config")} {
+		if err := c.snapshotConfig(ctx, d, []*v1beta1.ReplicaSet{rs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkConfig(t, f, rs, "v1")
+
+	// Rollouts that haven't completed aren't snapshotted.
+	next, nextRS := configTestDeployment(2)
+	next.Status.UpdatedReplicas = int32Ptr(1)
+	if err := c.snapshotConfig(ctx, next, []*v1beta1.ReplicaSet{rs, nextRS}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.getConfigMap(ctx, "default", snapshotName("hello-config", nextRS)); !isNotFound(err) {
+		t.Errorf("incomplete rollout was snapshotted: %v", err)
+	}
+}
+
+func TestRestoreConfig(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	setConfig(t, f, "v1")
+	d, rs := configTestDeployment(1)
+	c := newTestController(t, f, "--snapshot-config")
+	if err := c.snapshotConfig(ctx, d, []*v1beta1.ReplicaSet{rs}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ConfigMap is changed, and the Secret deleted, by the failed
+	// revision.
+	setConfig(t, f, "v2")
+	f.mu.Lock()
+	delete(f.secrets, "default/hello-secret")
+	f.mu.Unlock()
+
+	current, _ := configTestDeployment(2)
+	note := c.restoreConfig(ctx, current, rs)
+	if want := ", restored ConfigMap hello-config, Secret hello-secret"; note != want {
+		t.Errorf("got note %q, want %q", note, want)
+	}
+	checkConfig(t, f, nil, "v1")
+
+	// Restoring again changes nothing.
+	if note := c.restoreConfig(ctx, current, rs); note != "" {
+		t.Errorf("restoring unchanged config: got note %q", note)
+	}
+}
+
+func TestRestoreConfigWithoutSnapshot(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	setConfig(t, f, "v2")
+	_, rs := configTestDeployment(1)
+	current, _ := configTestDeployment(2)
+	c := newTestController(t, f, "--snapshot-config")
+
+	// The target's rollout never completed, or completed before config
+	// was snapshotted.
+	if note := c.restoreConfig(ctx, current, rs); note != "" {
+		t.Errorf("got note %q, want none", note)
+	}
+	checkConfig(t, f, nil, "v2")
+}
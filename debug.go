@@ -0,0 +1,65 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+)
+
+// registerDebug serves the runtime's profiles at /debug/pprof/, and its
+// memory stats and the sizes of each controller's in-memory state at
+// /debug/vars, for profiling controllers managing many deployments. They're
+// registered on the given mux, rather than the default one, so they're only
+// served with run --debug.
+func registerDebug(mux *http.ServeMux, controllers ...*rollbackController) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	publishDebugVars.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+		expvar.Publish("controllers", expvar.Func(func() interface{} {
+			vars := make([]*controllerVars, len(controllers))
+			for i, c := range controllers {
+				vars[i] = c.debugVars()
+			}
+			return vars
+		}))
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+}
+
+// Vars can only be published once per process.
+var publishDebugVars sync.Once
+
+// controllerVars are the sizes of a controller's in-memory state, which
+// grows with the number of deployments it manages.
+type controllerVars struct {
+	Cluster       string `json:"cluster,omitempty"`
+	Failed        int    `json:"failed"`
+	Records       int    `json:"records"`
+	Handled       int    `json:"handled"`
+	FailingSince  int    `json:"failingSince"`
+	Budgets       int    `json:"budgets"`
+	Verifications int    `json:"verifications"`
+}
+
+func (c *rollbackController) debugVars() *controllerVars {
+	v := &controllerVars{Cluster: c.cluster}
+	c.status.mu.Lock()
+	v.Failed = len(c.status.failed)
+	v.Records = len(c.status.records)
+	c.status.mu.Unlock()
+
+	c.mu.Lock()
+	v.Handled = len(c.handled)
+	v.FailingSince = len(c.failingSince)
+	v.Budgets = len(c.budgets)
+	v.Verifications = len(c.verifications)
+	c.mu.Unlock()
+	return v
+}
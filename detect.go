@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// detector decides if a deployment has failed. If it has, detect returns a
+// human readable reason.
+type detector interface {
+	detect(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (failed bool, reason string, err error)
+}
+
+// progressDeadlineDetector marks deployments as failed once the API server
+// reports they've exceeded their progress deadline.
+type progressDeadlineDetector struct{}
+
+func (progressDeadlineDetector) detect(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (bool, string, error) {
+	if !deploymentFailed(d) {
+		return false, "", nil
+	}
+	return true, "ProgressDeadlineExceeded", nil
+}
+
+// stuckRolloutDetector marks rollouts as failed once they've run longer than
+// a timeout, for deployments without a progress deadline, or with one so
+// long the API server won't report them as failed first.
+type stuckRolloutDetector struct {
+	timeout time.Duration
+	now     func() time.Time
+}
+
+func (t *stuckRolloutDetector) detect(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (bool, string, error) {
+	if d.Spec.ProgressDeadlineSeconds != nil && time.Duration(d.Spec.GetProgressDeadlineSeconds())*time.Second <= t.timeout {
+		return false, "", nil
+	}
+	// Paused rollouts don't progress.
+	if d.Spec.GetPaused() || rolloutComplete(d) {
+		return false, "", nil
+	}
+	rs := newReplicaSet(d, replicaSets)
+	if rs == nil {
+		return false, "", nil
+	}
+	start := rolloutStart(d, rs)
+	if elapsed := t.now().Sub(start); elapsed > t.timeout {
+		return true, fmt.Sprintf("RolloutStuck: rollout started at %s didn't complete within %s", start.UTC().Format(time.RFC3339), t.timeout), nil
+	}
+	return false, "", nil
+}
+
+// rolloutStart returns when the rollout of a deployment's current ReplicaSet
+// started: when the ReplicaSet was created, or, if an older ReplicaSet is
+// being rolled out again, when the deployment was last rolled back, or when
+// its Progressing condition last changed, such as when it was resumed.
+func rolloutStart(d *v1beta1.Deployment, rs *v1beta1.ReplicaSet) time.Time {
+	start := time.Unix(rs.Metadata.GetCreationTimestamp().GetSeconds(), 0)
+	if last, err := time.Parse(time.RFC3339, d.Metadata.GetAnnotations()[annotationLastRollbackTime]); err == nil && last.After(start) {
+		start = last
+	}
+	for _, c := range d.Status.GetConditions() {
+		if c.GetType() != "Progressing" {
+			continue
+		}
+		if t := time.Unix(c.GetLastTransitionTime().GetSeconds(), 0); t.After(start) {
+			start = t
+		}
+	}
+	return start
+}
+
+// detect runs all detectors against a deployment, returning the first
+// failure found.
+func (c *rollbackController) detect(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (bool, string, error) {
+	ctx, s := c.startDeploymentSpan(ctx, "detect", d)
+	for _, det := range c.detectors {
+		failed, reason, err := det.detect(ctx, d, replicaSets)
+		if err != nil || failed {
+			s.setAttr("reason", reason)
+			s.finish(err)
+			return failed, reason, err
+		}
+	}
+	s.finish(nil)
+	return false, "", nil
+}
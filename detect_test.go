@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+func TestStuckRolloutDetector(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// When the deployment's ReplicaSet was created.
+		created string
+		// The deployment's progress deadline in seconds, if set.
+		deadline    int32
+		paused      bool
+		complete    bool
+		annotations map[string]string
+		// When its Progressing condition last changed, if it has one.
+		progressing string
+
+		wantFailed bool
+	}{
+		{
+			name:       "stuck",
+			created:    "2017-06-01T10:00:00Z",
+			wantFailed: true,
+		},
+		{
+			name:    "in progress",
+			created: "2017-06-01T11:30:00Z",
+		},
+		{
+			// The API server reports it first.
+			name:     "shorter progress deadline",
+			created:  "2017-06-01T10:00:00Z",
+			deadline: 600,
+		},
+		{
+			name:       "longer progress deadline",
+			created:    "2017-06-01T10:00:00Z",
+			deadline:   86400,
+			wantFailed: true,
+		},
+		{
+			name:    "paused",
+			created: "2017-06-01T10:00:00Z",
+			paused:  true,
+		},
+		{
+			name:     "complete",
+			created:  "2017-06-01T10:00:00Z",
+			complete: true,
+		},
+		{
+			// An older ReplicaSet rolled out again by a rollback.
+			name:        "rolled back to",
+			created:     "2017-05-01T12:00:00Z",
+			annotations: map[string]string{annotationLastRollbackTime: "2017-06-01T11:30:00Z"},
+		},
+		{
+			name:        "resumed",
+			created:     "2017-06-01T10:00:00Z",
+			progressing: "2017-06-01T11:30:00Z",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := testDeployment("hello", 2, false)
+			if test.deadline != 0 {
+				d.Spec.ProgressDeadlineSeconds = int32Ptr(test.deadline)
+			}
+			d.Spec.Paused = k8s.Bool(test.paused)
+			if test.complete {
+				d.Status.Replicas = int32Ptr(2)
+				d.Status.UpdatedReplicas = int32Ptr(2)
+				d.Status.AvailableReplicas = int32Ptr(2)
+			}
+			for k, v := range test.annotations {
+				d.Metadata.Annotations[k] = v
+			}
+			if test.progressing != "" {
+				d.Status.Conditions = []*v1beta1.DeploymentCondition{{
+					Type:               k8s.String("Progressing"),
+					Status:             k8s.String("True"),
+					Reason:             k8s.String("DeploymentResumed"),
+					LastTransitionTime: fakeTime(test.progressing),
+				}}
+			}
+			rs := testReplicaSet(d, 2)
+			rs.Metadata.CreationTimestamp = fakeTime(test.created)
+
+			det := &stuckRolloutDetector{timeout: time.Hour, now: func() time.Time { return now }}
+			failed, reason, err := det.detect(context.Background(), d, []*v1beta1.ReplicaSet{rs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed != test.wantFailed {
+				t.Errorf("failed=%t (%q), want %t", failed, reason, test.wantFailed)
+			}
+			if failed && !strings.HasPrefix(reason, "RolloutStuck: ") {
+				t.Errorf("got reason %q, want RolloutStuck", reason)
+			}
+		})
+	}
+}
+
+func TestRolloutTimeout(t *testing.T) {
+	f := newFakeAPI()
+	c := newTestController(t, f, "--rollout-timeout=1h")
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.clock = func() time.Time { return now }
+
+	d := testDeployment("hello", 2, false)
+	rs := testReplicaSet(d, 2)
+	rs.Metadata.CreationTimestamp = fakeTime("2017-06-01T10:00:00Z")
+	f.addDeployment(d)
+	f.addReplicaSet(rs)
+	f.addReplicaSet(testReplicaSet(d, 1))
+
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if actions := c.actions("hello"); !reflect.DeepEqual(actions, []string{"rollback"}) {
+		t.Fatalf("got actions %q, want rollback", actions)
+	}
+	want := "RolloutStuck: rollout started at 2017-06-01T10:00:00Z didn't complete within 1h0m0s"
+	if got := c.status.failed[0].Reason; got != want {
+		t.Errorf("got reason %q, want %q", got, want)
+	}
+}
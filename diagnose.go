@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Limits on the diagnostics collected for a failed deployment, so records
+// and notifications stay a reasonable size.
+const (
+	maxDiagnosedPods   = 3
+	diagnosticLogLines = 20
+)
+
+// podDiagnostic describes why a pod of a failed rollout isn't ready.
+type podDiagnostic struct {
+	Pod        string                 `json:"pod"`
+	Node       string                 `json:"node,omitempty"`
+	Phase      string                 `json:"phase"`
+	Containers []*containerDiagnostic `json:"containers"`
+}
+
+type containerDiagnostic struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+	ExitCode int32  `json:"exitCode,omitempty"`
+	Restarts int32  `json:"restarts"`
+	// The last lines of the container's logs, or of its last terminated
+	// instance if it's restarting.
+	Logs []string `json:"logs,omitempty"`
+}
+
+// diagnose collects the statuses and recent logs of the containers that
+// aren't ready in a failed rollout's new ReplicaSet, so on-call engineers can
+// see why it failed without digging through the cluster. It's best effort:
+// errors are logged, and only as much as could be collected is returned.
+func (c *rollbackController) diagnose(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) []*podDiagnostic {
+	rs := newReplicaSet(d, replicaSets)
+	if rs == nil {
+		return nil
+	}
+	pods, err := c.api.listPods(ctx, d.Metadata.GetNamespace())
+	if err != nil {
+		c.logger.Printf("diagnose deployment %s: list pods: %v", d.Metadata.GetName(), err)
+		return nil
+	}
+
+	var diags []*podDiagnostic
+	for _, p := range pods {
+		if len(diags) == maxDiagnosedPods {
+			break
+		}
+		if !podOwnedBy(p, rs) {
+			continue
+		}
+		var containers []*containerDiagnostic
+		for _, cs := range p.Status.GetContainerStatuses() {
+			if cs.GetReady() {
+				continue
+			}
+			containers = append(containers, c.diagnoseContainer(ctx, p, cs))
+		}
+		if len(containers) == 0 {
+			continue
+		}
+		diags = append(diags, &podDiagnostic{
+			Pod:        p.Metadata.GetName(),
+			Node:       p.Spec.GetNodeName(),
+			Phase:      p.Status.GetPhase(),
+			Containers: containers,
+		})
+	}
+	return diags
+}
+
+func (c *rollbackController) diagnoseContainer(ctx context.Context, p *v1.Pod, cs *v1.ContainerStatus) *containerDiagnostic {
+	diag := &containerDiagnostic{Name: cs.GetName(), Restarts: cs.GetRestartCount()}
+
+	state := cs.GetState()
+	switch {
+	case state.GetWaiting() != nil:
+		diag.State = "waiting"
+		diag.Reason = state.GetWaiting().GetReason()
+		diag.Message = state.GetWaiting().GetMessage()
+	case state.GetTerminated() != nil:
+		diag.State = "terminated"
+		diag.Reason = state.GetTerminated().GetReason()
+		diag.Message = state.GetTerminated().GetMessage()
+		diag.ExitCode = state.GetTerminated().GetExitCode()
+	case state.GetRunning() != nil:
+		diag.State = "running"
+	}
+
+	// A crash looping container is usually waiting to restart, so its exit
+	// code and logs are those of the last instance.
+	previous := false
+	if last := cs.GetLastState().GetTerminated(); last != nil && diag.State != "terminated" {
+		diag.ExitCode = last.GetExitCode()
+		previous = true
+	}
+	if diag.State == "waiting" && !previous {
+		// The container has never started, for example because its image
+		// can't be pulled, so there are no logs.
+		return diag
+	}
+	logs, err := c.api.podLogs(ctx, p.Metadata.GetNamespace(), p.Metadata.GetName(), cs.GetName(), previous, diagnosticLogLines)
+	if err != nil {
+		c.logger.Printf("diagnose pod %s: get logs of container %s: %v", p.Metadata.GetName(), cs.GetName(), err)
+		return diag
+	}
+	if logs = strings.TrimRight(logs, "\n"); logs != "" {
+		diag.Logs = strings.Split(logs, "\n")
+	}
+	return diag
+}
+
+// podOwnedBy reports if a pod belongs to a ReplicaSet, falling back to the
+// pod-template-hash label for API servers that don't set owner references.
+func podOwnedBy(p *v1.Pod, rs *v1beta1.ReplicaSet) bool {
+	if p.Metadata.GetNamespace() != rs.Metadata.GetNamespace() {
+		return false
+	}
+	if refs := p.Metadata.GetOwnerReferences(); len(refs) > 0 {
+		for _, ref := range refs {
+			if ref.GetUid() == rs.Metadata.GetUid() {
+				return true
+			}
+		}
+		return false
+	}
+	hash := rs.Metadata.GetLabels()[podTemplateHashLabel]
+	return hash != "" && p.Metadata.GetLabels()[podTemplateHashLabel] == hash
+}
+
+// summarizeDiagnostics returns a one line summary of diagnostics, short
+// enough for an event message.
+func summarizeDiagnostics(diags []*podDiagnostic) string {
+	var parts []string
+	for _, p := range diags {
+		for _, cs := range p.Containers {
+			s := fmt.Sprintf("pod %s container %s %s", p.Pod, cs.Name, cs.State)
+			if cs.Reason != "" {
+				s += " (" + cs.Reason + ")"
+			}
+			if cs.ExitCode != 0 {
+				s += fmt.Sprintf(", exit code %d", cs.ExitCode)
+			}
+			if cs.Restarts > 0 {
+				s += fmt.Sprintf(", %d restarts", cs.Restarts)
+			}
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// testPod returns a running pod of a ReplicaSet, identified by its
+// pod-template-hash label, with the given container statuses.
+func testPod(rs *v1beta1.ReplicaSet, name string, statuses ...*v1.ContainerStatus) *v1.Pod {
+	return &v1.Pod{
+		Metadata: &v1.ObjectMeta{
+			Name:      k8s.String(name),
+			Namespace: rs.Metadata.Namespace,
+			Labels:    map[string]string{podTemplateHashLabel: rs.Metadata.GetLabels()[podTemplateHashLabel]},
+		},
+		Spec:   &v1.PodSpec{NodeName: k8s.String("node-1")},
+		Status: &v1.PodStatus{Phase: k8s.String("Running"), ContainerStatuses: statuses},
+	}
+}
+
+func readyContainer(name string) *v1.ContainerStatus {
+	return &v1.ContainerStatus{
+		Name:  k8s.String(name),
+		Ready: k8s.Bool(true),
+		State: &v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+	}
+}
+
+func waitingContainer(name, reason string) *v1.ContainerStatus {
+	return &v1.ContainerStatus{
+		Name:         k8s.String(name),
+		Ready:        k8s.Bool(false),
+		RestartCount: int32Ptr(0),
+		State: &v1.ContainerState{Waiting: &v1.ContainerStateWaiting{
+			Reason:  k8s.String(reason),
+			Message: k8s.String(reason + " for " + name),
+		}},
+	}
+}
+
+// crashLoopingContainer returns the status of a container waiting to be
+// restarted after exiting with an exit code.
+func crashLoopingContainer(name string, exitCode, restarts int32) *v1.ContainerStatus {
+	cs := waitingContainer(name, "CrashLoopBackOff")
+	cs.RestartCount = int32Ptr(restarts)
+	cs.LastState = &v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+		ExitCode: int32Ptr(exitCode),
+		Reason:   k8s.String("Error"),
+	}}
+	return cs
+}
+
+func indentJSON(t *testing.T, v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDiagnose(t *testing.T) {
+	f := newFakeAPI()
+	d := testDeployment("hello", 2, true)
+	rs := testReplicaSet(d, 2)
+	old := testReplicaSet(d, 1)
+	var logs []string
+	for i := 1; i <= 25; i++ {
+		logs = append(logs, fmt.Sprintf("line %d", i))
+	}
+
+	f.addPod(testPod(rs, "hello-a", crashLoopingContainer("hello", 2, 3), readyContainer("proxy")))
+	f.setLogs("default", "hello-a", "hello", strings.Join(logs, "\n")+"\n")
+	// Containers that never started have no logs worth fetching.
+	f.addPod(testPod(rs, "hello-b", waitingContainer("hello", "ErrImagePull")))
+	f.setLogs("default", "hello-b", "hello", "stale\n")
+	f.addPod(testPod(rs, "hello-c", readyContainer("hello")))
+	f.addPod(testPod(old, "hello-old", waitingContainer("hello", "ErrImagePull")))
+
+	c := newTestController(t, f)
+	diags := c.diagnose(context.Background(), d, []*v1beta1.ReplicaSet{rs, old})
+	want := []*podDiagnostic{
+		{
+			Pod:   "hello-a",
+			Node:  "node-1",
+			Phase: "Running",
+			Containers: []*containerDiagnostic{{
+				Name:     "hello",
+				State:    "waiting",
+				Reason:   "CrashLoopBackOff",
+				Message:  "CrashLoopBackOff for hello",
+				ExitCode: 2,
+				Restarts: 3,
+				Logs:     logs[5:],
+			}},
+		},
+		{
+			Pod:   "hello-b",
+			Node:  "node-1",
+			Phase: "Running",
+			Containers: []*containerDiagnostic{{
+				Name:    "hello",
+				State:   "waiting",
+				Reason:  "ErrImagePull",
+				Message: "ErrImagePull for hello",
+			}},
+		},
+	}
+	if !reflect.DeepEqual(diags, want) {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", indentJSON(t, diags), indentJSON(t, want))
+	}
+
+	wantSummary := "pod hello-a container hello waiting (CrashLoopBackOff), exit code 2, 3 restarts; pod hello-b container hello waiting (ErrImagePull)"
+	if got := summarizeDiagnostics(diags); got != wantSummary {
+		t.Errorf("got summary %q, want %q", got, wantSummary)
+	}
+}
+
+func TestDiagnoseLimit(t *testing.T) {
+	f := newFakeAPI()
+	d := testDeployment("hello", 2, true)
+	rs := testReplicaSet(d, 2)
+	for i := 0; i < maxDiagnosedPods+2; i++ {
+		f.addPod(testPod(rs, fmt.Sprintf("hello-%d", i), waitingContainer("hello", "ErrImagePull")))
+	}
+	c := newTestController(t, f)
+	if diags := c.diagnose(context.Background(), d, []*v1beta1.ReplicaSet{rs}); len(diags) != maxDiagnosedPods {
+		t.Errorf("got %d diagnosed pods, want %d", len(diags), maxDiagnosedPods)
+	}
+}
+
+func TestPodOwnedBy(t *testing.T) {
+	d := testDeployment("hello", 2, true)
+	rs := testReplicaSet(d, 2)
+	rs.Metadata.Uid = k8s.String("uid-rs")
+
+	p := testPod(rs, "hello-a")
+	if !podOwnedBy(p, rs) {
+		t.Error("pod with the ReplicaSet's template hash isn't owned by it")
+	}
+	// Owner references take precedence over labels.
+	p.Metadata.OwnerReferences = []*v1.OwnerReference{{Uid: k8s.String("uid-other")}}
+	if podOwnedBy(p, rs) {
+		t.Error("pod owned by another ReplicaSet is owned by it")
+	}
+	p.Metadata.OwnerReferences[0].Uid = k8s.String("uid-rs")
+	if !podOwnedBy(p, rs) {
+		t.Error("pod referencing the ReplicaSet isn't owned by it")
+	}
+	p.Metadata.Namespace = k8s.String("other")
+	if podOwnedBy(p, rs) {
+		t.Error("pod in another namespace is owned by it")
+	}
+}
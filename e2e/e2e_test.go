@@ -0,0 +1,21 @@
+//go:build e2e
+// +build e2e
+
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+// TestE2E runs the end-to-end tests with go test, which takes the same flags
+// as the command after -args:
+//
+//	$ go test -tags e2e -timeout 30m ./e2e -args --use-existing
+func TestE2E(t *testing.T) {
+	l := log.New(os.Stderr, "e2e: ", log.LstdFlags)
+	if err := runE2E(l, ".."); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,234 @@
+// Command e2e runs the rollback controller against a real API server and
+// checks that it rolls back failed deployments.
+//
+// It creates a throwaway cluster with kind, builds and runs the controller
+// with --client=kubectl, then applies the deployments in testdata. Run it
+// from the root of the repo:
+//
+//	$ go run ./e2e
+//
+// or as a test, for CI:
+//
+//	$ go test -tags e2e ./e2e
+//
+// The controller only speaks extensions/v1beta1, which Kubernetes stopped
+// serving for deployments in v1.16, so the default node image is v1.15.
+// Deployments are created both with that API and with apps/v1, which is what
+// most manifests use, and which the API server converts. kind and kubectl
+// must be on the PATH.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	cluster   = flag.String("cluster", "rollback-e2e", "Name of the kind cluster.")
+	image     = flag.String("image", "kindest/node:v1.15.12", "kind node image to create the cluster with.")
+	keep      = flag.Bool("keep-cluster", false, "Don't delete the cluster afterwards, for debugging.")
+	existing  = flag.Bool("use-existing", false, "Use an existing kind cluster instead of creating one. Implies --keep-cluster.")
+	namespace = flag.String("namespace", "rollback-e2e", "Namespace to create the test deployments in.")
+	timeout   = flag.Duration("timeout", 3*time.Minute, "How long to wait for each step.")
+)
+
+// testCase is a deployment that's created from a good manifest, and then
+// updated with a bad one, which must be rolled back.
+type testCase struct {
+	deployment string
+	good, bad  string
+}
+
+var testCases = []testCase{
+	{"e2e-hello", "good.yaml", "bad.yaml"},
+	{"e2e-hello-apps-v1", "apps-v1-good.yaml", "apps-v1-bad.yaml"},
+}
+
+func main() {
+	flag.Parse()
+	l := log.New(os.Stderr, "e2e: ", log.LstdFlags)
+	if err := runE2E(l, "."); err != nil {
+		l.Fatalf("FAIL: %v", err)
+	}
+	l.Print("PASS")
+}
+
+// runE2E runs every test case. root is the root of the repo.
+func runE2E(l *log.Logger, root string) error {
+	dir, err := ioutil.TempDir("", "rollback-e2e")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	h := &harness{
+		logger:     l,
+		root:       root,
+		cluster:    *cluster,
+		namespace:  *namespace,
+		kubeconfig: filepath.Join(dir, "kubeconfig"),
+		timeout:    *timeout,
+	}
+	err = h.run(dir, *image, *existing)
+	if !*keep && !*existing {
+		if err := h.deleteCluster(); err != nil {
+			l.Printf("delete cluster: %v", err)
+		}
+	}
+	return err
+}
+
+// harness drives a kind cluster through kubectl.
+type harness struct {
+	logger     *log.Logger
+	root       string
+	cluster    string
+	namespace  string
+	kubeconfig string
+	timeout    time.Duration
+}
+
+func (h *harness) run(dir, image string, existing bool) error {
+	if !existing {
+		h.logger.Printf("creating kind cluster %s (%s)", h.cluster, image)
+		if _, err := h.command("kind", "create", "cluster", "--name", h.cluster, "--image", image, "--wait", "2m"); err != nil {
+			return fmt.Errorf("create cluster: %v", err)
+		}
+	}
+	config, err := h.command("kind", "get", "kubeconfig", "--name", h.cluster)
+	if err != nil {
+		return fmt.Errorf("get kubeconfig: %v", err)
+	}
+	if err := ioutil.WriteFile(h.kubeconfig, []byte(config), 0600); err != nil {
+		return err
+	}
+
+	// Build the controller from the root of the repo, and run it with the
+	// cluster's credentials.
+	bin := filepath.Join(dir, "kube-rollback-controller")
+	h.logger.Print("building controller")
+	if _, err := h.command("go", "build", "-o", bin, h.root); err != nil {
+		return fmt.Errorf("build controller: %v", err)
+	}
+	if _, err := h.kubectl("create", "namespace", h.namespace); err != nil {
+		return fmt.Errorf("create namespace: %v", err)
+	}
+	controller := exec.Command(bin, "run", "--client=kubectl", "--namespace="+h.namespace)
+	controller.Env = append(os.Environ(), "KUBECONFIG="+h.kubeconfig)
+	controller.Stdout = os.Stderr
+	controller.Stderr = os.Stderr
+	if err := controller.Start(); err != nil {
+		return fmt.Errorf("start controller: %v", err)
+	}
+	defer controller.Process.Kill()
+
+	for _, tc := range testCases {
+		if err := h.runCase(tc); err != nil {
+			return fmt.Errorf("%s: %v", tc.deployment, err)
+		}
+	}
+	return nil
+}
+
+func (h *harness) runCase(tc testCase) error {
+	testdata := filepath.Join(h.root, "e2e", "testdata")
+	h.logger.Printf("creating good deployment %s", tc.deployment)
+	if _, err := h.kubectl("apply", "-f", filepath.Join(testdata, tc.good)); err != nil {
+		return err
+	}
+	if _, err := h.kubectl("rollout", "status", "deployment/"+tc.deployment, "--timeout="+h.timeout.String()); err != nil {
+		return fmt.Errorf("good deployment didn't become ready: %v", err)
+	}
+
+	h.logger.Printf("rolling out bad deployment %s", tc.deployment)
+	if _, err := h.kubectl("apply", "-f", filepath.Join(testdata, tc.bad)); err != nil {
+		return err
+	}
+	// The deployment controller rolls back by copying the previous pod
+	// template into a new revision.
+	err := h.waitFor("deployment to be rolled back", func() (bool, error) {
+		version, err := h.kubectl("get", "deployment", tc.deployment,
+			"-o", "jsonpath={.spec.template.spec.containers[0].env[0].value}")
+		if err != nil {
+			return false, err
+		}
+		rev, err := h.kubectl("get", "deployment", tc.deployment,
+			"-o", `jsonpath={.metadata.annotations.deployment\.kubernetes\.io/revision}`)
+		if err != nil {
+			return false, err
+		}
+		return version == "good" && rev == "3", nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = h.waitFor("RolledBack event", func() (bool, error) {
+		out, err := h.kubectl("get", "events", "--field-selector", "reason=RolledBack,involvedObject.name="+tc.deployment,
+			"-o", "name")
+		return out != "", err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := h.kubectl("rollout", "status", "deployment/"+tc.deployment, "--timeout="+h.timeout.String()); err != nil {
+		return fmt.Errorf("rolled back deployment didn't become ready: %v", err)
+	}
+	return nil
+}
+
+func (h *harness) deleteCluster() error {
+	h.logger.Printf("deleting kind cluster %s", h.cluster)
+	_, err := h.command("kind", "delete", "cluster", "--name", h.cluster)
+	return err
+}
+
+// waitFor polls a condition until it's true or the harness times out.
+// Errors are retried, since the API server may be briefly unavailable.
+func (h *harness) waitFor(desc string, cond func() (bool, error)) error {
+	h.logger.Printf("waiting for %s", desc)
+	deadline := time.Now().Add(h.timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		ok, err := cond()
+		if ok {
+			return nil
+		}
+		lastErr = err
+		time.Sleep(2 * time.Second)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("timed out waiting for %s: %v", desc, lastErr)
+	}
+	return fmt.Errorf("timed out waiting for %s", desc)
+}
+
+func (h *harness) kubectl(args ...string) (string, error) {
+	args = append([]string{"--kubeconfig", h.kubeconfig, "--namespace", h.namespace}, args...)
+	return h.command("kubectl", args...)
+}
+
+// command runs a command, returning its trimmed stdout.
+func (h *harness) command(name string, args ...string) (string, error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() != 0 {
+			err = errors.New(strings.TrimSpace(stderr.String()))
+		}
+		return "", fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
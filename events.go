@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/unversioned"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Types of Kubernetes events.
+const (
+	eventNormal  = "Normal"
+	eventWarning = "Warning"
+)
+
+// The component events are reported from.
+const eventSource = "rollback-controller"
+
+// recordEvent creates a Kubernetes event for a deployment, so the
+// controller's actions show up in "kubectl describe". Events are best
+// effort, and failures are logged rather than returned.
+func (c *rollbackController) recordEvent(ctx context.Context, d *v1beta1.Deployment, eventType, reason, msg string) {
+	var (
+		now     = c.now()
+		seconds = now.Unix()
+		nanos   = int32(now.Nanosecond())
+		count   = int32(1)
+	)
+	ts := &unversioned.Time{Seconds: &seconds, Nanos: &nanos}
+	e := &v1.Event{
+		Metadata: &v1.ObjectMeta{
+			Name:      k8s.String(fmt.Sprintf("%s.%x", d.Metadata.GetName(), now.UnixNano())),
+			Namespace: k8s.String(d.Metadata.GetNamespace()),
+		},
+		InvolvedObject: &v1.ObjectReference{
+			Kind:            k8s.String("Deployment"),
+			ApiVersion:      k8s.String("extensions/v1beta1"),
+			Namespace:       k8s.String(d.Metadata.GetNamespace()),
+			Name:            k8s.String(d.Metadata.GetName()),
+			Uid:             k8s.String(d.Metadata.GetUid()),
+			ResourceVersion: k8s.String(d.Metadata.GetResourceVersion()),
+		},
+		Reason:         k8s.String(reason),
+		Message:        k8s.String(msg),
+		Source:         &v1.EventSource{Component: k8s.String(eventSource)},
+		FirstTimestamp: ts,
+		LastTimestamp:  ts,
+		Count:          &count,
+		Type:           k8s.String(eventType),
+	}
+	if err := c.api.createEvent(ctx, e); err != nil {
+		c.logger.Printf("create event for deployment %s: %v", d.Metadata.GetName(), err)
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/unversioned"
+	"github.com/ericchiang/k8s/api/v1"
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	batchv1 "github.com/ericchiang/k8s/apis/batch/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	policyv1beta1 "github.com/ericchiang/k8s/apis/policy/v1beta1"
+	"github.com/golang/protobuf/proto"
+)
+
+// fakeAPI is an in-memory deploymentAPI. Objects are copied on the way in
+// and out, so callers can't modify its state without writing it, and
+// writes bump the resource version like a real API server. It doesn't run
+// a deployment controller: rollbacks and scaling are recorded, not acted on,
+// and status is only changed by callers.
+type fakeAPI struct {
+	mu          sync.Mutex
+	deployments map[string]*v1beta1.Deployment
+	replicaSets map[string]*v1beta1.ReplicaSet
+	pods        map[string]*v1.Pod
+	hpas        map[string]*autoscalingv1.HorizontalPodAutoscaler
+	pdbs        map[string]*policyv1beta1.PodDisruptionBudget
+	configMaps  map[string]*v1.ConfigMap
+	secrets     map[string]*v1.Secret
+	namespaces  map[string]*v1.Namespace
+	jobs        map[string]*batchv1.Job
+	// Container logs, keyed by namespace/pod/container.
+	logs    map[string]string
+	events  []*v1.Event
+	version int
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		deployments: make(map[string]*v1beta1.Deployment),
+		replicaSets: make(map[string]*v1beta1.ReplicaSet),
+		pods:        make(map[string]*v1.Pod),
+		hpas:        make(map[string]*autoscalingv1.HorizontalPodAutoscaler),
+		pdbs:        make(map[string]*policyv1beta1.PodDisruptionBudget),
+		configMaps:  make(map[string]*v1.ConfigMap),
+		secrets:     make(map[string]*v1.Secret),
+		namespaces:  make(map[string]*v1.Namespace),
+		jobs:        make(map[string]*batchv1.Job),
+		logs:        make(map[string]string),
+	}
+}
+
+func fakeKey(m *v1.ObjectMeta) string {
+	return m.GetNamespace() + "/" + m.GetName()
+}
+
+// nextVersion must be called with mu held.
+func (f *fakeAPI) nextVersion() *string {
+	f.version++
+	return k8s.String(strconv.Itoa(f.version))
+}
+
+// addDeployment creates or replaces a deployment.
+func (f *fakeAPI) addDeployment(d *v1beta1.Deployment) {
+	d = proto.Clone(d).(*v1beta1.Deployment)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d.Metadata.ResourceVersion = f.nextVersion()
+	f.deployments[fakeKey(d.Metadata)] = d
+}
+
+// addReplicaSet creates or replaces a ReplicaSet.
+func (f *fakeAPI) addReplicaSet(rs *v1beta1.ReplicaSet) {
+	rs = proto.Clone(rs).(*v1beta1.ReplicaSet)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rs.Metadata.ResourceVersion = f.nextVersion()
+	f.replicaSets[fakeKey(rs.Metadata)] = rs
+}
+
+// addPod creates or replaces a pod.
+func (f *fakeAPI) addPod(p *v1.Pod) {
+	p = proto.Clone(p).(*v1.Pod)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p.Metadata.ResourceVersion = f.nextVersion()
+	f.pods[fakeKey(p.Metadata)] = p
+}
+
+// addHorizontalPodAutoscaler creates or replaces an HPA.
+func (f *fakeAPI) addHorizontalPodAutoscaler(h *autoscalingv1.HorizontalPodAutoscaler) {
+	h = proto.Clone(h).(*autoscalingv1.HorizontalPodAutoscaler)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h.Metadata.ResourceVersion = f.nextVersion()
+	f.hpas[fakeKey(h.Metadata)] = h
+}
+
+// addPodDisruptionBudget creates or replaces a PodDisruptionBudget.
+func (f *fakeAPI) addPodDisruptionBudget(p *policyv1beta1.PodDisruptionBudget) {
+	p = proto.Clone(p).(*policyv1beta1.PodDisruptionBudget)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p.Metadata.ResourceVersion = f.nextVersion()
+	f.pdbs[fakeKey(p.Metadata)] = p
+}
+
+// addNamespace creates or replaces a namespace.
+func (f *fakeAPI) addNamespace(ns *v1.Namespace) {
+	ns = proto.Clone(ns).(*v1.Namespace)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ns.Metadata.ResourceVersion = f.nextVersion()
+	f.namespaces[ns.Metadata.GetName()] = ns
+}
+
+// addJob creates or replaces a Job, for example to set its status.
+func (f *fakeAPI) addJob(job *batchv1.Job) {
+	job = proto.Clone(job).(*batchv1.Job)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job.Metadata.ResourceVersion = f.nextVersion()
+	f.jobs[fakeKey(job.Metadata)] = job
+}
+
+// setLogs sets the logs returned for a container.
+func (f *fakeAPI) setLogs(namespace, pod, container, logs string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs[namespace+"/"+pod+"/"+container] = logs
+}
+
+// recordedEvents returns the events created so far.
+func (f *fakeAPI) recordedEvents() []*v1.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*v1.Event(nil), f.events...)
+}
+
+func (f *fakeAPI) listDeployments(ctx context.Context, namespace string) ([]*v1beta1.Deployment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []*v1beta1.Deployment
+	for _, d := range f.deployments {
+		if namespace == "" || d.Metadata.GetNamespace() == namespace {
+			items = append(items, proto.Clone(d).(*v1beta1.Deployment))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return fakeKey(items[i].Metadata) < fakeKey(items[j].Metadata) })
+	return items, nil
+}
+
+func (f *fakeAPI) getDeployment(ctx context.Context, namespace, name string) (*v1beta1.Deployment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.deployments[namespace+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("deployment %s/%s not found", namespace, name)
+	}
+	return proto.Clone(d).(*v1beta1.Deployment), nil
+}
+
+// patchDeployment applies the patch to the deployment's JSON, see
+// fakePatch. Like the API server, it rejects patches setting a resource
+// version other than the deployment's current one.
+func (f *fakeAPI) patchDeployment(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := namespace + "/" + name
+	cur, ok := f.deployments[key]
+	if !ok {
+		return nil, fakeNotFound("deployment", key)
+	}
+	d := new(v1beta1.Deployment)
+	if err := fakePatch(cur, patch, d); err != nil {
+		return nil, err
+	}
+	if d.Metadata.GetResourceVersion() != cur.Metadata.GetResourceVersion() {
+		return nil, &k8s.APIError{
+			Code: http.StatusConflict,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("deployment %s: the object has been modified", key)),
+				Reason:  k8s.String("Conflict"),
+			},
+		}
+	}
+	d.Metadata.Namespace, d.Metadata.Name = cur.Metadata.Namespace, cur.Metadata.Name
+	d.Metadata.ResourceVersion = f.nextVersion()
+	d.Metadata.Generation = cur.Metadata.Generation
+	if !proto.Equal(d.Spec, cur.Spec) {
+		generation := cur.Metadata.GetGeneration() + 1
+		d.Metadata.Generation = &generation
+	}
+	f.deployments[key] = d
+	return proto.Clone(d).(*v1beta1.Deployment), nil
+}
+
+// patchDeploymentStatus only supports the condition patches written by
+// reportCondition.
+func (f *fakeAPI) patchDeploymentStatus(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error) {
+	var p conditionPatch
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, &k8s.APIError{
+			Code: http.StatusBadRequest,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("invalid patch: %v", err)),
+				Reason:  k8s.String("BadRequest"),
+			},
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := namespace + "/" + name
+	cur, ok := f.deployments[key]
+	if !ok {
+		return nil, fakeNotFound("deployment", key)
+	}
+	d := proto.Clone(cur).(*v1beta1.Deployment)
+	if d.Status == nil {
+		d.Status = new(v1beta1.DeploymentStatus)
+	}
+	for _, c := range p.Status.Conditions {
+		cond := findCondition(d, c.Type)
+		if cond == nil {
+			cond = &v1beta1.DeploymentCondition{Type: k8s.String(c.Type)}
+			d.Status.Conditions = append(d.Status.Conditions, cond)
+		}
+		cond.Status, cond.Reason, cond.Message = k8s.String(c.Status), k8s.String(c.Reason), k8s.String(c.Message)
+		cond.LastUpdateTime, cond.LastTransitionTime = fakeTime(c.LastUpdateTime), fakeTime(c.LastTransitionTime)
+	}
+	d.Metadata.ResourceVersion = f.nextVersion()
+	f.deployments[key] = d
+	return proto.Clone(d).(*v1beta1.Deployment), nil
+}
+
+// fakeTime parses an RFC 3339 timestamp, returning nil if it's invalid.
+func fakeTime(s string) *unversioned.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &unversioned.Time{Seconds: proto.Int64(t.Unix())}
+}
+
+func (f *fakeAPI) patchReplicaSet(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.ReplicaSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := namespace + "/" + name
+	cur, ok := f.replicaSets[key]
+	if !ok {
+		return nil, fakeNotFound("replicaset", key)
+	}
+	rs := new(v1beta1.ReplicaSet)
+	if err := fakePatch(cur, patch, rs); err != nil {
+		return nil, err
+	}
+	rs.Metadata.Namespace, rs.Metadata.Name = cur.Metadata.Namespace, cur.Metadata.Name
+	rs.Metadata.ResourceVersion = f.nextVersion()
+	f.replicaSets[key] = rs
+	return proto.Clone(rs).(*v1beta1.ReplicaSet), nil
+}
+
+// fakePatch applies a strategic merge patch to the JSON of cur, merging the
+// lists strategicMergePatch merges by name, and decodes the result into obj.
+func fakePatch(cur interface{}, patch []byte, obj interface{}) error {
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return &k8s.APIError{
+			Code: http.StatusBadRequest,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("invalid patch: %v", err)),
+				Reason:  k8s.String("BadRequest"),
+			},
+		}
+	}
+	doc, err := toJSONValue(cur)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(applyStrategicMergePatch("", doc, p))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, obj); err != nil {
+		return &k8s.APIError{
+			Code: http.StatusUnprocessableEntity,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("invalid object: %v", err)),
+				Reason:  k8s.String("Invalid"),
+			},
+		}
+	}
+	return nil
+}
+
+func (f *fakeAPI) listReplicaSets(ctx context.Context, namespace string) ([]*v1beta1.ReplicaSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []*v1beta1.ReplicaSet
+	for _, rs := range f.replicaSets {
+		if namespace == "" || rs.Metadata.GetNamespace() == namespace {
+			items = append(items, proto.Clone(rs).(*v1beta1.ReplicaSet))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return fakeKey(items[i].Metadata) < fakeKey(items[j].Metadata) })
+	return items, nil
+}
+
+func (f *fakeAPI) createEvent(ctx context.Context, e *v1.Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, proto.Clone(e).(*v1.Event))
+	return nil
+}
+
+func (f *fakeAPI) listPods(ctx context.Context, namespace string) ([]*v1.Pod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []*v1.Pod
+	for _, p := range f.pods {
+		if namespace == "" || p.Metadata.GetNamespace() == namespace {
+			items = append(items, proto.Clone(p).(*v1.Pod))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return fakeKey(items[i].Metadata) < fakeKey(items[j].Metadata) })
+	return items, nil
+}
+
+// podLogs ignores previous, returning the same logs for every instance of a
+// container.
+func (f *fakeAPI) podLogs(ctx context.Context, namespace, pod, container string, previous bool, lines int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	logs, ok := f.logs[namespace+"/"+pod+"/"+container]
+	if !ok {
+		return "", fmt.Errorf("no logs for container %s in pod %s/%s", container, namespace, pod)
+	}
+	l := strings.SplitAfter(logs, "\n")
+	if len(l) > 0 && l[len(l)-1] == "" {
+		l = l[:len(l)-1]
+	}
+	if len(l) > lines {
+		l = l[len(l)-lines:]
+	}
+	return strings.Join(l, ""), nil
+}
+
+func (f *fakeAPI) listHorizontalPodAutoscalers(ctx context.Context, namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []*autoscalingv1.HorizontalPodAutoscaler
+	for _, h := range f.hpas {
+		if namespace == "" || h.Metadata.GetNamespace() == namespace {
+			items = append(items, proto.Clone(h).(*autoscalingv1.HorizontalPodAutoscaler))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return fakeKey(items[i].Metadata) < fakeKey(items[j].Metadata) })
+	return items, nil
+}
+
+func (f *fakeAPI) listPodDisruptionBudgets(ctx context.Context, namespace string) ([]*policyv1beta1.PodDisruptionBudget, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []*policyv1beta1.PodDisruptionBudget
+	for _, p := range f.pdbs {
+		if namespace == "" || p.Metadata.GetNamespace() == namespace {
+			items = append(items, proto.Clone(p).(*policyv1beta1.PodDisruptionBudget))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return fakeKey(items[i].Metadata) < fakeKey(items[j].Metadata) })
+	return items, nil
+}
+
+func (f *fakeAPI) getJob(ctx context.Context, namespace, name string) (*batchv1.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, ok := f.jobs[namespace+"/"+name]
+	if !ok {
+		return nil, fakeNotFound("job", namespace+"/"+name)
+	}
+	return proto.Clone(job).(*batchv1.Job), nil
+}
+
+// createJob supports generateName, appending the next resource version to
+// the prefix.
+func (f *fakeAPI) createJob(ctx context.Context, job *batchv1.Job) (*batchv1.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job = proto.Clone(job).(*batchv1.Job)
+	job.Metadata.ResourceVersion = f.nextVersion()
+	if job.Metadata.GetName() == "" {
+		job.Metadata.Name = k8s.String(job.Metadata.GetGenerateName() + job.Metadata.GetResourceVersion())
+	}
+	key := fakeKey(job.Metadata)
+	if _, ok := f.jobs[key]; ok {
+		return nil, &k8s.APIError{
+			Code: http.StatusConflict,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("job %s already exists", key)),
+				Reason:  k8s.String("AlreadyExists"),
+			},
+		}
+	}
+	f.jobs[key] = job
+	return proto.Clone(job).(*batchv1.Job), nil
+}
+
+func (f *fakeAPI) listNamespaces(ctx context.Context) ([]*v1.Namespace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []*v1.Namespace
+	for _, ns := range f.namespaces {
+		items = append(items, proto.Clone(ns).(*v1.Namespace))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Metadata.GetName() < items[j].Metadata.GetName() })
+	return items, nil
+}
+
+func (f *fakeAPI) getNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ns, ok := f.namespaces[name]
+	if !ok {
+		return nil, fakeNotFound("namespace", name)
+	}
+	return proto.Clone(ns).(*v1.Namespace), nil
+}
+
+func (f *fakeAPI) getConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cm, ok := f.configMaps[namespace+"/"+name]
+	if !ok {
+		return nil, fakeNotFound("configmap", namespace+"/"+name)
+	}
+	return proto.Clone(cm).(*v1.ConfigMap), nil
+}
+
+func (f *fakeAPI) createConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(cm.Metadata)
+	if _, ok := f.configMaps[key]; ok {
+		return nil, &k8s.APIError{
+			Code: http.StatusConflict,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("configmap %s already exists", key)),
+				Reason:  k8s.String("AlreadyExists"),
+			},
+		}
+	}
+	cm = proto.Clone(cm).(*v1.ConfigMap)
+	cm.Metadata.ResourceVersion = f.nextVersion()
+	f.configMaps[key] = cm
+	return proto.Clone(cm).(*v1.ConfigMap), nil
+}
+
+func (f *fakeAPI) updateConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(cm.Metadata)
+	cur, ok := f.configMaps[key]
+	if !ok {
+		return nil, fakeNotFound("configmap", key)
+	}
+	if cm.Metadata.GetResourceVersion() != cur.Metadata.GetResourceVersion() {
+		return nil, &k8s.APIError{
+			Code: http.StatusConflict,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("configmap %s: the object has been modified", key)),
+				Reason:  k8s.String("Conflict"),
+			},
+		}
+	}
+	cm = proto.Clone(cm).(*v1.ConfigMap)
+	cm.Metadata.ResourceVersion = f.nextVersion()
+	f.configMaps[key] = cm
+	return proto.Clone(cm).(*v1.ConfigMap), nil
+}
+
+func (f *fakeAPI) getSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secret, ok := f.secrets[namespace+"/"+name]
+	if !ok {
+		return nil, fakeNotFound("secret", namespace+"/"+name)
+	}
+	return proto.Clone(secret).(*v1.Secret), nil
+}
+
+func (f *fakeAPI) createSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(secret.Metadata)
+	if _, ok := f.secrets[key]; ok {
+		return nil, &k8s.APIError{
+			Code: http.StatusConflict,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("secret %s already exists", key)),
+				Reason:  k8s.String("AlreadyExists"),
+			},
+		}
+	}
+	secret = proto.Clone(secret).(*v1.Secret)
+	secret.Metadata.ResourceVersion = f.nextVersion()
+	f.secrets[key] = secret
+	return proto.Clone(secret).(*v1.Secret), nil
+}
+
+func (f *fakeAPI) updateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(secret.Metadata)
+	cur, ok := f.secrets[key]
+	if !ok {
+		return nil, fakeNotFound("secret", key)
+	}
+	if secret.Metadata.GetResourceVersion() != cur.Metadata.GetResourceVersion() {
+		return nil, &k8s.APIError{
+			Code: http.StatusConflict,
+			Status: &unversioned.Status{
+				Message: k8s.String(fmt.Sprintf("secret %s: the object has been modified", key)),
+				Reason:  k8s.String("Conflict"),
+			},
+		}
+	}
+	secret = proto.Clone(secret).(*v1.Secret)
+	secret.Metadata.ResourceVersion = f.nextVersion()
+	f.secrets[key] = secret
+	return proto.Clone(secret).(*v1.Secret), nil
+}
+
+func fakeNotFound(kind, key string) error {
+	return &k8s.APIError{
+		Code: http.StatusNotFound,
+		Status: &unversioned.Status{
+			Message: k8s.String(fmt.Sprintf("%s %s not found", kind, key)),
+			Reason:  k8s.String("NotFound"),
+		},
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitChange is a change to a single file, proposed as a pull request.
+type gitChange struct {
+	branch  string
+	path    string
+	content string
+	title   string
+	body    string
+}
+
+// gitHost reads files from and proposes changes to a hosted git repo.
+type gitHost interface {
+	// readFile returns the contents of a file on the base branch.
+	readFile(ctx context.Context, path string) (string, error)
+	// proposeChange commits a change to a new branch and opens a pull, or
+	// merge, request for it against the base branch. It returns the
+	// request's URL.
+	proposeChange(ctx context.Context, change *gitChange) (string, error)
+}
+
+// gitAPI makes JSON requests to a provider's REST API.
+type gitAPI struct {
+	url    string
+	client *http.Client
+	token  func() (string, error)
+	// Sets the token on a request.
+	auth func(h http.Header, token string)
+}
+
+// do makes a request, encoding req and decoding the response into resp if
+// they're non-nil.
+func (a *gitAPI) do(ctx context.Context, method, path string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	r, err := http.NewRequest(method, a.url+path, body)
+	if err != nil {
+		return err
+	}
+	token, err := a.token()
+	if err != nil {
+		return err
+	}
+	a.auth(r.Header, token)
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := a.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 10<<20))
+	if err != nil {
+		return fmt.Errorf("%s %s: read response: %v", method, path, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, bytes.TrimSpace(b))
+	}
+	if resp != nil {
+		if err := json.Unmarshal(b, resp); err != nil {
+			return fmt.Errorf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+	return nil
+}
+
+// gitHub implements gitHost using the GitHub REST API.
+type gitHub struct {
+	*gitAPI
+	repo string
+	base string
+}
+
+func (g *gitHub) readFile(ctx context.Context, path string) (string, error) {
+	content, _, err := g.getContents(ctx, path, g.base)
+	return content, err
+}
+
+func (g *gitHub) getContents(ctx context.Context, path, ref string) (content, sha string, err error) {
+	var file struct {
+		Content string `json:"content"`
+		SHA     string `json:"sha"`
+	}
+	p := fmt.Sprintf("/repos/%s/contents/%s?ref=%s", g.repo, path, url.QueryEscape(ref))
+	if err := g.do(ctx, "GET", p, nil, &file); err != nil {
+		return "", "", err
+	}
+	// The API wraps base64 content at 60 characters.
+	b, err := base64.StdEncoding.DecodeString(removeNewlines(file.Content))
+	if err != nil {
+		return "", "", fmt.Errorf("decode %s: %v", path, err)
+	}
+	return string(b), file.SHA, nil
+}
+
+func (g *gitHub) proposeChange(ctx context.Context, change *gitChange) (string, error) {
+	var ref struct {
+		Object struct {
+			SHA string `json:"sha"`
+		} `json:"object"`
+	}
+	if err := g.do(ctx, "GET", fmt.Sprintf("/repos/%s/git/ref/heads/%s", g.repo, g.base), nil, &ref); err != nil {
+		return "", fmt.Errorf("get base branch: %v", err)
+	}
+	newRef := map[string]string{"ref": "refs/heads/" + change.branch, "sha": ref.Object.SHA}
+	if err := g.do(ctx, "POST", fmt.Sprintf("/repos/%s/git/refs", g.repo), newRef, nil); err != nil {
+		return "", fmt.Errorf("create branch %s: %v", change.branch, err)
+	}
+
+	_, sha, err := g.getContents(ctx, change.path, change.branch)
+	if err != nil {
+		return "", err
+	}
+	commit := map[string]string{
+		"message": change.title,
+		"content": base64.StdEncoding.EncodeToString([]byte(change.content)),
+		"sha":     sha,
+		"branch":  change.branch,
+	}
+	if err := g.do(ctx, "PUT", fmt.Sprintf("/repos/%s/contents/%s", g.repo, change.path), commit, nil); err != nil {
+		return "", fmt.Errorf("commit %s: %v", change.path, err)
+	}
+
+	pull := map[string]string{
+		"title": change.title,
+		"body":  change.body,
+		"head":  change.branch,
+		"base":  g.base,
+	}
+	var resp struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := g.do(ctx, "POST", fmt.Sprintf("/repos/%s/pulls", g.repo), pull, &resp); err != nil {
+		return "", fmt.Errorf("open pull request: %v", err)
+	}
+	return resp.HTMLURL, nil
+}
+
+// gitLab implements gitHost using the GitLab REST API.
+type gitLab struct {
+	*gitAPI
+	project string
+	base    string
+}
+
+func (g *gitLab) projectPath() string {
+	return "/projects/" + url.PathEscape(g.project)
+}
+
+func (g *gitLab) readFile(ctx context.Context, path string) (string, error) {
+	var file struct {
+		Content string `json:"content"`
+	}
+	p := fmt.Sprintf("%s/repository/files/%s?ref=%s", g.projectPath(), url.PathEscape(path), url.QueryEscape(g.base))
+	if err := g.do(ctx, "GET", p, nil, &file); err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(removeNewlines(file.Content))
+	if err != nil {
+		return "", fmt.Errorf("decode %s: %v", path, err)
+	}
+	return string(b), nil
+}
+
+func (g *gitLab) proposeChange(ctx context.Context, change *gitChange) (string, error) {
+	// A commit can create its branch from the base branch in one request.
+	commit := map[string]interface{}{
+		"branch":         change.branch,
+		"start_branch":   g.base,
+		"commit_message": change.title,
+		"actions": []map[string]string{{
+			"action":    "update",
+			"file_path": change.path,
+			"content":   change.content,
+		}},
+	}
+	if err := g.do(ctx, "POST", g.projectPath()+"/repository/commits", commit, nil); err != nil {
+		return "", fmt.Errorf("commit %s: %v", change.path, err)
+	}
+
+	mr := map[string]string{
+		"source_branch": change.branch,
+		"target_branch": g.base,
+		"title":         change.title,
+		"description":   change.body,
+	}
+	var resp struct {
+		WebURL string `json:"web_url"`
+	}
+	if err := g.do(ctx, "POST", g.projectPath()+"/merge_requests", mr, &resp); err != nil {
+		return "", fmt.Errorf("open merge request: %v", err)
+	}
+	return resp.WebURL, nil
+}
+
+func removeNewlines(s string) string {
+	return strings.Replace(s, "\n", "", -1)
+}
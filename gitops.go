@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Supported git hosting providers for the git strategy.
+const (
+	gitProviderGitHub = "github"
+	gitProviderGitLab = "gitlab"
+)
+
+// gitConfig configures the git strategy. Instead of modifying the cluster,
+// which a GitOps controller syncing from git would immediately undo, the git
+// strategy proposes a change reverting the failed rollout's images and
+// leaves applying it to the GitOps controller.
+type gitConfig struct {
+	Provider string `json:"provider"`
+	// API URL of the provider. Defaults to github.com or gitlab.com.
+	APIURL string `json:"apiURL"`
+	// "owner/repo" on GitHub, or the project's path or ID on GitLab.
+	Repo string `json:"repo"`
+	// Branch changes are proposed against. Defaults to "master".
+	BaseBranch string `json:"baseBranch"`
+	// File holding an API token. It's read for every change, so it can be
+	// mounted from a Secret and rotated.
+	TokenFile string `json:"tokenFile"`
+
+	// Path of each deployment's manifest in the repo. Paths keyed by
+	// "namespace/deployment" take precedence over PathTemplate, in which
+	// "{namespace}" and "{deployment}" are replaced.
+	Paths        map[string]string `json:"paths"`
+	PathTemplate string            `json:"pathTemplate"`
+}
+
+func (g *gitConfig) validate() error {
+	switch g.Provider {
+	case gitProviderGitHub, gitProviderGitLab:
+	default:
+		return fmt.Errorf("unknown provider %q", g.Provider)
+	}
+	if g.Repo == "" {
+		return fmt.Errorf("repo is required")
+	}
+	if g.TokenFile == "" {
+		return fmt.Errorf("tokenFile is required")
+	}
+	if len(g.Paths) == 0 && g.PathTemplate == "" {
+		return fmt.Errorf("one of paths or pathTemplate is required")
+	}
+	return nil
+}
+
+// manifestPath returns the path of a deployment's manifest in the repo.
+func (g *gitConfig) manifestPath(d *v1beta1.Deployment) (string, bool) {
+	ns, name := d.Metadata.GetNamespace(), d.Metadata.GetName()
+	if p, ok := g.Paths[ns+"/"+name]; ok {
+		return p, true
+	}
+	if g.PathTemplate == "" {
+		return "", false
+	}
+	r := strings.NewReplacer("{namespace}", ns, "{deployment}", name)
+	return r.Replace(g.PathTemplate), true
+}
+
+// newGitHost initializes a client for the configured provider.
+func newGitHost(g *gitConfig, client *http.Client) gitHost {
+	token := func() (string, error) {
+		b, err := ioutil.ReadFile(g.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read token: %v", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	base := g.BaseBranch
+	if base == "" {
+		base = "master"
+	}
+	api := &gitAPI{client: client, token: token}
+	if g.Provider == gitProviderGitLab {
+		api.url = "https://gitlab.com/api/v4"
+		if g.APIURL != "" {
+			api.url = strings.TrimSuffix(g.APIURL, "/")
+		}
+		api.auth = func(h http.Header, token string) {
+			h.Set("Private-Token", token)
+		}
+		return &gitLab{gitAPI: api, project: g.Repo, base: base}
+	}
+	api.url = "https://api.github.com"
+	api.auth = func(h http.Header, token string) {
+		h.Set("Authorization", "token "+token)
+		h.Set("Accept", "application/vnd.github.v3+json")
+	}
+	if g.APIURL != "" {
+		api.url = strings.TrimSuffix(g.APIURL, "/")
+	}
+	return &gitHub{gitAPI: api, repo: g.Repo, base: base}
+}
+
+// imageChange is an image of a failed deployment and the image it should be
+// reverted to.
+type imageChange struct {
+	from, to string
+}
+
+func (c imageChange) String() string {
+	return c.from + " to " + c.to
+}
+
+// imageChanges returns the images of a failed deployment's containers that
+// differ from those of the ReplicaSet it would be rolled back to, paired with
+// the image they should be reverted to, sorted by image.
+func imageChanges(d *v1beta1.Deployment, target *v1beta1.ReplicaSet) []imageChange {
+	good := make(map[string]string)
+	for _, c := range target.Spec.GetTemplate().GetSpec().GetContainers() {
+		good[c.GetName()] = c.GetImage()
+	}
+	seen := make(map[imageChange]bool)
+	var changes []imageChange
+	for _, c := range d.Spec.GetTemplate().GetSpec().GetContainers() {
+		img, ok := good[c.GetName()]
+		change := imageChange{c.GetImage(), img}
+		if ok && img != c.GetImage() && !seen[change] {
+			seen[change] = true
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].from != changes[j].from {
+			return changes[i].from < changes[j].from
+		}
+		return changes[i].to < changes[j].to
+	})
+	return changes
+}
+
+// manifestObject holds the fields of a manifest's documents used to find a
+// deployment's.
+type manifestObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+}
+
+// definesDeployment reports whether a YAML document is a deployment's
+// manifest. Documents without a namespace match deployments in any
+// namespace, since it's usually set when they're applied.
+func definesDeployment(doc []string, d *v1beta1.Deployment) bool {
+	data, err := yamlToJSON([]byte(strings.Join(doc, "")))
+	if err != nil {
+		return false
+	}
+	var obj manifestObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return false
+	}
+	ns := obj.Metadata.Namespace
+	return obj.Kind == "Deployment" && obj.Metadata.Name == d.Metadata.GetName() &&
+		(ns == "" || ns == d.Metadata.GetNamespace())
+}
+
+// revertImages replaces images in a deployment's document of a manifest,
+// leaving other documents, which may use the same images, alone. It works on
+// the text rather than parsing the YAML so the rest of the file, including
+// comments, is left exactly as it was. It reports whether anything was
+// replaced.
+func revertImages(manifest string, d *v1beta1.Deployment, changes []imageChange) (string, bool) {
+	lines := strings.SplitAfter(manifest, "\n")
+	changed := false
+	start := 0
+	for end := 0; end <= len(lines); end++ {
+		if end < len(lines) && !isDocumentSeparator(lines[end]) {
+			continue
+		}
+		if definesDeployment(lines[start:end], d) && revertLines(lines[start:end], changes) {
+			changed = true
+		}
+		start = end + 1
+	}
+	return strings.Join(lines, ""), changed
+}
+
+// isDocumentSeparator reports whether a line starts a new YAML document,
+// optionally followed by a comment.
+func isDocumentSeparator(line string) bool {
+	line = strings.TrimRight(line, " \t\r\n")
+	return line == "---" || strings.HasPrefix(line, "--- #") || strings.HasPrefix(line, "---\t#")
+}
+
+// revertLines replaces images in a document's lines, reporting whether
+// anything was replaced.
+func revertLines(lines []string, changes []imageChange) bool {
+	changed := false
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t-")
+		if !strings.HasPrefix(trimmed, "image:") {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(trimmed, "image:"))
+		if j := strings.Index(value, " #"); j >= 0 {
+			value = strings.TrimSpace(value[:j])
+		}
+		unquoted := strings.Trim(value, `"'`)
+		for _, change := range changes {
+			if change.from == unquoted {
+				lines[i] = strings.Replace(line, unquoted, change.to, 1)
+				changed = true
+				break
+			}
+		}
+	}
+	return changed
+}
+
+// gitRevert proposes a change reverting a failed deployment's images in git,
+// once per failed revision.
+func (c *rollbackController) gitRevert(ctx context.Context, f *failure) error {
+	d := f.d
+	if c.git == nil {
+		return fmt.Errorf("the git strategy requires git to be configured")
+	}
+	if !c.once("git-revert", d) {
+		return nil
+	}
+	// Try again on the next pass if the git host can't be reached.
+	retry := false
+	defer func() {
+		if retry {
+			c.forget("git-revert", d)
+		}
+	}()
+	target, skipped, why := rollbackTarget(d, f.replicaSets)
+	c.skippedIdentical(ctx, d, skipped)
+	if target == nil {
+		return c.noRollbackTarget(ctx, f, why)
+	}
+	fail := func(msg string) error {
+		msg = fmt.Sprintf("deployment failed (%s) but a revert couldn't be proposed: %s", f.reason, msg)
+		c.logger.Printf("not reverting deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+		c.recordAction(d, "notify", 0, msg)
+		return c.notify(ctx, d, "git-revert-failed", severityCritical, msg)
+	}
+
+	changes := imageChanges(d, target)
+	if len(changes) == 0 {
+		return fail("the failed revision didn't change any images")
+	}
+	path, ok := c.cfg.Git.manifestPath(d)
+	if !ok {
+		return fail("no manifest path configured for the deployment")
+	}
+	manifest, err := c.git.readFile(ctx, path)
+	if err != nil {
+		retry = true
+		return fmt.Errorf("read %s: %v", path, err)
+	}
+	reverted, ok := revertImages(manifest, d, changes)
+	if !ok {
+		return fail(fmt.Sprintf("the deployment's manifest in %s doesn't reference the failed images", path))
+	}
+
+	targetRevision := revision(target.Metadata.GetAnnotations())
+	var images []string
+	for _, change := range changes {
+		images = append(images, change.String())
+	}
+	title := fmt.Sprintf("Roll back %s/%s to revision %d", d.Metadata.GetNamespace(), d.Metadata.GetName(), targetRevision)
+	url, err := c.git.proposeChange(ctx, &gitChange{
+		branch:  fmt.Sprintf("rollback-controller/%s-%s-%d", d.Metadata.GetNamespace(), d.Metadata.GetName(), revision(d.Metadata.GetAnnotations())),
+		path:    path,
+		content: reverted,
+		title:   title,
+		body: fmt.Sprintf("Revision %d of deployment %s/%s failed: %s\n\nThis reverts %s.",
+			revision(d.Metadata.GetAnnotations()), d.Metadata.GetNamespace(), d.Metadata.GetName(), f.reason, strings.Join(images, ", ")),
+	})
+	if err != nil {
+		retry = true
+		return fmt.Errorf("propose change: %v", err)
+	}
+
+	msg := fmt.Sprintf("deployment failed (%s), proposed a revert to revision %d: %s", f.reason, targetRevision, url)
+	c.logger.Printf("proposed revert of deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), url)
+	c.recordAction(d, "git-revert", targetRevision, msg)
+	c.recordEvent(ctx, d, eventWarning, "RevertProposed", msg)
+	return c.notify(ctx, d, "git-revert", severityCritical, msg)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// fakeGitHost serves files from memory and records proposed changes.
+type fakeGitHost struct {
+	files   map[string]string
+	changes []*gitChange
+}
+
+func (h *fakeGitHost) readFile(ctx context.Context, path string) (string, error) {
+	return h.files[path], nil
+}
+
+func (h *fakeGitHost) proposeChange(ctx context.Context, change *gitChange) (string, error) {
+	h.changes = append(h.changes, change)
+	return "https://git.example.com/pulls/1", nil
+}
+
+// setImages sets the containers of a pod template, from pairs of names and
+// images.
+func setImages(t *v1.PodTemplateSpec, images ...string) {
+	t.Spec.Containers = nil
+	for i := 0; i < len(images); i += 2 {
+		t.Spec.Containers = append(t.Spec.Containers, &v1.Container{
+			Name:  k8s.String(images[i]),
+			Image: k8s.String(images[i+1]),
+		})
+	}
+}
+
+func TestImageChanges(t *testing.T) {
+	d := testDeployment("hello", 2, true)
+	setImages(d.Spec.Template, "web", "web:v2", "proxy", "proxy:v2", "worker", "web:v2", "logger", "logger:v1", "new", "new:v1")
+	target := testReplicaSet(d, 1)
+	target.Spec.Template = testTemplate("hello", 1)
+	setImages(target.Spec.Template, "web", "web:v1", "proxy", "proxy:v1", "worker", "web:v1", "logger", "logger:v1")
+
+	want := []imageChange{{"proxy:v2", "proxy:v1"}, {"web:v2", "web:v1"}}
+	if got := imageChanges(d, target); !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %v, want %v", got, want)
+	}
+}
+
+func TestRevertImages(t *testing.T) {
+	changes := []imageChange{{"hello:v2", "hello:v1"}}
+	tests := []struct {
+		name     string
+		manifest string
+		want     string
+		changed  bool
+	}{
+		{
+			name: "single document",
+			manifest: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: hello
+spec:
+  template:
+    spec:
+      containers:
+      - name: hello
+        image: "hello:v2" # pinned by CI
+`,
+			want: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: hello
+spec:
+  template:
+    spec:
+      containers:
+      - name: hello
+        image: "hello:v1" # pinned by CI
+`,
+			changed: true,
+		},
+		{
+			name: "other documents",
+			manifest: `kind: Deployment
+metadata:
+  name: hello-canary
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v2
+---
+kind: Deployment
+metadata:
+  name: hello
+  namespace: default
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v2
+--- # the hello job
+kind: Job
+metadata:
+  name: hello
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v2
+`,
+			want: `kind: Deployment
+metadata:
+  name: hello-canary
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v2
+---
+kind: Deployment
+metadata:
+  name: hello
+  namespace: default
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v1
+--- # the hello job
+kind: Job
+metadata:
+  name: hello
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v2
+`,
+			changed: true,
+		},
+		{
+			name: "other namespace",
+			manifest: `kind: Deployment
+metadata:
+  name: hello
+  namespace: staging
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v2
+`,
+		},
+		{
+			name: "images not referenced",
+			manifest: `kind: Deployment
+metadata:
+  name: hello
+spec:
+  template:
+    spec:
+      containers:
+      - image: hello:v3
+`,
+		},
+	}
+	d := testDeployment("hello", 2, true)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, changed := revertImages(test.manifest, d, changes)
+			if changed != test.changed {
+				t.Errorf("changed=%t, want %t", changed, test.changed)
+			}
+			want := test.want
+			if !test.changed {
+				want = test.manifest
+			}
+			if got != want {
+				t.Errorf("got manifest:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestGitRevert(t *testing.T) {
+	f := newFakeAPI()
+	d := testDeployment("hello", 2, true)
+	setImages(d.Spec.Template, "web", "web:v2", "proxy", "proxy:v2")
+	target := testReplicaSet(d, 1)
+	target.Spec.Template = testTemplate("hello", 1)
+	setImages(target.Spec.Template, "web", "web:v1", "proxy", "proxy:v1")
+	f.addDeployment(d)
+
+	c := newTestController(t, f)
+	c.cfg.Git = &gitConfig{PathTemplate: "{namespace}/{deployment}.yaml"}
+	host := &fakeGitHost{files: map[string]string{
+		"default/hello.yaml": "kind: Deployment\nmetadata:\n  name: hello\nspec:\n  template:\n    spec:\n      containers:\n      - image: web:v2\n      - image: proxy:v2\n",
+	}}
+	c.git = host
+
+	failed := &failure{d: d, reason: "ProgressDeadlineExceeded", replicaSets: []*v1beta1.ReplicaSet{testReplicaSet(d, 2), target}}
+	if err := c.gitRevert(context.Background(), failed); err != nil {
+		t.Fatal(err)
+	}
+	if len(host.changes) != 1 {
+		t.Fatalf("got %d proposed changes, want 1", len(host.changes))
+	}
+	change := host.changes[0]
+	if want := "This reverts proxy:v2 to proxy:v1, web:v2 to web:v1."; !strings.HasSuffix(change.body, want) {
+		t.Errorf("got body %q, want it to end with %q", change.body, want)
+	}
+	if want := "      - image: web:v1\n      - image: proxy:v1\n"; !strings.HasSuffix(change.content, want) {
+		t.Errorf("got content %q, want images reverted", change.content)
+	}
+	if actions := c.actions("hello"); !reflect.DeepEqual(actions, []string{"git-revert"}) {
+		t.Errorf("got actions %q, want git-revert", actions)
+	}
+
+	// A failed revision is only reverted once.
+	if err := c.gitRevert(context.Background(), failed); err != nil {
+		t.Fatal(err)
+	}
+	if len(host.changes) != 1 {
+		t.Errorf("revision was reverted again")
+	}
+}
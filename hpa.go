@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/golang/protobuf/proto"
+)
+
+// autoscaler returns the HorizontalPodAutoscaler targeting a deployment, or
+// nil if its replicas aren't autoscaled. The controller never sets the
+// replicas of an autoscaled deployment, since the autoscaler would fight it.
+func (c *rollbackController) autoscaler(ctx context.Context, d *v1beta1.Deployment) (*autoscalingv1.HorizontalPodAutoscaler, error) {
+	hpas, err := c.api.listHorizontalPodAutoscalers(ctx, d.Metadata.GetNamespace())
+	if err != nil {
+		return nil, fmt.Errorf("list horizontal pod autoscalers: %v", err)
+	}
+	for _, h := range hpas {
+		ref := h.Spec.GetScaleTargetRef()
+		if ref.GetKind() == "Deployment" && ref.GetName() == d.Metadata.GetName() {
+			return h, nil
+		}
+	}
+	return nil, nil
+}
+
+// onlyReplicasChanged reports if two versions of a deployment's spec differ
+// only in their number of replicas.
+func onlyReplicasChanged(a, b *v1beta1.DeploymentSpec) bool {
+	a = proto.Clone(a).(*v1beta1.DeploymentSpec)
+	b = proto.Clone(b).(*v1beta1.DeploymentSpec)
+	a.Replicas, b.Replicas = nil, nil
+	return proto.Equal(a, b)
+}
+
+// scaledByAutoscaler reports if a deployment's spec changed from before only
+// because its autoscaler scaled it. Acting on a deployment that was scaled
+// is still safe, since the decision to act on it doesn't depend on its
+// replicas.
+func (c *rollbackController) scaledByAutoscaler(ctx context.Context, before *v1beta1.DeploymentSpec, latest *v1beta1.Deployment) (bool, error) {
+	if !onlyReplicasChanged(before, latest.Spec) {
+		return false, nil
+	}
+	h, err := c.autoscaler(ctx, latest)
+	if err != nil {
+		return false, err
+	}
+	return h != nil, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// annotationLastGoodImages records the images of a deployment's containers,
+// as a JSON object keyed by container name, the last time a rollout of the
+// deployment completed. It's maintained for deployments using the image
+// strategy.
+const annotationLastGoodImages = "rollback-controller/last-good-images"
+
+// rolloutComplete reports if every replica of a deployment is running its
+// current spec and available.
+func rolloutComplete(d *v1beta1.Deployment) bool {
+	if d.Status.GetObservedGeneration() < d.Metadata.GetGeneration() {
+		return false
+	}
+	replicas := d.Spec.GetReplicas()
+	return d.Status.GetUpdatedReplicas() == replicas &&
+		d.Status.GetAvailableReplicas() == replicas &&
+		d.Status.GetReplicas() == replicas
+}
+
+func containerImages(d *v1beta1.Deployment) map[string]string {
+	images := make(map[string]string)
+	for _, c := range d.Spec.GetTemplate().GetSpec().GetContainers() {
+		images[c.GetName()] = c.GetImage()
+	}
+	return images
+}
+
+// recordGoodImages records the images of a healthy deployment using the
+// image strategy once its rollout completes.
+func (c *rollbackController) recordGoodImages(ctx context.Context, d *v1beta1.Deployment) error {
+	if s, err := c.strategyFor(d); err != nil || s != strategyImage || !rolloutComplete(d) {
+		return nil
+	}
+	b, err := json.Marshal(containerImages(d))
+	if err != nil {
+		return err
+	}
+	if d.Metadata.GetAnnotations()[annotationLastGoodImages] == string(b) {
+		return nil
+	}
+	err = c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+		setAnnotation(d, annotationLastGoodImages, string(b))
+	})
+	if err != nil {
+		return fmt.Errorf("record good images: %v", err)
+	}
+	c.logger.Printf("recorded good images of deployment: %s: %s", *d.Metadata.Name, b)
+	return nil
+}
+
+// imageRollback sets the images of a failed deployment's containers back to
+// those recorded after its last completed rollout, independent of its
+// ReplicaSet history. Only the images are changed, so any other changes to
+// the pod template made by the failed revision are kept.
+func (c *rollbackController) imageRollback(ctx context.Context, f *failure) error {
+	d := f.d
+	v, ok := d.Metadata.GetAnnotations()[annotationLastGoodImages]
+	if !ok {
+		return c.noRollbackTarget(ctx, f, "no images have been recorded from a completed rollout")
+	}
+	var good map[string]string
+	if err := json.Unmarshal([]byte(v), &good); err != nil {
+		return c.noRollbackTarget(ctx, f, fmt.Sprintf("invalid %s annotation: %v", annotationLastGoodImages, err))
+	}
+
+	var changes []string
+	for name, img := range containerImages(d) {
+		if prev, ok := good[name]; ok && prev != img {
+			changes = append(changes, fmt.Sprintf("%s from %s to %s", name, img, prev))
+		}
+	}
+	if len(changes) == 0 {
+		return c.noRollbackTarget(ctx, f, "the deployment's images already match the last completed rollout")
+	}
+	sort.Strings(changes)
+
+	now := c.now()
+	annotations, ok := c.countRollback(d, now)
+	if !ok {
+		return c.tripCircuitBreaker(ctx, f)
+	}
+	if !c.spendBudget(d, now) {
+		return c.overBudget(ctx, f)
+	}
+	note := c.stopFailedRollout(ctx, d, f.replicaSets)
+	err := c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+		for k, v := range annotations {
+			setAnnotation(d, k, v)
+		}
+		setRollbackAnnotations(d, 0, "rolled back images of failed deployment: "+f.reason, now)
+		for _, container := range d.Spec.GetTemplate().GetSpec().GetContainers() {
+			if prev, ok := good[container.GetName()]; ok {
+				img := prev
+				container.Image = &img
+			}
+		}
+	})
+	if err != nil {
+		c.refundBudget(d, now)
+		return err
+	}
+	msg := fmt.Sprintf("rolled back images of failed deployment (%s): %s%s", f.reason, strings.Join(changes, ", "), note)
+	c.logger.Printf("rolled back images of deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.startVerification(ctx, d, c.newRecord(d, "image-rollback", 0, msg))
+	c.recordEvent(ctx, d, eventNormal, "ImagesRolledBack", msg)
+	return c.notify(ctx, d, "image-rollback", severityInfo, msg)
+}
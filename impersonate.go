@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/ericchiang/k8s"
+)
+
+// Key of the impersonation config applying to namespaces without their own.
+const impersonateDefault = "*"
+
+// impersonation is an identity the controller acts as in a namespace, so it
+// doesn't need write access to deployments in every namespace, and its
+// changes are attributed to the tenant in the API server's audit logs. It's
+// set in the config file, rather than on namespaces, so tenants can't choose
+// who the controller acts as.
+type impersonation struct {
+	// User to impersonate, and its groups.
+	User   string   `json:"user"`
+	Groups []string `json:"groups"`
+	// Name of a ServiceAccount in the namespace to impersonate instead.
+	ServiceAccount string `json:"serviceAccount"`
+}
+
+func (i *impersonation) validate() error {
+	if (i.User == "") == (i.ServiceAccount == "") {
+		return fmt.Errorf("one of user or serviceAccount is required")
+	}
+	if i.ServiceAccount != "" && len(i.Groups) > 0 {
+		return fmt.Errorf("groups can't be set with serviceAccount")
+	}
+	return nil
+}
+
+// identity returns the user and groups to impersonate in a namespace. No
+// groups are sent for service accounts: the API server adds their groups
+// itself, and sending them would need permission to impersonate the groups
+// as well.
+func (i *impersonation) identity(namespace string) (string, []string) {
+	if i.ServiceAccount == "" {
+		return i.User, i.Groups
+	}
+	return "system:serviceaccount:" + namespace + ":" + i.ServiceAccount, nil
+}
+
+type impersonationKey struct{}
+
+// impersonating returns a context whose Kubernetes API requests impersonate
+// the identity configured for a namespace, if any. Everything the controller
+// does while reconciling a deployment is done as that identity.
+func (c *rollbackController) impersonating(ctx context.Context, namespace string) context.Context {
+	i, ok := c.cfg.Impersonate[namespace]
+	if !ok {
+		if i, ok = c.cfg.Impersonate[impersonateDefault]; !ok {
+			return ctx
+		}
+	}
+	user, groups := i.identity(namespace)
+	h := http.Header{"Impersonate-User": {user}}
+	if len(groups) > 0 {
+		h["Impersonate-Group"] = groups
+	}
+	return context.WithValue(ctx, impersonationKey{}, h)
+}
+
+// clientFor returns the client to make a request with, which adds the
+// impersonation headers of the context, if any. The client doesn't pass
+// contexts to its requests, so the headers are set when they're built.
+func (a *clientAPI) clientFor(ctx context.Context) *k8s.Client {
+	h, ok := ctx.Value(impersonationKey{}).(http.Header)
+	if !ok {
+		return a.client
+	}
+	client := *a.client
+	setHeaders := a.client.SetHeaders
+	client.SetHeaders = func(header http.Header) error {
+		if setHeaders != nil {
+			if err := setHeaders(header); err != nil {
+				return err
+			}
+		}
+		for k, v := range h {
+			header[k] = v
+		}
+		return nil
+	}
+	return &client
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImpersonating(t *testing.T) {
+	cfg := &config{Impersonate: map[string]*impersonation{
+		"team-a":           {User: "alice", Groups: []string{"team-a-deployers"}},
+		impersonateDefault: {ServiceAccount: "rollbacks"},
+	}}
+	c := &rollbackController{cfg: cfg}
+	in := &installation{cfg: cfg}
+	rules := append(in.rules(), in.clusterRules()...)
+	granted := func(resource, name string) bool {
+		for _, r := range rules {
+			if reflect.DeepEqual(r.Resources, []string{resource}) && stringsContain(r.Verbs, "impersonate") && stringsContain(r.ResourceNames, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		namespace string
+		want      http.Header
+	}{
+		{"team-a", http.Header{"Impersonate-User": {"alice"}, "Impersonate-Group": {"team-a-deployers"}}},
+		// The API server adds the service account groups.
+		{"team-b", http.Header{"Impersonate-User": {"system:serviceaccount:team-b:rollbacks"}}},
+	}
+	for _, test := range tests {
+		ctx := c.impersonating(context.Background(), test.namespace)
+		h, _ := ctx.Value(impersonationKey{}).(http.Header)
+		if !reflect.DeepEqual(h, test.want) {
+			t.Errorf("%s: got headers %v, want %v", test.namespace, h, test.want)
+		}
+
+		// The installed RBAC rules must let the controller impersonate
+		// everything it sends.
+		user := h.Get("Impersonate-User")
+		if strings.HasPrefix(user, "system:serviceaccount:") {
+			parts := strings.Split(user, ":")
+			if !granted("serviceaccounts", parts[len(parts)-1]) {
+				t.Errorf("%s: impersonating service account %s isn't granted", test.namespace, user)
+			}
+		} else if !granted("users", user) {
+			t.Errorf("%s: impersonating user %s isn't granted", test.namespace, user)
+		}
+		for _, g := range h["Impersonate-Group"] {
+			if !granted("groups", g) {
+				t.Errorf("%s: impersonating group %s isn't granted", test.namespace, g)
+			}
+		}
+	}
+
+	c.cfg = &config{}
+	if ctx := c.impersonating(context.Background(), "team-a"); ctx.Value(impersonationKey{}) != nil {
+		t.Errorf("impersonating without an impersonate setting")
+	}
+}
+
+func stringsContain(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Incident management integrations. Critical notifications open an incident
+// that pages someone, while informational ones, such as a completed
+// rollback, open an incident and immediately resolve it, so there's a
+// record of what the controller did without waking anyone up. Incidents are
+// deduplicated per event, so repeated notifications about the same event
+// update one incident, while a later event about the same deployment never
+// joins an incident that was resolved.
+
+// pagerDutyConfig configures notifications through the PagerDuty Events API.
+type pagerDutyConfig struct {
+	// File holding the integration's routing key.
+	RoutingKeyFile string `json:"routingKeyFile"`
+	// Events API URL. Defaults to "https://events.pagerduty.com/v2/enqueue".
+	URL string `json:"url"`
+}
+
+func (p *pagerDutyConfig) validate() error {
+	if p.RoutingKeyFile == "" {
+		return fmt.Errorf("routingKeyFile is required")
+	}
+	return nil
+}
+
+// opsgenieConfig configures notifications through the Opsgenie Alert API.
+type opsgenieConfig struct {
+	// File holding an API key of an API integration.
+	APIKeyFile string `json:"apiKeyFile"`
+	// API URL. Defaults to "https://api.opsgenie.com", use
+	// "https://api.eu.opsgenie.com" for EU accounts.
+	URL string `json:"url"`
+}
+
+func (o *opsgenieConfig) validate() error {
+	if o.APIKeyFile == "" {
+		return fmt.Errorf("apiKeyFile is required")
+	}
+	return nil
+}
+
+// incidentSource names the deployment a notification is about, including
+// its cluster if known.
+func incidentSource(n *notification) string {
+	source := n.Namespace + "/" + n.Deployment
+	if n.Cluster != "" {
+		source = n.Cluster + "/" + source
+	}
+	return source
+}
+
+// dedupKey identifies the incident for an event of a kind for a revision of a
+// deployment, see notificationKey.
+func dedupKey(n *notification) string {
+	key := managerName + "/" + incidentSource(n)
+	if n.Key != "" {
+		key += "/" + n.Key
+	}
+	return key
+}
+
+// readSecret reads a key from a file. Keys are read for every request, so
+// they can be mounted from a Secret and rotated.
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s: %v", path, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// postJSON POSTs a JSON request, setting any headers provided.
+func postJSON(ctx context.Context, client *http.Client, u string, header http.Header, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("POST %s: %s: %s", req.URL.Path, resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// truncate shortens s to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// pagerDutyNotifier sends notifications as PagerDuty events.
+//
+// See: https://developer.pagerduty.com/docs/events-api-v2/trigger-events/
+type pagerDutyNotifier struct {
+	cfg    *pagerDutyConfig
+	client *http.Client
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Component     string                 `json:"component"`
+	Group         string                 `json:"group"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+func (p *pagerDutyNotifier) notify(ctx context.Context, n *notification) error {
+	key, err := readSecret(p.cfg.RoutingKeyFile)
+	if err != nil {
+		return err
+	}
+	u := p.cfg.URL
+	if u == "" {
+		u = "https://events.pagerduty.com/v2/enqueue"
+	}
+
+	severity := "critical"
+	if n.Severity == severityInfo {
+		severity = "info"
+	}
+	details := map[string]interface{}{"message": n.Message}
+	if n.Region != "" {
+		details["region"] = n.Region
+	}
+	if len(n.Diagnostics) > 0 {
+		details["diagnostics"] = n.Diagnostics
+	}
+	source := incidentSource(n)
+	trigger := &pagerDutyEvent{
+		RoutingKey:  key,
+		EventAction: "trigger",
+		DedupKey:    dedupKey(n),
+		Payload: &pagerDutyPayload{
+			Summary:       truncate(fmt.Sprintf("deployment %s: %s", source, n.Message), 1024),
+			Source:        source,
+			Severity:      severity,
+			Component:     n.Deployment,
+			Group:         n.Namespace,
+			CustomDetails: details,
+		},
+	}
+	if err := postJSON(ctx, p.client, u, nil, trigger); err != nil {
+		return fmt.Errorf("trigger pagerduty event: %v", err)
+	}
+	if n.Severity != severityInfo {
+		return nil
+	}
+	resolve := &pagerDutyEvent{RoutingKey: key, EventAction: "resolve", DedupKey: dedupKey(n)}
+	if err := postJSON(ctx, p.client, u, nil, resolve); err != nil {
+		return fmt.Errorf("resolve pagerduty event: %v", err)
+	}
+	return nil
+}
+
+// opsgenieNotifier sends notifications as Opsgenie alerts.
+//
+// See: https://docs.opsgenie.com/docs/alert-api
+type opsgenieNotifier struct {
+	cfg    *opsgenieConfig
+	client *http.Client
+}
+
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description"`
+	Priority    string            `json:"priority"`
+	Source      string            `json:"source"`
+	Tags        []string          `json:"tags,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+func (o *opsgenieNotifier) notify(ctx context.Context, n *notification) error {
+	key, err := readSecret(o.cfg.APIKeyFile)
+	if err != nil {
+		return err
+	}
+	base := o.cfg.URL
+	if base == "" {
+		base = "https://api.opsgenie.com"
+	}
+	base = strings.TrimSuffix(base, "/")
+	header := http.Header{"Authorization": {"GenieKey " + key}}
+
+	priority := "P1"
+	if n.Severity == severityInfo {
+		priority = "P5"
+	}
+	description := n.Message
+	if len(n.Diagnostics) > 0 {
+		description += "\n\n" + summarizeDiagnostics(n.Diagnostics)
+	}
+	details := map[string]string{"namespace": n.Namespace, "deployment": n.Deployment}
+	if n.Cluster != "" {
+		details["cluster"] = n.Cluster
+	}
+	if n.Region != "" {
+		details["region"] = n.Region
+	}
+	alert := &opsgenieAlert{
+		Message:     truncate(fmt.Sprintf("deployment %s: %s", incidentSource(n), n.Message), 130),
+		Alias:       dedupKey(n),
+		Description: truncate(description, 15000),
+		Priority:    priority,
+		Source:      managerName,
+		Tags:        []string{managerName, n.Severity},
+		Details:     details,
+	}
+	if err := postJSON(ctx, o.client, base+"/v2/alerts", header, alert); err != nil {
+		return fmt.Errorf("create opsgenie alert: %v", err)
+	}
+	if n.Severity != severityInfo {
+		return nil
+	}
+	closeAlert := map[string]string{"source": managerName, "note": "handled by " + managerName}
+	u := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", base, url.PathEscape(dedupKey(n)))
+	if err := postJSON(ctx, o.client, u, header, closeAlert); err != nil {
+		return fmt.Errorf("close opsgenie alert: %v", err)
+	}
+	return nil
+}
+
+// multiNotifier sends notifications to several notifiers.
+type multiNotifier []notifier
+
+func (m multiNotifier) notify(ctx context.Context, n *notification) error {
+	var errs []string
+	for _, nf := range m {
+		if err := nf.notify(ctx, n); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// incidentEvent is a request received by a fake incident management API.
+type incidentEvent struct {
+	action string
+	key    string
+}
+
+// incidentServer records the requests it receives, decoded by parse.
+func incidentServer(parse func(r *http.Request, body []byte) incidentEvent) (*httptest.Server, func() []incidentEvent) {
+	var (
+		mu     sync.Mutex
+		events []incidentEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events = append(events, parse(r, body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return srv, func() []incidentEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]incidentEvent(nil), events...)
+	}
+}
+
+// testSecret writes a key to a file in dir, returning its path.
+func testSecret(t *testing.T, dir, key string) string {
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sendIncidents sends a completed rollback, the circuit breaker tripping
+// twice for the same revision, and a later rollback, returning their
+// notifications' dedup keys.
+func sendIncidents(t *testing.T, nf notifier) (rollback, tripped, later string) {
+	c := newTestController(t, newFakeAPI())
+	d := testDeployment("hello", 2, true)
+	notifications := []*notification{
+		c.newNotification(d, "rollback", severityInfo, "rolled back"),
+		c.newNotification(d, "circuit-breaker", severityCritical, "tripped"),
+		c.newNotification(d, "circuit-breaker", severityCritical, "tripped again"),
+		c.newNotification(testDeployment("hello", 3, true), "rollback", severityInfo, "rolled back"),
+	}
+	for _, n := range notifications {
+		if err := nf.notify(context.Background(), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dedupKey(notifications[0]), dedupKey(notifications[1]), dedupKey(notifications[3])
+}
+
+func TestPagerDutyIncidents(t *testing.T) {
+	srv, received := incidentServer(func(r *http.Request, body []byte) incidentEvent {
+		var e pagerDutyEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		if e.RoutingKey != "routing-key" {
+			t.Errorf("routing key %q, want routing-key", e.RoutingKey)
+		}
+		action := e.EventAction
+		if e.Payload != nil {
+			action += " " + e.Payload.Severity
+		}
+		return incidentEvent{action, e.DedupKey}
+	})
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "pagerduty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &pagerDutyNotifier{
+		cfg:    &pagerDutyConfig{RoutingKeyFile: testSecret(t, dir, "routing-key"), URL: srv.URL},
+		client: srv.Client(),
+	}
+	rollback, tripped, later := sendIncidents(t, p)
+	want := []incidentEvent{
+		{"trigger info", rollback},
+		{"resolve", rollback},
+		{"trigger critical", tripped},
+		{"trigger critical", tripped},
+		{"trigger info", later},
+		{"resolve", later},
+	}
+	if got := received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+	if rollback == tripped || rollback == later {
+		t.Errorf("events share incidents: %q, %q, %q", rollback, tripped, later)
+	}
+}
+
+func TestOpsgenieIncidents(t *testing.T) {
+	srv, received := incidentServer(func(r *http.Request, body []byte) incidentEvent {
+		if got := r.Header.Get("Authorization"); got != "GenieKey api-key" {
+			t.Errorf("authorization %q, want GenieKey api-key", got)
+		}
+		if r.URL.Path == "/v2/alerts" {
+			var a opsgenieAlert
+			if err := json.Unmarshal(body, &a); err != nil {
+				t.Errorf("decode alert: %v", err)
+			}
+			return incidentEvent{"create " + a.Priority, a.Alias}
+		}
+		if r.URL.Query().Get("identifierType") != "alias" {
+			t.Errorf("%s: not identified by alias", r.URL)
+		}
+		// Aliases contain slashes, so they're escaped in the path.
+		p := strings.TrimPrefix(r.URL.EscapedPath(), "/v2/alerts/")
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			t.Errorf("unexpected request %s", r.URL)
+			return incidentEvent{}
+		}
+		alias, err := url.PathUnescape(p[:i])
+		if err != nil {
+			t.Errorf("%s: %v", r.URL, err)
+		}
+		return incidentEvent{p[i+1:], alias}
+	})
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "opsgenie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &opsgenieNotifier{
+		cfg:    &opsgenieConfig{APIKeyFile: testSecret(t, dir, "api-key"), URL: srv.URL},
+		client: srv.Client(),
+	}
+	rollback, tripped, later := sendIncidents(t, o)
+	want := []incidentEvent{
+		{"create P5", rollback},
+		{"close", rollback},
+		{"create P1", tripped},
+		{"create P1", tripped},
+		{"create P5", later},
+		{"close", later},
+	}
+	if got := received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+}
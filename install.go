@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where the installed controller's config file is mounted.
+const (
+	installConfigDir  = "/etc/kube-rollback-controller"
+	installConfigFile = "config.yaml"
+)
+
+// Address the installed controller serves metrics and the admin API on, if
+// --http-addr isn't set.
+const installHTTPAddr = ":8080"
+
+// object is a Kubernetes object in the API's JSON. Objects are built by hand,
+// rather than with the client's types, since the client's JSON encoding of
+// some fields differs from the API's.
+type object map[string]interface{}
+
+func newObject(apiVersion, kind, namespace, name string, labels map[string]string) object {
+	metadata := object{"name": name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	return object{"apiVersion": apiVersion, "kind": kind, "metadata": metadata}
+}
+
+// policyRule is an RBAC rule.
+type policyRule struct {
+	APIGroups     []string `json:"apiGroups"`
+	Resources     []string `json:"resources"`
+	ResourceNames []string `json:"resourceNames,omitempty"`
+	Verbs         []string `json:"verbs"`
+}
+
+// installation is what install generates the manifests of.
+type installation struct {
+	name      string
+	namespace string
+	image     string
+	// Namespace the controller reconciles, or "" for all of them.
+	scope string
+	cfg   *config
+	// Contents of the config file, if any, installed as a ConfigMap.
+	configFile []byte
+	// Arguments of the controller's run command.
+	args     []string
+	httpAddr string
+	// Whether state is kept in ConfigMaps, see --state-store.
+	configMapState bool
+}
+
+// rules returns the permissions the controller needs in each namespace it
+// reconciles, for the features enabled by its flags and config file.
+func (in *installation) rules() []policyRule {
+	replicaSetVerbs := []string{"list"}
+	if in.cfg.ScaleDownFailedReplicaSet {
+		replicaSetVerbs = append(replicaSetVerbs, "patch")
+	}
+	rules := []policyRule{
+		{APIGroups: []string{"extensions"}, Resources: []string{"deployments"}, Verbs: []string{"get", "list", "patch"}},
+		{APIGroups: []string{"extensions"}, Resources: []string{"replicasets"}, Verbs: replicaSetVerbs},
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create"}},
+		// For failure diagnostics and classes, and quarantine.
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list"}},
+		{APIGroups: []string{""}, Resources: []string{"pods/log"}, Verbs: []string{"get"}},
+		{APIGroups: []string{"autoscaling"}, Resources: []string{"horizontalpodautoscalers"}, Verbs: []string{"list"}},
+		{APIGroups: []string{"policy"}, Resources: []string{"poddisruptionbudgets"}, Verbs: []string{"list"}},
+	}
+	// Namespace defaults. A Role can only grant access to its own namespace.
+	if in.scope == "" {
+		rules = append(rules, policyRule{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"list"}})
+	} else {
+		rules = append(rules, policyRule{APIGroups: []string{""}, Resources: []string{"namespaces"}, ResourceNames: []string{in.scope}, Verbs: []string{"get"}})
+	}
+	if in.cfg.StatusCondition {
+		rules = append(rules, policyRule{APIGroups: []string{"extensions"}, Resources: []string{"deployments/status"}, Verbs: []string{"patch"}})
+	}
+	// Verification can be enabled by annotating any deployment or namespace,
+	// not only by the verifyJob setting, see startVerification.
+	rules = append(rules, policyRule{APIGroups: []string{"batch"}, Resources: []string{"jobs"}, Verbs: []string{"get", "create"}})
+	if in.configMapState || in.cfg.SnapshotConfig {
+		rules = append(rules, policyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "create", "update"}})
+	}
+	if in.cfg.SnapshotConfig {
+		rules = append(rules, policyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get", "create", "update"}})
+	}
+	if sas := in.impersonated("serviceAccount"); len(sas) > 0 {
+		rules = append(rules, policyRule{APIGroups: []string{""}, Resources: []string{"serviceaccounts"}, ResourceNames: sas, Verbs: []string{"impersonate"}})
+	}
+	return rules
+}
+
+// clusterRules returns the permissions the controller needs that aren't
+// about a namespace, when it only reconciles one.
+func (in *installation) clusterRules() []policyRule {
+	var rules []policyRule
+	if users := in.impersonated("user"); len(users) > 0 {
+		rules = append(rules, policyRule{APIGroups: []string{""}, Resources: []string{"users"}, ResourceNames: users, Verbs: []string{"impersonate"}})
+	}
+	if groups := in.impersonated("group"); len(groups) > 0 {
+		rules = append(rules, policyRule{APIGroups: []string{""}, Resources: []string{"groups"}, ResourceNames: groups, Verbs: []string{"impersonate"}})
+	}
+	return rules
+}
+
+// impersonated returns the sorted names of the users, groups, or service
+// accounts the impersonate setting names.
+func (in *installation) impersonated(kind string) []string {
+	seen := make(map[string]bool)
+	for _, i := range in.cfg.Impersonate {
+		switch kind {
+		case "user":
+			if i.User != "" {
+				seen[i.User] = true
+			}
+		case "group":
+			for _, g := range i.Groups {
+				seen[g] = true
+			}
+		case "serviceAccount":
+			if i.ServiceAccount != "" {
+				seen[i.ServiceAccount] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// role returns a Role, or ClusterRole if namespace is empty, and its binding
+// to the controller's ServiceAccount.
+func (in *installation) role(namespace, name string, rules []policyRule, labels map[string]string) []object {
+	kind, bindingKind := "ClusterRole", "ClusterRoleBinding"
+	if namespace != "" {
+		kind, bindingKind = "Role", "RoleBinding"
+	}
+	role := newObject("rbac.authorization.k8s.io/v1", kind, namespace, name, labels)
+	role["rules"] = rules
+	binding := newObject("rbac.authorization.k8s.io/v1", bindingKind, namespace, name, labels)
+	binding["roleRef"] = object{"apiGroup": "rbac.authorization.k8s.io", "kind": kind, "name": name}
+	binding["subjects"] = []object{{"kind": "ServiceAccount", "name": in.name, "namespace": in.namespace}}
+	return []object{role, binding}
+}
+
+// objects returns the manifests of the installation, in the order they
+// should be applied.
+func (in *installation) objects() ([]object, error) {
+	labels := map[string]string{"app.kubernetes.io/name": in.name}
+	var objs []object
+	if !isSystemNamespace(in.namespace) {
+		objs = append(objs, newObject("v1", "Namespace", "", in.namespace, labels))
+	}
+	objs = append(objs, newObject("v1", "ServiceAccount", in.namespace, in.name, labels))
+
+	if in.scope == "" {
+		objs = append(objs, in.role("", in.name, append(in.rules(), in.clusterRules()...), labels)...)
+	} else {
+		objs = append(objs, in.role(in.scope, in.name, in.rules(), labels)...)
+		if rules := in.clusterRules(); len(rules) > 0 {
+			objs = append(objs, in.role("", in.name+"-"+in.scope, rules, labels)...)
+		}
+	}
+	if cm := in.cfg.NotifyTemplatesConfigMap; cm != "" {
+		// Checked by validate.
+		parts := strings.SplitN(cm, "/", 2)
+		objs = append(objs, in.role(parts[0], in.name+"-templates", []policyRule{
+			{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{parts[1]}, Verbs: []string{"get"}},
+		}, labels)...)
+	}
+
+	args := append([]string{"run"}, in.args...)
+	container := object{
+		"name":  "controller",
+		"image": in.image,
+		"env": []object{
+			{"name": envPodName, "valueFrom": object{"fieldRef": object{"fieldPath": "metadata.name"}}},
+			{"name": envPodNamespace, "valueFrom": object{"fieldRef": object{"fieldPath": "metadata.namespace"}}},
+		},
+	}
+	podSpec := object{"serviceAccountName": in.name, "containers": []object{container}}
+	if in.configFile != nil {
+		cm := newObject("v1", "ConfigMap", in.namespace, in.name+"-config", labels)
+		cm["data"] = map[string]string{installConfigFile: string(in.configFile)}
+		objs = append(objs, cm)
+
+		args = append(args, "--config="+installConfigDir+"/"+installConfigFile)
+		container["volumeMounts"] = []object{{"name": "config", "mountPath": installConfigDir, "readOnly": true}}
+		podSpec["volumes"] = []object{{"name": "config", "configMap": object{"name": in.name + "-config"}}}
+	}
+	container["args"] = args
+
+	var port int
+	if in.httpAddr != "" {
+		_, p, err := net.SplitHostPort(in.httpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --http-addr: %v", err)
+		}
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid --http-addr: port must be a number")
+		}
+		container["ports"] = []object{{"name": "http", "containerPort": port}}
+		container["readinessProbe"] = object{"httpGet": object{"path": "/metrics", "port": "http"}}
+	}
+
+	deployment := newObject("apps/v1", "Deployment", in.namespace, in.name, labels)
+	deployment["spec"] = object{
+		// The controller doesn't elect a leader, so only one can run.
+		"replicas": 1,
+		"strategy": object{"type": "Recreate"},
+		"selector": object{"matchLabels": labels},
+		"template": object{
+			"metadata": object{"labels": labels},
+			"spec":     podSpec,
+		},
+	}
+	objs = append(objs, deployment)
+
+	if port != 0 {
+		svc := newObject("v1", "Service", in.namespace, in.name, labels)
+		svc["metadata"].(object)["annotations"] = map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   strconv.Itoa(port),
+		}
+		svc["spec"] = object{
+			"selector": labels,
+			"ports":    []object{{"name": "http", "port": port, "targetPort": "http"}},
+		}
+		objs = append(objs, svc)
+	}
+	return objs, nil
+}
+
+func isSystemNamespace(namespace string) bool {
+	if namespace == "default" {
+		return true
+	}
+	for _, ns := range defaultSystemNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// manifests returns the installation's objects as a stream of YAML
+// documents.
+func (in *installation) manifests() ([]byte, error) {
+	objs, err := in.objects()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for i, obj := range objs {
+		if i > 0 {
+			b.WriteString("---\n")
+		}
+		data, err := toYAML(obj)
+		if err != nil {
+			return nil, fmt.Errorf("encode %s: %v", obj["kind"], err)
+		}
+		b.Write(data)
+	}
+	return b.Bytes(), nil
+}
+
+// Flags of install that aren't passed on to the installed controller.
+var installOnlyFlags = map[string]bool{
+	"install-namespace": true,
+	"name":              true,
+	"image":             true,
+	"apply":             true,
+	"config":            true,
+	"http-addr":         true,
+}
+
+// Flags of run that can't be used by an installed controller, and why.
+var uninstallableFlags = map[string]string{
+	"client":   "the installed controller uses the in-cluster client",
+	"contexts": "install one controller per cluster instead",
+	"once":     "the installed controller runs forever",
+}
+
+// cmdInstall prints, or applies, the manifests to run the controller in a
+// cluster, with permissions for the features its flags and config file
+// enable.
+func cmdInstall(args []string) {
+	var (
+		installNamespace string
+		name             string
+		image            string
+		apply            bool
+	)
+	fs, g, r := newRunFlagSet("install")
+	fs.StringVar(&installNamespace, "install-namespace", "rollback-controller", "Namespace to install the controller in. It's created if it doesn't exist. Flags other than --install-namespace, --name, --image, --apply, and --config are passed to the installed controller.")
+	fs.StringVar(&name, "name", "kube-rollback-controller", "Name of the controller's Deployment, ServiceAccount, and RBAC objects.")
+	fs.StringVar(&image, "image", "", "Image of the controller. Required.")
+	fs.BoolVar(&apply, "apply", false, "Apply the manifests with kubectl, instead of printing them.")
+	fs.Parse(args)
+
+	l := log.New(os.Stderr, "", 0)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if image == "" {
+		l.Fatal("--image is required")
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for flagName, why := range uninstallableFlags {
+		if set[flagName] {
+			l.Fatalf("--%s can't be used with install: %s", flagName, why)
+		}
+	}
+	if (g.namespace != "") == r.allNamespaces {
+		l.Fatal("one of --namespace or --all-namespaces is required")
+	}
+
+	cfg, data, err := g.loadConfig()
+	if err != nil {
+		l.Fatal(err)
+	}
+	in := &installation{
+		name:           name,
+		namespace:      installNamespace,
+		image:          image,
+		scope:          g.namespace,
+		cfg:            cfg,
+		configFile:     data,
+		httpAddr:       r.httpAddr,
+		configMapState: r.storeType == stateStoreConfigMap,
+	}
+	if in.httpAddr == "" {
+		in.httpAddr = installHTTPAddr
+	}
+	in.args = append(in.args, "--http-addr="+in.httpAddr)
+	fs.Visit(func(f *flag.Flag) {
+		if !installOnlyFlags[f.Name] {
+			in.args = append(in.args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+
+	manifests, err := in.manifests()
+	if err != nil {
+		l.Fatal(err)
+	}
+	if !apply {
+		os.Stdout.Write(manifests)
+		return
+	}
+	cmd := exec.Command("kubectl", "apply", "-f", "-")
+	cmd.Stdin = bytes.NewReader(manifests)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		l.Fatalf("kubectl apply failed: %v", err)
+	}
+}
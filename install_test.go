@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// grants reports whether any of rules allows a verb on a resource.
+func grants(rules []policyRule, group, resource, verb string) bool {
+	for _, r := range rules {
+		if stringsContain(r.APIGroups, group) && stringsContain(r.Resources, resource) && stringsContain(r.Verbs, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInstallRules(t *testing.T) {
+	type permission struct{ group, resource, verb string }
+	var (
+		patchReplicaSets = permission{"extensions", "replicasets", "patch"}
+		patchStatus      = permission{"extensions", "deployments/status", "patch"}
+		createJobs       = permission{"batch", "jobs", "create"}
+		updateConfigMaps = permission{"", "configmaps", "update"}
+		updateSecrets    = permission{"", "secrets", "update"}
+		listNamespaces   = permission{"", "namespaces", "list"}
+	)
+	tests := []struct {
+		name           string
+		cfg            *config
+		scope          string
+		configMapState bool
+
+		want    []permission
+		wantNot []permission
+	}{
+		{
+			name: "defaults",
+			cfg:  &config{},
+			// Any deployment can enable verification with an annotation.
+			want:    []permission{createJobs, listNamespaces},
+			wantNot: []permission{patchReplicaSets, patchStatus, updateConfigMaps, updateSecrets},
+		},
+		{
+			name:    "single namespace",
+			cfg:     &config{},
+			scope:   "team-a",
+			wantNot: []permission{listNamespaces},
+		},
+		{
+			name: "scale down failed ReplicaSet",
+			cfg:  &config{ScaleDownFailedReplicaSet: true},
+			want: []permission{patchReplicaSets},
+		},
+		{
+			name: "status condition",
+			cfg:  &config{StatusCondition: true},
+			want: []permission{patchStatus},
+		},
+		{
+			name: "verify job",
+			cfg:  &config{VerifyJob: "smoke-test"},
+			want: []permission{createJobs},
+		},
+		{
+			name:           "ConfigMap state",
+			cfg:            &config{},
+			configMapState: true,
+			want:           []permission{updateConfigMaps},
+			wantNot:        []permission{updateSecrets},
+		},
+		{
+			name: "snapshot config",
+			cfg:  &config{SnapshotConfig: true},
+			want: []permission{updateConfigMaps, updateSecrets},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := &installation{cfg: test.cfg, scope: test.scope, configMapState: test.configMapState}
+			rules := in.rules()
+			for _, p := range test.want {
+				if !grants(rules, p.group, p.resource, p.verb) {
+					t.Errorf("%s %s isn't granted", p.verb, p.resource)
+				}
+			}
+			for _, p := range test.wantNot {
+				if grants(rules, p.group, p.resource, p.verb) {
+					t.Errorf("%s %s is granted", p.verb, p.resource)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallClusterRules(t *testing.T) {
+	in := &installation{
+		name:      "kube-rollback-controller",
+		namespace: "rollback-controller",
+		scope:     "team-a",
+		cfg: &config{Impersonate: map[string]*impersonation{
+			"team-a": {User: "alice", Groups: []string{"deployers"}},
+		}},
+	}
+	objs, err := in.objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, obj := range objs {
+		kinds = append(kinds, obj["kind"].(string))
+	}
+	// A namespaced Role, and a ClusterRole for impersonating users and
+	// groups, which aren't namespaced.
+	want := []string{"Namespace", "ServiceAccount", "Role", "RoleBinding", "ClusterRole", "ClusterRoleBinding", "Deployment"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("got objects %q, want %q", kinds, want)
+	}
+	if rules := objs[4]["rules"].([]policyRule); grants(rules, "extensions", "deployments", "patch") {
+		t.Errorf("ClusterRole of a single namespace installation grants patching deployments")
+	}
+	if rules := objs[2]["rules"].([]policyRule); grants(rules, "", "users", "impersonate") {
+		t.Errorf("Role grants impersonating users")
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/ericchiang/k8s"
@@ -19,6 +21,11 @@ import (
 
 // Has a deployment gone over its progress deadline?
 func deploymentFailed(d *v1beta1.Deployment) bool {
+	// Conditions describe the spec of the observed generation. If the
+	// deployment has been updated since, they're stale.
+	if d.Status.GetObservedGeneration() < d.Metadata.GetGeneration() {
+		return false
+	}
 	eq := func(s *string, to string) bool {
 		return s != nil && *s == to
 	}
@@ -37,53 +44,440 @@ func deploymentFailed(d *v1beta1.Deployment) bool {
 // rollbackController is a controller that auto-rolls back any
 // deployment that's been marked as failed.
 type rollbackController struct {
-	client *k8s.Client
+	api    deploymentAPI
 	logger *log.Logger
+
+	// Namespace to reconcile deployments in, or "" for all namespaces.
+	namespace string
+
+	// Name of the cluster when running against multiple clusters, included
+	// in metrics, notifications, and the admin API.
+	cluster string
+
+	// Current settings, and the values derived from them. Set by configure.
+	cfg      *config
+	notifier notifier
+	git      gitHost
+	plugins  map[string]pluginCaller
+
+	// Detectors are consulted in order to decide if a deployment has failed.
+	detectors []detector
+
+	// State reported by the admin API.
+	status statusTracker
+
+	// Persists state across restarts, if set.
+	store stateStore
+
+	// Records every decision, if set.
+	auditLog *auditLog
+
+	// Returns the time decisions are made at, see now. Nil means the wall
+	// clock.
+	clock func() time.Time
+
+	// The controller's own deployment, see findSelf. Only used by run.
+	self selfDeployment
+
+	// Events that have already been handled, and when, see once, when
+	// deployments were first seen failing, see confirmed, recent automatic
+	// rollbacks in each namespace, see spendBudget, the state last saved of
+	// each namespace loaded from the store, and the default annotations of
+	// each namespace, see annotation, and rollbacks being verified, see
+	// checkVerification.
+	mu                sync.Mutex
+	handled           map[handledKey]time.Time
+	failingSince      map[string]failingSince
+	budgets           map[string][]time.Time
+	savedState        map[string][]byte
+	namespaceDefaults map[string]map[string]string
+	verifications     map[string]*verification
+
+	// Notification templates from the config file, and from the
+	// notifyTemplatesConfigMap, see template.
+	fileTemplates      map[string]*template.Template
+	configMapTemplates map[string]*template.Template
+}
+
+// failingSince records when a revision of a deployment was first seen
+// failing.
+type failingSince struct {
+	revision int64
+	since    time.Time
+}
+
+// handledKey identifies an event of a kind for a revision of a deployment.
+// Deployments are identified by UID, so a deployment that's deleted and
+// recreated with the same name starts over.
+type handledKey struct {
+	namespace string
+	uid       string
+	revision  int64
+	kind      string
+}
+
+func handledKeyFor(kind string, d *v1beta1.Deployment) handledKey {
+	uid := d.Metadata.GetUid()
+	if uid == "" {
+		uid = d.Metadata.GetName()
+	}
+	return handledKey{d.Metadata.GetNamespace(), uid, revision(d.Metadata.GetAnnotations()), kind}
+}
+
+// now returns the current time. Simulations set clock to the time their
+// snapshot was taken.
+func (c *rollbackController) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// once reports if this is the first time an event of the given kind has
+// happened for a deployment's current revision. It's used to avoid sending
+// the same notification every time a failed deployment is seen. Events that
+// were handled are saved with the rest of the controller's state, so a
+// restarted controller doesn't handle them again.
+func (c *rollbackController) once(kind string, d *v1beta1.Deployment) bool {
+	key := handledKeyFor(kind, d)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.handled[key]; ok {
+		return false
+	}
+	if c.handled == nil {
+		c.handled = make(map[handledKey]time.Time)
+	}
+	c.handled[key] = c.now().UTC()
+	return true
+}
+
+// forget undoes once, so the next event of the given kind for the
+// deployment's current revision is handled again.
+func (c *rollbackController) forget(kind string, d *v1beta1.Deployment) {
+	key := handledKeyFor(kind, d)
+
+	c.mu.Lock()
+	delete(c.handled, key)
+	c.mu.Unlock()
 }
 
-// run causes the rollback controller to scan through all deployments,
-// and roll back failed ones. It does not loop, and returns any errors
-// that API calls encounter.
-func (c *rollbackController) run(ctx context.Context) error {
-	deployments, err := c.client.ExtensionsV1Beta1().ListDeployments(ctx, c.client.Namespace)
+// confirmed reports if a deployment has been failing for at least the
+// configured confirmation delay. Conditions like ProgressDeadlineExceeded can
+// flap when nodes are slow to pull images, so a failure must still be
+// detected after the delay before the deployment is handled.
+func (c *rollbackController) confirmed(d *v1beta1.Deployment, now time.Time) bool {
+	if c.cfg.ConfirmationDelay.Duration <= 0 {
+		return true
+	}
+	key := d.Metadata.GetNamespace() + "/" + d.Metadata.GetName()
+	rev := revision(d.Metadata.GetAnnotations())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.failingSince[key]
+	if !ok || f.revision != rev {
+		if c.failingSince == nil {
+			c.failingSince = make(map[string]failingSince)
+		}
+		f = failingSince{revision: rev, since: now}
+		c.failingSince[key] = f
+	}
+	return now.Sub(f.since) >= c.cfg.ConfirmationDelay.Duration
+}
+
+// recovered forgets when a deployment that's no longer failing was first seen
+// failing.
+func (c *rollbackController) recovered(d *v1beta1.Deployment) {
+	c.mu.Lock()
+	delete(c.failingSince, d.Metadata.GetNamespace()+"/"+d.Metadata.GetName())
+	c.mu.Unlock()
+}
+
+// run causes the rollback controller to scan through every kind of resource
+// enabled by the resources setting, and roll back failed objects. It does
+// not loop, and returns any errors that API calls encounter.
+func (c *rollbackController) run(ctx context.Context) (err error) {
+	ctx, s := startSpan(ctx, "run", "k8s.cluster.name", c.cluster, "k8s.namespace.name", c.namespace)
+	defer func() { s.finish(err) }()
+
+	var errs []string
+	for _, kind := range c.cfg.Resources {
+		if err := reconcilers[kind].reconcileAll(ctx, c); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", kind, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reconcileDeployments scans through all deployments, and rolls back failed
+// ones. Deployments are reconciled concurrently by a pool of workers.
+func (c *rollbackController) reconcileDeployments(ctx context.Context) (err error) {
+	ctx, s := startSpan(ctx, "reconcile deployments")
+	defer func() { s.finish(err) }()
+
+	deployments, err := c.api.listDeployments(ctx, c.namespace)
 	if err != nil {
 		return fmt.Errorf("list deployments: %v", err)
 	}
 
+	replicaSets, err := c.api.listReplicaSets(ctx, c.namespace)
+	if err != nil {
+		return fmt.Errorf("list replica sets: %v", err)
+	}
+
+	if c.store != nil {
+		c.loadState(ctx, deploymentNamespaces(deployments))
+	}
+	c.findSelf(ctx, replicaSets)
+	c.loadNamespaceDefaults(ctx)
+	c.loadTemplates(ctx)
+
+	q := newWorkQueue()
+	for _, d := range deployments {
+		q.add(d)
+	}
+	q.shutDown()
+
 	var (
-		toUpdate []*v1beta1.Deployment
-		failed   int
+		wg sync.WaitGroup
+
+		mu         sync.Mutex
+		failed     []*deploymentStatus
+		rolledBack int
+		errs       []error
+		errStatus  []*reconcileError
 	)
-	for _, d := range deployments.Items {
-		if !deploymentFailed(d) {
-			continue
-		}
+	workers := c.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				d, ok := q.get()
+				if !ok {
+					return
+				}
+				status, err := c.reconcile(ctx, d, replicaSets)
+				if err != nil {
+					c.logger.Printf("reconcile deployment %s: %v", *d.Metadata.Name, err)
+					metricErrors.inc(c.metricLabels(d)...)
+					c.audit(d, decisionError, err.Error())
+				}
+				if err := c.reportCondition(ctx, d, status); err != nil {
+					c.logger.Printf("report condition of deployment %s: %v", *d.Metadata.Name, err)
+				}
+				q.done(d)
 
-		failed++
-		if d.Spec.RollbackTo == nil {
-			toUpdate = append(toUpdate, d)
+				mu.Lock()
+				if status != nil {
+					failed = append(failed, status)
+					if status.State != stateFailed && status.State != stateConfirming && status.State != stateWaiting {
+						rolledBack++
+					}
+				}
+				if err != nil {
+					errs = append(errs, err)
+					errStatus = append(errStatus, &reconcileError{
+						Cluster:   c.cluster,
+						Namespace: d.Metadata.GetNamespace(),
+						Name:      d.Metadata.GetName(),
+						Error:     err.Error(),
+					})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	c.status.setFailed(failed)
+	c.status.setErrors(errStatus)
+	c.pruneHandled()
+	if c.store != nil {
+		if err := c.saveState(ctx); err != nil {
+			c.logger.Printf("%v", err)
 		}
 	}
+	s.setAttr("deployments", strconv.Itoa(len(deployments)))
+	s.setAttr("failed", strconv.Itoa(len(failed)))
 
 	c.logger.Printf("deployments=%d, failed=%d, rolled back=%d",
-		len(deployments.Items), failed, failed-len(toUpdate))
+		len(deployments), len(failed), rolledBack)
+	if len(errs) > 0 {
+		return fmt.Errorf("%d deployment(s) failed to reconcile, first error: %v", len(errs), errs[0])
+	}
+	return nil
+}
 
-	for _, d := range toUpdate {
-		var lastRevision int64 = 0
-		d.Spec.RollbackTo = &v1beta1.RollbackConfig{
-			Revision: &lastRevision,
+// reconcile checks a single deployment for failures, and handles it if it's
+// failed. It returns the deployment's status, or nil if it's healthy.
+func (c *rollbackController) reconcile(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (status *deploymentStatus, err error) {
+	ctx = c.impersonating(ctx, d.Metadata.GetNamespace())
+	ctx, s := c.startDeploymentSpan(ctx, "reconcile", d)
+	defer func() {
+		if status != nil {
+			s.setAttr("state", status.State)
 		}
-		if _, err := c.client.ExtensionsV1Beta1().UpdateDeployment(ctx, d); err != nil {
-			return fmt.Errorf("update deployment: %v", err)
+		s.finish(err)
+	}()
+
+	// Deployments paused by a human are never rolled back automatically,
+	// whether or not they've failed.
+	if d.Spec.GetPaused() && !pausedByController(d) {
+		if c.once("paused", d) {
+			c.logger.Printf("skipping paused deployment: %s", *d.Metadata.Name)
 		}
-		c.logger.Printf("rolled back deployment: %s", *d.Metadata.Name)
+		return nil, nil
 	}
-	return nil
+	enabled, err := c.enabled(d)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, nil
+	}
+	if err := c.checkVerification(ctx, d, c.now()); err != nil {
+		return nil, fmt.Errorf("verify rollback: %v", err)
+	}
+
+	failed, reason, err := c.detect(ctx, d, replicaSets)
+	if err != nil {
+		return nil, fmt.Errorf("detect failure: %v", err)
+	}
+	if !failed {
+		c.recovered(d)
+		if err := c.snapshotConfig(ctx, d, replicaSets); err != nil {
+			return nil, err
+		}
+		return nil, c.recordGoodImages(ctx, d)
+	}
+
+	ctx = withFailureReason(ctx, reason)
+
+	if state := handledState(d); state != "" {
+		return c.newDeploymentStatus(d, reason, state), nil
+	}
+	now := c.now()
+	_, quarantined := quarantinedSince(d, c.cfg.Quarantine.Duration, now)
+	if !quarantined && !c.confirmed(d, now) {
+		return c.newDeploymentStatus(d, reason, stateConfirming), nil
+	}
+	status = c.newDeploymentStatus(d, reason, stateFailed)
+
+	if c.once("failure", d) {
+		c.logger.Printf("deployment failed: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), reason)
+		metricFailures.inc(c.metricLabels(d)...)
+		c.audit(d, decisionDetected, reason)
+	}
+
+	if owner := c.skippedOwner(d); owner != "" {
+		c.skipOwned(ctx, d, reason, owner)
+		return status, nil
+	}
+
+	strategy, err := c.strategyFor(d)
+	if err != nil {
+		return status, err
+	}
+	// Deployments that chose a strategy keep it whatever the failure.
+	if _, ok := d.Metadata.GetAnnotations()[annotationStrategy]; !ok && len(c.cfg.FailureClasses) > 0 {
+		class, err := c.classify(ctx, d, replicaSets)
+		if err != nil {
+			return status, fmt.Errorf("classify failure: %v", err)
+		}
+		status.Class = class
+		if action, ok := c.cfg.FailureClasses[class]; ok {
+			if action == classActionWait {
+				if c.once("wait", d) {
+					c.logger.Printf("waiting on deployment: %s region=%q: failure classified as %s", *d.Metadata.Name, c.regionOf(d), class)
+				}
+				status.State = stateWaiting
+				return status, nil
+			}
+			strategy = action
+			status.Strategy = action
+		}
+	}
+	// Rolling back the controller's own deployment during an upgrade could
+	// leave nothing running to roll it forward again.
+	if c.isSelf(d) && !c.cfg.AllowSelfRollback && strategy != strategyNotifyOnly {
+		if c.once("self", d) {
+			c.logger.Printf("not handling deployment: %s region=%q: it's the controller's own deployment", *d.Metadata.Name, c.regionOf(d))
+		}
+		strategy = strategyNotifyOnly
+		status.Strategy = strategy
+	}
+	if strategy != strategyNotifyOnly {
+		ok, err := c.checkRegionPolicy(ctx, d, reason)
+		if err != nil {
+			return status, fmt.Errorf("check region policy: %v", err)
+		}
+		if !ok {
+			return status, nil
+		}
+		ok, err = c.checkWindows(ctx, d, reason, now)
+		if err != nil {
+			return status, fmt.Errorf("check time windows: %v", err)
+		}
+		if !ok {
+			return status, nil
+		}
+	}
+	if strategy == strategyRollback || strategy == strategyImage {
+		ok, err := c.checkCooldown(ctx, d, reason, now)
+		if err != nil {
+			return status, fmt.Errorf("check cooldown: %v", err)
+		}
+		if !ok {
+			return status, nil
+		}
+	}
+
+	f := &failure{d: d, reason: reason, replicaSets: replicaSets}
+	hctx, hs := c.startDeploymentSpan(ctx, strategy, d)
+	err = strategies[strategy](c, hctx, f)
+	hs.finish(err)
+	if modified, ok := err.(*modifiedError); ok {
+		c.aborted(ctx, d, strategy, modified)
+		return status, nil
+	}
+	if err != nil {
+		return status, fmt.Errorf("%s: %v", strategy, err)
+	}
+	// The strategy updated d, so report what it did in this pass rather
+	// than the next.
+	if state := handledState(d); state != "" {
+		status.State = state
+	}
+	return status, nil
+}
+
+// handledState returns the state of a failed deployment that has already been
+// handled, because it's being rolled back, or has been paused by the
+// controller or scaled down.
+// It returns "" if the deployment still needs to be handled.
+func handledState(d *v1beta1.Deployment) string {
+	switch {
+	case d.Spec.RollbackTo != nil:
+		return stateRollingBack
+	case d.Spec.GetPaused():
+		return statePaused
+	case d.Spec.GetReplicas() == 0:
+		return stateScaledDown
+	}
+	return ""
 }
 
-// Convenience for development. Use kubectl's current context to
-// fill out a client config.
-func kubectlClient() (*k8s.Client, error) {
+// Convenience for development. Use kubectl's current context, or the named
+// context if non-empty, to fill out a client config.
+func kubectlClient(kubeContext string) (*k8s.Client, error) {
 	stderr := new(bytes.Buffer)
 	stdout := new(bytes.Buffer)
 	cmd := exec.Command("kubectl", "config", "view", "--raw", "-o", "json")
@@ -100,6 +494,9 @@ func kubectlClient() (*k8s.Client, error) {
 	if err := json.Unmarshal(stdout.Bytes(), config); err != nil {
 		return nil, fmt.Errorf("invalid output for kubectl config view: %v", err)
 	}
+	if kubeContext != "" {
+		config.CurrentContext = kubeContext
+	}
 
 	return k8s.NewClient(config)
 }
@@ -109,39 +506,49 @@ const (
 	clientKubectl   = "kubectl"
 )
 
-func main() {
-	var (
-		clientType string
-	)
-	flag.StringVar(&clientType, "client", clientInCluster, "Strategy for initializing the Kubernetes client. Either uses 'in-cluster' or grabs current context with 'kubectl'.")
-	flag.Parse()
+const usage = `Usage: kube-rollback-controller [command] [flags]
 
-	l := log.New(os.Stderr, "", log.LstdFlags)
+Commands:
+  run                    Run the controller, rolling back failed deployments (default).
+  status                 List failed deployments.
+  rollback <deployment>  Roll back a deployment to its previous revision.
+  pause <deployment>     Pause a deployment.
+  webhook                Run the admission webhook that records last known good revisions.
+  simulate <directory>   Show what the controller would do with a snapshot of manifests.
+  export                 Dump the audit log written by run --audit-log as JSON or CSV.
+  install                Print or apply the manifests to run the controller in a cluster.
 
-	var (
-		client *k8s.Client
-		err    error
-	)
-	switch clientType {
-	case clientInCluster:
-		if client, err = k8s.NewInClusterClient(); err != nil {
-			l.Fatalf("initialize in-cluster client: %v", err)
-		}
-	case clientKubectl:
-		if client, err = kubectlClient(); err != nil {
-			l.Fatalf("initialize client from kubectl: %v", err)
-		}
-	default:
-		l.Fatalf("unrecognized client type: %s", clientType)
-	}
+Run "kube-rollback-controller <command> -h" for a command's flags.
+`
 
-	// Start the rollback controller and run forever.
-	c := rollbackController{client: client, logger: l}
-	for {
-		if err := c.run(context.Background()); err != nil {
-			l.Printf("running rollbackController: %v", err)
-		}
+func main() {
+	args := os.Args[1:]
+	cmd := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
-		time.Sleep(2 * time.Second)
+	switch cmd {
+	case "run":
+		cmdRun(args)
+	case "status":
+		cmdStatus(args)
+	case "rollback":
+		cmdRollback(args)
+	case "pause":
+		cmdPause(args)
+	case "webhook":
+		cmdWebhook(args)
+	case "simulate":
+		cmdSimulate(args)
+	case "export":
+		cmdExport(args)
+	case "install":
+		cmdInstall(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
 	}
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/unversioned"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// testDeployment returns a deployment in the default namespace at a
+// revision, running the image "<name>:v<revision>", and if failed, with a
+// status reporting ProgressDeadlineExceeded.
+func testDeployment(name string, rev int64, failed bool) *v1beta1.Deployment {
+	generation := rev
+	labels := map[string]string{"app": name}
+	d := &v1beta1.Deployment{
+		Metadata: &v1.ObjectMeta{
+			Name:        k8s.String(name),
+			Namespace:   k8s.String("default"),
+			Uid:         k8s.String("uid-" + name),
+			Generation:  &generation,
+			Annotations: map[string]string{revisionAnnotation: strconv.FormatInt(rev, 10)},
+			Labels:      labels,
+		},
+		Spec: &v1beta1.DeploymentSpec{
+			Replicas: int32Ptr(2),
+			Selector: &unversioned.LabelSelector{MatchLabels: labels},
+			Template: testTemplate(name, rev),
+		},
+		Status: &v1beta1.DeploymentStatus{
+			ObservedGeneration: &generation,
+		},
+	}
+	if failed {
+		d.Status.Conditions = []*v1beta1.DeploymentCondition{{
+			Type:   k8s.String("Progressing"),
+			Status: k8s.String("False"),
+			Reason: k8s.String("ProgressDeadlineExceeded"),
+		}}
+	}
+	return d
+}
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func testTemplate(name string, rev int64) *v1.PodTemplateSpec {
+	return &v1.PodTemplateSpec{
+		Metadata: &v1.ObjectMeta{Labels: map[string]string{"app": name}},
+		Spec: &v1.PodSpec{
+			Containers: []*v1.Container{{
+				Name:  k8s.String(name),
+				Image: k8s.String(name + ":v" + strconv.FormatInt(rev, 10)),
+			}},
+		},
+	}
+}
+
+// testReplicaSet returns a ready ReplicaSet of a revision of a deployment,
+// running the same image as testDeployment at that revision.
+func testReplicaSet(d *v1beta1.Deployment, rev int64) *v1beta1.ReplicaSet {
+	name := d.Metadata.GetName()
+	return &v1beta1.ReplicaSet{
+		Metadata: &v1.ObjectMeta{
+			Name:        k8s.String(name + "-" + strconv.FormatInt(rev, 10)),
+			Namespace:   d.Metadata.Namespace,
+			Annotations: map[string]string{revisionAnnotation: strconv.FormatInt(rev, 10)},
+			Labels:      map[string]string{podTemplateHashLabel: "hash-" + strconv.FormatInt(rev, 10)},
+			OwnerReferences: []*v1.OwnerReference{{
+				Kind:       k8s.String("Deployment"),
+				Name:       d.Metadata.Name,
+				Uid:        d.Metadata.Uid,
+				Controller: k8s.Bool(true),
+			}},
+		},
+		Spec: &v1beta1.ReplicaSetSpec{
+			Replicas: int32Ptr(2),
+			Template: testTemplate(name, rev),
+		},
+		Status: &v1beta1.ReplicaSetStatus{
+			Replicas:      int32Ptr(2),
+			ReadyReplicas: int32Ptr(2),
+		},
+	}
+}
+
+// newTestController returns a controller using the fake API, configured by
+// the given flags.
+func newTestController(t *testing.T, f *fakeAPI, args ...string) *rollbackController {
+	fs, g := newFlagSet("test", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := g.baseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &rollbackController{api: f, logger: log.New(ioutil.Discard, "", 0)}
+	c.configure(cfg)
+	return c
+}
+
+// actions returns the actions recorded for a deployment, oldest first.
+func (c *rollbackController) actions(name string) []string {
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	var actions []string
+	for _, r := range c.status.records {
+		if r.Deployment == name {
+			actions = append(actions, r.Action)
+		}
+	}
+	return actions
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name string
+		// Flags and the deployment's annotations.
+		args        []string
+		annotations map[string]string
+		failed      bool
+		paused      bool
+		// Revisions with ReplicaSets, other than the current one.
+		previous []int64
+
+		wantState      string
+		wantActions    []string
+		wantRollbackTo int64
+		wantPaused     bool
+		wantReplicas   int32
+	}{
+		{
+			name:         "healthy",
+			previous:     []int64{1},
+			wantReplicas: 2,
+		},
+		{
+			name:           "rollback",
+			wantState:      stateRollingBack,
+			failed:         true,
+			previous:       []int64{1},
+			wantActions:    []string{"rollback"},
+			wantRollbackTo: 1,
+			wantReplicas:   2,
+		},
+		{
+			name:           "rollback to previous revision",
+			wantState:      stateRollingBack,
+			failed:         true,
+			previous:       []int64{1, 2},
+			wantActions:    []string{"rollback"},
+			wantRollbackTo: 2,
+			wantReplicas:   2,
+		},
+		{
+			name:         "no rollback target",
+			wantState:    stateFailed,
+			failed:       true,
+			wantActions:  []string{"no-rollback-target"},
+			wantReplicas: 2,
+		},
+		{
+			name:         "confirming",
+			wantState:    stateConfirming,
+			args:         []string{"--confirmation-delay=1h"},
+			failed:       true,
+			previous:     []int64{1},
+			wantReplicas: 2,
+		},
+		{
+			name:         "paused by a human",
+			failed:       true,
+			paused:       true,
+			previous:     []int64{1},
+			wantPaused:   true,
+			wantReplicas: 2,
+		},
+		{
+			name:         "pause strategy",
+			wantState:    statePaused,
+			annotations:  map[string]string{annotationStrategy: strategyPause},
+			failed:       true,
+			previous:     []int64{1},
+			wantActions:  []string{"pause"},
+			wantPaused:   true,
+			wantReplicas: 2,
+		},
+		{
+			name:         "scale to zero strategy",
+			wantState:    stateScaledDown,
+			args:         []string{"--default-strategy=scale-to-zero"},
+			failed:       true,
+			previous:     []int64{1},
+			wantActions:  []string{"scale-to-zero"},
+			wantReplicas: 0,
+		},
+		{
+			name:         "notify only strategy",
+			wantState:    stateFailed,
+			annotations:  map[string]string{annotationStrategy: strategyNotifyOnly},
+			failed:       true,
+			previous:     []int64{1},
+			wantActions:  []string{"notify"},
+			wantReplicas: 2,
+		},
+		{
+			name:         "disabled",
+			annotations:  map[string]string{annotationEnabled: "false"},
+			failed:       true,
+			previous:     []int64{1},
+			wantReplicas: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			d := testDeployment("hello", 3, test.failed)
+			for k, v := range test.annotations {
+				d.Metadata.Annotations[k] = v
+			}
+			if test.paused {
+				d.Spec.Paused = k8s.Bool(true)
+			}
+			f.addDeployment(d)
+			f.addReplicaSet(testReplicaSet(d, 3))
+			for _, rev := range test.previous {
+				f.addReplicaSet(testReplicaSet(d, rev))
+			}
+			c := newTestController(t, f, test.args...)
+
+			if err := c.run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			var state string
+			if len(c.status.failed) > 0 {
+				state = c.status.failed[0].State
+			}
+			if state != test.wantState {
+				t.Errorf("state %q, want %q", state, test.wantState)
+			}
+			// A second pass must not act on the deployment again.
+			if err := c.run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := f.getDeployment(context.Background(), "default", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev := got.Spec.GetRollbackTo().GetRevision(); rev != test.wantRollbackTo {
+				t.Errorf("rolled back to revision %d, want %d", rev, test.wantRollbackTo)
+			}
+			if got.Spec.GetPaused() != test.wantPaused {
+				t.Errorf("paused=%t, want %t", got.Spec.GetPaused(), test.wantPaused)
+			}
+			if got.Spec.GetReplicas() != test.wantReplicas {
+				t.Errorf("replicas=%d, want %d", got.Spec.GetReplicas(), test.wantReplicas)
+			}
+			if actions := c.actions("hello"); !reflect.DeepEqual(actions, test.wantActions) {
+				t.Errorf("actions %q, want %q", actions, test.wantActions)
+			}
+		})
+	}
+}
+
+func TestOnce(t *testing.T) {
+	c := &rollbackController{}
+	d := testDeployment("hello", 1, true)
+	other := testDeployment("other", 1, true)
+
+	if !c.once("failure", d) {
+		t.Fatal("first failure wasn't handled")
+	}
+	if c.once("failure", d) {
+		t.Error("failure was handled twice")
+	}
+	if !c.once("notify", d) {
+		t.Error("event of another kind wasn't handled")
+	}
+	if !c.once("failure", other) {
+		t.Error("failure of another deployment wasn't handled")
+	}
+
+	// A new revision starts over.
+	next := testDeployment("hello", 2, true)
+	if !c.once("failure", next) {
+		t.Error("failure of a new revision wasn't handled")
+	}
+
+	// So does a deployment recreated with the same name.
+	recreated := testDeployment("hello", 1, true)
+	recreated.Metadata.Uid = k8s.String("new-uid")
+	if !c.once("failure", recreated) {
+		t.Error("failure of a recreated deployment wasn't handled")
+	}
+
+	c.forget("failure", d)
+	if !c.once("failure", d) {
+		t.Error("forgotten failure wasn't handled again")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Metrics exported by the controller. Every metric about a deployment is
+// labeled with its cluster and region, see metricLabels.
+var (
+	metricFailures = newCounterVec(
+		"rollback_controller_failures_total",
+		"Number of failed deployment rollouts detected.",
+		"cluster", "namespace", "deployment", "region",
+	)
+	metricActions = newCounterVec(
+		"rollback_controller_actions_total",
+		"Number of actions taken on failed deployments, by action.",
+		"cluster", "namespace", "deployment", "region", "action",
+	)
+	metricNoRollbackTarget = newCounterVec(
+		"rollback_controller_no_rollback_target_total",
+		"Number of failed deployments that couldn't be rolled back because no previous revision exists.",
+		"cluster", "namespace", "deployment", "region",
+	)
+	metricIdenticalRevisions = newCounterVec(
+		"rollback_controller_identical_revisions_skipped_total",
+		"Number of revisions skipped as rollback targets because they have the same pod template as the failed revision.",
+		"cluster", "namespace", "deployment", "region",
+	)
+	metricPDBLimitedScaleDowns = newCounterVec(
+		"rollback_controller_pdb_limited_scale_downs_total",
+		"Number of failed ReplicaSets that PodDisruptionBudgets kept from being scaled down to zero before a rollback.",
+		"cluster", "namespace", "deployment", "region",
+	)
+	metricErrors = newCounterVec(
+		"rollback_controller_errors_total",
+		"Number of errors encountered reconciling deployments.",
+		"cluster", "namespace", "deployment", "region",
+	)
+
+	// Kubernetes API requests, see rateLimitedTransport.
+	metricAPIRequestDuration = newHistogramVec(
+		"rollback_controller_api_request_duration_seconds",
+		"Latency of Kubernetes API requests, by verb, resource, and status code.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		"cluster", "verb", "resource", "code",
+	)
+	metricAPIThrottled = newCounterVec(
+		"rollback_controller_api_throttled_requests_total",
+		"Number of Kubernetes API requests delayed by client-side rate limiting.",
+		"cluster",
+	)
+	metricAPIThrottleSeconds = newCounterVec(
+		"rollback_controller_api_throttle_seconds_total",
+		"Total time Kubernetes API requests were delayed by client-side rate limiting.",
+		"cluster",
+	)
+)
+
+// metricLabels returns the values of the labels shared by every metric about
+// a deployment.
+func (c *rollbackController) metricLabels(d *v1beta1.Deployment) []string {
+	return []string{c.cluster, d.Metadata.GetNamespace(), d.Metadata.GetName(), c.regionOf(d)}
+}
+
+// metrics is the set of all metrics served by metricsHandler.
+var metrics = []metric{
+	metricFailures,
+	metricActions,
+	metricNoRollbackTarget,
+	metricIdenticalRevisions,
+	metricPDBLimitedScaleDowns,
+	metricErrors,
+	metricAPIRequestDuration,
+	metricAPIThrottled,
+	metricAPIThrottleSeconds,
+}
+
+// metric writes itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a Prometheus counter partitioned by a set of labels. No
+// Prometheus client library is vendored, so this implements just enough of
+// the text exposition format to be scraped.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // Keyed by label values joined by '\xff'.
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// inc increments the counter for a set of label values, which must be
+// provided in the same order as the counter's labels.
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+// add adds v to the counter for a set of label values.
+func (c *counterVec) add(v float64, labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+	c.mu.Lock()
+	c.values[strings.Join(labelValues, "\xff")] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, formatLabels(c.labels, strings.Split(k, "\xff")), c.values[k])
+	}
+}
+
+// histogramVec is a Prometheus histogram partitioned by a set of labels.
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64 // Upper bounds, in increasing order.
+	labels  []string
+
+	mu     sync.Mutex
+	values map[string]*histogram // Keyed by label values joined by '\xff'.
+}
+
+type histogram struct {
+	counts []uint64 // Observations per bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, values: map[string]*histogram{}}
+}
+
+// observe records a value for a set of label values, which must be provided
+// in the same order as the histogram's labels.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o, ok := h.values[key]
+	if !ok {
+		o = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = o
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			o.counts[i]++
+			break
+		}
+	}
+	o.count++
+	o.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o := h.values[k]
+		values := strings.Split(k, "\xff")
+		labels := append(append([]string(nil), h.labels...), "le")
+		bucket := func(le string) string {
+			return formatLabels(labels, append(append([]string(nil), values...), le))
+		}
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += o.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket(strconv.FormatFloat(b, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket("+Inf"), o.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, formatLabels(h.labels, values), o.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), o.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricsHandler serves all metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
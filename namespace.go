@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// annotationEnabled opts a deployment in to, or out of, being handled by the
+// controller. With the optIn setting, only deployments that set it to "true"
+// are handled, otherwise only those that set it to "false" are skipped.
+const annotationEnabled = "rollback-controller/enabled"
+
+// Namespaces of cluster components, such as CNI and DNS, excluded by default
+// by the systemNamespaces setting.
+var defaultSystemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// annotationCooldown overrides the cooldown setting for a single deployment.
+const annotationCooldown = "rollback-controller/cooldown"
+
+// Annotations a namespace can set to change the defaults of the deployments
+// in it. A deployment's own annotations take precedence over its
+// namespace's, which take precedence over the controller's settings.
+var namespaceDefaults = []string{
+	annotationEnabled,
+	annotationStrategy,
+	annotationMinAvailable,
+	annotationCooldown,
+	annotationVerifyJob,
+}
+
+// loadNamespaceDefaults reads the default annotations of the namespaces the
+// controller reconciles. If they can't be read, the defaults last read are
+// kept.
+func (c *rollbackController) loadNamespaceDefaults(ctx context.Context) {
+	var namespaces []*v1.Namespace
+	if c.namespace != "" {
+		ns, err := c.api.getNamespace(ctx, c.namespace)
+		if err != nil {
+			c.logger.Printf("get namespace %s: %v", c.namespace, err)
+			return
+		}
+		namespaces = []*v1.Namespace{ns}
+	} else {
+		var err error
+		namespaces, err = c.api.listNamespaces(ctx)
+		if err != nil {
+			c.logger.Printf("list namespaces: %v", err)
+			return
+		}
+	}
+
+	defaults := make(map[string]map[string]string)
+	for _, ns := range namespaces {
+		annotations := ns.Metadata.GetAnnotations()
+		for _, k := range namespaceDefaults {
+			if v, ok := annotations[k]; ok {
+				if defaults[ns.Metadata.GetName()] == nil {
+					defaults[ns.Metadata.GetName()] = make(map[string]string)
+				}
+				defaults[ns.Metadata.GetName()][k] = v
+			}
+		}
+	}
+	c.mu.Lock()
+	c.namespaceDefaults = defaults
+	c.mu.Unlock()
+}
+
+// annotation returns the value of an annotation for a deployment, from the
+// deployment or else its namespace's defaults.
+func (c *rollbackController) annotation(d *v1beta1.Deployment, key string) (string, bool) {
+	if v, ok := d.Metadata.GetAnnotations()[key]; ok {
+		return v, true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.namespaceDefaults[d.Metadata.GetNamespace()][key]
+	return v, ok
+}
+
+// systemNamespace reports if a namespace holds cluster components, which
+// a controller deployed cluster-wide mustn't roll back by accident. A
+// controller whose namespace is set to a system namespace handles it.
+func (c *rollbackController) systemNamespace(namespace string) bool {
+	if c.namespace == namespace {
+		return false
+	}
+	for _, ns := range c.cfg.SystemNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// enabled reports if a deployment should be handled by the controller.
+// Deployments in system namespaces, other than the controller's own, must be
+// enabled explicitly, with the enabled annotation on the deployment or its
+// namespace.
+func (c *rollbackController) enabled(d *v1beta1.Deployment) (bool, error) {
+	v, ok := c.annotation(d, annotationEnabled)
+	if !ok {
+		// The controller still notifies about its own deployment failing,
+		// which is often in a system namespace.
+		if c.systemNamespace(d.Metadata.GetNamespace()) && !c.isSelf(d) {
+			return false, nil
+		}
+		return !c.cfg.OptIn, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation %q", annotationEnabled, v)
+	}
+	return enabled, nil
+}
+
+// cooldownFor returns how long after a rollback a deployment must wait before
+// it's rolled back again.
+func (c *rollbackController) cooldownFor(d *v1beta1.Deployment) (time.Duration, error) {
+	v, ok := c.annotation(d, annotationCooldown)
+	if !ok {
+		return c.cfg.Cooldown.Duration, nil
+	}
+	cooldown, err := time.ParseDuration(v)
+	if err != nil || cooldown < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q", annotationCooldown, v)
+	}
+	return cooldown, nil
+}
+
+// cooldownState returns when a deployment was last rolled back by the
+// controller, and when the cooldown after it ends. Either is zero if unknown,
+// or if the deployment has no cooldown.
+func (c *rollbackController) cooldownState(d *v1beta1.Deployment) (last, until time.Time, err error) {
+	cooldown, err := c.cooldownFor(d)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	last, err = time.Parse(time.RFC3339, d.Metadata.GetAnnotations()[annotationLastRollbackTime])
+	if err != nil {
+		return time.Time{}, time.Time{}, nil
+	}
+	if cooldown == 0 {
+		return last, time.Time{}, nil
+	}
+	return last, last.Add(cooldown), nil
+}
+
+// checkCooldown determines if a failed deployment was rolled back too
+// recently to be rolled back again. If it was, a human is notified once, and
+// it's rolled back once the cooldown ends if it's still failing.
+func (c *rollbackController) checkCooldown(ctx context.Context, d *v1beta1.Deployment, reason string, now time.Time) (bool, error) {
+	last, until, err := c.cooldownState(d)
+	if err != nil || !now.Before(until) {
+		return err == nil, err
+	}
+	cooldown := until.Sub(last)
+	if !c.once("cooldown", d) {
+		return false, nil
+	}
+	msg := fmt.Sprintf("deployment failed (%s) within the %s cooldown after its last rollback at %s, not rolling back until %s",
+		reason, cooldown, last.UTC().Format(time.RFC3339), last.Add(cooldown).UTC().Format(time.RFC3339))
+	c.logger.Printf("not rolling back deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.recordAction(d, "notify", 0, msg)
+	return false, c.notify(ctx, d, "cooldown", severityCritical, msg)
+}
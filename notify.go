@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Severities for notifications.
+const (
+	severityInfo     = "info"
+	severityCritical = "critical"
+)
+
+// notification describes something the controller did, or something it
+// needs a human to look at.
+type notification struct {
+	Cluster    string `json:"cluster,omitempty"`
+	Namespace  string `json:"namespace"`
+	Deployment string `json:"deployment"`
+	Region     string `json:"region,omitempty"`
+	Severity   string `json:"severity"`
+	Message    string `json:"message"`
+
+	// Why the rollout failed, if the notification is about a failure, the
+	// deployment's revision, and the revision it was rolled back to, if it
+	// was.
+	Reason     string `json:"reason,omitempty"`
+	Revision   int64  `json:"revision,omitempty"`
+	ToRevision int64  `json:"toRevision,omitempty"`
+
+	// Identifies the notification, from the deployment's UID and revision
+	// and the kind of event it's about, so receivers can drop a notification
+	// sent again, such as by a controller that restarted before saving that
+	// it had been sent. See notificationKey.
+	Key string `json:"key"`
+
+	// The deployment's labels and annotations, for message templates.
+	Labels      map[string]string `json:"-"`
+	Annotations map[string]string `json:"-"`
+
+	// Why the rollout failed, if known.
+	Diagnostics []*podDiagnostic `json:"diagnostics,omitempty"`
+}
+
+// notifier delivers notifications to on-call engineers.
+type notifier interface {
+	notify(ctx context.Context, n *notification) error
+}
+
+// logNotifier writes notifications to the controller's logs. It's used when
+// no other notifier is configured.
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (l *logNotifier) notify(ctx context.Context, n *notification) error {
+	msg := n.Message
+	if len(n.Diagnostics) > 0 {
+		msg += ": " + summarizeDiagnostics(n.Diagnostics)
+	}
+	l.logger.Printf("notification: severity=%s deployment=%s/%s region=%q: %s",
+		n.Severity, n.Namespace, n.Deployment, n.Region, msg)
+	return nil
+}
+
+// notify sends a notification about an event of a kind, such as "rollback"
+// or "cooldown", for a deployment.
+func (c *rollbackController) notify(ctx context.Context, d *v1beta1.Deployment, kind, severity, msg string) error {
+	return c.send(ctx, c.newNotification(d, kind, severity, msg))
+}
+
+func (c *rollbackController) newNotification(d *v1beta1.Deployment, kind, severity, msg string) *notification {
+	return &notification{
+		Key:         notificationKey(d, kind),
+		Cluster:     c.cluster,
+		Namespace:   d.Metadata.GetNamespace(),
+		Deployment:  d.Metadata.GetName(),
+		Region:      c.regionOf(d),
+		Severity:    severity,
+		Message:     msg,
+		Revision:    revision(d.Metadata.GetAnnotations()),
+		Labels:      d.Metadata.GetLabels(),
+		Annotations: d.Metadata.GetAnnotations(),
+	}
+}
+
+// notificationKey identifies the notification about an event of a kind for
+// a revision of a deployment. Messages include details, such as times, that
+// can differ when the same event is notified about again, so they're left
+// out.
+func notificationKey(d *v1beta1.Deployment, kind string) string {
+	key := handledKeyFor(kind, d)
+	return fmt.Sprintf("%s/%d/%s", key.uid, key.revision, key.kind)
+}
+
+func (c *rollbackController) send(ctx context.Context, n *notification) error {
+	if n.Reason == "" {
+		n.Reason = failureReason(ctx)
+	}
+	ctx, s := startSpan(ctx, "notify", "severity", n.Severity)
+	err := c.notifier.notify(ctx, n)
+	s.finish(err)
+	if err != nil {
+		return fmt.Errorf("notify: %v", err)
+	}
+	return nil
+}
+
+// webhookNotifier POSTs notifications as JSON to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookNotifier) notify(ctx context.Context, n *notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("marshal notification: %v", err)
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("post notification: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("post notification: unexpected status %s", resp.Status)
+	}
+	return nil
+}
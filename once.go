@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// onceSummary is the report printed by run --once of a single reconcile
+// pass, for running the controller as a CronJob or in CI pipelines.
+type onceSummary struct {
+	// Failed deployments as of the pass.
+	Failed []*deploymentStatus `json:"failed"`
+	// Actions taken during the pass.
+	Actions []*rollbackRecord `json:"actions"`
+	// Errors reconciling deployments, such as rollbacks that couldn't be
+	// applied, or reconciling a cluster at all.
+	Errors []*reconcileError `json:"errors"`
+}
+
+// reconcileError is an error handling a deployment. Name is empty for errors
+// that aren't about a single deployment, such as failing to list them.
+type reconcileError struct {
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Error     string `json:"error"`
+}
+
+// Actions that mean a failed deployment couldn't be rolled back.
+var failedRollbackActions = map[string]bool{
+	"no-rollback-target": true,
+}
+
+// failed reports if a rollback failed during the pass, in which case run
+// --once exits non-zero.
+func (s *onceSummary) failed() bool {
+	if len(s.Errors) > 0 {
+		return true
+	}
+	for _, r := range s.Actions {
+		if failedRollbackActions[r.Action] {
+			return true
+		}
+	}
+	return false
+}
+
+// runOnce runs a single reconcile pass of each controller, and summarizes
+// what they found and did. Verifications of rollbacks aren't waited for.
+func runOnce(ctx context.Context, controllers []*rollbackController) *onceSummary {
+	s := &onceSummary{
+		Failed:  []*deploymentStatus{},
+		Actions: []*rollbackRecord{},
+		Errors:  []*reconcileError{},
+	}
+	for _, c := range controllers {
+		start := c.now().UTC()
+		err := c.run(ctx)
+		if err != nil {
+			c.logger.Printf("running rollbackController: %v", err)
+		}
+
+		c.status.mu.Lock()
+		if err != nil && len(c.status.errors) == 0 {
+			// The pass failed before reconciling any deployments.
+			s.Errors = append(s.Errors, &reconcileError{Cluster: c.cluster, Error: err.Error()})
+		}
+		s.Failed = append(s.Failed, c.status.failed...)
+		for _, r := range c.status.records {
+			// Skip records restored from the state store.
+			if !r.Time.Before(start) {
+				s.Actions = append(s.Actions, r)
+			}
+		}
+		s.Errors = append(s.Errors, c.status.errors...)
+		c.status.mu.Unlock()
+	}
+	return s
+}
+
+func (s *onceSummary) write(w io.Writer) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode summary: %v", err)
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// skippedOwner returns a description of the owner of a deployment that
+// shouldn't be rolled back, or "" if there isn't one. Deployments created by
+// operators, such as a Kafka cluster's, are reconciled forward again by
+// their operator as soon as they're rolled back, so rolling them back only
+// fights the operator. Deployments owned by one of the skipOwnerKinds are
+// skipped, and so is any deployment with a controlling owner, unless
+// skipOperatorOwned is disabled or the deployment itself sets the enabled
+// annotation to "true".
+func (c *rollbackController) skippedOwner(d *v1beta1.Deployment) string {
+	refs := d.Metadata.GetOwnerReferences()
+	for _, ref := range refs {
+		for _, kind := range c.cfg.SkipOwnerKinds {
+			if ref.GetKind() == kind {
+				return fmt.Sprintf("%s %s", ref.GetKind(), ref.GetName())
+			}
+		}
+	}
+	if !c.cfg.SkipOperatorOwned || d.Metadata.GetAnnotations()[annotationEnabled] == "true" {
+		return ""
+	}
+	for _, ref := range refs {
+		if ref.GetController() {
+			return fmt.Sprintf("%s %s", ref.GetKind(), ref.GetName())
+		}
+	}
+	return ""
+}
+
+// skipOwned reports a failed deployment that isn't handled because it's
+// owned by another controller, once per revision.
+func (c *rollbackController) skipOwned(ctx context.Context, d *v1beta1.Deployment, reason, owner string) {
+	if !c.once("owned", d) {
+		return
+	}
+	msg := fmt.Sprintf("deployment failed (%s) but isn't handled, it's owned by %s which would roll it forward again", reason, owner)
+	c.logger.Printf("not rolling back deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.recordAction(d, "skipped", 0, msg)
+	c.recordEvent(ctx, d, eventWarning, "RollbackSkipped", msg)
+}
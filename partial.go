@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/golang/protobuf/proto"
+)
+
+// partialRollout reports if pods of revisions older than the deployment's
+// current one are still ready, because its rollout is only partially
+// complete.
+func partialRollout(d *v1beta1.Deployment, current *v1beta1.ReplicaSet, replicaSets []*v1beta1.ReplicaSet) bool {
+	for _, rs := range replicaSets {
+		if rs != current && ownedBy(rs, d) && rs.Status.GetReadyReplicas() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// scaleDown is the result of scaleDownFailedReplicaSet.
+type scaleDown struct {
+	// The ReplicaSet scaled down, or nil if it wasn't.
+	rs *v1beta1.ReplicaSet
+	// Replicas before and after.
+	from, to int32
+	// PodDisruptionBudget that kept the ReplicaSet from being scaled down
+	// to zero, if any.
+	limitedBy string
+}
+
+// scaleDownFailedReplicaSet scales the ReplicaSet of a failed deployment's
+// current revision to zero if its rollout is only partially complete. Its
+// pods stop serving immediately, and traffic is served by the pods of older
+// revisions that are still running, rather than waiting for the rollback's
+// rolling update to replace them. A rollout that completed isn't touched,
+// since there'd be nothing left serving.
+//
+// Ready pods covered by PodDisruptionBudgets are only taken down as far as
+// the budgets allow. The rest are left to the rollback's rolling update.
+// It returns nil if the ReplicaSet doesn't need scaling down.
+func (c *rollbackController) scaleDownFailedReplicaSet(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (*scaleDown, error) {
+	current := newReplicaSet(d, replicaSets)
+	if current == nil || current.Spec.GetReplicas() == 0 || !partialRollout(d, current, replicaSets) {
+		return nil, nil
+	}
+	pdbs, err := c.api.listPodDisruptionBudgets(ctx, d.Metadata.GetNamespace())
+	if err != nil {
+		return nil, fmt.Errorf("list pod disruption budgets: %v", err)
+	}
+	result := &scaleDown{from: current.Spec.GetReplicas()}
+	if allowed, pdb := disruptionsAllowed(current, pdbs); pdb != "" {
+		ready := current.Status.GetReadyReplicas()
+		if ready > result.from {
+			ready = result.from
+		}
+		if allowed < ready {
+			// Pods that aren't ready don't count towards the budget.
+			result.to = ready - allowed
+			result.limitedBy = pdb
+			metricPDBLimitedScaleDowns.inc(c.metricLabels(d)...)
+		}
+	}
+	if result.to == result.from {
+		return result, nil
+	}
+
+	rs := proto.Clone(current).(*v1beta1.ReplicaSet)
+	rs.Spec.Replicas = &result.to
+	if rs.Metadata.Annotations == nil {
+		rs.Metadata.Annotations = make(map[string]string)
+	}
+	rs.Metadata.Annotations[annotationManagedBy] = managerName
+	patch, err := strategicMergePatch(current, rs)
+	if err != nil {
+		return nil, fmt.Errorf("compute patch: %v", err)
+	}
+	rs, err = c.api.patchReplicaSet(ctx, rs.Metadata.GetNamespace(), rs.Metadata.GetName(), patch)
+	if err != nil {
+		return nil, fmt.Errorf("patch replica set %s: %v", current.Metadata.GetName(), err)
+	}
+	c.logger.Printf("scaled down ReplicaSet of failed deployment: %s region=%q: %s from %d to %d replicas",
+		*d.Metadata.Name, c.regionOf(d), rs.Metadata.GetName(), result.from, result.to)
+	result.rs = rs
+	return result, nil
+}
+
+// stopFailedRollout scales down the failed ReplicaSet of a deployment before
+// it's rolled back, if the scaleDownFailedReplicaSet setting is enabled,
+// returning a note to add to the rollback's message. The rollback goes ahead
+// even if the ReplicaSet can't be scaled down.
+func (c *rollbackController) stopFailedRollout(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) string {
+	if !c.cfg.ScaleDownFailedReplicaSet {
+		return ""
+	}
+	s, err := c.scaleDownFailedReplicaSet(ctx, d, replicaSets)
+	if err != nil {
+		c.logger.Printf("scale down failed ReplicaSet of deployment %s: %v", *d.Metadata.Name, err)
+		return ""
+	}
+	switch {
+	case s == nil:
+		return ""
+	case s.rs == nil:
+		return fmt.Sprintf(", didn't scale down the failed revision's ReplicaSet first: PodDisruptionBudget %s allows no disruptions", s.limitedBy)
+	case s.limitedBy != "":
+		return fmt.Sprintf(", scaled ReplicaSet %s of the failed revision down from %d to %d replicas first, as far as PodDisruptionBudget %s allows",
+			s.rs.Metadata.GetName(), s.from, s.to, s.limitedBy)
+	}
+	return fmt.Sprintf(", scaled ReplicaSet %s of the failed revision down to zero first", s.rs.Metadata.GetName())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Deployments are written with strategic merge patches that only contain the
+// fields the controller changed, rather than by replacing the whole object,
+// so fields written by anyone else since the deployment was read are kept.
+//
+// Patches are computed from the JSON of a deployment before and after it was
+// modified. Objects are merged key by key, and keys that were removed are set
+// to null. Lists are replaced, except for the lists below, which Kubernetes
+// merges by the name of their elements: only the elements that changed are
+// included, with just the fields that changed.
+var namedLists = map[string]bool{
+	"containers":       true,
+	"initContainers":   true,
+	"env":              true,
+	"volumes":          true,
+	"imagePullSecrets": true,
+}
+
+// Directive deleting an element of a merged list, or, as an element of its
+// own, replacing the whole list.
+const patchDirective = "$patch"
+
+// strategicMergePatch returns a patch that changes before into after, or nil
+// if they're the same. Fields whose JSON differs from the API's, such as
+// quantities, must not change, since their new values are sent as is.
+func strategicMergePatch(before, after interface{}) ([]byte, error) {
+	a, err := toJSONValue(before)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toJSONValue(after)
+	if err != nil {
+		return nil, err
+	}
+	p, changed := diffJSON("", a, b)
+	if !changed {
+		return nil, nil
+	}
+	return json.Marshal(p)
+}
+
+// withResourceVersion adds a resource version to a patch of an object, so
+// the API server only applies it to that version of the object.
+func withResourceVersion(patch []byte, resourceVersion string) ([]byte, error) {
+	var p map[string]interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	metadata, ok := p["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		p["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = resourceVersion
+	return json.Marshal(p)
+}
+
+// toJSONValue converts v to the generic value it's encoded as in JSON.
+func toJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var x interface{}
+	if err := json.Unmarshal(b, &x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// diffJSON returns the patch of the value of a field, and if it changed.
+func diffJSON(field string, before, after interface{}) (interface{}, bool) {
+	if a, ok := before.(map[string]interface{}); ok {
+		if b, ok := after.(map[string]interface{}); ok {
+			p := make(map[string]interface{})
+			for k, bv := range b {
+				av, ok := a[k]
+				if !ok {
+					p[k] = bv
+				} else if sub, changed := diffJSON(k, av, bv); changed {
+					p[k] = sub
+				}
+			}
+			for k := range a {
+				if _, ok := b[k]; !ok {
+					p[k] = nil
+				}
+			}
+			return p, len(p) > 0
+		}
+	}
+	if namedLists[field] {
+		a, aok := byName(before)
+		b, bok := byName(after)
+		if aok && bok {
+			return diffNamedList(before.([]interface{}), after.([]interface{}), a, b)
+		}
+		// The API server merges the list by name even if its elements
+		// can't be told apart by name, so it must be told to replace it.
+		if l, ok := after.([]interface{}); ok && !reflect.DeepEqual(before, after) {
+			return append(append([]interface{}(nil), l...), map[string]interface{}{patchDirective: "replace"}), true
+		}
+	}
+	if reflect.DeepEqual(before, after) {
+		return nil, false
+	}
+	return after, true
+}
+
+// diffNamedList returns the patch of a list merged by name.
+func diffNamedList(before, after []interface{}, a, b map[string]map[string]interface{}) (interface{}, bool) {
+	var p []interface{}
+	for _, e := range after {
+		e := e.(map[string]interface{})
+		name := e["name"].(string)
+		prev, ok := a[name]
+		if !ok {
+			p = append(p, e)
+			continue
+		}
+		if sub, changed := diffJSON("", prev, e); changed {
+			sub := sub.(map[string]interface{})
+			sub["name"] = name
+			p = append(p, sub)
+		}
+	}
+	for _, e := range before {
+		name := e.(map[string]interface{})["name"].(string)
+		if _, ok := b[name]; !ok {
+			p = append(p, map[string]interface{}{"name": name, patchDirective: "delete"})
+		}
+	}
+	return p, len(p) > 0
+}
+
+// byName indexes a list of objects by their names. It returns false if v
+// isn't a list, or any of its elements isn't an object with a unique name.
+func byName(v interface{}) (map[string]map[string]interface{}, bool) {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	m := make(map[string]map[string]interface{})
+	for _, e := range l {
+		o, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := o["name"].(string)
+		if !ok {
+			return nil, false
+		}
+		if _, ok := m[name]; ok {
+			return nil, false
+		}
+		m[name] = o
+	}
+	return m, true
+}
+
+// applyStrategicMergePatch applies a patch returned by strategicMergePatch
+// to the JSON value of an object, the way the API server would.
+func applyStrategicMergePatch(field string, doc, patch interface{}) interface{} {
+	if p, ok := patch.(map[string]interface{}); ok {
+		d, ok := doc.(map[string]interface{})
+		if !ok {
+			d = make(map[string]interface{})
+		}
+		for k, v := range p {
+			if v == nil {
+				delete(d, k)
+				continue
+			}
+			d[k] = applyStrategicMergePatch(k, d[k], v)
+		}
+		return d
+	}
+	if namedLists[field] {
+		d, dok := doc.([]interface{})
+		p, pok := patch.([]interface{})
+		if dok && pok {
+			return applyNamedList(d, p)
+		}
+	}
+	return patch
+}
+
+// applyNamedList applies the patch of a list merged by name.
+func applyNamedList(doc, patch []interface{}) []interface{} {
+	for i, e := range patch {
+		if e, ok := e.(map[string]interface{}); ok && e[patchDirective] == "replace" {
+			return append(patch[:i:i], patch[i+1:]...)
+		}
+	}
+	for _, e := range patch {
+		e, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := e["name"].(string)
+		i := indexByName(doc, name)
+		if e[patchDirective] == "delete" {
+			if i >= 0 {
+				doc = append(doc[:i], doc[i+1:]...)
+			}
+			continue
+		}
+		if i < 0 {
+			doc = append(doc, applyStrategicMergePatch("", nil, e))
+			continue
+		}
+		doc[i] = applyStrategicMergePatch("", doc[i], e)
+	}
+	return doc
+}
+
+func indexByName(l []interface{}, name string) int {
+	for i, e := range l {
+		if o, ok := e.(map[string]interface{}); ok && o["name"] == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStrategicMergePatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		// Expected patch, or "" if nothing changed.
+		want string
+	}{
+		{
+			name:   "unchanged",
+			before: `{"a":1,"b":{"c":[1,2]}}`,
+			after:  `{"a":1,"b":{"c":[1,2]}}`,
+		},
+		{
+			name:   "fields",
+			before: `{"a":1,"b":{"c":2,"d":3},"e":4}`,
+			after:  `{"a":1,"b":{"c":5,"d":3},"f":6}`,
+			want:   `{"b":{"c":5},"e":null,"f":6}`,
+		},
+		{
+			name:   "list replaced",
+			before: `{"args":["a","b"]}`,
+			after:  `{"args":["a","c"]}`,
+			want:   `{"args":["a","c"]}`,
+		},
+		{
+			name:   "named list element changed",
+			before: `{"containers":[{"name":"a","image":"a:1","args":["x"]},{"name":"b","image":"b:1"}]}`,
+			after:  `{"containers":[{"name":"a","image":"a:2","args":["x"]},{"name":"b","image":"b:1"}]}`,
+			want:   `{"containers":[{"image":"a:2","name":"a"}]}`,
+		},
+		{
+			name:   "named list element added and removed",
+			before: `{"env":[{"name":"A","value":"1"},{"name":"B","value":"2"}]}`,
+			after:  `{"env":[{"name":"A","value":"1"},{"name":"C","value":"3"}]}`,
+			want:   `{"env":[{"name":"C","value":"3"},{"$patch":"delete","name":"B"}]}`,
+		},
+		{
+			name:   "nested named lists",
+			before: `{"spec":{"template":{"spec":{"containers":[{"name":"a","env":[{"name":"X","value":"1"},{"name":"Y","value":"2"}]}]}}}}`,
+			after:  `{"spec":{"template":{"spec":{"containers":[{"name":"a","env":[{"name":"X","value":"1"},{"name":"Y","value":"3"}]}]}}}}`,
+			want:   `{"spec":{"template":{"spec":{"containers":[{"env":[{"name":"Y","value":"3"}],"name":"a"}]}}}}`,
+		},
+		{
+			name:   "named list with duplicate names",
+			before: `{"env":[{"name":"A","value":"1"},{"name":"A","value":"2"}]}`,
+			after:  `{"env":[{"name":"A","value":"1"}]}`,
+			want:   `{"env":[{"name":"A","value":"1"},{"$patch":"replace"}]}`,
+		},
+		{
+			name:   "named list emptied",
+			before: `{"volumes":[{"name":"a"}]}`,
+			after:  `{"volumes":[]}`,
+			want:   `{"volumes":[{"$patch":"delete","name":"a"}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var before, after interface{}
+			if err := json.Unmarshal([]byte(test.before), &before); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.after), &after); err != nil {
+				t.Fatal(err)
+			}
+			patch, err := strategicMergePatch(before, after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != test.want {
+				t.Errorf("got patch %s, want %s", patch, test.want)
+			}
+			if patch == nil {
+				return
+			}
+
+			// Applying the patch must produce after.
+			var p interface{}
+			if err := json.Unmarshal(patch, &p); err != nil {
+				t.Fatal(err)
+			}
+			if got := applyStrategicMergePatch("", before, p); !reflect.DeepEqual(got, after) {
+				t.Errorf("applying patch: got %v, want %v", got, after)
+			}
+		})
+	}
+}
+
+func TestWithResourceVersion(t *testing.T) {
+	tests := []struct {
+		patch string
+		want  string
+	}{
+		{`{"spec":{"paused":true}}`, `{"metadata":{"resourceVersion":"5"},"spec":{"paused":true}}`},
+		{`{"metadata":{"annotations":{"a":"b"}}}`, `{"metadata":{"annotations":{"a":"b"},"resourceVersion":"5"}}`},
+	}
+	for _, test := range tests {
+		got, err := withResourceVersion([]byte(test.patch), "5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("withResourceVersion(%s): got %s, want %s", test.patch, got, test.want)
+		}
+	}
+}
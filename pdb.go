@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/ericchiang/k8s/api/unversioned"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	policyv1beta1 "github.com/ericchiang/k8s/apis/policy/v1beta1"
+)
+
+// disruptionsAllowed returns how many ready pods of a ReplicaSet can be taken
+// down without violating the PodDisruptionBudgets covering them, and the
+// name of the budget that allows the fewest. It returns "" if no budget
+// covers them. Budgets whose status is out of date allow no disruptions.
+func disruptionsAllowed(rs *v1beta1.ReplicaSet, pdbs []*policyv1beta1.PodDisruptionBudget) (int32, string) {
+	var (
+		allowed int32
+		name    string
+	)
+	labels := rs.Spec.GetTemplate().GetMetadata().GetLabels()
+	for _, pdb := range pdbs {
+		if pdb.Metadata.GetNamespace() != rs.Metadata.GetNamespace() || !selectorMatches(pdb.Spec.GetSelector(), labels) {
+			continue
+		}
+		n := pdb.Status.GetDisruptionsAllowed()
+		if pdb.Status.GetObservedGeneration() < pdb.Metadata.GetGeneration() {
+			n = 0
+		}
+		if name == "" || n < allowed {
+			allowed, name = n, pdb.Metadata.GetName()
+		}
+	}
+	return allowed, name
+}
+
+// selectorMatches reports if a label selector matches a set of labels. Empty
+// selectors match nothing, as they do for PodDisruptionBudgets.
+func selectorMatches(sel *unversioned.LabelSelector, labels map[string]string) bool {
+	if len(sel.GetMatchLabels()) == 0 && len(sel.GetMatchExpressions()) == 0 {
+		return false
+	}
+	for k, v := range sel.GetMatchLabels() {
+		if labels[k] != v {
+			return false
+		}
+	}
+	for _, req := range sel.GetMatchExpressions() {
+		v, ok := labels[req.GetKey()]
+		in := false
+		for _, value := range req.GetValues() {
+			if ok && v == value {
+				in = true
+			}
+		}
+		switch req.GetOperator() {
+		case "In":
+			if !in {
+				return false
+			}
+		case "NotIn":
+			if in {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/unversioned"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	policyv1beta1 "github.com/ericchiang/k8s/apis/policy/v1beta1"
+)
+
+// testPDB returns an up to date PodDisruptionBudget in the default namespace
+// selecting pods by labels.
+func testPDB(name string, allowed int32, labels map[string]string) *policyv1beta1.PodDisruptionBudget {
+	generation := int64(1)
+	return &policyv1beta1.PodDisruptionBudget{
+		Metadata: &v1.ObjectMeta{
+			Name:       k8s.String(name),
+			Namespace:  k8s.String("default"),
+			Generation: &generation,
+		},
+		Spec: &policyv1beta1.PodDisruptionBudgetSpec{
+			Selector: &unversioned.LabelSelector{MatchLabels: labels},
+		},
+		Status: &policyv1beta1.PodDisruptionBudgetStatus{
+			ObservedGeneration: &generation,
+			DisruptionsAllowed: &allowed,
+		},
+	}
+}
+
+func TestDisruptionsAllowed(t *testing.T) {
+	rs := testReplicaSet(testDeployment("hello", 2, true), 2)
+	app := map[string]string{"app": "hello"}
+	stale := testPDB("stale", 5, app)
+	// The budget changed since its status was computed.
+	generation := int64(2)
+	stale.Metadata.Generation = &generation
+	otherNamespace := testPDB("other-namespace", 0, app)
+	otherNamespace.Metadata.Namespace = k8s.String("other")
+
+	tests := []struct {
+		name        string
+		pdbs        []*policyv1beta1.PodDisruptionBudget
+		wantAllowed int32
+		wantName    string
+	}{
+		{name: "no budgets"},
+		{
+			name:        "covered",
+			pdbs:        []*policyv1beta1.PodDisruptionBudget{testPDB("hello", 1, app)},
+			wantAllowed: 1,
+			wantName:    "hello",
+		},
+		{
+			name:        "fewest wins",
+			pdbs:        []*policyv1beta1.PodDisruptionBudget{testPDB("loose", 3, app), testPDB("strict", 1, app)},
+			wantAllowed: 1,
+			wantName:    "strict",
+		},
+		{
+			name:     "stale status",
+			pdbs:     []*policyv1beta1.PodDisruptionBudget{stale},
+			wantName: "stale",
+		},
+		{
+			name: "not covered",
+			pdbs: []*policyv1beta1.PodDisruptionBudget{
+				testPDB("other-app", 0, map[string]string{"app": "other"}),
+				testPDB("empty", 0, nil),
+				otherNamespace,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, name := disruptionsAllowed(rs, test.pdbs)
+			if allowed != test.wantAllowed || name != test.wantName {
+				t.Errorf("got %d allowed by %q, want %d by %q", allowed, name, test.wantAllowed, test.wantName)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"app": "hello", "tier": "web"}
+	req := func(key, op string, values ...string) *unversioned.LabelSelectorRequirement {
+		return &unversioned.LabelSelectorRequirement{Key: k8s.String(key), Operator: k8s.String(op), Values: values}
+	}
+	tests := []struct {
+		name string
+		sel  *unversioned.LabelSelector
+		want bool
+	}{
+		{"empty", &unversioned.LabelSelector{}, false},
+		{"labels", &unversioned.LabelSelector{MatchLabels: map[string]string{"app": "hello"}}, true},
+		{"other labels", &unversioned.LabelSelector{MatchLabels: map[string]string{"app": "other"}}, false},
+		{"in", &unversioned.LabelSelector{MatchExpressions: []*unversioned.LabelSelectorRequirement{req("tier", "In", "web", "api")}}, true},
+		{"not in", &unversioned.LabelSelector{MatchExpressions: []*unversioned.LabelSelectorRequirement{req("tier", "NotIn", "web")}}, false},
+		{"exists", &unversioned.LabelSelector{MatchExpressions: []*unversioned.LabelSelectorRequirement{req("tier", "Exists")}}, true},
+		{"does not exist", &unversioned.LabelSelector{MatchExpressions: []*unversioned.LabelSelectorRequirement{req("canary", "DoesNotExist")}}, true},
+		{"unknown operator", &unversioned.LabelSelector{MatchExpressions: []*unversioned.LabelSelectorRequirement{req("tier", "Like", "w*")}}, false},
+	}
+	for _, test := range tests {
+		if got := selectorMatches(test.sel, labels); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScaleDownFailedReplicaSet(t *testing.T) {
+	app := map[string]string{"app": "hello"}
+	tests := []struct {
+		name string
+		pdbs []*policyv1beta1.PodDisruptionBudget
+		// Whether the previous revision's pods are still ready.
+		complete bool
+
+		wantReplicas int32
+		wantNote     string
+	}{
+		{
+			name:     "no budget",
+			wantNote: ", scaled ReplicaSet hello-2 of the failed revision down to zero first",
+		},
+		{
+			name:         "limited by budget",
+			pdbs:         []*policyv1beta1.PodDisruptionBudget{testPDB("hello", 1, app)},
+			wantReplicas: 2,
+			wantNote:     ", scaled ReplicaSet hello-2 of the failed revision down from 3 to 2 replicas first, as far as PodDisruptionBudget hello allows",
+		},
+		{
+			name:         "budget allows no disruptions",
+			pdbs:         []*policyv1beta1.PodDisruptionBudget{testPDB("hello", 0, app)},
+			wantReplicas: 3,
+			wantNote:     ", didn't scale down the failed revision's ReplicaSet first: PodDisruptionBudget hello allows no disruptions",
+		},
+		{
+			name:         "budget allows all ready pods",
+			pdbs:         []*policyv1beta1.PodDisruptionBudget{testPDB("hello", 3, app)},
+			wantReplicas: 0,
+			wantNote:     ", scaled ReplicaSet hello-2 of the failed revision down to zero first",
+		},
+		{
+			// Nothing would be left serving.
+			name:         "complete rollout",
+			complete:     true,
+			wantReplicas: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			d := testDeployment("hello", 2, true)
+			current := testReplicaSet(d, 2)
+			current.Spec.Replicas = int32Ptr(3)
+			current.Status.Replicas = int32Ptr(3)
+			current.Status.ReadyReplicas = int32Ptr(3)
+			previous := testReplicaSet(d, 1)
+			if test.complete {
+				previous.Status.ReadyReplicas = int32Ptr(0)
+			}
+			f.addReplicaSet(current)
+			f.addReplicaSet(previous)
+			for _, pdb := range test.pdbs {
+				f.addPodDisruptionBudget(pdb)
+			}
+			c := newTestController(t, f, "--scale-down-failed-replicaset")
+
+			note := c.stopFailedRollout(context.Background(), d, []*v1beta1.ReplicaSet{current, previous})
+			if note != test.wantNote {
+				t.Errorf("got note %q, want %q", note, test.wantNote)
+			}
+			replicaSets, err := f.listReplicaSets(context.Background(), "default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rs := range replicaSets {
+				if rs.Metadata.GetName() == "hello-2" && rs.Spec.GetReplicas() != test.wantReplicas {
+					t.Errorf("failed ReplicaSet has %d replicas, want %d", rs.Spec.GetReplicas(), test.wantReplicas)
+				}
+				if rs.Metadata.GetName() == "hello-1" && rs.Spec.GetReplicas() != 2 {
+					t.Errorf("previous ReplicaSet was scaled to %d replicas", rs.Spec.GetReplicas())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+)
+
+// annotationPlugin names the plugin handling a deployment with the plugin
+// strategy, if more than one is configured.
+const annotationPlugin = "rollback-controller/plugin"
+
+// Default timeout of calls to plugins.
+const defaultPluginTimeout = 10 * time.Second
+
+// pluginConfig is an external gRPC service implementing the Plugin service
+// of plugin.proto, for failure detection and handling the controller doesn't
+// know about, such as asking an internal deploy system.
+type pluginConfig struct {
+	Name string `json:"name"`
+	// Address of the plugin, as host:port.
+	Address string `json:"address"`
+	// Whether to connect over TLS, and the PEM bundle of CAs to verify the
+	// plugin's certificate with. The system's roots are used by default.
+	TLS    bool   `json:"tls"`
+	CAFile string `json:"caFile"`
+	// How long each call may take.
+	Timeout duration `json:"timeout"`
+}
+
+func (p *pluginConfig) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if _, _, err := net.SplitHostPort(p.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", p.Address, err)
+	}
+	if p.CAFile != "" {
+		if !p.TLS {
+			return fmt.Errorf("caFile requires tls")
+		}
+		if _, err := loadCAs(p.CAFile); err != nil {
+			return err
+		}
+	}
+	if p.Timeout.Duration < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+func loadCAs(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read caFile: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Messages of plugin.proto.
+
+type pluginDetectRequest struct {
+	Cluster     string   `protobuf:"bytes,1,opt,name=cluster" json:"cluster,omitempty"`
+	Deployment  []byte   `protobuf:"bytes,2,opt,name=deployment" json:"deployment,omitempty"`
+	ReplicaSets [][]byte `protobuf:"bytes,3,rep,name=replica_sets" json:"replica_sets,omitempty"`
+}
+
+func (m *pluginDetectRequest) Reset()         { *m = pluginDetectRequest{} }
+func (m *pluginDetectRequest) String() string { return proto.CompactTextString(m) }
+func (*pluginDetectRequest) ProtoMessage()    {}
+
+type pluginDetectResponse struct {
+	Failed bool   `protobuf:"varint,1,opt,name=failed" json:"failed,omitempty"`
+	Reason string `protobuf:"bytes,2,opt,name=reason" json:"reason,omitempty"`
+}
+
+func (m *pluginDetectResponse) Reset()         { *m = pluginDetectResponse{} }
+func (m *pluginDetectResponse) String() string { return proto.CompactTextString(m) }
+func (*pluginDetectResponse) ProtoMessage()    {}
+
+type pluginActRequest struct {
+	Cluster     string   `protobuf:"bytes,1,opt,name=cluster" json:"cluster,omitempty"`
+	Deployment  []byte   `protobuf:"bytes,2,opt,name=deployment" json:"deployment,omitempty"`
+	ReplicaSets [][]byte `protobuf:"bytes,3,rep,name=replica_sets" json:"replica_sets,omitempty"`
+	Reason      string   `protobuf:"bytes,4,opt,name=reason" json:"reason,omitempty"`
+}
+
+func (m *pluginActRequest) Reset()         { *m = pluginActRequest{} }
+func (m *pluginActRequest) String() string { return proto.CompactTextString(m) }
+func (*pluginActRequest) ProtoMessage()    {}
+
+type pluginActResponse struct {
+	Message string `protobuf:"bytes,1,opt,name=message" json:"message,omitempty"`
+}
+
+func (m *pluginActResponse) Reset()         { *m = pluginActResponse{} }
+func (m *pluginActResponse) String() string { return proto.CompactTextString(m) }
+func (*pluginActResponse) ProtoMessage()    {}
+
+// pluginCaller makes unary calls to a plugin.
+type pluginCaller interface {
+	call(ctx context.Context, method string, req, resp proto.Message) error
+}
+
+// grpcPlugin is a minimal gRPC client, enough for the unary calls of the
+// Plugin service, since the gRPC library isn't vendored.
+type grpcPlugin struct {
+	name    string
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+// newGRPCPlugin returns a client for a plugin. Plugins without TLS are
+// spoken to using HTTP/2 without TLS, as gRPC servers expect.
+func newGRPCPlugin(cfg *pluginConfig) (*grpcPlugin, error) {
+	t := &http2.Transport{}
+	scheme := "https"
+	if cfg.TLS {
+		t.TLSClientConfig = &tls.Config{}
+		if cfg.CAFile != "" {
+			pool, err := loadCAs(cfg.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			t.TLSClientConfig.RootCAs = pool
+		}
+	} else {
+		scheme = "http"
+		t.AllowHTTP = true
+		t.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultPluginTimeout
+	}
+	return &grpcPlugin{
+		name:    cfg.Name,
+		url:     scheme + "://" + cfg.Address + "/rollbackcontroller.plugin.Plugin/",
+		client:  &http.Client{Transport: t},
+		timeout: timeout,
+	}, nil
+}
+
+// Status codes of gRPC responses the controller checks for.
+const (
+	grpcOK            = 0
+	grpcUnimplemented = 12
+)
+
+// pluginError is a call to a plugin that returned a status other than OK.
+type pluginError struct {
+	code    int
+	message string
+}
+
+func (e *pluginError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.code, e.message)
+}
+
+func isUnimplemented(err error) bool {
+	e, ok := err.(*pluginError)
+	return ok && e.code == grpcUnimplemented
+}
+
+func (p *grpcPlugin) call(ctx context.Context, method string, req, resp proto.Message) (err error) {
+	ctx, s := startSpan(ctx, "plugin "+method, "plugin", p.name)
+	defer func() { s.finish(err) }()
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// Messages are framed by an uncompressed flag and their length.
+	frame := make([]byte, 5+len(b))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(b)))
+	copy(frame[5:], b)
+
+	r, err := http.NewRequest("POST", p.url+method, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/grpc+proto")
+	r.Header.Set("TE", "trailers")
+	r.Header.Set("Grpc-Timeout", strconv.FormatInt(int64(p.timeout/time.Millisecond), 10)+"m")
+	res, err := p.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	// The status is sent in the trailers, or in the headers of responses
+	// without a message.
+	status := res.Trailer.Get("Grpc-Status")
+	message := res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = res.Header.Get("Grpc-Status")
+		message = res.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("invalid grpc-status %q", status)
+	}
+	if code != grpcOK {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return &pluginError{code, message}
+	}
+
+	if len(body) < 5 {
+		return fmt.Errorf("response has no message")
+	}
+	if body[0] != 0 {
+		return fmt.Errorf("response is compressed")
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) != n {
+		return fmt.Errorf("response message is %d bytes, expected %d", len(body)-5, n)
+	}
+	if err := proto.Unmarshal(body[5:], resp); err != nil {
+		return fmt.Errorf("decode response: %v", err)
+	}
+	return nil
+}
+
+// closeIdle closes the plugin's idle connections once it's been replaced by
+// a config reload.
+func (p *grpcPlugin) closeIdle() {
+	p.client.Transport.(*http2.Transport).CloseIdleConnections()
+}
+
+// marshalObjects returns the protobuf encoding of a deployment and its
+// namespace's ReplicaSets, as sent to plugins.
+func marshalObjects(d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) ([]byte, [][]byte, error) {
+	deployment, err := d.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode deployment: %v", err)
+	}
+	rss := make([][]byte, len(replicaSets))
+	for i, rs := range replicaSets {
+		if rss[i], err = rs.Marshal(); err != nil {
+			return nil, nil, fmt.Errorf("encode replicaset: %v", err)
+		}
+	}
+	return deployment, rss, nil
+}
+
+// pluginDetector marks deployments as failed when a plugin says so.
+type pluginDetector struct {
+	name    string
+	plugin  pluginCaller
+	cluster string
+}
+
+func (p *pluginDetector) detect(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (bool, string, error) {
+	deployment, rss, err := marshalObjects(d, replicaSets)
+	if err != nil {
+		return false, "", err
+	}
+	var resp pluginDetectResponse
+	err = p.plugin.call(ctx, "Detect", &pluginDetectRequest{
+		Cluster:     p.cluster,
+		Deployment:  deployment,
+		ReplicaSets: rss,
+	}, &resp)
+	if isUnimplemented(err) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("plugin %s: %v", p.name, err)
+	}
+	if !resp.Failed {
+		return false, "", nil
+	}
+	reason := resp.Reason
+	if reason == "" {
+		reason = "marked as failed by plugin " + p.name
+	}
+	return true, reason, nil
+}
+
+// pluginFor returns the plugin handling a deployment with the plugin
+// strategy: the one named by its annotation, or the only one configured.
+func (c *rollbackController) pluginFor(d *v1beta1.Deployment) (string, pluginCaller, error) {
+	name, ok := c.annotation(d, annotationPlugin)
+	if !ok {
+		if len(c.plugins) != 1 {
+			return "", nil, fmt.Errorf("the plugin strategy requires the %s annotation when %d plugins are configured", annotationPlugin, len(c.plugins))
+		}
+		for n := range c.plugins {
+			name = n
+		}
+	}
+	p, ok := c.plugins[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no plugin named %q is configured", name)
+	}
+	return name, p, nil
+}
+
+// pluginAct lets a plugin handle a failed deployment, and notifies with what
+// it did.
+func (c *rollbackController) pluginAct(ctx context.Context, f *failure) error {
+	d := f.d
+	name, p, err := c.pluginFor(d)
+	if err != nil {
+		return err
+	}
+	deployment, rss, err := marshalObjects(d, f.replicaSets)
+	if err != nil {
+		return err
+	}
+	if !c.once("plugin", d) {
+		return nil
+	}
+	var resp pluginActResponse
+	err = p.call(ctx, "Act", &pluginActRequest{
+		Cluster:     c.cluster,
+		Deployment:  deployment,
+		ReplicaSets: rss,
+		Reason:      f.reason,
+	}, &resp)
+	if err != nil {
+		// Try again on the next pass.
+		c.forget("plugin", d)
+		return fmt.Errorf("plugin %s: %v", name, err)
+	}
+	msg := fmt.Sprintf("deployment failed (%s), handled by plugin %s", f.reason, name)
+	if resp.Message != "" {
+		msg += ": " + resp.Message
+	}
+	c.logger.Printf("plugin handled deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.recordAction(d, "plugin", 0, msg)
+	return c.notify(ctx, d, "plugin", severityCritical, msg)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// newTestPlugin returns a client for a plugin served by a handler over
+// HTTP/2 without TLS, as plugins without TLS are spoken to.
+func newTestPlugin(t *testing.T, h http.HandlerFunc) *grpcPlugin {
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	p, err := newGRPCPlugin(&pluginConfig{Name: "test", Address: srv.Listener.Addr().String(), Timeout: duration{time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.closeIdle)
+	return p
+}
+
+// grpcFrame frames a message as gRPC does, with a compressed flag and its
+// length.
+func grpcFrame(t *testing.T, m proto.Message, compressed bool) []byte {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 5+len(b))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(b)))
+	copy(frame[5:], b)
+	return frame
+}
+
+func TestGRPCPluginCall(t *testing.T) {
+	failed := &pluginDetectResponse{Failed: true, Reason: "deploy system says no"}
+	tests := []struct {
+		name string
+		// Response body, and status sent in the trailers, or, if
+		// headerStatus, in the headers.
+		body         func(t *testing.T) []byte
+		status       string
+		message      string
+		headerStatus bool
+		httpStatus   int
+
+		want        *pluginDetectResponse
+		wantCode    int
+		wantMessage string
+		wantErr     bool
+	}{
+		{
+			name:   "ok",
+			body:   func(t *testing.T) []byte { return grpcFrame(t, failed, false) },
+			status: "0",
+			want:   failed,
+		},
+		{
+			name:        "error in trailers",
+			status:      "12",
+			message:     "method%20Detect%20not%20implemented",
+			wantCode:    grpcUnimplemented,
+			wantMessage: "method Detect not implemented",
+		},
+		{
+			name:         "trailers only",
+			status:       "5",
+			message:      "not found",
+			headerStatus: true,
+			wantCode:     5,
+			wantMessage:  "not found",
+		},
+		{
+			name:    "compressed",
+			body:    func(t *testing.T) []byte { return grpcFrame(t, failed, true) },
+			status:  "0",
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			body:    func(t *testing.T) []byte { b := grpcFrame(t, failed, false); return b[:len(b)-1] },
+			status:  "0",
+			wantErr: true,
+		},
+		{
+			name:    "no message",
+			status:  "0",
+			wantErr: true,
+		},
+		{
+			name:    "no status",
+			body:    func(t *testing.T) []byte { return grpcFrame(t, failed, false) },
+			wantErr: true,
+		},
+		{
+			name:       "http error",
+			httpStatus: http.StatusServiceUnavailable,
+			wantErr:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPlugin(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/rollbackcontroller.plugin.Plugin/Detect" {
+					t.Errorf("request to %s", r.URL.Path)
+				}
+				if ct := r.Header.Get("Content-Type"); ct != "application/grpc+proto" {
+					t.Errorf("content type %q", ct)
+				}
+				if timeout := r.Header.Get("Grpc-Timeout"); timeout != "1000m" {
+					t.Errorf("grpc-timeout %q, want 1000m", timeout)
+				}
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var req pluginDetectRequest
+				if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+					t.Errorf("request isn't a single uncompressed message: %x", body)
+				} else if err := proto.Unmarshal(body[5:], &req); err != nil {
+					t.Errorf("decode request: %v", err)
+				} else if req.Cluster != "prod" {
+					t.Errorf("request for cluster %q, want prod", req.Cluster)
+				}
+
+				if test.httpStatus != 0 {
+					w.WriteHeader(test.httpStatus)
+					return
+				}
+				w.Header().Set("Content-Type", "application/grpc")
+				if test.headerStatus {
+					w.Header().Set("Grpc-Status", test.status)
+					w.Header().Set("Grpc-Message", test.message)
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				if test.body != nil {
+					w.Write(test.body(t))
+				}
+				if test.status != "" {
+					w.Header().Set(http.TrailerPrefix+"Grpc-Status", test.status)
+				}
+				if test.message != "" {
+					w.Header().Set(http.TrailerPrefix+"Grpc-Message", test.message)
+				}
+			})
+
+			var resp pluginDetectResponse
+			err := p.call(context.Background(), "Detect", &pluginDetectRequest{Cluster: "prod"}, &resp)
+			if test.wantCode != 0 {
+				e, ok := err.(*pluginError)
+				if !ok || e.code != test.wantCode {
+					t.Fatalf("expected status %d, got %v", test.wantCode, err)
+				}
+				if e.message != test.wantMessage {
+					t.Errorf("got message %q, want %q", e.message, test.wantMessage)
+				}
+				return
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			if test.want != nil && !proto.Equal(&resp, test.want) {
+				t.Errorf("got response %v, want %v", &resp, test.want)
+			}
+		})
+	}
+}
+
+func TestPluginDetector(t *testing.T) {
+	d := testDeployment("hello", 2, false)
+	tests := []struct {
+		name   string
+		status string
+		resp   *pluginDetectResponse
+
+		wantFailed bool
+		wantReason string
+		wantErr    bool
+	}{
+		{
+			name:   "healthy",
+			status: "0",
+			resp:   &pluginDetectResponse{},
+		},
+		{
+			name:       "failed",
+			status:     "0",
+			resp:       &pluginDetectResponse{Failed: true},
+			wantFailed: true,
+			wantReason: "marked as failed by plugin test",
+		},
+		{
+			// Plugins that only act don't implement Detect.
+			name:   "unimplemented",
+			status: "12",
+		},
+		{
+			name:    "unavailable",
+			status:  "14",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPlugin(t, func(w http.ResponseWriter, r *http.Request) {
+				var req pluginDetectRequest
+				body, _ := ioutil.ReadAll(r.Body)
+				if len(body) < 5 {
+					t.Errorf("request has no message")
+				} else if err := proto.Unmarshal(body[5:], &req); err != nil {
+					t.Errorf("decode request: %v", err)
+				}
+				if got, _ := d.Marshal(); string(req.Deployment) != string(got) {
+					t.Errorf("request doesn't carry the deployment")
+				}
+				w.Header().Set("Content-Type", "application/grpc")
+				w.WriteHeader(http.StatusOK)
+				if test.resp != nil {
+					w.Write(grpcFrame(t, test.resp, false))
+				}
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", test.status)
+			})
+			det := &pluginDetector{name: "test", plugin: p}
+			failed, reason, err := det.detect(context.Background(), d, nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			if failed != test.wantFailed || reason != test.wantReason {
+				t.Errorf("got failed=%t reason=%q, want failed=%t reason=%q", failed, reason, test.wantFailed, test.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Annotations for configuring the Prometheus detector on a deployment.
+const (
+	// A PromQL expression. The deployment is considered failed if the query
+	// returns any series, the same semantics as a Prometheus alerting rule.
+	// For example:
+	//
+	//    sum(rate(http_requests_total{app="hello",code=~"5.."}[1m]))
+	//      / sum(rate(http_requests_total{app="hello"}[1m])) > 0.05
+	//
+	annotationPrometheusQuery = "rollback-controller/prometheus-query"
+
+	// How long after a rollout starts the query is evaluated, overriding the
+	// prometheusWindow setting.
+	annotationPrometheusWindow = "rollback-controller/prometheus-window"
+)
+
+// prometheusDetector marks deployments as failed based on a per-deployment
+// Prometheus query evaluated during the rollout window.
+type prometheusDetector struct {
+	// Base URL of the Prometheus server, e.g. "http://prometheus:9090".
+	url    string
+	client *http.Client
+
+	// Default window after a rollout starts during which queries are
+	// evaluated.
+	window time.Duration
+	now    func() time.Time
+}
+
+func (p *prometheusDetector) detect(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (bool, string, error) {
+	annotations := d.Metadata.GetAnnotations()
+	query := annotations[annotationPrometheusQuery]
+	if query == "" {
+		return false, "", nil
+	}
+
+	window := p.window
+	if v, ok := annotations[annotationPrometheusWindow]; ok {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil {
+			return false, "", fmt.Errorf("invalid %s annotation %q", annotationPrometheusWindow, v)
+		}
+	}
+
+	rs := newReplicaSet(d, replicaSets)
+	if rs == nil {
+		return false, "", nil
+	}
+	if p.now().Sub(rolloutStart(d, rs)) > window {
+		return false, "", nil
+	}
+
+	qctx, s := startClientSpan(ctx, "prometheus query", "query", query)
+	n, err := p.query(qctx, query)
+	s.finish(err)
+	if err != nil {
+		return false, "", fmt.Errorf("prometheus query: %v", err)
+	}
+	if n == 0 {
+		return false, "", nil
+	}
+	return true, fmt.Sprintf("Prometheus query returned %d series: %s", n, query), nil
+}
+
+// queryResponse is the response format of the Prometheus HTTP API.
+//
+// See: https://prometheus.io/docs/querying/api/
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// query evaluates an instant query and returns the number of series it
+// matched. Scalar results count as a match if they're non-zero.
+func (p *prometheusDetector) query(ctx context.Context, query string) (int, error) {
+	u := strings.TrimSuffix(p.url, "/") + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var qr queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
+		return 0, fmt.Errorf("decode response (status %s): %v", resp.Status, err)
+	}
+	if qr.Status != "success" {
+		return 0, fmt.Errorf("query failed: %s", qr.Error)
+	}
+
+	switch qr.Data.ResultType {
+	case "vector", "matrix":
+		var series []json.RawMessage
+		if err := json.Unmarshal(qr.Data.Result, &series); err != nil {
+			return 0, fmt.Errorf("decode %s: %v", qr.Data.ResultType, err)
+		}
+		return len(series), nil
+	case "scalar":
+		// Scalars are encoded as [ <unix time>, "<value>" ].
+		var sample []interface{}
+		if err := json.Unmarshal(qr.Data.Result, &sample); err != nil || len(sample) != 2 {
+			return 0, fmt.Errorf("decode scalar: %s", qr.Data.Result)
+		}
+		s, _ := sample[1].(string)
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("decode scalar: %v", err)
+		}
+		if v == 0 {
+			return 0, nil
+		}
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("unsupported result type %q", qr.Data.ResultType)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+func TestPrometheusDetector(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	const query = `rate(errors{app="hello"}[1m]) > 1`
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// When the deployment's ReplicaSet was created.
+		created string
+		// The server's response, if it's queried.
+		response string
+
+		wantQueried bool
+		wantFailed  bool
+		wantErr     bool
+	}{
+		{
+			name:    "no query",
+			created: "2017-06-01T11:55:00Z",
+		},
+		{
+			name:        "series returned",
+			annotations: map[string]string{annotationPrometheusQuery: query},
+			created:     "2017-06-01T11:55:00Z",
+			response:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"2"]}]}}`,
+			wantQueried: true,
+			wantFailed:  true,
+		},
+		{
+			name:        "no series",
+			annotations: map[string]string{annotationPrometheusQuery: query},
+			created:     "2017-06-01T11:55:00Z",
+			response:    `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			wantQueried: true,
+		},
+		{
+			name:        "non-zero scalar",
+			annotations: map[string]string{annotationPrometheusQuery: query},
+			created:     "2017-06-01T11:55:00Z",
+			response:    `{"status":"success","data":{"resultType":"scalar","result":[1,"0.5"]}}`,
+			wantQueried: true,
+			wantFailed:  true,
+		},
+		{
+			name:        "zero scalar",
+			annotations: map[string]string{annotationPrometheusQuery: query},
+			created:     "2017-06-01T11:55:00Z",
+			response:    `{"status":"success","data":{"resultType":"scalar","result":[1,"0"]}}`,
+			wantQueried: true,
+		},
+		{
+			name:        "query error",
+			annotations: map[string]string{annotationPrometheusQuery: query},
+			created:     "2017-06-01T11:55:00Z",
+			response:    `{"status":"error","error":"parse error"}`,
+			wantQueried: true,
+			wantErr:     true,
+		},
+		{
+			name:        "window ended",
+			annotations: map[string]string{annotationPrometheusQuery: query},
+			created:     "2017-06-01T11:00:00Z",
+		},
+		{
+			name: "window annotation",
+			annotations: map[string]string{
+				annotationPrometheusQuery:  query,
+				annotationPrometheusWindow: "2h",
+			},
+			created:     "2017-06-01T11:00:00Z",
+			response:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"2"]}]}}`,
+			wantQueried: true,
+			wantFailed:  true,
+		},
+		{
+			name: "invalid window annotation",
+			annotations: map[string]string{
+				annotationPrometheusQuery:  query,
+				annotationPrometheusWindow: "soon",
+			},
+			created: "2017-06-01T11:55:00Z",
+			wantErr: true,
+		},
+		{
+			// An old ReplicaSet rolled out again by a rollback.
+			name: "rolled back to",
+			annotations: map[string]string{
+				annotationPrometheusQuery:  query,
+				annotationLastRollbackTime: "2017-06-01T11:55:00Z",
+			},
+			created:     "2017-05-01T12:00:00Z",
+			response:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"2"]}]}}`,
+			wantQueried: true,
+			wantFailed:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queried := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				queried = true
+				if r.URL.Path != "/api/v1/query" {
+					t.Errorf("unexpected request %s", r.URL)
+				}
+				if got := r.URL.Query().Get("query"); got != query {
+					t.Errorf("query %q, want %q", got, query)
+				}
+				fmt.Fprint(w, test.response)
+			}))
+			defer srv.Close()
+
+			p := &prometheusDetector{
+				url:    srv.URL + "/",
+				client: srv.Client(),
+				window: 10 * time.Minute,
+				now:    func() time.Time { return now },
+			}
+			d := testDeployment("hello", 2, false)
+			for k, v := range test.annotations {
+				d.Metadata.Annotations[k] = v
+			}
+			rs := testReplicaSet(d, 2)
+			rs.Metadata.CreationTimestamp = fakeTime(test.created)
+
+			failed, reason, err := p.detect(context.Background(), d, []*v1beta1.ReplicaSet{rs})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("detect: err=%v, want error %t", err, test.wantErr)
+			}
+			if queried != test.wantQueried {
+				t.Errorf("queried=%t, want %t", queried, test.wantQueried)
+			}
+			if failed != test.wantFailed {
+				t.Errorf("failed=%t (%q), want %t", failed, reason, test.wantFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Reasons of waiting containers that fail a quarantined rollout straight
+// away.
+var quarantineWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+}
+
+// quarantinedSince returns when a deployment was last rolled back, if it's
+// been quarantined since then and its current revision is a new rollout
+// rather than the rollback's. A rollback is rolled out as the revision after
+// the one it rolled back from, so later revisions are new rollouts, likely of
+// the same broken artifact.
+func quarantinedSince(d *v1beta1.Deployment, period time.Duration, now time.Time) (time.Time, bool) {
+	if period <= 0 {
+		return time.Time{}, false
+	}
+	annotations := d.Metadata.GetAnnotations()
+	last, err := time.Parse(time.RFC3339, annotations[annotationLastRollbackTime])
+	if err != nil || now.Sub(last) >= period {
+		return time.Time{}, false
+	}
+	from, err := strconv.ParseInt(annotations[annotationFromRevision], 10, 64)
+	if err != nil || revision(annotations) <= from+1 {
+		return time.Time{}, false
+	}
+	return last, true
+}
+
+// quarantineDetector watches new rollouts of deployments that were recently
+// rolled back more strictly: they fail if any of their containers restarts
+// or can't start, or if they don't complete within a shorter deadline than
+// their progress deadline. Quarantined deployments are also handled without
+// the confirmation delay.
+type quarantineDetector struct {
+	api deploymentAPI
+	// How long after a rollback new rollouts are quarantined.
+	period time.Duration
+	// How long a quarantined rollout has to complete.
+	deadline time.Duration
+	now      func() time.Time
+}
+
+func (q *quarantineDetector) detect(ctx context.Context, d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (bool, string, error) {
+	now := q.now()
+	last, ok := quarantinedSince(d, q.period, now)
+	if !ok || rolloutComplete(d) {
+		return false, "", nil
+	}
+	rs := newReplicaSet(d, replicaSets)
+	if rs == nil {
+		return false, "", nil
+	}
+	prefix := fmt.Sprintf("quarantined since rollback at %s: ", last.UTC().Format(time.RFC3339))
+
+	pods, err := q.api.listPods(ctx, d.Metadata.GetNamespace())
+	if err != nil {
+		return false, "", fmt.Errorf("list pods: %v", err)
+	}
+	for _, p := range pods {
+		if !podOwnedBy(p, rs) {
+			continue
+		}
+		for _, cs := range p.Status.GetContainerStatuses() {
+			if n := cs.GetRestartCount(); n > 0 {
+				return true, fmt.Sprintf("%scontainer %s of pod %s restarted %d times", prefix, cs.GetName(), p.Metadata.GetName(), n), nil
+			}
+			if reason := cs.GetState().GetWaiting().GetReason(); quarantineWaitingReasons[reason] {
+				return true, fmt.Sprintf("%scontainer %s of pod %s is waiting: %s", prefix, cs.GetName(), p.Metadata.GetName(), reason), nil
+			}
+		}
+	}
+
+	// The rollout starts when its ReplicaSet is created, or, if it reuses an
+	// older ReplicaSet, it's measured from the rollback.
+	start := time.Unix(rs.Metadata.GetCreationTimestamp().GetSeconds(), 0)
+	if start.Before(last) {
+		start = last
+	}
+	if now.Sub(start) > q.deadline {
+		return true, fmt.Sprintf("%srollout didn't complete within %s", prefix, q.deadline), nil
+	}
+	return false, "", nil
+}
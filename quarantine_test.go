@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// quarantinedDeployment returns a deployment at a revision, rolled back from
+// revision 2 at the given time.
+func quarantinedDeployment(rev int64, failed bool, rolledBack string) *v1beta1.Deployment {
+	d := testDeployment("hello", rev, failed)
+	d.Metadata.Annotations[annotationLastRollbackTime] = rolledBack
+	d.Metadata.Annotations[annotationFromRevision] = "2"
+	return d
+}
+
+func TestQuarantinedSince(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		d      *v1beta1.Deployment
+		period time.Duration
+		want   bool
+	}{
+		{name: "never rolled back", d: testDeployment("hello", 4, false), period: time.Hour},
+		// Revision 3 is the rollback's own rollout.
+		{name: "rollback", d: quarantinedDeployment(3, false, "2017-06-01T11:30:00Z"), period: time.Hour},
+		{name: "new rollout", d: quarantinedDeployment(4, false, "2017-06-01T11:30:00Z"), period: time.Hour, want: true},
+		{name: "quarantine ended", d: quarantinedDeployment(4, false, "2017-06-01T10:30:00Z"), period: time.Hour},
+		{name: "disabled", d: quarantinedDeployment(4, false, "2017-06-01T11:30:00Z")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			last, got := quarantinedSince(test.d, test.period, now)
+			if got != test.want {
+				t.Errorf("quarantined=%t, want %t", got, test.want)
+			}
+			if got && !last.Equal(time.Date(2017, 6, 1, 11, 30, 0, 0, time.UTC)) {
+				t.Errorf("quarantined since %s, want the last rollback", last)
+			}
+		})
+	}
+}
+
+func TestQuarantineDetector(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// When the deployment was rolled back, when its ReplicaSet was
+		// created, and its pods' containers.
+		rolledBack string
+		created    string
+		containers []*v1.ContainerStatus
+		complete   bool
+
+		wantReason string
+	}{
+		{
+			name:       "healthy",
+			rolledBack: "2017-06-01T11:30:00Z",
+			created:    "2017-06-01T11:59:00Z",
+			containers: []*v1.ContainerStatus{readyContainer("hello"), waitingContainer("proxy", "ContainerCreating")},
+		},
+		{
+			name:       "restarted",
+			rolledBack: "2017-06-01T11:30:00Z",
+			created:    "2017-06-01T11:59:00Z",
+			containers: []*v1.ContainerStatus{crashLoopingContainer("hello", 1, 1)},
+			wantReason: "container hello of pod hello-a restarted 1 times",
+		},
+		{
+			name:       "can't start",
+			rolledBack: "2017-06-01T11:30:00Z",
+			created:    "2017-06-01T11:59:00Z",
+			containers: []*v1.ContainerStatus{waitingContainer("hello", "CreateContainerConfigError")},
+			wantReason: "container hello of pod hello-a is waiting: CreateContainerConfigError",
+		},
+		{
+			name:       "deadline exceeded",
+			rolledBack: "2017-06-01T11:30:00Z",
+			created:    "2017-06-01T11:55:00Z",
+			containers: []*v1.ContainerStatus{waitingContainer("hello", "ContainerCreating")},
+			wantReason: "rollout didn't complete within 2m0s",
+		},
+		{
+			// An older ReplicaSet rolled out again has until the deadline
+			// after the rollback.
+			name:       "older ReplicaSet",
+			rolledBack: "2017-06-01T11:59:00Z",
+			created:    "2017-05-01T12:00:00Z",
+			containers: []*v1.ContainerStatus{waitingContainer("hello", "ContainerCreating")},
+		},
+		{
+			name:       "complete",
+			rolledBack: "2017-06-01T11:30:00Z",
+			created:    "2017-06-01T11:50:00Z",
+			containers: []*v1.ContainerStatus{crashLoopingContainer("hello", 1, 1)},
+			complete:   true,
+		},
+		{
+			name:       "not quarantined",
+			rolledBack: "2017-06-01T10:30:00Z",
+			created:    "2017-06-01T11:59:00Z",
+			containers: []*v1.ContainerStatus{crashLoopingContainer("hello", 1, 1)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			d := quarantinedDeployment(4, false, test.rolledBack)
+			if test.complete {
+				d.Status.Replicas = int32Ptr(2)
+				d.Status.UpdatedReplicas = int32Ptr(2)
+				d.Status.AvailableReplicas = int32Ptr(2)
+			}
+			rs := testReplicaSet(d, 4)
+			rs.Metadata.CreationTimestamp = fakeTime(test.created)
+			f.addPod(testPod(rs, "hello-a", test.containers...))
+			q := &quarantineDetector{
+				api:      f,
+				period:   time.Hour,
+				deadline: 2 * time.Minute,
+				now:      func() time.Time { return now },
+			}
+
+			failed, reason, err := q.detect(context.Background(), d, []*v1beta1.ReplicaSet{rs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed != (test.wantReason != "") {
+				t.Fatalf("failed=%t (%q), want %t", failed, reason, test.wantReason != "")
+			}
+			if failed && !strings.HasSuffix(reason, test.wantReason) {
+				t.Errorf("got reason %q, want %q", reason, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestQuarantineSkipsConfirmation(t *testing.T) {
+	f := newFakeAPI()
+	c := newTestController(t, f, "--quarantine=1h", "--confirmation-delay=1h")
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.clock = func() time.Time { return now }
+
+	d := quarantinedDeployment(4, false, "2017-06-01T11:30:00Z")
+	rs := testReplicaSet(d, 4)
+	rs.Metadata.CreationTimestamp = fakeTime("2017-06-01T11:59:00Z")
+	f.addDeployment(d)
+	f.addReplicaSet(rs)
+	f.addReplicaSet(testReplicaSet(d, 3))
+	f.addPod(testPod(rs, "hello-a", crashLoopingContainer("hello", 1, 1)))
+
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if actions := c.actions("hello"); !reflect.DeepEqual(actions, []string{"rollback"}) {
+		t.Errorf("got actions %q, want an immediate rollback", actions)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// annotationPriority orders deployments in the work queue, so when many fail
+// at once, such as from a bad base image, critical services are rolled back
+// first. Higher priorities go first. The default is 0.
+const annotationPriority = "rollback-controller/priority"
+
+// priority parses the priority annotation of a deployment. Deployments
+// without a valid priority return 0.
+func priority(d *v1beta1.Deployment) int {
+	p, err := strconv.Atoi(d.Metadata.GetAnnotations()[annotationPriority])
+	if err != nil {
+		return 0
+	}
+	return p
+}
+
+// queueKey identifies a deployment in the work queue.
+type queueKey struct {
+	namespace, name string
+}
+
+func queueKeyFor(d *v1beta1.Deployment) queueKey {
+	return queueKey{d.Metadata.GetNamespace(), d.Metadata.GetName()}
+}
+
+// workQueue is a queue of deployments waiting to be reconciled, ordered by
+// priority, and FIFO among deployments of the same priority. It's safe to
+// use from multiple goroutines.
+//
+// A deployment is queued at most once: adding one that's already queued
+// replaces it with the newer copy, keeping its place. A deployment is also
+// only handed to one worker at a time. Adding one while it's being
+// reconciled queues it again once the worker calls done, so updates from
+// concurrent reconciles of the same deployment can't conflict.
+type workQueue struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	keys       []queueKey
+	priorities []int // priorities[i] is the priority of keys[i].
+	// Latest copy of each deployment waiting to be reconciled, including
+	// ones added while being reconciled, which aren't in keys until done.
+	pending map[queueKey]*v1beta1.Deployment
+	// Deployments handed to workers that haven't called done.
+	processing map[queueKey]bool
+	shutdown   bool
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{
+		pending:    make(map[queueKey]*v1beta1.Deployment),
+		processing: make(map[queueKey]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// add queues a deployment. Deployments added after shutDown is called are
+// dropped.
+func (q *workQueue) add(d *v1beta1.Deployment) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.shutdown {
+		return
+	}
+	k := queueKeyFor(d)
+	_, queued := q.pending[k]
+	q.pending[k] = d
+	if queued || q.processing[k] {
+		return
+	}
+	q.insert(k, priority(d))
+}
+
+// insert adds a key after every key of the same or higher priority.
+func (q *workQueue) insert(k queueKey, p int) {
+	i := sort.Search(len(q.priorities), func(i int) bool { return q.priorities[i] < p })
+	q.keys = append(q.keys, queueKey{})
+	copy(q.keys[i+1:], q.keys[i:])
+	q.keys[i] = k
+	q.priorities = append(q.priorities, 0)
+	copy(q.priorities[i+1:], q.priorities[i:])
+	q.priorities[i] = p
+	q.cond.Signal()
+}
+
+// get blocks until a deployment is available. It returns false once the
+// queue has been shut down and drained. Callers must call done once they've
+// finished with the deployment.
+func (q *workQueue) get() (*v1beta1.Deployment, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Deployments being reconciled may be queued again by done, so the
+	// queue isn't drained until they're finished.
+	for len(q.keys) == 0 && (!q.shutdown || len(q.processing) > 0) {
+		q.cond.Wait()
+	}
+	if len(q.keys) == 0 {
+		return nil, false
+	}
+	k := q.keys[0]
+	q.keys = q.keys[1:]
+	q.priorities = q.priorities[1:]
+	d := q.pending[k]
+	delete(q.pending, k)
+	q.processing[k] = true
+	return d, true
+}
+
+// done marks a deployment returned by get as finished, queueing it again if
+// it was added since.
+func (q *workQueue) done(d *v1beta1.Deployment) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	k := queueKeyFor(d)
+	delete(q.processing, k)
+	if latest, ok := q.pending[k]; ok {
+		q.insert(k, priority(latest))
+	}
+	// Wake workers waiting for the queue to drain.
+	q.cond.Broadcast()
+}
+
+// shutDown stops the queue from accepting new deployments. Workers drain
+// any deployments that are already queued.
+func (q *workQueue) shutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shutdown = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// drain gets every deployment from a queue that has been shut down, calling
+// done for each, and returns their names and revisions.
+func drain(q *workQueue) []string {
+	var got []string
+	for {
+		d, ok := q.get()
+		if !ok {
+			return got
+		}
+		got = append(got, d.Metadata.GetName()+"@"+strconv.FormatInt(revision(d.Metadata.GetAnnotations()), 10))
+		q.done(d)
+	}
+}
+
+func withPriority(d *v1beta1.Deployment, p int) *v1beta1.Deployment {
+	d.Metadata.Annotations[annotationPriority] = strconv.Itoa(p)
+	return d
+}
+
+func TestWorkQueueOrder(t *testing.T) {
+	q := newWorkQueue()
+	q.add(testDeployment("a", 1, true))
+	q.add(withPriority(testDeployment("b", 1, true), 10))
+	q.add(testDeployment("c", 1, true))
+	q.add(withPriority(testDeployment("d", 1, true), 10))
+	q.add(withPriority(testDeployment("e", 1, true), -1))
+	q.shutDown()
+	q.add(testDeployment("f", 1, true))
+
+	want := []string{"b@1", "d@1", "a@1", "c@1", "e@1"}
+	if got := drain(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWorkQueueDeduplicates(t *testing.T) {
+	q := newWorkQueue()
+	q.add(testDeployment("a", 1, true))
+	q.add(testDeployment("b", 1, true))
+	// Replaces the queued copy, keeping its place.
+	q.add(testDeployment("a", 2, true))
+	q.shutDown()
+
+	want := []string{"a@2", "b@1"}
+	if got := drain(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWorkQueueSerializes(t *testing.T) {
+	q := newWorkQueue()
+	q.add(testDeployment("a", 1, true))
+	a, _ := q.get()
+
+	// Added while being processed, so it's not handed out again until
+	// done, even though other deployments are.
+	q.add(testDeployment("a", 2, true))
+	q.add(testDeployment("a", 3, true))
+	q.add(testDeployment("b", 1, true))
+	q.shutDown()
+	b, ok := q.get()
+	if !ok || b.Metadata.GetName() != "b" {
+		t.Fatalf("got %q, want b", b.GetMetadata().GetName())
+	}
+	q.done(b)
+
+	got := make(chan []string)
+	go func() { got <- drain(q) }()
+	q.done(a)
+	if got, want := <-got, []string{"a@3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q after done, want %q", got, want)
+	}
+}
+
+func TestWorkQueueConcurrentWorkers(t *testing.T) {
+	q := newWorkQueue()
+	for i := 0; i < 20; i++ {
+		q.add(testDeployment("d"+strconv.Itoa(i%5), 1, true))
+	}
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		processing = make(map[string]bool)
+		// Receives each deployment once its last revision is processed.
+		finished = make(chan string, 5)
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				d, ok := q.get()
+				if !ok {
+					return
+				}
+				name := d.Metadata.GetName()
+				mu.Lock()
+				if processing[name] {
+					t.Errorf("%s handed to two workers at once", name)
+				}
+				processing[name] = true
+				mu.Unlock()
+
+				// Requeue each deployment a few times while it's processed.
+				if rev := revision(d.Metadata.GetAnnotations()); rev < 3 {
+					q.add(testDeployment(name, rev+1, true))
+				} else {
+					finished <- name
+				}
+
+				mu.Lock()
+				processing[name] = false
+				mu.Unlock()
+				q.done(d)
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		<-finished
+	}
+	q.shutDown()
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of events to qps on average, allowing bursts of
+// up to burst events.
+type tokenBucket struct {
+	qps   float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(qps float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{qps: qps, burst: float64(burst), tokens: float64(burst)}
+}
+
+// reserve takes a token, returning how long the caller must wait before
+// using it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.qps
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.qps * float64(time.Second))
+}
+
+// rateLimitedTransport limits the rate of requests to the Kubernetes API,
+// and records their latency and how long they were throttled for. Every
+// request made with the client goes through it, including the ones the
+// client doesn't support, such as patches and logs.
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *tokenBucket // nil if requests aren't limited.
+	cluster string
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.limiter != nil {
+		if wait := t.limiter.reserve(time.Now()); wait > 0 {
+			metricAPIThrottled.inc(t.cluster)
+			metricAPIThrottleSeconds.add(wait.Seconds(), t.cluster)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metricAPIRequestDuration.observe(time.Since(start).Seconds(), t.cluster, req.Method, apiResource(req.URL.Path), code)
+	return resp, err
+}
+
+// apiResource returns the resource a Kubernetes API path refers to, such as
+// "deployments" for "/apis/extensions/v1beta1/namespaces/default/deployments/web".
+// Subresources are included, such as "pods/log".
+func apiResource(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return "other"
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+	if len(parts) >= 3 {
+		return parts[0] + "/" + parts[2]
+	}
+	return parts[0]
+}
+
+// jitter returns d increased by a random amount of up to factor times d, so
+// controllers started at the same time don't make their requests in lockstep.
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*factor*float64(d))
+}
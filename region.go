@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// The default label used to determine a deployment's region.
+const defaultRegionLabel = "failure-domain.beta.kubernetes.io/region"
+
+// Modes for region policies.
+const (
+	// Roll back failed deployments automatically. The default.
+	regionModeAuto = "auto"
+	// Notify, then wait for a human to approve the rollback by setting the
+	// approve-rollback annotation.
+	regionModeApprove = "approve"
+	// Notify, but never roll back.
+	regionModeNotify = "notify"
+)
+
+// annotationApproveRollback approves a rollback of a deployment in a region
+// that requires approval. The value must be the failing revision, so an
+// approval can't accidentally apply to a later rollout.
+const annotationApproveRollback = "rollback-controller/approve-rollback"
+
+// regionPolicy determines how failed deployments in a region are handled.
+type regionPolicy struct {
+	Mode string `json:"mode"`
+}
+
+func (p regionPolicy) validate() error {
+	switch p.Mode {
+	case "", regionModeAuto, regionModeApprove, regionModeNotify:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", p.Mode)
+}
+
+// regionOf returns the region of a deployment, or "" if it isn't labeled
+// with one.
+func (c *rollbackController) regionOf(d *v1beta1.Deployment) string {
+	return d.Metadata.GetLabels()[c.cfg.RegionLabel]
+}
+
+// regionMode returns the mode of the policy for a deployment's region.
+func (c *rollbackController) regionMode(d *v1beta1.Deployment) string {
+	p, ok := c.cfg.Regions[c.regionOf(d)]
+	if !ok || p.Mode == "" {
+		return regionModeAuto
+	}
+	return p.Mode
+}
+
+// rollbackApproved reports if a human approved rolling back the deployment's
+// current revision.
+func rollbackApproved(d *v1beta1.Deployment) bool {
+	v, ok := d.Metadata.GetAnnotations()[annotationApproveRollback]
+	return ok && v == strconv.FormatInt(revision(d.Metadata.GetAnnotations()), 10)
+}
+
+// checkRegionPolicy determines if the deployment's region allows it to be
+// rolled back now, notifying a human if it doesn't.
+func (c *rollbackController) checkRegionPolicy(ctx context.Context, d *v1beta1.Deployment, reason string) (bool, error) {
+	var msg string
+	switch c.regionMode(d) {
+	case regionModeNotify:
+		msg = fmt.Sprintf("deployment failed (%s), region %q doesn't allow automatic rollbacks", reason, c.regionOf(d))
+	case regionModeApprove:
+		if rollbackApproved(d) {
+			return true, nil
+		}
+		msg = fmt.Sprintf("deployment failed (%s), region %q requires approval to roll back: set annotation %s=%d",
+			reason, c.regionOf(d), annotationApproveRollback, revision(d.Metadata.GetAnnotations()))
+	default:
+		return true, nil
+	}
+
+	if !c.once("region-policy", d) {
+		return false, nil
+	}
+	c.logger.Printf("not rolling back deployment: %s: %s", *d.Metadata.Name, msg)
+	c.recordAction(d, "notify", 0, msg)
+	return false, c.notify(ctx, d, "region-policy", severityCritical, msg)
+}
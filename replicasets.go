@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/golang/protobuf/proto"
+)
+
+// The annotation the deployment controller uses to record which revision
+// a deployment or ReplicaSet corresponds to.
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// revision parses the revision annotation of an object. Objects without a
+// valid revision return 0.
+func revision(annotations map[string]string) int64 {
+	r, err := strconv.ParseInt(annotations[revisionAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return r
+}
+
+// ownedBy reports if a ReplicaSet belongs to a deployment. Older API servers
+// don't set owner references, so fall back to comparing the deployment's
+// selector against the ReplicaSet's labels.
+func ownedBy(rs *v1beta1.ReplicaSet, d *v1beta1.Deployment) bool {
+	if rs.Metadata.GetNamespace() != d.Metadata.GetNamespace() {
+		return false
+	}
+	if refs := rs.Metadata.GetOwnerReferences(); len(refs) > 0 {
+		for _, ref := range refs {
+			if ref.GetUid() == d.Metadata.GetUid() {
+				return true
+			}
+		}
+		return false
+	}
+
+	if d.Spec.Selector == nil || len(d.Spec.Selector.MatchLabels) == 0 {
+		return false
+	}
+	labels := rs.Metadata.GetLabels()
+	for k, v := range d.Spec.Selector.MatchLabels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// previousReplicaSets returns the ReplicaSets of the revisions before the
+// deployment's current one, newest first.
+func previousReplicaSets(d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) []*v1beta1.ReplicaSet {
+	current := revision(d.Metadata.GetAnnotations())
+
+	var prev []*v1beta1.ReplicaSet
+	for _, rs := range replicaSets {
+		if ownedBy(rs, d) && revision(rs.Metadata.GetAnnotations()) < current {
+			prev = append(prev, rs)
+		}
+	}
+	sort.Slice(prev, func(i, j int) bool {
+		return revision(prev[i].Metadata.GetAnnotations()) > revision(prev[j].Metadata.GetAnnotations())
+	})
+	return prev
+}
+
+// sameTemplate reports if two ReplicaSets run the same pod template, in
+// which case rolling back from one to the other changes nothing. Hashes are
+// compared first. They're computed differently by different versions of the
+// deployment controller, so templates with different hashes are compared
+// without them.
+func sameTemplate(a, b *v1beta1.ReplicaSet) bool {
+	hashA := a.Metadata.GetLabels()[podTemplateHashLabel]
+	hashB := b.Metadata.GetLabels()[podTemplateHashLabel]
+	if hashA != "" && hashA == hashB {
+		return true
+	}
+	strip := func(rs *v1beta1.ReplicaSet) *v1.PodTemplateSpec {
+		t, ok := proto.Clone(rs.Spec.GetTemplate()).(*v1.PodTemplateSpec)
+		if !ok || t == nil {
+			return nil
+		}
+		if t.Metadata != nil {
+			delete(t.Metadata.Labels, podTemplateHashLabel)
+		}
+		return t
+	}
+	ta, tb := strip(a), strip(b)
+	return ta != nil && tb != nil && proto.Equal(ta, tb)
+}
+
+// rollbackTarget returns the ReplicaSet a failed deployment should be rolled
+// back to: the last known good revision recorded by the admission webhook,
+// or else the previous revision. Revisions with the same pod template as the
+// failed one, such as after repeated rollbacks, would only roll back to the
+// same failure, so they're skipped for an older revision, and returned as
+// skipped. If there isn't a target, it returns a reason instead.
+func rollbackTarget(d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) (*v1beta1.ReplicaSet, []*v1beta1.ReplicaSet, string) {
+	if d.Spec.RevisionHistoryLimit != nil && *d.Spec.RevisionHistoryLimit == 0 {
+		return nil, nil, "revisionHistoryLimit is 0, so no previous revisions are kept"
+	}
+	if revision(d.Metadata.GetAnnotations()) == 0 {
+		return nil, nil, "deployment has no revision annotation"
+	}
+	failed := newReplicaSet(d, replicaSets)
+	identical := func(rs *v1beta1.ReplicaSet) bool {
+		return failed != nil && sameTemplate(rs, failed)
+	}
+
+	var skipped []*v1beta1.ReplicaSet
+	if rs := lastKnownGood(d, replicaSets); rs != nil {
+		if !identical(rs) {
+			return rs, nil, ""
+		}
+		skipped = append(skipped, rs)
+	}
+	for _, rs := range previousReplicaSets(d, replicaSets) {
+		if identical(rs) {
+			if len(skipped) == 0 || skipped[0] != rs {
+				skipped = append(skipped, rs)
+			}
+			continue
+		}
+		return rs, skipped, ""
+	}
+	if len(skipped) > 0 {
+		return nil, skipped, "every previous revision has the same pod template as the failed one"
+	}
+	return nil, nil, "no ReplicaSet found for a previous revision, it may have been garbage collected"
+}
+
+// newReplicaSet returns the ReplicaSet of the deployment's current revision,
+// or nil if it hasn't been created yet.
+func newReplicaSet(d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) *v1beta1.ReplicaSet {
+	current := revision(d.Metadata.GetAnnotations())
+	for _, rs := range replicaSets {
+		if ownedBy(rs, d) && revision(rs.Metadata.GetAnnotations()) == current {
+			return rs
+		}
+	}
+	return nil
+}
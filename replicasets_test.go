@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		// Annotations of the deployment, at revision 4.
+		annotations map[string]string
+		// Revisions with ReplicaSets, including the current one, and those
+		// running the same template as the current one.
+		revisions []int64
+		identical []int64
+		noHistory bool
+
+		want        int64
+		wantSkipped []int64
+		wantReason  bool
+	}{
+		{
+			name:      "previous revision",
+			revisions: []int64{1, 2, 3, 4},
+			want:      3,
+		},
+		{
+			name:      "previous revision without current replica set",
+			revisions: []int64{1, 2},
+			want:      2,
+		},
+		{
+			name:        "last known good revision",
+			annotations: map[string]string{annotationLastKnownGood: "2"},
+			revisions:   []int64{1, 2, 3, 4},
+			want:        2,
+		},
+		{
+			name:        "last known good template hash",
+			annotations: map[string]string{annotationLastKnownGoodHash: "hash-1"},
+			revisions:   []int64{1, 2, 3, 4},
+			want:        1,
+		},
+		{
+			name:        "last known good revision garbage collected",
+			annotations: map[string]string{annotationLastKnownGood: "1"},
+			revisions:   []int64{2, 3, 4},
+			want:        3,
+		},
+		{
+			name:        "skip identical revisions",
+			revisions:   []int64{1, 2, 3, 4},
+			identical:   []int64{3, 2},
+			want:        1,
+			wantSkipped: []int64{3, 2},
+		},
+		{
+			name:        "skip identical last known good revision",
+			annotations: map[string]string{annotationLastKnownGood: "2"},
+			revisions:   []int64{1, 2, 3, 4},
+			identical:   []int64{2},
+			want:        3,
+			wantSkipped: []int64{2},
+		},
+		{
+			name:        "every revision identical",
+			revisions:   []int64{1, 2, 4},
+			identical:   []int64{1, 2},
+			wantSkipped: []int64{2, 1},
+			wantReason:  true,
+		},
+		{
+			name:       "no previous revision",
+			revisions:  []int64{4},
+			wantReason: true,
+		},
+		{
+			name:       "no revision history",
+			revisions:  []int64{1, 2, 3, 4},
+			noHistory:  true,
+			wantReason: true,
+		},
+		{
+			name:        "no revision",
+			annotations: map[string]string{revisionAnnotation: ""},
+			revisions:   []int64{1, 2, 3, 4},
+			wantReason:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := testDeployment("hello", 4, true)
+			for k, v := range test.annotations {
+				d.Metadata.Annotations[k] = v
+			}
+			if test.noHistory {
+				d.Spec.RevisionHistoryLimit = new(int32)
+			}
+			var replicaSets []*v1beta1.ReplicaSet
+			for _, rev := range test.revisions {
+				replicaSets = append(replicaSets, testReplicaSet(d, rev))
+			}
+			// ReplicaSets of another deployment are never targets.
+			replicaSets = append(replicaSets, testReplicaSet(testDeployment("other", 2, false), 1))
+			for _, rev := range test.identical {
+				for _, rs := range replicaSets {
+					if revision(rs.Metadata.GetAnnotations()) == rev && ownedBy(rs, d) {
+						rs.Spec.Template.Spec.Containers[0].Image = k8s.String("hello:v4")
+						delete(rs.Metadata.Labels, podTemplateHashLabel)
+					}
+				}
+			}
+
+			target, skipped, reason := rollbackTarget(d, replicaSets)
+			if got := revision(target.GetMetadata().GetAnnotations()); got != test.want {
+				t.Errorf("target revision %d, want %d", got, test.want)
+			}
+			var gotSkipped []int64
+			for _, rs := range skipped {
+				gotSkipped = append(gotSkipped, revision(rs.Metadata.GetAnnotations()))
+			}
+			if !reflect.DeepEqual(gotSkipped, test.wantSkipped) {
+				t.Errorf("skipped revisions %d, want %d", gotSkipped, test.wantSkipped)
+			}
+			if (reason != "") != test.wantReason {
+				t.Errorf("reason %q, want reason %t", reason, test.wantReason)
+			}
+			if (target == nil) != test.wantReason {
+				t.Errorf("target %v, want reason %t", target != nil, test.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Kinds of resources, by the names used in the resources setting.
+const (
+	resourceDeployments  = "deployments"
+	resourceStatefulSets = "statefulsets"
+	resourceDaemonSets   = "daemonsets"
+)
+
+// resourceReconciler checks every object of one kind of resource for
+// failures in a single pass, and handles the ones that failed. Each kind
+// has its own way of detecting failures and of rolling back: deployments
+// use the controller's detectors and strategies.
+type resourceReconciler interface {
+	reconcileAll(ctx context.Context, c *rollbackController) error
+}
+
+// reconcilers holds a reconciler for each kind of resource the controller
+// can handle. Kinds are enabled with the resources setting.
+var reconcilers = map[string]resourceReconciler{
+	resourceDeployments: deploymentReconciler{},
+}
+
+// Kinds that can't be handled yet, and why.
+var unsupportedResources = map[string]string{
+	// The apps/v1beta1 StatefulSets and extensions/v1beta1 DaemonSets the
+	// client supports don't support rolling updates or keep a revision
+	// history, so there's no rollout to detect failures in or previous
+	// revision to roll back to.
+	resourceStatefulSets: "the client's StatefulSet API has no revision history to roll back to",
+	resourceDaemonSets:   "the client's DaemonSet API has no revision history to roll back to",
+}
+
+func validateResources(kinds []string) error {
+	if len(kinds) == 0 {
+		return fmt.Errorf("at least one resource is required")
+	}
+	for _, kind := range kinds {
+		if _, ok := reconcilers[kind]; ok {
+			continue
+		}
+		if why, ok := unsupportedResources[kind]; ok {
+			return fmt.Errorf("%s aren't supported: %s", kind, why)
+		}
+		return fmt.Errorf("unknown resource %q", kind)
+	}
+	return nil
+}
+
+// deploymentReconciler reconciles deployments, see reconcileDeployments.
+type deploymentReconciler struct{}
+
+func (deploymentReconciler) reconcileAll(ctx context.Context, c *rollbackController) error {
+	return c.reconcileDeployments(ctx)
+}
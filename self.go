@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Environment variables identifying the controller's own pod, set using the
+// downward API:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.name
+//	- name: POD_NAMESPACE
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.namespace
+const (
+	envPodName      = "POD_NAME"
+	envPodNamespace = "POD_NAMESPACE"
+)
+
+// selfDeployment describes the controller's own deployment, found once.
+type selfDeployment struct {
+	found     bool
+	namespace string
+	name      string
+}
+
+// findSelf looks up the deployment running the controller, through its pod
+// and ReplicaSet. Rolling back the controller's own deployment in the middle
+// of an upgrade could leave it unable to run at all, so it's never handled
+// automatically unless allowSelfRollback is set.
+//
+// The lookup is only done once a pod's been found, or if the downward API
+// variables aren't set, for example when running outside the cluster.
+func (c *rollbackController) findSelf(ctx context.Context, replicaSets []*v1beta1.ReplicaSet) {
+	if c.self.found {
+		return
+	}
+	podName, podNamespace := os.Getenv(envPodName), os.Getenv(envPodNamespace)
+	if podName == "" || podNamespace == "" {
+		c.self.found = true
+		return
+	}
+	if c.namespace != "" && c.namespace != podNamespace {
+		// The controller's deployment isn't one it reconciles.
+		c.self.found = true
+		return
+	}
+	pods, err := c.api.listPods(ctx, podNamespace)
+	if err != nil {
+		c.logger.Printf("find controller's own deployment: list pods: %v", err)
+		return
+	}
+	c.self.found = true
+	for _, p := range pods {
+		if p.Metadata.GetName() != podName {
+			continue
+		}
+		for _, rs := range replicaSets {
+			if !podOwnedBy(p, rs) {
+				continue
+			}
+			for _, ref := range rs.Metadata.GetOwnerReferences() {
+				if ref.GetKind() == "Deployment" {
+					c.self.namespace, c.self.name = podNamespace, ref.GetName()
+					c.logger.Printf("running in deployment %s/%s, it won't be handled automatically", c.self.namespace, c.self.name)
+					return
+				}
+			}
+		}
+	}
+}
+
+// isSelf reports if a deployment is the controller's own.
+func (c *rollbackController) isSelf(d *v1beta1.Deployment) bool {
+	return c.self.name != "" && d.Metadata.GetNamespace() == c.self.namespace && d.Metadata.GetName() == c.self.name
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s/api/resource"
+	"github.com/ericchiang/k8s/api/unversioned"
+	"github.com/ericchiang/k8s/api/v1"
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	batchv1 "github.com/ericchiang/k8s/apis/batch/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	policyv1beta1 "github.com/ericchiang/k8s/apis/policy/v1beta1"
+	"github.com/ericchiang/k8s/util/intstr"
+	"github.com/golang/protobuf/proto"
+)
+
+// loadSnapshot adds the objects in a directory of YAML or JSON manifests to
+// a fake API, such as the output of
+//
+//	kubectl get deployments,replicasets,pods -o yaml
+//
+// Files can hold a single object, a List, or several documents separated by
+// "---". Kinds the controller doesn't read are skipped. It returns the number
+// of objects loaded.
+func loadSnapshot(dir string, f *fakeAPI) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if fi.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return n, err
+		}
+		for i, doc := range splitDocuments(string(data)) {
+			b, err := yamlToJSON([]byte(doc))
+			if err != nil {
+				return n, fmt.Errorf("%s: document %d: %v", path, i+1, err)
+			}
+			loaded, err := addSnapshotObject(f, b)
+			if err != nil {
+				return n, fmt.Errorf("%s: document %d: %v", path, i+1, err)
+			}
+			n += loaded
+		}
+	}
+	return n, nil
+}
+
+// splitDocuments splits a YAML stream into its documents, which yamlToJSON
+// doesn't support.
+func splitDocuments(data string) []string {
+	var (
+		docs []string
+		cur  []string
+	)
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "---" {
+			docs = append(docs, strings.Join(cur, "\n"))
+			cur = nil
+			continue
+		}
+		cur = append(cur, line)
+	}
+	docs = append(docs, strings.Join(cur, "\n"))
+
+	var nonEmpty []string
+	for _, doc := range docs {
+		if strings.TrimSpace(stripComments(doc)) != "" {
+			nonEmpty = append(nonEmpty, doc)
+		}
+	}
+	return nonEmpty
+}
+
+func stripComments(doc string) string {
+	var lines []string
+	for _, line := range strings.Split(doc, "\n") {
+		lines = append(lines, stripComment(line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// addSnapshotObject adds the object, or the items of the List, in the API's
+// JSON to the fake API.
+func addSnapshotObject(f *fakeAPI, b []byte) (int, error) {
+	var head struct {
+		Kind  string            `json:"kind"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(b, &head); err != nil {
+		return 0, err
+	}
+	if strings.HasSuffix(head.Kind, "List") {
+		n := 0
+		for _, item := range head.Items {
+			loaded, err := addSnapshotObject(f, item)
+			if err != nil {
+				return n, err
+			}
+			n += loaded
+		}
+		return n, nil
+	}
+
+	var err error
+	switch head.Kind {
+	case "Deployment":
+		d := new(v1beta1.Deployment)
+		if err = decodeAPIJSON(b, d); err == nil {
+			f.addDeployment(d)
+		}
+	case "ReplicaSet":
+		rs := new(v1beta1.ReplicaSet)
+		if err = decodeAPIJSON(b, rs); err == nil {
+			f.addReplicaSet(rs)
+		}
+	case "Pod":
+		p := new(v1.Pod)
+		if err = decodeAPIJSON(b, p); err == nil {
+			f.addPod(p)
+		}
+	case "Namespace":
+		ns := new(v1.Namespace)
+		if err = decodeAPIJSON(b, ns); err == nil {
+			f.addNamespace(ns)
+		}
+	case "HorizontalPodAutoscaler":
+		h := new(autoscalingv1.HorizontalPodAutoscaler)
+		if err = decodeAPIJSON(b, h); err == nil {
+			f.addHorizontalPodAutoscaler(h)
+		}
+	case "PodDisruptionBudget":
+		p := new(policyv1beta1.PodDisruptionBudget)
+		if err = decodeAPIJSON(b, p); err == nil {
+			f.addPodDisruptionBudget(p)
+		}
+	case "Job":
+		job := new(batchv1.Job)
+		if err = decodeAPIJSON(b, job); err == nil {
+			f.addJob(job)
+		}
+	default:
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("decode %s: %v", head.Kind, err)
+	}
+	return 1, nil
+}
+
+var (
+	intOrStringType = reflect.TypeOf(intstr.IntOrString{})
+	quantityType    = reflect.TypeOf(resource.Quantity{})
+)
+
+// decodeAPIJSON decodes an object in the JSON used by the API, rather than
+// the client's JSON encoding of its protobuf types, which differs for
+// quantities and int-or-string values.
+func decodeAPIJSON(b []byte, obj interface{}) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	b, err := json.Marshal(convertAPIValue(v, reflect.TypeOf(obj)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, obj)
+}
+
+// convertAPIValue converts a value of the API's JSON to the client's JSON
+// encoding of the type it's decoded into.
+func convertAPIValue(v interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case intOrStringType:
+		switch v := v.(type) {
+		case float64:
+			return map[string]interface{}{"type": 0, "intVal": v}
+		case string:
+			return map[string]interface{}{"type": 1, "strVal": v}
+		}
+		return v
+	case quantityType:
+		switch v := v.(type) {
+		case float64:
+			return map[string]interface{}{"string": fmt.Sprint(v)}
+		case string:
+			return map[string]interface{}{"string": v}
+		}
+		return v
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if fv, ok := m[name]; ok && name != "" && name != "-" {
+				m[name] = convertAPIValue(fv, field.Type)
+			}
+		}
+		return m
+	case reflect.Slice:
+		l, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		for i := range l {
+			l[i] = convertAPIValue(l[i], t.Elem())
+		}
+		return l
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for k := range m {
+			m[k] = convertAPIValue(m[k], t.Elem())
+		}
+		return m
+	}
+	return v
+}
+
+// simulatedGitHost stands in for the git host in simulations, which must not
+// propose changes.
+type simulatedGitHost struct{}
+
+func (simulatedGitHost) readFile(ctx context.Context, path string) (string, error) {
+	return "", fmt.Errorf("git isn't available in simulations, would have read %s", path)
+}
+
+func (simulatedGitHost) proposeChange(ctx context.Context, change *gitChange) (string, error) {
+	return "", fmt.Errorf("git isn't available in simulations")
+}
+
+// simulatedPlugin stands in for plugins in simulations, which mustn't act.
+type simulatedPlugin struct{}
+
+func (simulatedPlugin) call(ctx context.Context, method string, req, resp proto.Message) error {
+	return fmt.Errorf("plugins aren't available in simulations, would have called %s", method)
+}
+
+// snapshotTime returns the latest time recorded in the objects of a fake
+// API, an estimate of when a snapshot was taken, or the zero time if they
+// don't record any.
+func snapshotTime(f *fakeAPI) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var latest time.Time
+	add := func(t *unversioned.Time) {
+		if t := time.Unix(t.GetSeconds(), 0); t.Unix() > 0 && t.After(latest) {
+			latest = t
+		}
+	}
+	for _, d := range f.deployments {
+		add(d.Metadata.GetCreationTimestamp())
+		for _, c := range d.Status.GetConditions() {
+			add(c.GetLastUpdateTime())
+			add(c.GetLastTransitionTime())
+		}
+		if t, err := time.Parse(time.RFC3339, d.Metadata.GetAnnotations()[annotationLastRollbackTime]); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	for _, rs := range f.replicaSets {
+		add(rs.Metadata.GetCreationTimestamp())
+	}
+	for _, p := range f.pods {
+		add(p.Metadata.GetCreationTimestamp())
+		for _, c := range p.Status.GetConditions() {
+			add(c.GetLastTransitionTime())
+		}
+	}
+	return latest
+}
+
+// simulate runs a single reconcile pass over the objects of a fake API, as
+// of the given time, without contacting anything but the fake. Notifications
+// are logged, and detectors that query other services, including plugins,
+// are dropped. A single pass can't see a deployment keep failing, so the
+// confirmation delay is treated as over. It returns the failed deployments
+// and the actions the controller would have taken.
+func (c *rollbackController) simulate(ctx context.Context, at time.Time) ([]*deploymentStatus, []*rollbackRecord, error) {
+	c.clock = func() time.Time { return at }
+	cfg := c.cfg.clone()
+	cfg.ConfirmationDelay.Duration = 0
+	c.cfg = cfg
+
+	c.notifier = &templatedNotifier{notifierLog, &logNotifier{logger: c.logger}, c}
+	if c.git != nil {
+		c.git = simulatedGitHost{}
+	}
+	for name := range c.plugins {
+		c.plugins[name] = simulatedPlugin{}
+	}
+	var detectors []detector
+	for _, d := range c.detectors {
+		switch d.(type) {
+		case *prometheusDetector, *pluginDetector:
+		default:
+			detectors = append(detectors, d)
+		}
+	}
+	c.detectors = detectors
+
+	err := c.run(ctx)
+
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	records := append([]*rollbackRecord(nil), c.status.records...)
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return c.status.failed, records, err
+}
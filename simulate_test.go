@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+func TestSimulate(t *testing.T) {
+	// When the snapshot was taken. The wall clock is years later.
+	taken := time.Date(2017, 6, 1, 10, 10, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		args []string
+		// Failed, rather than stuck, at snapshot time, and rolled back
+		// that long before it.
+		failed     bool
+		rolledBack time.Duration
+		// Evaluate the snapshot this long after it was taken.
+		after time.Duration
+
+		wantActions []string
+	}{
+		{
+			name:        "confirmation delay",
+			args:        []string{"--confirmation-delay=1h"},
+			failed:      true,
+			wantActions: []string{"rollback"},
+		},
+		{
+			name: "rollout not yet stuck",
+			args: []string{"--rollout-timeout=15m"},
+		},
+		{
+			name:        "rollout stuck later",
+			args:        []string{"--rollout-timeout=15m"},
+			after:       15 * time.Minute,
+			wantActions: []string{"rollback"},
+		},
+		{
+			name:        "within cooldown",
+			args:        []string{"--cooldown=1h"},
+			failed:      true,
+			rolledBack:  30 * time.Minute,
+			wantActions: []string{"notify"},
+		},
+		{
+			name:        "after cooldown",
+			args:        []string{"--cooldown=1h"},
+			failed:      true,
+			rolledBack:  90 * time.Minute,
+			wantActions: []string{"rollback"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			d := testDeployment("hello", 2, test.failed)
+			started := fakeTime(taken.Add(-5 * time.Minute).Format(time.RFC3339))
+			d.Metadata.CreationTimestamp = fakeTime(taken.Add(-24 * time.Hour).Format(time.RFC3339))
+			if test.failed {
+				d.Status.Conditions[0].LastUpdateTime = fakeTime(taken.Format(time.RFC3339))
+			} else {
+				d.Status.Conditions = []*v1beta1.DeploymentCondition{{
+					Type:               k8s.String("Progressing"),
+					Status:             k8s.String("True"),
+					Reason:             k8s.String("ReplicaSetUpdated"),
+					LastUpdateTime:     fakeTime(taken.Format(time.RFC3339)),
+					LastTransitionTime: started,
+				}}
+			}
+			if test.rolledBack != 0 {
+				d.Metadata.Annotations[annotationLastRollbackTime] = taken.Add(-test.rolledBack).Format(time.RFC3339)
+			}
+			f.addDeployment(d)
+			old := testReplicaSet(d, 1)
+			old.Metadata.CreationTimestamp = d.Metadata.CreationTimestamp
+			f.addReplicaSet(old)
+			cur := testReplicaSet(d, 2)
+			cur.Metadata.CreationTimestamp = started
+			cur.Status.ReadyReplicas = int32Ptr(0)
+			f.addReplicaSet(cur)
+
+			if got := snapshotTime(f); !got.Equal(taken) {
+				t.Fatalf("snapshot time %s, want %s", got, taken)
+			}
+			c := newTestController(t, f, test.args...)
+			at := taken.Add(test.after)
+			_, records, err := c.simulate(context.Background(), at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actions []string
+			for _, r := range records {
+				actions = append(actions, r.Action)
+				if !r.Time.Equal(at) {
+					t.Errorf("%s recorded at %s, want %s", r.Action, r.Time, at)
+				}
+			}
+			if !reflect.DeepEqual(actions, test.wantActions) {
+				t.Errorf("got actions %q, want %q", actions, test.wantActions)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/golang/protobuf/proto"
+)
+
+// Rollback attempt counts and last known good revisions are kept in
+// annotations on the deployments themselves. The rest of the controller's
+// state, such as when deployments started failing, namespace budgets, recent
+// actions, and the notifications already sent, is held in memory, and
+// optionally persisted by a stateStore so it survives restarts.
+
+// stateStore persists the controller's state for each namespace.
+type stateStore interface {
+	// load returns the saved state of a namespace, or an empty state if
+	// nothing has been saved.
+	load(ctx context.Context, namespace string) (*namespaceState, error)
+	// save saves the state of a namespace, returning a *stateConflictError
+	// if it was saved by someone else since it was last loaded.
+	save(ctx context.Context, namespace string, s *namespaceState) error
+}
+
+// stateConflictError is returned when a namespace's state was saved by
+// someone else, such as another replica of the controller, since it was
+// loaded.
+type stateConflictError struct {
+	namespace string
+}
+
+func (e *stateConflictError) Error() string {
+	return fmt.Sprintf("state of namespace %s was saved by someone else since it was loaded", e.namespace)
+}
+
+// Number of times saveState tries to save a namespace's state that keeps
+// being saved by someone else between loading and saving it.
+const maxSaveAttempts = 3
+
+// Number of records saved for each namespace. Records are saved without
+// their diagnostics to keep the state small.
+const maxSavedRecords = 50
+
+// Number of handled events saved for each namespace, the most recent first.
+// Older events are of revisions long since replaced.
+const maxSavedHandled = 500
+
+// namespaceState is the persisted state of a namespace.
+type namespaceState struct {
+	// When each deployment was first seen failing, see confirmed.
+	FailingSince map[string]failingSinceState `json:"failingSince,omitempty"`
+	// Recent automatic rollbacks, see spendBudget.
+	Rollbacks []time.Time `json:"rollbacks,omitempty"`
+	// Recent actions, oldest first.
+	Records []*rollbackRecord `json:"records,omitempty"`
+	// Events that have been handled, such as notifications sent, see once,
+	// oldest first.
+	Handled []handledEventState `json:"handled,omitempty"`
+}
+
+type failingSinceState struct {
+	Revision int64     `json:"revision"`
+	Since    time.Time `json:"since"`
+}
+
+type handledEventState struct {
+	Kind     string    `json:"kind"`
+	UID      string    `json:"uid"`
+	Revision int64     `json:"revision"`
+	Time     time.Time `json:"time"`
+}
+
+// loadState loads the saved state of namespaces before each pass, so what
+// another controller saved, such as one that was replaced or is failing
+// over, is seen before acting. A namespace that has never been loaded is
+// retried on the next pass, and its state isn't saved until it has been.
+func (c *rollbackController) loadState(ctx context.Context, namespaces []string) {
+	for _, ns := range namespaces {
+		s, err := c.store.load(ctx, ns)
+		if err != nil {
+			c.logger.Printf("load state of namespace %s: %v", ns, err)
+			continue
+		}
+		c.restoreState(ns, s)
+	}
+}
+
+// restoreState merges a namespace's saved state into the controller's,
+// unless it's what the controller last loaded or saved itself.
+func (c *rollbackController) restoreState(ns string, s *namespaceState) {
+	b, _ := json.Marshal(s)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if saved, ok := c.savedState[ns]; ok && string(saved) == string(b) {
+		return
+	}
+	if c.savedState == nil {
+		c.savedState = make(map[string][]byte)
+	}
+	if c.failingSince == nil {
+		c.failingSince = make(map[string]failingSince)
+	}
+	if c.budgets == nil {
+		c.budgets = make(map[string][]time.Time)
+	}
+	for name, f := range s.FailingSince {
+		key := ns + "/" + name
+		if _, ok := c.failingSince[key]; !ok {
+			c.failingSince[key] = failingSince{revision: f.Revision, since: f.Since}
+		}
+	}
+	if c.handled == nil {
+		c.handled = make(map[handledKey]time.Time)
+	}
+	for _, h := range s.Handled {
+		key := handledKey{ns, h.UID, h.Revision, h.Kind}
+		if _, ok := c.handled[key]; !ok {
+			c.handled[key] = h.Time
+		}
+	}
+	c.budgets[ns] = mergeTimes(c.budgets[ns], s.Rollbacks)
+	c.status.addRecords(s.Records)
+	// Saving the merged state next pass writes anything that changed since.
+	c.savedState[ns] = b
+}
+
+// mergeTimes returns the times in either list, sorted and without
+// duplicates.
+func mergeTimes(a, b []time.Time) []time.Time {
+	merged := append(append([]time.Time(nil), a...), b...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Before(merged[j]) })
+	var times []time.Time
+	for i, t := range merged {
+		if i == 0 || !t.Equal(merged[i-1]) {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+// saveState saves the state of every loaded namespace that has changed since
+// it was last loaded or saved. If someone else saved a namespace's state in
+// the meantime, it's loaded again and merged before retrying, rather than
+// overwritten.
+func (c *rollbackController) saveState(ctx context.Context) error {
+	var errs []string
+	for ns, s := range c.namespaceStates() {
+		if err := c.saveNamespaceState(ctx, ns, s); err != nil {
+			errs = append(errs, fmt.Sprintf("namespace %s: %v", ns, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("save state: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *rollbackController) saveNamespaceState(ctx context.Context, ns string, s *namespaceState) error {
+	for attempt := 1; ; attempt++ {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("marshal state: %v", err)
+		}
+		c.mu.Lock()
+		unchanged := string(c.savedState[ns]) == string(b)
+		c.mu.Unlock()
+		if unchanged {
+			return nil
+		}
+		err = c.store.save(ctx, ns, s)
+		if err == nil {
+			c.mu.Lock()
+			c.savedState[ns] = b
+			c.mu.Unlock()
+			return nil
+		}
+		if _, ok := err.(*stateConflictError); !ok || attempt == maxSaveAttempts {
+			return err
+		}
+		saved, err := c.store.load(ctx, ns)
+		if err != nil {
+			return err
+		}
+		c.restoreState(ns, saved)
+		s = c.namespaceStates()[ns]
+	}
+}
+
+// pruneHandled forgets all but the most recent maxSavedHandled handled
+// events of each namespace, the same events namespaceStates saves, so the
+// controller's memory doesn't grow with every revision it has seen.
+func (c *rollbackController) pruneHandled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	byNamespace := make(map[string][]handledKey)
+	for key := range c.handled {
+		byNamespace[key.namespace] = append(byNamespace[key.namespace], key)
+	}
+	for _, keys := range byNamespace {
+		if len(keys) <= maxSavedHandled {
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool { return c.handled[keys[i]].After(c.handled[keys[j]]) })
+		for _, key := range keys[maxSavedHandled:] {
+			delete(c.handled, key)
+		}
+	}
+}
+
+// namespaceStates returns the current state of every loaded namespace.
+func (c *rollbackController) namespaceStates() map[string]*namespaceState {
+	states := make(map[string]*namespaceState)
+
+	c.mu.Lock()
+	for ns := range c.savedState {
+		states[ns] = &namespaceState{Rollbacks: append([]time.Time(nil), c.budgets[ns]...)}
+	}
+	for key, f := range c.failingSince {
+		i := strings.Index(key, "/")
+		s, ok := states[key[:i]]
+		if !ok {
+			continue
+		}
+		if s.FailingSince == nil {
+			s.FailingSince = make(map[string]failingSinceState)
+		}
+		s.FailingSince[key[i+1:]] = failingSinceState{Revision: f.revision, Since: f.since}
+	}
+	for key, t := range c.handled {
+		if s, ok := states[key.namespace]; ok {
+			s.Handled = append(s.Handled, handledEventState{Kind: key.kind, UID: key.uid, Revision: key.revision, Time: t})
+		}
+	}
+	c.mu.Unlock()
+
+	for _, s := range states {
+		// Keep the most recent, ordered so unchanged state marshals the same.
+		sort.Slice(s.Handled, func(i, j int) bool {
+			a, b := s.Handled[i], s.Handled[j]
+			if !a.Time.Equal(b.Time) {
+				return a.Time.After(b.Time)
+			}
+			if a.UID != b.UID {
+				return a.UID < b.UID
+			}
+			if a.Revision != b.Revision {
+				return a.Revision < b.Revision
+			}
+			return a.Kind < b.Kind
+		})
+		if len(s.Handled) > maxSavedHandled {
+			s.Handled = s.Handled[:maxSavedHandled]
+		}
+		for i, j := 0, len(s.Handled)-1; i < j; i, j = i+1, j-1 {
+			s.Handled[i], s.Handled[j] = s.Handled[j], s.Handled[i]
+		}
+	}
+
+	c.status.mu.Lock()
+	for i := len(c.status.records) - 1; i >= 0; i-- {
+		r := c.status.records[i]
+		s, ok := states[r.Namespace]
+		if !ok || len(s.Records) == maxSavedRecords {
+			continue
+		}
+		saved := *r
+		saved.Diagnostics = nil
+		s.Records = append(s.Records, &saved)
+	}
+	c.status.mu.Unlock()
+
+	for _, s := range states {
+		// Records were collected newest first.
+		for i, j := 0, len(s.Records)-1; i < j; i, j = i+1, j-1 {
+			s.Records[i], s.Records[j] = s.Records[j], s.Records[i]
+		}
+	}
+	return states
+}
+
+// Supported values of --state-store.
+const (
+	stateStoreMemory    = "memory"
+	stateStoreConfigMap = "configmap"
+)
+
+// Name of the key holding the state in a configMapStore's ConfigMaps.
+const stateConfigMapKey = "state.json"
+
+// configMapStore saves each namespace's state in a ConfigMap in that
+// namespace. ConfigMaps are written with the resource version they were
+// last read or written at, so state saved by someone else in the meantime
+// isn't overwritten.
+type configMapStore struct {
+	api  deploymentAPI
+	name string
+
+	// The ConfigMap of each namespace as last read or written, or nil if it
+	// didn't exist.
+	mu         sync.Mutex
+	configMaps map[string]*v1.ConfigMap
+}
+
+// setConfigMap records the ConfigMap of a namespace as last read or
+// written.
+func (s *configMapStore) setConfigMap(namespace string, cm *v1.ConfigMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.configMaps == nil {
+		s.configMaps = make(map[string]*v1.ConfigMap)
+	}
+	s.configMaps[namespace] = cm
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*k8s.APIError)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+func (s *configMapStore) load(ctx context.Context, namespace string) (*namespaceState, error) {
+	state := new(namespaceState)
+	cm, err := s.api.getConfigMap(ctx, namespace, s.name)
+	if err != nil {
+		if isNotFound(err) {
+			s.setConfigMap(namespace, nil)
+			return state, nil
+		}
+		return nil, fmt.Errorf("get configmap %s: %v", s.name, err)
+	}
+	s.setConfigMap(namespace, cm)
+	data, ok := cm.GetData()[stateConfigMapKey]
+	if !ok {
+		return state, nil
+	}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("configmap %s: invalid %s: %v", s.name, stateConfigMapKey, err)
+	}
+	return state, nil
+}
+
+func (s *configMapStore) save(ctx context.Context, namespace string, state *namespaceState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	cm, loaded := s.configMaps[namespace]
+	s.mu.Unlock()
+	if !loaded {
+		return fmt.Errorf("configmap %s hasn't been loaded", s.name)
+	}
+
+	if cm == nil {
+		cm = &v1.ConfigMap{
+			Metadata: &v1.ObjectMeta{
+				Name:        k8s.String(s.name),
+				Namespace:   k8s.String(namespace),
+				Annotations: map[string]string{annotationManagedBy: managerName},
+			},
+			Data: map[string]string{stateConfigMapKey: string(b)},
+		}
+		created, err := s.api.createConfigMap(ctx, cm)
+		if err != nil {
+			if isConflict(err) {
+				return &stateConflictError{namespace}
+			}
+			return fmt.Errorf("create configmap %s: %v", s.name, err)
+		}
+		s.setConfigMap(namespace, created)
+		return nil
+	}
+	cm = proto.Clone(cm).(*v1.ConfigMap)
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[stateConfigMapKey] = string(b)
+	updated, err := s.api.updateConfigMap(ctx, cm)
+	if err != nil {
+		if isConflict(err) {
+			return &stateConflictError{namespace}
+		}
+		return fmt.Errorf("update configmap %s: %v", s.name, err)
+	}
+	s.setConfigMap(namespace, updated)
+	return nil
+}
+
+// deploymentNamespaces returns the namespaces of a list of deployments,
+// sorted and without duplicates.
+func deploymentNamespaces(deployments []*v1beta1.Deployment) []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, d := range deployments {
+		if ns := d.Metadata.GetNamespace(); !seen[ns] {
+			seen[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConfigMapStoreConcurrentSaves(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	hello := testDeployment("hello", 2, true)
+	world := testDeployment("world", 3, true)
+
+	// Two controllers sharing the same ConfigMaps, such as a controller and
+	// the replacement taking over from it.
+	a := newTestController(t, f, "--namespace-budget=5")
+	a.store = &configMapStore{api: f, name: "state"}
+	b := newTestController(t, f, "--namespace-budget=5")
+	b.store = &configMapStore{api: f, name: "state"}
+	a.loadState(ctx, []string{"default"})
+	b.loadState(ctx, []string{"default"})
+
+	if !a.once("failure", hello) {
+		t.Fatal("first failure wasn't new")
+	}
+	a.recordAction(hello, "rollback", 1, "rolled back")
+	if !a.spendBudget(hello, time.Now()) {
+		t.Fatal("budget wasn't available")
+	}
+	if err := a.saveState(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// b saves after a, without having loaded what a saved.
+	if !b.once("failure", world) {
+		t.Fatal("first failure wasn't new")
+	}
+	if err := b.saveState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if b.once("failure", hello) {
+		t.Error("failure handled by another controller was handled again")
+	}
+
+	saved, err := (&configMapStore{api: f, name: "state"}).load(ctx, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Handled) != 2 {
+		t.Errorf("saved %d handled events, want 2: %+v", len(saved.Handled), saved.Handled)
+	}
+	if len(saved.Records) != 1 || len(saved.Rollbacks) != 1 {
+		t.Errorf("saved %d records and %d rollbacks, want 1 of each", len(saved.Records), len(saved.Rollbacks))
+	}
+
+	// Loading state again before the next pass picks up what b saved, and
+	// doesn't repeat what a already had.
+	a.loadState(ctx, []string{"default"})
+	if a.once("failure", world) {
+		t.Error("failure handled by another controller was handled again")
+	}
+	if got := a.actions("hello"); len(got) != 1 {
+		t.Errorf("got actions %q after reloading state, want one", got)
+	}
+	if got := len(a.budgets["default"]); got != 1 {
+		t.Errorf("got %d rollbacks in the budget after reloading state, want 1", got)
+	}
+}
+
+func TestPruneHandled(t *testing.T) {
+	c := newTestController(t, newFakeAPI())
+	start := time.Now()
+	c.handled = make(map[handledKey]time.Time)
+	for i := 0; i < maxSavedHandled+10; i++ {
+		c.handled[handledKey{"default", "uid", int64(i), "failure"}] = start.Add(time.Duration(i) * time.Second)
+	}
+	c.handled[handledKey{"other", "uid", 1, "failure"}] = start
+
+	c.pruneHandled()
+	if got, want := len(c.handled), maxSavedHandled+1; got != want {
+		t.Fatalf("kept %d handled events, want %d", got, want)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := c.handled[handledKey{"default", "uid", int64(i), "failure"}]; ok {
+			t.Errorf("kept event of revision %d, one of the oldest", i)
+		}
+	}
+	if _, ok := c.handled[handledKey{"other", "uid", 1, "failure"}]; !ok {
+		t.Error("pruned event of a namespace under the limit")
+	}
+}
+
+func TestNotificationKey(t *testing.T) {
+	d := testDeployment("hello", 2, true)
+	a := notificationKey(d, "cooldown")
+	if a != "uid-hello/2/cooldown" {
+		t.Errorf("got key %q", a)
+	}
+	if b := notificationKey(d, "rollback"); a == b {
+		t.Errorf("events of different kinds have the same key %q", a)
+	}
+	if b := notificationKey(testDeployment("hello", 3, true), "cooldown"); a == b {
+		t.Errorf("events of different revisions have the same key %q", a)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// annotationStrategy lets a deployment choose how it's handled when it
+// fails, overriding the defaultStrategy setting.
+const annotationStrategy = "rollback-controller/strategy"
+
+// annotationPausedByController records the revision of a deployment the
+// controller paused, to tell it apart from deployments paused by a human.
+const annotationPausedByController = "rollback-controller/paused-by-controller"
+
+// Annotations recording the controller's last rollback of a deployment, for
+// deploy tooling to read, for example to block promoting the artifact that
+// was rolled back again. to-revision isn't set by image rollbacks, which roll
+// forward to a new revision instead.
+const (
+	annotationLastRollbackTime = "rollback-controller/last-rollback-time"
+	annotationFromRevision     = "rollback-controller/from-revision"
+	annotationToRevision       = "rollback-controller/to-revision"
+	annotationRollbackReason   = "rollback-controller/reason"
+)
+
+// setRollbackAnnotations records a rollback of a deployment from its current
+// revision. A toRevision of zero means there's no target revision.
+func setRollbackAnnotations(d *v1beta1.Deployment, toRevision int64, reason string, now time.Time) {
+	setAnnotation(d, annotationLastRollbackTime, now.UTC().Format(time.RFC3339))
+	setAnnotation(d, annotationFromRevision, strconv.FormatInt(revision(d.Metadata.GetAnnotations()), 10))
+	if toRevision != 0 {
+		setAnnotation(d, annotationToRevision, strconv.FormatInt(toRevision, 10))
+	} else {
+		delete(d.Metadata.Annotations, annotationToRevision)
+	}
+	setAnnotation(d, annotationRollbackReason, reason)
+}
+
+// Strategies for handling failed deployments.
+const (
+	strategyRollback    = "rollback"
+	strategyPause       = "pause"
+	strategyScaleToZero = "scale-to-zero"
+	strategyNotifyOnly  = "notify-only"
+	strategyGit         = "git"
+	strategyImage       = "image"
+	strategyPlugin      = "plugin"
+)
+
+// failure is a failed deployment being handled by a strategy.
+type failure struct {
+	d *v1beta1.Deployment
+	// Why the deployment is considered failed.
+	reason string
+	// All ReplicaSets in the deployment's namespace.
+	replicaSets []*v1beta1.ReplicaSet
+}
+
+// strategyHandler acts on a failed deployment.
+type strategyHandler func(c *rollbackController, ctx context.Context, f *failure) error
+
+var strategies = map[string]strategyHandler{
+	strategyRollback:    (*rollbackController).rollback,
+	strategyPause:       (*rollbackController).pause,
+	strategyScaleToZero: (*rollbackController).scaleToZero,
+	strategyNotifyOnly:  (*rollbackController).notifyOnly,
+	strategyGit:         (*rollbackController).gitRevert,
+	strategyImage:       (*rollbackController).imageRollback,
+	strategyPlugin:      (*rollbackController).pluginAct,
+}
+
+func validateStrategy(s string) error {
+	if _, ok := strategies[s]; !ok {
+		return fmt.Errorf("unknown strategy %q", s)
+	}
+	return nil
+}
+
+// pausedByController reports if a deployment is paused because the controller
+// paused its current revision, rather than by a human.
+func pausedByController(d *v1beta1.Deployment) bool {
+	v, ok := d.Metadata.GetAnnotations()[annotationPausedByController]
+	return d.Spec.GetPaused() && ok && v == strconv.FormatInt(revision(d.Metadata.GetAnnotations()), 10)
+}
+
+// strategyFor returns the strategy a deployment, or its namespace, has
+// chosen.
+func (c *rollbackController) strategyFor(d *v1beta1.Deployment) (string, error) {
+	s, ok := c.annotation(d, annotationStrategy)
+	if !ok {
+		return c.cfg.DefaultStrategy, nil
+	}
+	if err := validateStrategy(s); err != nil {
+		return "", fmt.Errorf("invalid %s annotation: %v", annotationStrategy, err)
+	}
+	return s, nil
+}
+
+// rollback rolls a deployment back to its previous revision. If the
+// previous ReplicaSet doesn't have the minimum number of ready pods, the
+// deployment is paused instead. Deployments that have been rolled back too
+// many times recently are scaled to zero. See stopFailedRollout for partially
+// complete rollouts.
+func (c *rollbackController) rollback(ctx context.Context, f *failure) error {
+	d := f.d
+	target, skipped, why := rollbackTarget(d, f.replicaSets)
+	c.skippedIdentical(ctx, d, skipped)
+	if target == nil {
+		return c.noRollbackTarget(ctx, f, why)
+	}
+
+	ok, why, err := c.checkAvailability(d, target)
+	if err != nil {
+		return fmt.Errorf("check availability: %v", err)
+	}
+	if !ok {
+		return c.pauseDeployment(ctx, d, "deployment failed and was paused instead of rolled back: "+why)
+	}
+
+	now := c.now()
+	annotations, ok := c.countRollback(d, now)
+	if !ok {
+		return c.tripCircuitBreaker(ctx, f)
+	}
+	if !c.spendBudget(d, now) {
+		return c.overBudget(ctx, f)
+	}
+
+	// Diagnose the failed pods before they might be scaled down.
+	diags := c.diagnose(ctx, d, f.replicaSets)
+	note := c.stopFailedRollout(ctx, d, f.replicaSets)
+	err = c.rollbackTo(ctx, d, target, "rolled back failed deployment: "+f.reason+note, diags, annotations)
+	// Only rollbacks that were written count against the budget, not those
+	// that failed or were aborted. Errors sending the notification come
+	// after the rollback was written.
+	if d.Spec.RollbackTo == nil {
+		c.refundBudget(d, now)
+	}
+	return err
+}
+
+// rollbackTo rolls a deployment back to the revision of a target ReplicaSet,
+// setting any annotations provided along with the rollback annotations, using
+// msg as the reason. Diagnostics of the failed rollout, if
+// any, are attached to the rollback's record, event, and notification.
+func (c *rollbackController) rollbackTo(ctx context.Context, d *v1beta1.Deployment, target *v1beta1.ReplicaSet, msg string, diags []*podDiagnostic, annotations map[string]string) error {
+	targetRevision := revision(target.Metadata.GetAnnotations())
+	// Restore the target's config before its pods are recreated.
+	configNote := c.restoreConfig(ctx, d, target)
+	resumed := false
+	err := c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+		for k, v := range annotations {
+			setAnnotation(d, k, v)
+		}
+		setRollbackAnnotations(d, targetRevision, msg, c.now())
+		d.Spec.RollbackTo = &v1beta1.RollbackConfig{
+			Revision: &targetRevision,
+		}
+		// Rollbacks of paused deployments aren't acted on until they're
+		// resumed.
+		resumed = c.cfg.UnpauseAfterRollback && pausedByController(d)
+		if resumed {
+			d.Spec.Paused = k8s.Bool(false)
+			delete(d.Metadata.Annotations, annotationPausedByController)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("rolled back deployment: %s region=%q to revision %d", *d.Metadata.Name, c.regionOf(d), targetRevision)
+	msg = fmt.Sprintf("%s (revision %d to %d)", msg, revision(d.Metadata.GetAnnotations()), targetRevision)
+	if resumed {
+		msg += ", resumed the deployment paused by the controller"
+	}
+	msg += configNote
+	rec := c.newRecord(d, "rollback", targetRevision, msg)
+	rec.Diagnostics = diags
+	c.startVerification(ctx, d, rec)
+
+	eventMsg := msg
+	if len(diags) > 0 {
+		eventMsg += ": " + summarizeDiagnostics(diags)
+	}
+	c.recordEvent(ctx, d, eventNormal, "RolledBack", eventMsg)
+
+	n := c.newNotification(d, "rollback", severityInfo, msg)
+	n.Diagnostics = diags
+	n.ToRevision = targetRevision
+	return c.send(ctx, n)
+}
+
+// noRollbackTarget reports a failed deployment that can't be rolled back
+// because there's no previous revision to go back to. Updating the
+// deployment anyway would either do nothing or fail.
+func (c *rollbackController) noRollbackTarget(ctx context.Context, f *failure, why string) error {
+	d := f.d
+	if !c.once("no-rollback-target", d) {
+		return nil
+	}
+	msg := fmt.Sprintf("deployment failed (%s) but can't be rolled back: no rollback target available: %s", f.reason, why)
+	c.logger.Printf("not rolling back deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	metricNoRollbackTarget.inc(c.metricLabels(d)...)
+	c.recordAction(d, "no-rollback-target", 0, msg)
+	c.recordEvent(ctx, d, eventWarning, "NoRollbackTarget", msg)
+	return c.notify(ctx, d, "no-rollback-target", severityCritical, msg)
+}
+
+// skippedIdentical reports revisions that weren't rolled back to because
+// they have the same pod template as the failed revision, see rollbackTarget.
+func (c *rollbackController) skippedIdentical(ctx context.Context, d *v1beta1.Deployment, skipped []*v1beta1.ReplicaSet) {
+	if len(skipped) == 0 || !c.once("identical-revision", d) {
+		return
+	}
+	revisions := make([]string, len(skipped))
+	for i, rs := range skipped {
+		revisions[i] = strconv.FormatInt(revision(rs.Metadata.GetAnnotations()), 10)
+	}
+	msg := fmt.Sprintf("skipped revision(s) %s with the same pod template as failed revision %d",
+		strings.Join(revisions, ", "), revision(d.Metadata.GetAnnotations()))
+	c.logger.Printf("deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	metricIdenticalRevisions.add(float64(len(skipped)), c.metricLabels(d)...)
+	c.recordEvent(ctx, d, eventWarning, "IdenticalRevisionSkipped", msg)
+}
+
+// pause pauses a failed deployment so a human can decide what to do.
+func (c *rollbackController) pause(ctx context.Context, f *failure) error {
+	return c.pauseDeployment(ctx, f.d, "deployment failed and was paused: "+f.reason)
+}
+
+// pauseDeployment pauses a deployment, then notifies a human.
+func (c *rollbackController) pauseDeployment(ctx context.Context, d *v1beta1.Deployment, msg string) error {
+	annotations := map[string]string{
+		annotationPausedByController: strconv.FormatInt(revision(d.Metadata.GetAnnotations()), 10),
+	}
+	if err := c.setPaused(ctx, d, msg, annotations); err != nil {
+		return err
+	}
+	return c.notify(ctx, d, "pause", severityCritical, msg)
+}
+
+// setPaused pauses a deployment, setting any annotations provided.
+func (c *rollbackController) setPaused(ctx context.Context, d *v1beta1.Deployment, msg string, annotations map[string]string) error {
+	err := c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+		for k, v := range annotations {
+			setAnnotation(d, k, v)
+		}
+		d.Spec.Paused = k8s.Bool(true)
+	})
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("paused deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.recordAction(d, "pause", 0, msg)
+	c.recordEvent(ctx, d, eventWarning, "Paused", msg)
+	return nil
+}
+
+// scaleToZero scales a failed deployment down to zero replicas, taking it
+// out of service entirely. Autoscaled deployments are paused instead.
+func (c *rollbackController) scaleToZero(ctx context.Context, f *failure) error {
+	d := f.d
+	h, err := c.autoscaler(ctx, d)
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		return c.pauseDeployment(ctx, d, fmt.Sprintf("deployment failed (%s) and was paused instead of scaled to zero, its replicas are managed by HorizontalPodAutoscaler %s",
+			f.reason, h.Metadata.GetName()))
+	}
+	err = c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+		d.Spec.Replicas = new(int32)
+	})
+	if err != nil {
+		return err
+	}
+	msg := "deployment failed and was scaled to zero replicas: " + f.reason
+	c.logger.Printf("scaled deployment to zero: %s region=%q", *d.Metadata.Name, c.regionOf(d))
+	c.recordAction(d, "scale-to-zero", 0, msg)
+	c.recordEvent(ctx, d, eventWarning, "ScaledToZero", msg)
+
+	return c.notify(ctx, d, "scale-to-zero", severityCritical, msg)
+}
+
+// notifyOnly sends a notification about the failure, once per revision, and
+// leaves the deployment alone.
+func (c *rollbackController) notifyOnly(ctx context.Context, f *failure) error {
+	d := f.d
+	if !c.once("notify-only", d) {
+		return nil
+	}
+	msg := "deployment failed: " + f.reason
+	c.recordAction(d, "notify", 0, msg)
+	return c.notify(ctx, d, "notify-only", severityCritical, msg)
+}
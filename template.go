@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Names of notifiers, which key their message templates. A "default"
+// template is used by notifiers without their own.
+const (
+	notifierLog       = "log"
+	notifierWebhook   = "webhook"
+	notifierPagerDuty = "pagerDuty"
+	notifierOpsgenie  = "opsgenie"
+	notifierDefault   = "default"
+)
+
+var notifierNames = map[string]bool{
+	notifierLog:       true,
+	notifierWebhook:   true,
+	notifierPagerDuty: true,
+	notifierOpsgenie:  true,
+	notifierDefault:   true,
+}
+
+// Functions available to message templates, in addition to text/template's.
+var templateFuncs = template.FuncMap{
+	"summarize": summarizeDiagnostics,
+	"truncate":  func(n int, s string) string { return truncate(s, n) },
+	"join":      strings.Join,
+	"upper":     strings.ToUpper,
+}
+
+// parseTemplates parses message templates keyed by notifier name.
+func parseTemplates(texts map[string]string) (map[string]*template.Template, error) {
+	var names []string
+	for name := range texts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := make(map[string]*template.Template)
+	for _, name := range names {
+		if !notifierNames[name] {
+			return nil, fmt.Errorf("unknown notifier %q", name)
+		}
+		t, err := template.New(name).Funcs(templateFuncs).Parse(texts[name])
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// loadTemplates reads message templates from the notifyTemplatesConfigMap, if
+// set. They take precedence over the config file's. If the ConfigMap can't
+// be read, the templates last read are kept.
+func (c *rollbackController) loadTemplates(ctx context.Context) {
+	if c.cfg.NotifyTemplatesConfigMap == "" {
+		return
+	}
+	parts := strings.SplitN(c.cfg.NotifyTemplatesConfigMap, "/", 2)
+	cm, err := c.api.getConfigMap(ctx, parts[0], parts[1])
+	if err != nil {
+		c.logger.Printf("get notification templates configmap %s: %v", c.cfg.NotifyTemplatesConfigMap, err)
+		return
+	}
+	templates, err := parseTemplates(cm.GetData())
+	if err != nil {
+		c.logger.Printf("invalid notification templates in configmap %s, keeping previous templates: %v", c.cfg.NotifyTemplatesConfigMap, err)
+		return
+	}
+	c.mu.Lock()
+	c.configMapTemplates = templates
+	c.mu.Unlock()
+}
+
+// template returns the message template of a notifier, or nil if it has
+// none.
+func (c *rollbackController) template(name string) *template.Template {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range []string{name, notifierDefault} {
+		if t, ok := c.configMapTemplates[key]; ok {
+			return t
+		}
+		if t, ok := c.fileTemplates[key]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// templatedNotifier renders the message of notifications with the wrapped
+// notifier's template, if it has one. Templates are executed with the
+// notification, and can use the deployment's labels and annotations, such
+// as {{index .Annotations "rollback-controller/from-revision"}}. If a
+// template fails, the notification is sent with its original message, so a
+// broken template doesn't lose a page.
+type templatedNotifier struct {
+	name     string
+	notifier notifier
+	c        *rollbackController
+}
+
+func (t *templatedNotifier) notify(ctx context.Context, n *notification) error {
+	tmpl := t.c.template(t.name)
+	if tmpl == nil {
+		return t.notifier.notify(ctx, n)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, n); err != nil {
+		t.c.logger.Printf("execute %s notification template: %v", t.name, err)
+		return t.notifier.notify(ctx, n)
+	}
+	rendered := *n
+	rendered.Message = strings.TrimSpace(b.String())
+	return t.notifier.notify(ctx, &rendered)
+}
+
+type failureReasonKey struct{}
+
+// withFailureReason records why a deployment failed in a context, so
+// notifications sent while handling it report the reason.
+func withFailureReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, failureReasonKey{}, reason)
+}
+
+func failureReason(ctx context.Context) string {
+	reason, _ := ctx.Value(failureReasonKey{}).(string)
+	return reason
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s/api/v1"
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	batchv1 "github.com/ericchiang/k8s/apis/batch/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	policyv1beta1 "github.com/ericchiang/k8s/apis/policy/v1beta1"
+)
+
+// Reconcile passes are traced with OpenTelemetry spans, exported to a
+// collector using the OTLP/HTTP JSON encoding. No OpenTelemetry library is
+// vendored, so like the metrics this implements just enough of the protocol
+// to be useful.
+//
+// See: https://opentelemetry.io/docs/specs/otlp/
+
+// tracer exports finished spans. If nil, tracing is disabled and spans are
+// no-ops.
+var tracer *otlpExporter
+
+// Maximum number of finished spans buffered between exports. Spans finished
+// while the buffer is full are dropped.
+const maxQueuedSpans = 4096
+
+// span is a timed operation within a trace. A nil span is valid and does
+// nothing, so callers don't need to check if tracing is enabled.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	client   bool
+
+	name  string
+	start time.Time
+	end   time.Time
+	attrs map[string]string
+	err   error
+}
+
+type spanKey struct{}
+
+// startSpan starts a span as a child of the span in ctx, if any, and returns
+// a context holding the new span. attrs are key value pairs.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, start: time.Now(), attrs: make(map[string]string)}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startDeploymentSpan starts a span about a deployment.
+func (c *rollbackController) startDeploymentSpan(ctx context.Context, name string, d *v1beta1.Deployment) (context.Context, *span) {
+	return startSpan(ctx, name,
+		"k8s.cluster.name", c.cluster,
+		"k8s.namespace.name", d.Metadata.GetNamespace(),
+		"k8s.deployment.name", d.Metadata.GetName(),
+	)
+}
+
+// startClientSpan starts a span for a call to another service.
+func startClientSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	ctx, s := startSpan(ctx, name, attrs...)
+	if s != nil {
+		s.client = true
+	}
+	return ctx, s
+}
+
+func (s *span) setAttr(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// finish ends the span, marking it as failed if err is non-nil, and queues
+// it for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	tracer.add(s)
+}
+
+// otlpExporter periodically POSTs finished spans to an OTLP/HTTP endpoint.
+type otlpExporter struct {
+	// URL of the collector's traces endpoint, e.g.
+	// "http://otel-collector:4318/v1/traces".
+	url    string
+	client *http.Client
+	logger *log.Logger
+
+	mu      sync.Mutex
+	spans   []*span
+	dropped int
+}
+
+// newOTLPExporter returns an exporter sending spans to a collector. endpoint
+// is the collector's base URL, to which "/v1/traces" is appended.
+func newOTLPExporter(endpoint string, logger *log.Logger) *otlpExporter {
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: http.DefaultClient,
+		logger: logger,
+	}
+}
+
+func (e *otlpExporter) add(s *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) >= maxQueuedSpans {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, s)
+}
+
+// run exports queued spans every interval until ctx is canceled.
+func (e *otlpExporter) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := e.export(ctx); err != nil {
+			e.logger.Printf("export spans: %v", err)
+		}
+	}
+}
+
+func (e *otlpExporter) export(ctx context.Context) error {
+	e.mu.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		e.logger.Printf("dropped %d spans, export queue was full", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(newOTLPRequest(spans))
+	if err != nil {
+		return fmt.Errorf("marshal spans: %v", err)
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("post %s: %v", e.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("post %s: %s: %s", e.url, resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// Types of the OTLP JSON encoding. IDs are hex encoded and timestamps are
+// nanoseconds since the epoch, as strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Span kinds and status codes.
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindClient   = 3
+
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+func newOTLPAttribute(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+func newOTLPRequest(spans []*span) *otlpRequest {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "kube-rollback-controller"
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.client {
+			o.Kind = otlpSpanKindClient
+		}
+		for k, v := range s.attrs {
+			if v != "" {
+				o.Attributes = append(o.Attributes, newOTLPAttribute(k, v))
+			}
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, o)
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttribute{newOTLPAttribute("service.name", "kube-rollback-controller")}
+	rs.ScopeSpans = []otlpScopeSpans{scope}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// tracedAPI wraps a deploymentAPI, recording a client span for every call to
+// the API server.
+type tracedAPI struct {
+	api deploymentAPI
+}
+
+func (t *tracedAPI) listDeployments(ctx context.Context, namespace string) ([]*v1beta1.Deployment, error) {
+	ctx, s := startClientSpan(ctx, "list deployments", "k8s.namespace.name", namespace)
+	l, err := t.api.listDeployments(ctx, namespace)
+	s.setAttr("count", strconv.Itoa(len(l)))
+	s.finish(err)
+	return l, err
+}
+
+func (t *tracedAPI) getDeployment(ctx context.Context, namespace, name string) (*v1beta1.Deployment, error) {
+	ctx, s := startClientSpan(ctx, "get deployment", "k8s.namespace.name", namespace)
+	s.setAttr("k8s.deployment.name", name)
+	d, err := t.api.getDeployment(ctx, namespace, name)
+	s.finish(err)
+	return d, err
+}
+
+func (t *tracedAPI) patchDeployment(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error) {
+	ctx, s := startClientSpan(ctx, "patch deployment", "k8s.namespace.name", namespace)
+	s.setAttr("k8s.deployment.name", name)
+	d, err := t.api.patchDeployment(ctx, namespace, name, patch)
+	s.finish(err)
+	return d, err
+}
+
+func (t *tracedAPI) patchDeploymentStatus(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error) {
+	ctx, s := startClientSpan(ctx, "patch deployment status", "k8s.namespace.name", namespace)
+	s.setAttr("k8s.deployment.name", name)
+	d, err := t.api.patchDeploymentStatus(ctx, namespace, name, patch)
+	s.finish(err)
+	return d, err
+}
+
+func (t *tracedAPI) listReplicaSets(ctx context.Context, namespace string) ([]*v1beta1.ReplicaSet, error) {
+	ctx, s := startClientSpan(ctx, "list replica sets", "k8s.namespace.name", namespace)
+	l, err := t.api.listReplicaSets(ctx, namespace)
+	s.setAttr("count", strconv.Itoa(len(l)))
+	s.finish(err)
+	return l, err
+}
+
+func (t *tracedAPI) patchReplicaSet(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.ReplicaSet, error) {
+	ctx, s := startClientSpan(ctx, "patch replica set", "k8s.namespace.name", namespace)
+	s.setAttr("k8s.replicaset.name", name)
+	rs, err := t.api.patchReplicaSet(ctx, namespace, name, patch)
+	s.finish(err)
+	return rs, err
+}
+
+func (t *tracedAPI) createEvent(ctx context.Context, e *v1.Event) error {
+	ctx, s := startClientSpan(ctx, "create event", "k8s.namespace.name", e.Metadata.GetNamespace())
+	err := t.api.createEvent(ctx, e)
+	s.finish(err)
+	return err
+}
+
+func (t *tracedAPI) listPods(ctx context.Context, namespace string) ([]*v1.Pod, error) {
+	ctx, s := startClientSpan(ctx, "list pods", "k8s.namespace.name", namespace)
+	l, err := t.api.listPods(ctx, namespace)
+	s.setAttr("count", strconv.Itoa(len(l)))
+	s.finish(err)
+	return l, err
+}
+
+func (t *tracedAPI) podLogs(ctx context.Context, namespace, pod, container string, previous bool, lines int) (string, error) {
+	ctx, s := startClientSpan(ctx, "get pod logs", "k8s.namespace.name", namespace)
+	s.setAttr("k8s.pod.name", pod)
+	s.setAttr("k8s.container.name", container)
+	logs, err := t.api.podLogs(ctx, namespace, pod, container, previous, lines)
+	s.finish(err)
+	return logs, err
+}
+
+func (t *tracedAPI) listHorizontalPodAutoscalers(ctx context.Context, namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error) {
+	ctx, s := startClientSpan(ctx, "list horizontal pod autoscalers", "k8s.namespace.name", namespace)
+	l, err := t.api.listHorizontalPodAutoscalers(ctx, namespace)
+	s.setAttr("count", strconv.Itoa(len(l)))
+	s.finish(err)
+	return l, err
+}
+
+func (t *tracedAPI) listPodDisruptionBudgets(ctx context.Context, namespace string) ([]*policyv1beta1.PodDisruptionBudget, error) {
+	ctx, s := startClientSpan(ctx, "list pod disruption budgets", "k8s.namespace.name", namespace)
+	l, err := t.api.listPodDisruptionBudgets(ctx, namespace)
+	s.setAttr("count", strconv.Itoa(len(l)))
+	s.finish(err)
+	return l, err
+}
+
+func (t *tracedAPI) getJob(ctx context.Context, namespace, name string) (*batchv1.Job, error) {
+	ctx, s := startClientSpan(ctx, "get job", "k8s.namespace.name", namespace)
+	s.setAttr("k8s.job.name", name)
+	job, err := t.api.getJob(ctx, namespace, name)
+	s.finish(err)
+	return job, err
+}
+
+func (t *tracedAPI) createJob(ctx context.Context, job *batchv1.Job) (*batchv1.Job, error) {
+	ctx, s := startClientSpan(ctx, "create job", "k8s.namespace.name", job.Metadata.GetNamespace())
+	created, err := t.api.createJob(ctx, job)
+	if err == nil {
+		s.setAttr("k8s.job.name", created.Metadata.GetName())
+	}
+	s.finish(err)
+	return created, err
+}
+
+func (t *tracedAPI) listNamespaces(ctx context.Context) ([]*v1.Namespace, error) {
+	ctx, s := startClientSpan(ctx, "list namespaces")
+	l, err := t.api.listNamespaces(ctx)
+	s.setAttr("count", strconv.Itoa(len(l)))
+	s.finish(err)
+	return l, err
+}
+
+func (t *tracedAPI) getNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	ctx, s := startClientSpan(ctx, "get namespace", "k8s.namespace.name", name)
+	ns, err := t.api.getNamespace(ctx, name)
+	s.finish(err)
+	return ns, err
+}
+
+func (t *tracedAPI) getConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error) {
+	ctx, s := startClientSpan(ctx, "get configmap", "k8s.namespace.name", namespace)
+	cm, err := t.api.getConfigMap(ctx, namespace, name)
+	s.finish(err)
+	return cm, err
+}
+
+func (t *tracedAPI) createConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	ctx, s := startClientSpan(ctx, "create configmap", "k8s.namespace.name", cm.Metadata.GetNamespace())
+	created, err := t.api.createConfigMap(ctx, cm)
+	s.finish(err)
+	return created, err
+}
+
+func (t *tracedAPI) updateConfigMap(ctx context.Context, cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	ctx, s := startClientSpan(ctx, "update configmap", "k8s.namespace.name", cm.Metadata.GetNamespace())
+	updated, err := t.api.updateConfigMap(ctx, cm)
+	s.finish(err)
+	return updated, err
+}
+
+func (t *tracedAPI) getSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	ctx, s := startClientSpan(ctx, "get secret", "k8s.namespace.name", namespace)
+	secret, err := t.api.getSecret(ctx, namespace, name)
+	s.finish(err)
+	return secret, err
+}
+
+func (t *tracedAPI) createSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	ctx, s := startClientSpan(ctx, "create secret", "k8s.namespace.name", secret.Metadata.GetNamespace())
+	created, err := t.api.createSecret(ctx, secret)
+	s.finish(err)
+	return created, err
+}
+
+func (t *tracedAPI) updateSecret(ctx context.Context, secret *v1.Secret) (*v1.Secret, error) {
+	ctx, s := startClientSpan(ctx, "update secret", "k8s.namespace.name", secret.Metadata.GetNamespace())
+	updated, err := t.api.updateSecret(ctx, secret)
+	s.finish(err)
+	return updated, err
+}
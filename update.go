@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/golang/protobuf/proto"
+)
+
+// annotationManagedBy is set on every deployment the controller writes, so
+// humans and other controllers can tell it's acting on the deployment.
+const (
+	annotationManagedBy = "rollback-controller/managed-by"
+	managerName         = "kube-rollback-controller"
+)
+
+// modifiedError is returned when a deployment's spec was changed by someone
+// else, such as a human running kubectl or another controller, after the
+// controller decided how to act on it.
+type modifiedError struct {
+	from, to int64
+}
+
+func (e *modifiedError) Error() string {
+	return fmt.Sprintf("deployment was modified by another actor (generation %d to %d), not acting on outdated state", e.from, e.to)
+}
+
+// Number of times modifyDeployment tries to patch a deployment that keeps
+// being written by someone else between reading and patching it.
+const maxModifyAttempts = 3
+
+// modifyDeployment applies mutate to a deployment and patches it on the API
+// server. Only the fields mutate changes are written, see
+// strategicMergePatch. mutate is applied to the latest version of the
+// deployment, and if its spec has changed since d was read, for example
+// because a new revision was rolled out, the decision to modify it was based
+// on outdated state and nothing is written. Changes made by a
+// HorizontalPodAutoscaler scaling the deployment are the exception.
+//
+// The patch includes the resource version of the latest version, so the API
+// server rejects it if the deployment was written again in the meantime,
+// rather than applying mutate's changes to a version it never saw. The
+// deployment is then read and checked again.
+//
+// On success d is replaced by the patched deployment. If the spec changed, a
+// *modifiedError is returned.
+func (c *rollbackController) modifyDeployment(ctx context.Context, d *v1beta1.Deployment, mutate func(d *v1beta1.Deployment)) error {
+	for attempt := 1; ; attempt++ {
+		latest, err := c.api.getDeployment(ctx, d.Metadata.GetNamespace(), d.Metadata.GetName())
+		if err != nil {
+			return fmt.Errorf("get deployment: %v", err)
+		}
+		if generation := d.Metadata.GetGeneration(); latest.Metadata.GetGeneration() != generation {
+			scaled, err := c.scaledByAutoscaler(ctx, d.Spec, latest)
+			if err != nil {
+				return err
+			}
+			if !scaled {
+				return &modifiedError{from: generation, to: latest.Metadata.GetGeneration()}
+			}
+		}
+
+		before := proto.Clone(latest).(*v1beta1.Deployment)
+		mutate(latest)
+		setAnnotation(latest, annotationManagedBy, managerName)
+		patch, err := strategicMergePatch(before, latest)
+		if err != nil {
+			return fmt.Errorf("compute patch: %v", err)
+		}
+		if patch == nil {
+			*d = *before
+			return nil
+		}
+		if patch, err = withResourceVersion(patch, before.Metadata.GetResourceVersion()); err != nil {
+			return fmt.Errorf("compute patch: %v", err)
+		}
+		patched, err := c.api.patchDeployment(ctx, d.Metadata.GetNamespace(), d.Metadata.GetName(), patch)
+		if isConflict(err) && attempt < maxModifyAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("patch deployment: %v", err)
+		}
+		*d = *patched
+		return nil
+	}
+}
+
+func isConflict(err error) bool {
+	apiErr, ok := err.(*k8s.APIError)
+	return ok && apiErr.Code == http.StatusConflict
+}
+
+// aborted reports a failed deployment that wasn't acted on because someone
+// else modified it first. The deployment is reconsidered from its new state
+// on the next pass.
+func (c *rollbackController) aborted(ctx context.Context, d *v1beta1.Deployment, strategy string, err *modifiedError) {
+	msg := fmt.Sprintf("%s aborted: %v", strategy, err)
+	c.logger.Printf("not acting on deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.recordAction(d, "aborted", 0, msg)
+	c.recordEvent(ctx, d, eventWarning, "RollbackAborted", msg)
+}
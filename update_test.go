@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+func TestModifyDeployment(t *testing.T) {
+	tests := []struct {
+		name string
+		// Patch applied by someone else after the deployment is read.
+		patch      string
+		autoscaler bool
+
+		wantModified bool
+	}{
+		{
+			name: "unchanged",
+		},
+		{
+			name:  "labels changed",
+			patch: `{"metadata":{"labels":{"team":"web"}}}`,
+		},
+		{
+			name:         "new revision rolled out",
+			patch:        `{"spec":{"template":{"spec":{"containers":[{"name":"hello","image":"hello:v3"}]}}}}`,
+			wantModified: true,
+		},
+		{
+			name:       "scaled by autoscaler",
+			patch:      `{"spec":{"replicas":5}}`,
+			autoscaler: true,
+		},
+		{
+			name:         "scaled by someone else",
+			patch:        `{"spec":{"replicas":5}}`,
+			wantModified: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeAPI()
+			f.addDeployment(testDeployment("hello", 2, true))
+			if test.autoscaler {
+				f.addHorizontalPodAutoscaler(&autoscalingv1.HorizontalPodAutoscaler{
+					Metadata: &v1.ObjectMeta{Name: k8s.String("hello"), Namespace: k8s.String("default")},
+					Spec: &autoscalingv1.HorizontalPodAutoscalerSpec{
+						ScaleTargetRef: &autoscalingv1.CrossVersionObjectReference{
+							Kind: k8s.String("Deployment"),
+							Name: k8s.String("hello"),
+						},
+					},
+				})
+			}
+			c := newTestController(t, f)
+
+			d, err := f.getDeployment(ctx, "default", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.patch != "" {
+				if _, err := f.patchDeployment(ctx, "default", "hello", []byte(test.patch)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, err := f.getDeployment(ctx, "default", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+				d.Spec.Paused = k8s.Bool(true)
+			})
+			after, getErr := f.getDeployment(ctx, "default", "hello")
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			if test.wantModified {
+				if _, ok := err.(*modifiedError); !ok {
+					t.Fatalf("expected modified error, got %v", err)
+				}
+				if after.Metadata.GetResourceVersion() != before.Metadata.GetResourceVersion() {
+					t.Errorf("deployment was written")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !after.Spec.GetPaused() {
+				t.Errorf("deployment wasn't paused")
+			}
+			if got := after.Metadata.GetAnnotations()[annotationManagedBy]; got != managerName {
+				t.Errorf("%s annotation %q, want %q", annotationManagedBy, got, managerName)
+			}
+			// Changes made by others are kept.
+			if after.Spec.GetReplicas() != before.Spec.GetReplicas() {
+				t.Errorf("replicas %d, want %d", after.Spec.GetReplicas(), before.Spec.GetReplicas())
+			}
+			if after.Metadata.GetLabels()["team"] != before.Metadata.GetLabels()["team"] {
+				t.Errorf("labels %v, want %v", after.Metadata.GetLabels(), before.Metadata.GetLabels())
+			}
+			if d.Metadata.GetResourceVersion() != after.Metadata.GetResourceVersion() {
+				t.Errorf("deployment wasn't replaced by the patched deployment")
+			}
+		})
+	}
+}
+
+// racingAPI writes a deployment before each of the first n patches of it,
+// as if someone else wrote it between the controller reading and patching
+// it.
+type racingAPI struct {
+	*fakeAPI
+	n     int
+	write string
+}
+
+func (r *racingAPI) patchDeployment(ctx context.Context, namespace, name string, patch []byte) (*v1beta1.Deployment, error) {
+	if r.n > 0 {
+		r.n--
+		if _, err := r.fakeAPI.patchDeployment(ctx, namespace, name, []byte(r.write)); err != nil {
+			return nil, err
+		}
+	}
+	return r.fakeAPI.patchDeployment(ctx, namespace, name, patch)
+}
+
+func TestModifyDeploymentConflict(t *testing.T) {
+	tests := []struct {
+		name  string
+		races int
+		write string
+
+		wantErr      bool
+		wantModified bool
+	}{
+		{
+			name:  "retried",
+			races: 1,
+			write: `{"metadata":{"labels":{"team":"web"}}}`,
+		},
+		{
+			name:    "too many conflicts",
+			races:   maxModifyAttempts,
+			write:   `{"metadata":{"labels":{"team":"web"}}}`,
+			wantErr: true,
+		},
+		{
+			name:         "new revision rolled out",
+			races:        1,
+			write:        `{"metadata":{"labels":{"team":"web"}},"spec":{"template":{"spec":{"containers":[{"name":"hello","image":"hello:v3"}]}}}}`,
+			wantErr:      true,
+			wantModified: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeAPI()
+			f.addDeployment(testDeployment("hello", 2, true))
+			c := newTestController(t, f)
+			c.api = &racingAPI{fakeAPI: f, n: test.races, write: test.write}
+
+			d, err := f.getDeployment(ctx, "default", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.modifyDeployment(ctx, d, func(d *v1beta1.Deployment) {
+				d.Spec.Paused = k8s.Bool(true)
+			})
+			if _, ok := err.(*modifiedError); ok != test.wantModified {
+				t.Errorf("expected modified error %t, got %v", test.wantModified, err)
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %t, got %v", test.wantErr, err)
+			}
+			after, err := f.getDeployment(ctx, "default", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Spec.GetPaused() == test.wantErr {
+				t.Errorf("paused=%t, want %t", after.Spec.GetPaused(), !test.wantErr)
+			}
+			if after.Metadata.GetLabels()["team"] != "web" {
+				t.Errorf("write by someone else was lost: labels %v", after.Metadata.GetLabels())
+			}
+		})
+	}
+}
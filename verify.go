@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	batchv1 "github.com/ericchiang/k8s/apis/batch/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	"github.com/golang/protobuf/proto"
+)
+
+// annotationVerifyJob names the Job used as a template to verify a
+// deployment after it's rolled back, overriding the verifyJob setting.
+const annotationVerifyJob = "rollback-controller/verify-job"
+
+// annotationVerifies is set on verification Jobs to the deployment and
+// revision they verify.
+const annotationVerifies = "rollback-controller/verifies"
+
+// Labels the Job controller sets on a Job's pod template, which must not be
+// copied from the template Job.
+var jobControllerLabels = []string{"controller-uid", "job-name"}
+
+// States of a rollback's verification.
+const (
+	verificationPending = "pending"
+	verificationRunning = "running"
+	verificationPassed  = "passed"
+	verificationFailed  = "failed"
+)
+
+// verificationResult is the outcome of running a smoke test after a
+// rollback, reported in its rollback record.
+type verificationResult struct {
+	Template string `json:"template"`
+	Job      string `json:"job,omitempty"`
+	State    string `json:"state"`
+	Message  string `json:"message,omitempty"`
+}
+
+// verification tracks a rollback being verified. Once the rollback's rollout
+// completes, a Job is created from the template, and the rollback passes
+// verification if the Job completes successfully before the verifyTimeout.
+type verification struct {
+	record *rollbackRecord
+	// Revision the deployment was rolled back from. The rollback creates a
+	// new revision, so a deployment whose revision is still this one hasn't
+	// been rolled back yet.
+	fromRevision int64
+	since        time.Time
+}
+
+// startVerification starts verifying a rollback, if the deployment or its
+// namespace names a Job template, or the verifyJob setting does. The record
+// is marked as pending and then recorded.
+func (c *rollbackController) startVerification(ctx context.Context, d *v1beta1.Deployment, rec *rollbackRecord) {
+	template, ok := c.annotation(d, annotationVerifyJob)
+	if !ok {
+		template = c.cfg.VerifyJob
+	}
+	if template == "" {
+		c.record(rec)
+		return
+	}
+	_, s := c.startDeploymentSpan(ctx, "start verification", d)
+	s.setAttr("verification.template", template)
+	defer s.finish(nil)
+
+	rec.Verification = &verificationResult{Template: template, State: verificationPending}
+	c.record(rec)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.verifications == nil {
+		c.verifications = make(map[string]*verification)
+	}
+	// A newer rollback replaces any verification still in progress.
+	c.verifications[d.Metadata.GetNamespace()+"/"+d.Metadata.GetName()] = &verification{
+		record:       rec,
+		fromRevision: rec.FromRevision,
+		since:        c.now(),
+	}
+}
+
+// checkVerification makes progress on verifying a deployment's last rollback,
+// if it's being verified.
+func (c *rollbackController) checkVerification(ctx context.Context, d *v1beta1.Deployment, now time.Time) (err error) {
+	key := d.Metadata.GetNamespace() + "/" + d.Metadata.GetName()
+	c.mu.Lock()
+	v, ok := c.verifications[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	result := *v.record.Verification
+	ctx, s := c.startDeploymentSpan(ctx, "verify", d)
+	s.setAttr("verification.template", result.Template)
+	defer func() {
+		s.setAttr("verification.state", result.State)
+		s.setAttr("verification.job", result.Job)
+		s.finish(err)
+	}()
+	timedOut := now.Sub(v.since) > c.cfg.VerifyTimeout.Duration
+	switch result.State {
+	case verificationPending:
+		if revision(d.Metadata.GetAnnotations()) == v.fromRevision || !rolloutComplete(d) {
+			if !timedOut {
+				return nil
+			}
+			result.State = verificationFailed
+			result.Message = fmt.Sprintf("the rollback's rollout didn't complete within %s", c.cfg.VerifyTimeout.Duration)
+			break
+		}
+		job, err := c.createVerificationJob(ctx, d, result.Template)
+		if err != nil {
+			result.State = verificationFailed
+			result.Message = fmt.Sprintf("create job from template %s: %v", result.Template, err)
+			break
+		}
+		c.logger.Printf("verifying rollback of deployment: %s region=%q: created job %s", *d.Metadata.Name, c.regionOf(d), job)
+		result.Job = job
+		result.State = verificationRunning
+	case verificationRunning:
+		job, err := c.api.getJob(ctx, d.Metadata.GetNamespace(), result.Job)
+		if err != nil {
+			return fmt.Errorf("get verification job %s: %v", result.Job, err)
+		}
+		done, passed, msg := jobResult(job)
+		if !done && !timedOut {
+			return nil
+		}
+		result.State = verificationFailed
+		if passed {
+			result.State = verificationPassed
+		}
+		result.Message = msg
+		if !done {
+			result.Message = fmt.Sprintf("job %s didn't finish within %s", result.Job, c.cfg.VerifyTimeout.Duration)
+		}
+	}
+	c.updateVerification(key, v, &result)
+	if result.State == verificationRunning {
+		return nil
+	}
+
+	msg := fmt.Sprintf("verification of rollback from revision %d %s", v.fromRevision, result.State)
+	if result.Job != "" {
+		msg += fmt.Sprintf(" (job %s)", result.Job)
+	}
+	if result.Message != "" {
+		msg += ": " + result.Message
+	}
+	c.logger.Printf("verified rollback of deployment: %s region=%q: %s", *d.Metadata.Name, c.regionOf(d), msg)
+	c.audit(d, "verification-"+result.State, msg)
+	if result.State == verificationPassed {
+		c.recordEvent(ctx, d, eventNormal, "RollbackVerified", msg)
+		return c.notify(ctx, d, "verification-"+result.State, severityInfo, msg)
+	}
+	c.recordEvent(ctx, d, eventWarning, "RollbackVerificationFailed", msg)
+	return c.notify(ctx, d, "verification-"+result.State, severityCritical, msg)
+}
+
+// updateVerification replaces a verification's record with one reporting a
+// new result. The record is copied, since records aren't modified once
+// recorded. Finished verifications are forgotten.
+func (c *rollbackController) updateVerification(key string, v *verification, result *verificationResult) {
+	rec := *v.record
+	rec.Verification = result
+	c.status.replaceRecord(v.record, &rec)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.verifications[key] != v {
+		return
+	}
+	if result.State == verificationRunning {
+		c.verifications[key] = &verification{record: &rec, fromRevision: v.fromRevision, since: v.since}
+	} else {
+		delete(c.verifications, key)
+	}
+}
+
+// createVerificationJob creates a Job from a template Job in the deployment's
+// namespace, returning its name. Template Jobs can set parallelism to zero
+// so they don't run themselves.
+func (c *rollbackController) createVerificationJob(ctx context.Context, d *v1beta1.Deployment, template string) (string, error) {
+	t, err := c.api.getJob(ctx, d.Metadata.GetNamespace(), template)
+	if err != nil {
+		return "", err
+	}
+	podTemplate := proto.Clone(t.Spec.GetTemplate()).(*v1.PodTemplateSpec)
+	if podTemplate.Metadata != nil {
+		for _, l := range jobControllerLabels {
+			delete(podTemplate.Metadata.Labels, l)
+		}
+	}
+	labels := make(map[string]string)
+	for k, v := range t.Metadata.GetLabels() {
+		labels[k] = v
+	}
+	for _, l := range jobControllerLabels {
+		delete(labels, l)
+	}
+
+	prefix := template
+	if len(prefix) > 40 {
+		prefix = prefix[:40]
+	}
+	job := &batchv1.Job{
+		Metadata: &v1.ObjectMeta{
+			GenerateName: k8s.String(prefix + "-verify-"),
+			Namespace:    k8s.String(d.Metadata.GetNamespace()),
+			Labels:       labels,
+			Annotations: map[string]string{
+				annotationManagedBy: managerName,
+				annotationVerifies:  d.Metadata.GetName() + "/" + strconv.FormatInt(revision(d.Metadata.GetAnnotations()), 10),
+			},
+		},
+		Spec: &batchv1.JobSpec{
+			Completions:           t.Spec.Completions,
+			ActiveDeadlineSeconds: t.Spec.ActiveDeadlineSeconds,
+			Template:              podTemplate,
+		},
+	}
+	created, err := c.api.createJob(ctx, job)
+	if err != nil {
+		return "", err
+	}
+	return created.Metadata.GetName(), nil
+}
+
+// jobResult reports if a Job has finished, if it succeeded, and why.
+func jobResult(job *batchv1.Job) (done, passed bool, msg string) {
+	for _, cond := range job.Status.GetConditions() {
+		if cond.GetStatus() != "True" {
+			continue
+		}
+		switch cond.GetType() {
+		case "Complete":
+			return true, true, ""
+		case "Failed":
+			msg := cond.GetReason()
+			if cond.GetMessage() != "" {
+				msg += ": " + cond.GetMessage()
+			}
+			return true, false, msg
+		}
+	}
+	return false, false, ""
+}
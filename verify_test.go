@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/api/v1"
+	batchv1 "github.com/ericchiang/k8s/apis/batch/v1"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// testTemplateJob returns a template Job for verifications, with the labels
+// the Job controller sets.
+func testTemplateJob(name string) *batchv1.Job {
+	labels := map[string]string{"app": "smoke-test", "job-name": name, "controller-uid": "uid-" + name}
+	return &batchv1.Job{
+		Metadata: &v1.ObjectMeta{
+			Name:      k8s.String(name),
+			Namespace: k8s.String("default"),
+			Labels:    labels,
+		},
+		Spec: &batchv1.JobSpec{
+			Parallelism: int32Ptr(0),
+			Template: &v1.PodTemplateSpec{
+				Metadata: &v1.ObjectMeta{Labels: labels},
+				Spec: &v1.PodSpec{Containers: []*v1.Container{{
+					Name:  k8s.String("smoke-test"),
+					Image: k8s.String("smoke-test:v1"),
+				}}},
+			},
+		},
+	}
+}
+
+// rolledBack returns the deployment created by rolling back from a
+// revision, with its rollout complete if done.
+func rolledBack(from int64, done bool) *v1beta1.Deployment {
+	d := testDeployment("hello", from+1, false)
+	d.Status.Replicas = int32Ptr(2)
+	d.Status.UpdatedReplicas = int32Ptr(2)
+	d.Status.AvailableReplicas = int32Ptr(1)
+	if done {
+		d.Status.AvailableReplicas = int32Ptr(2)
+	}
+	return d
+}
+
+// setJobCondition sets a condition on a Job in the fake API.
+func setJobCondition(f *fakeAPI, name, condition, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.jobs["default/"+name].Status = &batchv1.JobStatus{Conditions: []*batchv1.JobCondition{{
+		Type:   k8s.String(condition),
+		Status: k8s.String("True"),
+		Reason: k8s.String(reason),
+	}}}
+}
+
+// verificationOf returns the verification of the rollback from a revision
+// in the admin API's history.
+func (c *rollbackController) verificationOf(t *testing.T, from int64) verificationResult {
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	for _, r := range c.status.records {
+		if r.FromRevision == from && r.Verification != nil {
+			return *r.Verification
+		}
+	}
+	t.Fatalf("no verification of rollback from revision %d", from)
+	return verificationResult{}
+}
+
+func TestVerification(t *testing.T) {
+	tests := []struct {
+		name string
+		// Condition of the Job when it's checked, if any, and how long after
+		// the rollback it's checked.
+		condition string
+		reason    string
+		after     time.Duration
+
+		wantState   string
+		wantMessage string
+		wantEvent   string
+	}{
+		{
+			name:      "passed",
+			condition: "Complete",
+			wantState: verificationPassed,
+			wantEvent: "RollbackVerified",
+		},
+		{
+			name:        "failed",
+			condition:   "Failed",
+			reason:      "BackoffLimitExceeded",
+			wantState:   verificationFailed,
+			wantMessage: "BackoffLimitExceeded",
+			wantEvent:   "RollbackVerificationFailed",
+		},
+		{
+			name:        "timed out",
+			after:       11 * time.Minute,
+			wantState:   verificationFailed,
+			wantMessage: "job smoke-test-verify-2 didn't finish within 10m0s",
+			wantEvent:   "RollbackVerificationFailed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeAPI()
+			f.addJob(testTemplateJob("smoke-test"))
+			c := newTestController(t, f, "--verify-job=smoke-test")
+			now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+			c.clock = func() time.Time { return now }
+
+			d := testDeployment("hello", 2, true)
+			c.startVerification(ctx, d, c.newRecord(d, "rollback", 1, "rolled back"))
+			if got := c.verificationOf(t, 2); got.State != verificationPending || got.Template != "smoke-test" {
+				t.Fatalf("got verification %+v, want pending", got)
+			}
+
+			// Nothing is run until the rollback's rollout completes.
+			for _, d := range []*v1beta1.Deployment{d, rolledBack(2, false)} {
+				if err := c.checkVerification(ctx, d, now); err != nil {
+					t.Fatal(err)
+				}
+				if got := c.verificationOf(t, 2); got.State != verificationPending {
+					t.Fatalf("got verification %+v, want pending", got)
+				}
+			}
+
+			if err := c.checkVerification(ctx, rolledBack(2, true), now); err != nil {
+				t.Fatal(err)
+			}
+			got := c.verificationOf(t, 2)
+			if got.State != verificationRunning || got.Job == "" {
+				t.Fatalf("got verification %+v, want running", got)
+			}
+			job, err := f.getJob(ctx, "default", got.Job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := job.Metadata.GetAnnotations()[annotationVerifies]; v != "hello/3" {
+				t.Errorf("job verifies %q, want hello/3", v)
+			}
+			if _, ok := job.Spec.GetTemplate().GetMetadata().GetLabels()["job-name"]; ok {
+				t.Errorf("job's pods have the template Job's job-name label")
+			}
+			if job.Spec.Parallelism != nil {
+				t.Errorf("job copied the template Job's parallelism")
+			}
+
+			if test.condition != "" {
+				setJobCondition(f, got.Job, test.condition, test.reason)
+			}
+			if err := c.checkVerification(ctx, rolledBack(2, true), now.Add(test.after)); err != nil {
+				t.Fatal(err)
+			}
+			got = c.verificationOf(t, 2)
+			if got.State != test.wantState || got.Message != test.wantMessage {
+				t.Errorf("got verification %+v, want state %q, message %q", got, test.wantState, test.wantMessage)
+			}
+			events := f.recordedEvents()
+			if len(events) == 0 || events[len(events)-1].GetReason() != test.wantEvent {
+				t.Errorf("expected a %s event", test.wantEvent)
+			}
+			if len(c.verifications) != 0 {
+				t.Errorf("finished verification wasn't forgotten")
+			}
+		})
+	}
+}
+
+func TestVerificationRolloutTimeout(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	f.addJob(testTemplateJob("smoke-test"))
+	c := newTestController(t, f, "--verify-job=smoke-test", "--verify-timeout=5m")
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.clock = func() time.Time { return now }
+
+	d := testDeployment("hello", 2, true)
+	c.startVerification(ctx, d, c.newRecord(d, "rollback", 1, "rolled back"))
+	if err := c.checkVerification(ctx, rolledBack(2, false), now.Add(6*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got := c.verificationOf(t, 2)
+	if want := "the rollback's rollout didn't complete within 5m0s"; got.State != verificationFailed || got.Message != want {
+		t.Errorf("got verification %+v, want failed: %s", got, want)
+	}
+	if len(f.jobs) != 1 {
+		t.Errorf("created a job for a rollout that didn't complete")
+	}
+}
+
+func TestVerificationReplaced(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	f.addJob(testTemplateJob("smoke-test"))
+	c := newTestController(t, f, "--verify-job=smoke-test")
+
+	// The deployment is rolled back, fails again before the rollback's
+	// rollout completes, and is rolled back again.
+	first := testDeployment("hello", 2, true)
+	c.startVerification(ctx, first, c.newRecord(first, "rollback", 1, "rolled back"))
+	second := testDeployment("hello", 3, true)
+	c.startVerification(ctx, second, c.newRecord(second, "rollback", 1, "rolled back"))
+
+	if err := c.checkVerification(ctx, rolledBack(3, true), c.now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.verificationOf(t, 3); got.State != verificationRunning {
+		t.Errorf("got verification %+v of the newer rollback, want running", got)
+	}
+	if got := c.verificationOf(t, 2); got.State != verificationPending || got.Job != "" {
+		t.Errorf("got verification %+v of the replaced rollback, want it left pending", got)
+	}
+	if len(f.jobs) != 2 {
+		t.Errorf("got %d jobs, want the template and one verification", len(f.jobs))
+	}
+}
+
+func TestVerificationAnnotation(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeAPI()
+	c := newTestController(t, f)
+
+	d := testDeployment("hello", 2, true)
+	c.startVerification(ctx, d, c.newRecord(d, "rollback", 1, "rolled back"))
+	d.Metadata.Annotations[annotationVerifyJob] = "smoke-test"
+	c.startVerification(ctx, d, c.newRecord(d, "rollback", 1, "rolled back again"))
+
+	c.status.mu.Lock()
+	defer c.status.mu.Unlock()
+	if len(c.status.records) != 2 {
+		t.Fatalf("got %d records, want 2", len(c.status.records))
+	}
+	if v := c.status.records[0].Verification; v != nil {
+		t.Errorf("rollback without a verification job is verified: %+v", v)
+	}
+	if v := c.status.records[1].Verification; v == nil || v.Template != "smoke-test" {
+		t.Errorf("got verification %+v, want one using smoke-test", v)
+	}
+}
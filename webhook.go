@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Annotations set by the admission webhook recording the last revision of a
+// deployment that was healthy when it was replaced. Revision numbers change
+// when the deployment controller rolls back, so the ReplicaSet's
+// pod-template-hash label is recorded too, and preferred when choosing a
+// rollback target.
+const (
+	annotationLastKnownGood     = "rollback-controller/last-known-good-revision"
+	annotationLastKnownGoodHash = "rollback-controller/last-known-good-template-hash"
+)
+
+// The label the deployment controller uses to identify the pod template of a
+// ReplicaSet.
+const podTemplateHashLabel = "pod-template-hash"
+
+// The admission.k8s.io/v1beta1 types used by the webhook. The vendored client
+// doesn't include the admission API, so only the fields used are declared.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID  string `json:"uid"`
+	Kind struct {
+		Kind string `json:"kind"`
+	} `json:"kind"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Operation string          `json:"operation"`
+	Object    json.RawMessage `json:"object"`
+	OldObject json.RawMessage `json:"oldObject"`
+}
+
+type admissionResponse struct {
+	UID       string `json:"uid"`
+	Allowed   bool   `json:"allowed"`
+	PatchType string `json:"patchType,omitempty"`
+	Patch     []byte `json:"patch,omitempty"`
+}
+
+// webhookDeployment holds the fields of a deployment the webhook compares.
+type webhookDeployment struct {
+	Metadata struct {
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Template interface{} `json:"template"`
+	} `json:"spec"`
+}
+
+// jsonPatch is a single RFC 6902 operation.
+type jsonPatch struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// webhookServer is a mutating admission webhook that annotates deployments
+// with their last known good revision whenever their pod template changes,
+// so the rollback target is decided at deploy time rather than inferred from
+// ReplicaSet history later. It never rejects a request.
+type webhookServer struct {
+	api    deploymentAPI
+	logger *log.Logger
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var review admissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+	req := review.Request
+
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	patch, err := s.mutate(r.Context(), req)
+	if err != nil {
+		// Failing to record the revision shouldn't block a deploy.
+		s.logger.Printf("webhook: deployment %s/%s: %v", req.Namespace, req.Name, err)
+	} else if len(patch) > 0 {
+		b, err := json.Marshal(patch)
+		if err != nil {
+			s.logger.Printf("webhook: encode patch: %v", err)
+		} else {
+			resp.PatchType = "JSONPatch"
+			resp.Patch = b
+		}
+	}
+	writeJSON(w, admissionReview{APIVersion: review.APIVersion, Kind: review.Kind, Response: resp})
+}
+
+// mutate returns the patch for an admission request, if any.
+func (s *webhookServer) mutate(ctx context.Context, req *admissionRequest) ([]jsonPatch, error) {
+	if req.Kind.Kind != "Deployment" || req.Operation != "UPDATE" {
+		return nil, nil
+	}
+	var obj, old webhookDeployment
+	if err := json.Unmarshal(req.Object, &obj); err != nil {
+		return nil, fmt.Errorf("decode object: %v", err)
+	}
+	if err := json.Unmarshal(req.OldObject, &old); err != nil {
+		return nil, fmt.Errorf("decode old object: %v", err)
+	}
+	// Only new rollouts matter. Scaling, and the deployment controller's own
+	// updates, leave the pod template alone.
+	if reflect.DeepEqual(obj.Spec.Template, old.Spec.Template) {
+		return nil, nil
+	}
+
+	// Admission requests don't include status, so look up the deployment
+	// being replaced to see if it was healthy.
+	d, err := s.api.getDeployment(ctx, req.Namespace, req.Name)
+	if err != nil {
+		return nil, fmt.Errorf("get deployment: %v", err)
+	}
+	if deploymentFailed(d) || d.Spec.RollbackTo != nil {
+		// Keep whatever revision was last known to be good.
+		return nil, nil
+	}
+	rev := revision(d.Metadata.GetAnnotations())
+	if rev == 0 {
+		return nil, nil
+	}
+	replicaSets, err := s.api.listReplicaSets(ctx, req.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("list replica sets: %v", err)
+	}
+	values := map[string]string{annotationLastKnownGood: strconv.FormatInt(rev, 10)}
+	if rs := newReplicaSet(d, replicaSets); rs != nil {
+		if hash := rs.Metadata.GetLabels()[podTemplateHashLabel]; hash != "" {
+			values[annotationLastKnownGoodHash] = hash
+		}
+	}
+
+	if obj.Metadata.Annotations == nil {
+		return []jsonPatch{{Op: "add", Path: "/metadata/annotations", Value: values}}, nil
+	}
+	var patch []jsonPatch
+	for _, k := range []string{annotationLastKnownGood, annotationLastKnownGoodHash} {
+		path := "/metadata/annotations/" + escapeJSONPointer(k)
+		v, ok := values[k]
+		switch {
+		case ok:
+			patch = append(patch, jsonPatch{Op: "add", Path: path, Value: v})
+		case obj.Metadata.Annotations[k] != "":
+			// Don't leave a hash from an older revision behind.
+			patch = append(patch, jsonPatch{Op: "remove", Path: path})
+		}
+	}
+	return patch, nil
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapeJSONPointer(s string) string {
+	return jsonPointerEscaper.Replace(s)
+}
+
+// serveWebhook serves the admission webhook over TLS on /mutate. The API
+// server only calls webhooks over HTTPS.
+func serveWebhook(api deploymentAPI, logger *log.Logger, addr, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", &webhookServer{api: api, logger: logger})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// lastKnownGood returns the ReplicaSet recorded by the admission webhook as
+// the deployment's last known good revision, or nil if there isn't one.
+func lastKnownGood(d *v1beta1.Deployment, replicaSets []*v1beta1.ReplicaSet) *v1beta1.ReplicaSet {
+	annotations := d.Metadata.GetAnnotations()
+	hash := annotations[annotationLastKnownGoodHash]
+	rev, _ := strconv.ParseInt(annotations[annotationLastKnownGood], 10, 64)
+	if hash == "" && rev == 0 {
+		return nil
+	}
+	current := revision(annotations)
+	for _, rs := range replicaSets {
+		if !ownedBy(rs, d) || revision(rs.Metadata.GetAnnotations()) >= current {
+			continue
+		}
+		if hash != "" {
+			if rs.Metadata.GetLabels()[podTemplateHashLabel] == hash {
+				return rs
+			}
+			continue
+		}
+		if revision(rs.Metadata.GetAnnotations()) == rev {
+			return rs
+		}
+	}
+	return nil
+}
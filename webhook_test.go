@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// webhookObject returns a deployment as sent in an admission request.
+func webhookObject(t *testing.T, annotations map[string]string, image string) json.RawMessage {
+	obj := object{
+		"metadata": object{"annotations": annotations},
+		"spec": object{"template": object{"spec": object{
+			"containers": []object{{"name": "hello", "image": image}},
+		}}},
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWebhookMutate(t *testing.T) {
+	const (
+		revPath  = "/metadata/annotations/rollback-controller~1last-known-good-revision"
+		hashPath = "/metadata/annotations/rollback-controller~1last-known-good-template-hash"
+	)
+	stale := map[string]string{annotationLastKnownGood: "1", annotationLastKnownGoodHash: "hash-1"}
+	tests := []struct {
+		name      string
+		kind      string
+		operation string
+		// Annotations of the updated deployment.
+		annotations map[string]string
+		// Image of the updated deployment. The old one runs hello:v2.
+		image string
+		// Whether the current deployment has failed, or is rolling back.
+		failed      bool
+		rollingBack bool
+		// Whether the current revision has a ReplicaSet.
+		noReplicaSet bool
+
+		want []jsonPatch
+	}{
+		{
+			name:        "new rollout",
+			annotations: map[string]string{"team": "a"},
+			image:       "hello:v3",
+			want: []jsonPatch{
+				{Op: "add", Path: revPath, Value: "2"},
+				{Op: "add", Path: hashPath, Value: "hash-2"},
+			},
+		},
+		{
+			name:  "no annotations",
+			image: "hello:v3",
+			want: []jsonPatch{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{
+				annotationLastKnownGood:     "2",
+				annotationLastKnownGoodHash: "hash-2",
+			}}},
+		},
+		{
+			name:         "stale hash",
+			annotations:  stale,
+			image:        "hello:v3",
+			noReplicaSet: true,
+			want: []jsonPatch{
+				{Op: "add", Path: revPath, Value: "2"},
+				{Op: "remove", Path: hashPath},
+			},
+		},
+		{
+			name:        "scaled",
+			annotations: stale,
+			image:       "hello:v2",
+		},
+		{
+			name:        "failed",
+			annotations: stale,
+			image:       "hello:v3",
+			failed:      true,
+		},
+		{
+			name:        "rolling back",
+			annotations: stale,
+			image:       "hello:v3",
+			rollingBack: true,
+		},
+		{
+			name:      "created",
+			operation: "CREATE",
+			image:     "hello:v3",
+		},
+		{
+			name:  "not a deployment",
+			kind:  "StatefulSet",
+			image: "hello:v3",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeAPI()
+			d := testDeployment("hello", 2, test.failed)
+			if test.rollingBack {
+				rev := int64(1)
+				d.Spec.RollbackTo = &v1beta1.RollbackConfig{Revision: &rev}
+			}
+			f.addDeployment(d)
+			if !test.noReplicaSet {
+				f.addReplicaSet(testReplicaSet(d, 2))
+			}
+			f.addReplicaSet(testReplicaSet(d, 1))
+
+			req := &admissionRequest{
+				Namespace: "default",
+				Name:      "hello",
+				Operation: "UPDATE",
+				Object:    webhookObject(t, test.annotations, test.image),
+				OldObject: webhookObject(t, test.annotations, "hello:v2"),
+			}
+			req.Kind.Kind = "Deployment"
+			if test.kind != "" {
+				req.Kind.Kind = test.kind
+			}
+			if test.operation != "" {
+				req.Operation = test.operation
+			}
+			s := &webhookServer{api: f}
+			got, err := s.mutate(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got patch %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEscapeJSONPointer(t *testing.T) {
+	if got, want := escapeJSONPointer("example.com/a~b"), "example.com~1a~0b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLastKnownGood(t *testing.T) {
+	d := testDeployment("hello", 4, true)
+	var replicaSets []*v1beta1.ReplicaSet
+	for rev := int64(1); rev <= 4; rev++ {
+		replicaSets = append(replicaSets, testReplicaSet(d, rev))
+	}
+	// The deployment controller renumbers a ReplicaSet that's rolled back
+	// to, so revision 3's pods have the template hash recorded as revision
+	// 2's.
+	renumbered := testReplicaSet(d, 3)
+	renumbered.Metadata.Name = k8s.String("hello-renumbered")
+	renumbered.Metadata.Labels[podTemplateHashLabel] = "hash-renumbered"
+	replicaSets = append(replicaSets, renumbered)
+	other := testDeployment("other", 4, true)
+	otherRS := testReplicaSet(other, 1)
+	otherRS.Metadata.Labels[podTemplateHashLabel] = "hash-other"
+	replicaSets = append(replicaSets, otherRS)
+
+	tests := []struct {
+		name string
+		rev  string
+		hash string
+		want string
+	}{
+		{name: "none"},
+		{name: "revision", rev: "2", want: "hello-2"},
+		{name: "hash preferred", rev: "2", hash: "hash-1", want: "hello-1"},
+		{name: "renumbered", rev: "2", hash: "hash-renumbered", want: "hello-renumbered"},
+		{name: "hash not found", rev: "2", hash: "hash-gone"},
+		{name: "current revision", rev: "4"},
+		{name: "other deployment", hash: "hash-other"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := testDeployment("hello", 4, true)
+			if test.rev != "" {
+				d.Metadata.Annotations[annotationLastKnownGood] = test.rev
+			}
+			if test.hash != "" {
+				d.Metadata.Annotations[annotationLastKnownGoodHash] = test.hash
+			}
+			var got string
+			if rs := lastKnownGood(d, replicaSets); rs != nil {
+				got = rs.Metadata.GetName()
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
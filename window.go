@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s/apis/extensions/v1beta1"
+)
+
+// Actions of time windows.
+const (
+	// Automatic rollbacks are only allowed during allow windows. If no allow
+	// windows are configured, they're allowed at any time.
+	windowAllow = "allow"
+	// Automatic rollbacks are forbidden during deny windows, such as a
+	// deploy freeze. Deny windows take precedence over allow windows.
+	windowDeny = "deny"
+)
+
+// timeWindow is a recurring window of time, starting whenever its schedule
+// matches and lasting for its duration.
+type timeWindow struct {
+	Name string `json:"name"`
+	// Cron expression for the start of the window, see parseSchedule.
+	Schedule string   `json:"schedule"`
+	Duration duration `json:"duration"`
+	Action   string   `json:"action"`
+	// IANA time zone the schedule is evaluated in. Defaults to UTC.
+	TimeZone string `json:"timeZone"`
+
+	schedule *schedule
+	loc      *time.Location
+}
+
+func (w *timeWindow) validate() error {
+	switch w.Action {
+	case windowAllow, windowDeny:
+	default:
+		return fmt.Errorf("unknown action %q", w.Action)
+	}
+	if w.Duration.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	s, err := parseSchedule(w.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q: %v", w.Schedule, err)
+	}
+	w.schedule = s
+
+	w.loc = time.UTC
+	if w.TimeZone != "" {
+		if w.loc, err = time.LoadLocation(w.TimeZone); err != nil {
+			return fmt.Errorf("invalid time zone: %v", err)
+		}
+	}
+	return nil
+}
+
+// active reports if t falls within the window.
+func (w *timeWindow) active(t time.Time) bool {
+	t = t.In(w.loc).Truncate(time.Minute)
+	// Walk back through every minute the window could have started in.
+	// Windows are rarely longer than a few days, so this is cheap.
+	for start := t; t.Sub(start) < w.Duration.Duration; start = start.Add(-time.Minute) {
+		if w.schedule.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// windowsAllow reports if automatic rollbacks are allowed at t. If they
+// aren't, it returns the name of the window responsible.
+func windowsAllow(windows []*timeWindow, t time.Time) (bool, string) {
+	var allow []*timeWindow
+	for _, w := range windows {
+		if w.Action == windowAllow {
+			allow = append(allow, w)
+			continue
+		}
+		if w.active(t) {
+			return false, w.Name
+		}
+	}
+	if len(allow) == 0 {
+		return true, ""
+	}
+	for _, w := range allow {
+		if w.active(t) {
+			return true, ""
+		}
+	}
+	return false, "outside of allowed windows"
+}
+
+// checkWindows determines if the configured time windows allow the deployment
+// to be handled automatically now, notifying a human if they don't. As with
+// region policies, setting the approve-rollback annotation overrides them.
+func (c *rollbackController) checkWindows(ctx context.Context, d *v1beta1.Deployment, reason string, now time.Time) (bool, error) {
+	ok, window := windowsAllow(c.cfg.Windows, now)
+	if ok || rollbackApproved(d) {
+		return true, nil
+	}
+	if !c.once("time-window", d) {
+		return false, nil
+	}
+	msg := fmt.Sprintf("deployment failed (%s), automatic rollbacks aren't allowed now (%s): set annotation %s=%d to roll back",
+		reason, window, annotationApproveRollback, revision(d.Metadata.GetAnnotations()))
+	c.logger.Printf("not rolling back deployment: %s: %s", *d.Metadata.Name, msg)
+	c.recordAction(d, "notify", 0, msg)
+	return false, c.notify(ctx, d, "time-window", severityCritical, msg)
+}
+
+// schedule is a parsed cron expression.
+type schedule struct {
+	minute, hour, dom, month, dow uint64 // Bit sets of matching values.
+	domStar, dowStar              bool
+}
+
+// parseSchedule parses a standard five field cron expression: minute, hour,
+// day of month, month, and day of week. Fields may be "*", values, ranges
+// ("1-5"), lists ("1,3"), and steps ("*/15", "9-17/2"). Days of week are 0-6
+// starting on Sunday, and 7 is also accepted for Sunday.
+func parseSchedule(expr string) (*schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	var (
+		s   schedule
+		err error
+	)
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+	return &s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				// "5/15" means starting at 5, every 15.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", rng, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *schedule) matches(t time.Time) bool {
+	has := func(bits uint64, v int) bool { return bits&(1<<uint(v)) != 0 }
+	if !has(s.minute, t.Minute()) || !has(s.hour, t.Hour()) || !has(s.month, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(s.dom, t.Day()), has(s.dow, int(t.Weekday()))
+	// As in cron, if both days are restricted either can match.
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	}
+	return dom || dow
+}
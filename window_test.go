@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// 2026-10-12 is a Monday.
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	tests := []struct {
+		expr  string
+		match []string
+		miss  []string
+	}{
+		{
+			expr:  "* * * * *",
+			match: []string{"2026-10-12 00:00", "2026-12-31 23:59"},
+		},
+		{
+			expr:  "30 9 * * *",
+			match: []string{"2026-10-12 09:30", "2026-10-18 09:30"},
+			miss:  []string{"2026-10-12 09:31", "2026-10-12 10:30"},
+		},
+		{
+			expr:  "*/15 * * * *",
+			match: []string{"2026-10-12 10:00", "2026-10-12 10:45"},
+			miss:  []string{"2026-10-12 10:05"},
+		},
+		{
+			expr:  "5/20 * * * *",
+			match: []string{"2026-10-12 10:05", "2026-10-12 10:25", "2026-10-12 10:45"},
+			miss:  []string{"2026-10-12 10:00", "2026-10-12 10:20"},
+		},
+		{
+			expr:  "0 9-17/2 * * 1-5",
+			match: []string{"2026-10-12 09:00", "2026-10-16 17:00"},
+			miss:  []string{"2026-10-12 10:00", "2026-10-12 19:00", "2026-10-17 09:00"},
+		},
+		{
+			expr:  "0 0 * * 0,6",
+			match: []string{"2026-10-17 00:00", "2026-10-18 00:00"},
+			miss:  []string{"2026-10-12 00:00"},
+		},
+		{
+			expr:  "0 0 * * 7",
+			match: []string{"2026-10-18 00:00"},
+			miss:  []string{"2026-10-17 00:00"},
+		},
+		{
+			expr:  "0 0 1 12 *",
+			match: []string{"2026-12-01 00:00"},
+			miss:  []string{"2026-11-01 00:00", "2026-12-02 00:00"},
+		},
+		{
+			// Either day field can match when both are restricted.
+			expr:  "0 0 13 * 1",
+			match: []string{"2026-10-12 00:00", "2026-10-13 00:00", "2026-10-19 00:00"},
+			miss:  []string{"2026-10-14 00:00"},
+		},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.expr)
+		if err != nil {
+			t.Errorf("parse %q: %v", test.expr, err)
+			continue
+		}
+		for _, m := range test.match {
+			if !s.matches(at(m)) {
+				t.Errorf("%q doesn't match %s", test.expr, m)
+			}
+		}
+		for _, m := range test.miss {
+			if s.matches(at(m)) {
+				t.Errorf("%q matches %s", test.expr, m)
+			}
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	}
+	for _, test := range tests {
+		if _, err := parseSchedule(test); err == nil {
+			t.Errorf("expected error parsing %q", test)
+		}
+	}
+}
+
+func TestWindowsAllow(t *testing.T) {
+	window := func(name, schedule string, d time.Duration, action, tz string) *timeWindow {
+		w := &timeWindow{Name: name, Schedule: schedule, Duration: duration{d}, Action: action, TimeZone: tz}
+		if err := w.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	// Business hours in New York, and a freeze over the weekend.
+	business := window("business", "0 9 * * 1-5", 8*time.Hour, windowAllow, "America/New_York")
+	freeze := window("freeze", "0 18 * * 5", 62*time.Hour, windowDeny, "")
+
+	tests := []struct {
+		windows []*timeWindow
+		t       string
+		want    bool
+	}{
+		{nil, "2026-10-12T03:00:00Z", true},
+		{[]*timeWindow{business}, "2026-10-12T13:00:00Z", true},
+		{[]*timeWindow{business}, "2026-10-12T20:59:00Z", true},
+		{[]*timeWindow{business}, "2026-10-12T21:00:00Z", false},
+		{[]*timeWindow{business}, "2026-10-12T12:59:00Z", false},
+		{[]*timeWindow{freeze}, "2026-10-16T17:59:00Z", true},
+		{[]*timeWindow{freeze}, "2026-10-17T12:00:00Z", false},
+		{[]*timeWindow{freeze}, "2026-10-19T08:00:00Z", true},
+		// Deny windows take precedence.
+		{[]*timeWindow{business, freeze}, "2026-10-16T19:00:00Z", false},
+		{[]*timeWindow{business, freeze}, "2026-10-16T14:00:00Z", true},
+	}
+	for _, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, window := windowsAllow(test.windows, now); got != test.want {
+			t.Errorf("%d windows at %s: got %t (%s), want %t", len(test.windows), test.t, got, window, test.want)
+		}
+	}
+}
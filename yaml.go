@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// yamlToJSON converts a YAML document to JSON so it can be decoded with
+// encoding/json. No YAML library is vendored, so this only understands the
+// subset of YAML used by config files and Kubernetes manifests: block
+// mappings and sequences, plain and quoted scalars, flow collections, and
+// literal (|) and folded (>) block scalars. Anchors, tags, and multiple
+// documents are unsupported.
+func yamlToJSON(data []byte) ([]byte, error) {
+	text := strings.TrimSuffix(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	p := &yamlParser{lines: strings.Split(text, "\n")}
+	p.skipBlank()
+	if p.pos < len(p.lines) && strings.TrimSpace(p.lines[p.pos]) == "---" {
+		p.pos++
+		p.skipBlank()
+	}
+	if p.pos == len(p.lines) {
+		return []byte("null"), nil
+	}
+
+	v, err := p.parseBlock(indentOf(p.lines[p.pos]))
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected content")
+	}
+	return json.Marshal(v)
+}
+
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", p.pos+1, fmt.Sprintf(format, a...))
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// content returns a line without indentation or trailing comments.
+func content(line string) string {
+	return strings.TrimSpace(stripComment(line))
+}
+
+// stripComment removes a trailing comment from a line, ignoring '#'
+// characters inside of quotes or not preceded by whitespace.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// skipBlank advances past blank and comment-only lines.
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && content(p.lines[p.pos]) == "" {
+		p.pos++
+	}
+}
+
+func isSequenceItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+// parseBlock parses the mapping or sequence starting at the current line.
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	p.skipBlank()
+	if isSequenceItem(content(p.lines[p.pos])) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos == len(p.lines) {
+			return seq, nil
+		}
+		line := p.lines[p.pos]
+		if indentOf(line) < indent || !isSequenceItem(content(line)) {
+			return seq, nil
+		}
+		if indentOf(line) > indent {
+			return nil, p.errorf("bad indentation of sequence item")
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(strings.TrimSpace(line), "-"), " ")
+		switch {
+		case content(rest) == "":
+			// Item is a nested block on the following lines.
+			p.pos++
+			p.skipBlank()
+			if p.pos == len(p.lines) || indentOf(p.lines[p.pos]) <= indent {
+				seq = append(seq, nil)
+				continue
+			}
+			v, err := p.parseBlock(indentOf(p.lines[p.pos]))
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		case isSequenceItem(content(rest)) || mappingKey(rest) >= 0:
+			// Item is a block starting on this line, "- key: value". Rewrite
+			// the line as if the "- " were indentation and parse it as a
+			// block at that indentation.
+			itemIndent := len(line) - len(rest)
+			p.lines[p.pos] = strings.Repeat(" ", itemIndent) + rest
+			v, err := p.parseBlock(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		default:
+			v, err := p.parseValue(rest, indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+	}
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos == len(p.lines) {
+			return m, nil
+		}
+		line := p.lines[p.pos]
+		if indentOf(line) < indent {
+			return m, nil
+		}
+		if indentOf(line) > indent {
+			return nil, p.errorf("bad indentation of mapping entry")
+		}
+		text := strings.TrimSpace(line)
+		if isSequenceItem(content(text)) {
+			return m, nil
+		}
+
+		i := mappingKey(text)
+		if i < 0 {
+			return nil, p.errorf("expected a mapping entry")
+		}
+		key, err := parseScalarString(strings.TrimSpace(text[:i]))
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if _, ok := m[key]; ok {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		rest := strings.TrimLeft(text[i+1:], " ")
+
+		if content(rest) != "" {
+			if m[key], err = p.parseValue(rest, indent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Value is a nested block. Sequences are allowed at the same
+		// indentation as their key.
+		p.pos++
+		p.skipBlank()
+		switch {
+		case p.pos == len(p.lines):
+			m[key] = nil
+		case indentOf(p.lines[p.pos]) > indent:
+			if m[key], err = p.parseBlock(indentOf(p.lines[p.pos])); err != nil {
+				return nil, err
+			}
+		case indentOf(p.lines[p.pos]) == indent && isSequenceItem(content(p.lines[p.pos])):
+			if m[key], err = p.parseSequence(indent); err != nil {
+				return nil, err
+			}
+		default:
+			m[key] = nil
+		}
+	}
+}
+
+// mappingKey returns the index of the ':' separating a mapping key from its
+// value, or -1 if the text isn't a mapping entry.
+func mappingKey(text string) int {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return -1
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case i == 0 && (c == '"' || c == '\''):
+			quote = c
+		case c == '#' && i > 0 && text[i-1] == ' ':
+			return -1
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\t'):
+			return i
+		}
+	}
+	return -1
+}
+
+// parseValue parses the value of a mapping entry or sequence item. Block
+// scalars consume the following lines that are indented further than the
+// entry itself.
+func (p *yamlParser) parseValue(text string, indent int) (interface{}, error) {
+	s := content(text)
+	if s[0] == '|' || s[0] == '>' {
+		p.pos++
+		return p.parseBlockScalar(s, indent)
+	}
+	var (
+		v   interface{}
+		err error
+	)
+	if s[0] == '[' || s[0] == '{' {
+		v, err = parseFlow(s)
+	} else {
+		v, err = parseScalar(s)
+	}
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	p.pos++
+	return v, nil
+}
+
+func (p *yamlParser) parseBlockScalar(header string, indent int) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := strings.TrimLeft(header[1:], "123456789")
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, p.errorf("unsupported block scalar header %q", header)
+	}
+
+	var (
+		lines       []string
+		blockIndent = -1
+	)
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if indentOf(line) <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = indentOf(line)
+		}
+		if indentOf(line) < blockIndent {
+			return nil, p.errorf("bad indentation in block scalar")
+		}
+		lines = append(lines, line[blockIndent:])
+	}
+
+	// Trailing blank lines belong to the following content, not the scalar.
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var s string
+	if folded {
+		// Line breaks between lines are folded into spaces, and those
+		// followed by blank lines are dropped, leaving a newline for each
+		// blank line. Breaks next to more indented lines are kept.
+		moreIndented := func(l string) bool {
+			return strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")
+		}
+		prev := ""
+		for i, l := range lines {
+			switch {
+			case l == "":
+				s += "\n"
+			case i == 0:
+			case lines[i-1] != "" && !moreIndented(l) && !moreIndented(prev):
+				s += " "
+			case lines[i-1] != "" || (prev != "" && (moreIndented(l) || moreIndented(prev))):
+				s += "\n"
+			}
+			if l != "" {
+				s += l
+				prev = l
+			}
+		}
+	} else {
+		s = strings.Join(lines, "\n")
+	}
+
+	switch chomp {
+	case "-":
+	case "+":
+		s += strings.Repeat("\n", trailing+1)
+	default:
+		if len(lines) > 0 {
+			s += "\n"
+		}
+	}
+	return s, nil
+}
+
+// parseFlow parses a scalar or a flow collection, such as "[a, b]".
+func parseFlow(s string) (interface{}, error) {
+	f := &flowParser{s: s}
+	v, err := f.parse()
+	if err != nil {
+		return nil, err
+	}
+	f.space()
+	if f.pos != len(f.s) {
+		return nil, fmt.Errorf("unexpected trailing characters %q", f.s[f.pos:])
+	}
+	return v, nil
+}
+
+type flowParser struct {
+	s   string
+	pos int
+}
+
+func (f *flowParser) space() {
+	for f.pos < len(f.s) && (f.s[f.pos] == ' ' || f.s[f.pos] == '\t') {
+		f.pos++
+	}
+}
+
+func (f *flowParser) parse() (interface{}, error) {
+	f.space()
+	if f.pos == len(f.s) {
+		return nil, errors.New("unexpected end of value")
+	}
+	switch f.s[f.pos] {
+	case '[':
+		f.pos++
+		seq := []interface{}{}
+		for {
+			f.space()
+			if f.pos < len(f.s) && f.s[f.pos] == ']' {
+				f.pos++
+				return seq, nil
+			}
+			v, err := f.parse()
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.pos++
+		m := map[string]interface{}{}
+		for {
+			f.space()
+			if f.pos < len(f.s) && f.s[f.pos] == '}' {
+				f.pos++
+				return m, nil
+			}
+			k, err := f.scalar(":")
+			if err != nil {
+				return nil, err
+			}
+			key, err := parseScalarString(k)
+			if err != nil {
+				return nil, err
+			}
+			if f.pos == len(f.s) || f.s[f.pos] != ':' {
+				return nil, fmt.Errorf("expected ':' after key %q", key)
+			}
+			f.pos++
+			if m[key], err = f.parse(); err != nil {
+				return nil, err
+			}
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s, err := f.scalar(",]}")
+	if err != nil {
+		return nil, err
+	}
+	return parseScalar(s)
+}
+
+// separator consumes a ',' between collection items, leaving the closing
+// character in place.
+func (f *flowParser) separator(end byte) error {
+	f.space()
+	if f.pos == len(f.s) {
+		return fmt.Errorf("expected '%c'", end)
+	}
+	switch f.s[f.pos] {
+	case ',':
+		f.pos++
+		return nil
+	case end:
+		return nil
+	}
+	return fmt.Errorf("unexpected character '%c'", f.s[f.pos])
+}
+
+// scalar consumes a quoted or plain scalar, stopping at any of the
+// terminator characters.
+func (f *flowParser) scalar(terminators string) (string, error) {
+	start := f.pos
+	if q := f.s[f.pos]; q == '"' || q == '\'' {
+		for f.pos++; f.pos < len(f.s); f.pos++ {
+			switch {
+			case q == '"' && f.s[f.pos] == '\\':
+				f.pos++
+			case f.s[f.pos] == q && q == '\'' && f.pos+1 < len(f.s) && f.s[f.pos+1] == '\'':
+				f.pos++
+			case f.s[f.pos] == q:
+				f.pos++
+				return f.s[start:f.pos], nil
+			}
+		}
+		return "", errors.New("unterminated quoted string")
+	}
+	for f.pos < len(f.s) && !strings.ContainsRune(terminators, rune(f.s[f.pos])) {
+		f.pos++
+	}
+	return strings.TrimSpace(f.s[start:f.pos]), nil
+}
+
+var yamlNumber = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+
+// parseScalar parses a quoted or plain scalar, resolving plain scalars to
+// null, booleans, and numbers the way YAML 1.2's core schema does.
+func parseScalar(s string) (interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		return parseScalarString(s)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if !yamlNumber.MatchString(s) {
+		return s, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %s", s)
+	}
+	return f, nil
+}
+
+// parseScalarString parses a scalar which must be a string, such as a
+// mapping key.
+func parseScalarString(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	switch s[0] {
+	case '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double quoted string %s", s)
+		}
+		return v, nil
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("invalid single quoted string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return s, nil
+}
+
+// toYAML encodes a value as a YAML document, by way of its JSON encoding.
+// Mapping keys are sorted. Like yamlToJSON it only produces block mappings
+// and sequences, plain and double quoted scalars, and literal block scalars
+// for multiline strings, so its output can be read back by yamlToJSON.
+func toYAML(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+	var tree interface{}
+	if err := d.Decode(&tree); err != nil {
+		return nil, err
+	}
+	var out strings.Builder
+	switch tree.(type) {
+	case map[string]interface{}, []interface{}:
+		writeYAMLBlock(&out, tree, "")
+	default:
+		out.WriteString(yamlScalar(tree, "") + "\n")
+	}
+	return []byte(out.String()), nil
+}
+
+// writeYAMLBlock writes a non-empty mapping or sequence, each line prefixed
+// with indent.
+func writeYAMLBlock(out *strings.Builder, v interface{}, indent string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out.WriteString(indent + yamlScalar(k, indent) + ":")
+			switch child := v[k]; {
+			case isYAMLBlock(child):
+				out.WriteString("\n")
+				// Sequences aren't indented under their key, like kubectl's
+				// output.
+				childIndent := indent + "  "
+				if _, ok := child.([]interface{}); ok {
+					childIndent = indent
+				}
+				writeYAMLBlock(out, child, childIndent)
+			default:
+				out.WriteString(" " + yamlScalar(child, indent) + "\n")
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if !isYAMLBlock(item) {
+				out.WriteString(indent + "- " + yamlScalar(item, indent+"  ") + "\n")
+				continue
+			}
+			if _, ok := item.([]interface{}); ok {
+				out.WriteString(indent + "-\n")
+				writeYAMLBlock(out, item, indent+"  ")
+				continue
+			}
+			// The item's first key goes on the same line as the "-".
+			var b strings.Builder
+			writeYAMLBlock(&b, item, indent+"  ")
+			out.WriteString(indent + "- " + strings.TrimPrefix(b.String(), indent+"  "))
+		}
+	}
+}
+
+// isYAMLBlock reports if a value is written as a block, rather than a
+// scalar or an empty flow collection.
+func isYAMLBlock(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+var yaml11Special = map[string]bool{"y": true, "n": true, "yes": true, "no": true, "on": true, "off": true}
+
+var yamlPlain = regexp.MustCompile(`^[A-Za-z0-9_./][A-Za-z0-9_./:=-]*$`)
+
+// yamlScalar returns the YAML for a scalar or empty collection, written on
+// a line indented by indent.
+func yamlScalar(v interface{}, indent string) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	case string:
+		if strings.Contains(v, "\n") && !strings.HasPrefix(v, " ") && !strings.HasSuffix(v, "\n\n") {
+			header := "|"
+			if !strings.HasSuffix(v, "\n") {
+				header = "|-"
+			}
+			lines := strings.Split(strings.TrimSuffix(v, "\n"), "\n")
+			for i, line := range lines {
+				if line != "" {
+					lines[i] = indent + "  " + line
+				}
+			}
+			return header + "\n" + strings.Join(lines, "\n")
+		}
+		// Plain scalars that would be read as another type are quoted,
+		// including by YAML 1.1 parsers such as kubectl's, which also read
+		// "yes" and "off" as booleans, and "1:20" as a number.
+		if yamlPlain.MatchString(v) && !strings.HasSuffix(v, ":") && !yaml11Special[strings.ToLower(v)] && !strings.ContainsAny(v[:1], "0123456789.") {
+			if s, err := parseScalar(v); err == nil && s == v {
+				return v
+			}
+		}
+		return strconv.Quote(v)
+	}
+	return strconv.Quote(fmt.Sprint(v))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "mapping",
+			yaml: "a: 1\nb: foo # comment\nc:\n  d: true\n",
+			want: `{"a":1,"b":"foo","c":{"d":true}}`,
+		},
+		{
+			name: "sequence",
+			yaml: "a:\n- x\n- y: 1\n  z: 2\n",
+			want: `{"a":["x",{"y":1,"z":2}]}`,
+		},
+		{
+			name: "flow",
+			yaml: "a: [x, 'y', \"z\"]\nb: {c: 1}\n",
+			want: `{"a":["x","y","z"],"b":{"c":1}}`,
+		},
+		{
+			name: "quoted",
+			yaml: "a: \"1\"\nb: 'it''s'\nc: \"#\"\n",
+			want: `{"a":"1","b":"it's","c":"#"}`,
+		},
+		{
+			name: "literal",
+			yaml: "a: |\n  line 1\n  line 2\n\n  line 3\nb: 1\n",
+			want: `{"a":"line 1\nline 2\n\nline 3\n","b":1}`,
+		},
+		{
+			name: "literal strip",
+			yaml: "a: |-\n  text\n\n",
+			want: `{"a":"text"}`,
+		},
+		{
+			name: "literal keep",
+			yaml: "a: |+\n  text\n\n",
+			want: `{"a":"text\n\n"}`,
+		},
+		{
+			name: "folded",
+			yaml: "a: >\n  folded\n  text\n\n  para\n",
+			want: `{"a":"folded text\npara\n"}`,
+		},
+		{
+			name: "folded blank lines",
+			yaml: "a: >\n  one\n\n\n  two\n  three\n",
+			want: `{"a":"one\n\ntwo three\n"}`,
+		},
+		{
+			name: "folded more indented",
+			yaml: "a: >\n  text\n    code\n  more\n",
+			want: `{"a":"text\n  code\nmore\n"}`,
+		},
+		{
+			name: "folded strip",
+			yaml: "a: >-\n  folded\n  text\n",
+			want: `{"a":"folded text"}`,
+		},
+		{
+			name: "document marker",
+			yaml: "---\na: 1\n",
+			want: `{"a":1}`,
+		},
+		{
+			name: "empty",
+			yaml: "\n# comment\n",
+			want: `null`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := yamlToJSON([]byte(test.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestYAMLToJSONErrors(t *testing.T) {
+	tests := []string{
+		"a: 1\n b: 2\n",
+		"a: [1, 2\n",
+		"a: |x\n  text\n",
+	}
+	for _, test := range tests {
+		if _, err := yamlToJSON([]byte(test)); err == nil {
+			t.Errorf("expected error parsing %q", test)
+		}
+	}
+}
+
+func TestToYAMLRoundTrip(t *testing.T) {
+	tests := []interface{}{
+		map[string]interface{}{
+			"name":    "foo",
+			"count":   3.0,
+			"enabled": true,
+			"nothing": nil,
+		},
+		map[string]interface{}{
+			"script": "line 1\nline 2\n",
+			"list":   []interface{}{"a", map[string]interface{}{"b": "c"}},
+			"empty":  map[string]interface{}{},
+		},
+		map[string]interface{}{
+			"special": []interface{}{"yes", "no", "on", "null", "1.5", "0777", "- x", "a: b", "#c", ""},
+		},
+	}
+	for _, test := range tests {
+		b, err := toYAML(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := yamlToJSON(b)
+		if err != nil {
+			t.Fatalf("parse %s: %v", b, err)
+		}
+		var got interface{}
+		if err := json.Unmarshal(j, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test) {
+			t.Errorf("round trip of %s:\ngot  %#v\nwant %#v", b, got, test)
+		}
+	}
+}